@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apollo/praetor/gateway"
+	"github.com/apollo/praetor/pkg/version"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/retry"
+)
+
+// registryTokenSink is implemented by fetchers that accept gateway-delivered registry tokens.
+type registryTokenSink interface {
+	SetRegistryTokens(creds []gateway.RegistryCredential)
+}
+
+// registryCredentials resolves pull credentials per registry host. Gateway-delivered tokens win,
+// then the docker-style config.json at APOLLO_REGISTRY_AUTH_FILE, then the credentials file at
+// APOLLO_REGISTRY_CREDENTIALS_FILE ("<registry> <username> <password>" per line). Files are
+// re-read on every lookup so rotated credentials apply without restarting the agent.
+type registryCredentials struct {
+	mu     sync.RWMutex
+	tokens map[string]gatewayToken
+}
+
+type gatewayToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+		RegistryToken string `json:"registrytoken"`
+	} `json:"auths"`
+}
+
+func newRegistryCredentials() *registryCredentials {
+	return &registryCredentials{tokens: make(map[string]gatewayToken)}
+}
+
+// setGatewayTokens replaces the gateway-delivered tokens with the latest desired response.
+func (c *registryCredentials) setGatewayTokens(creds []gateway.RegistryCredential) {
+	tokens := make(map[string]gatewayToken, len(creds))
+	for _, cred := range creds {
+		host := normalizeRegistryHost(cred.Registry)
+		if host == "" || cred.AccessToken == "" {
+			continue
+		}
+		t := gatewayToken{token: cred.AccessToken}
+		if exp, err := time.Parse(time.RFC3339, cred.ExpiresAt); err == nil {
+			t.expiresAt = exp
+		}
+		tokens[host] = t
+	}
+	c.mu.Lock()
+	c.tokens = tokens
+	c.mu.Unlock()
+}
+
+// credential implements the oras auth.Client Credential callback.
+func (c *registryCredentials) credential(_ context.Context, hostport string) (auth.Credential, error) {
+	host := normalizeRegistryHost(hostport)
+
+	c.mu.RLock()
+	t, ok := c.tokens[host]
+	c.mu.RUnlock()
+	if ok && (t.expiresAt.IsZero() || nowFunc().Before(t.expiresAt)) {
+		return auth.Credential{AccessToken: t.token}, nil
+	}
+
+	if path := strings.TrimSpace(getenv("APOLLO_REGISTRY_AUTH_FILE", "")); path != "" {
+		cred, found, err := credentialFromDockerConfig(path, host)
+		if err != nil || found {
+			return cred, err
+		}
+	}
+	if path := strings.TrimSpace(getenv("APOLLO_REGISTRY_CREDENTIALS_FILE", "")); path != "" {
+		cred, found, err := credentialFromFile(path, host)
+		if err != nil || found {
+			return cred, err
+		}
+	}
+	return auth.EmptyCredential, nil
+}
+
+func credentialFromDockerConfig(path, host string) (auth.Credential, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return auth.EmptyCredential, false, nil
+		}
+		return auth.EmptyCredential, false, err
+	}
+	var cfg dockerConfigFile
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return auth.EmptyCredential, false, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for key, entry := range cfg.Auths {
+		if normalizeRegistryHost(key) != host {
+			continue
+		}
+		cred := auth.Credential{
+			Username:     entry.Username,
+			Password:     entry.Password,
+			RefreshToken: entry.IdentityToken,
+			AccessToken:  entry.RegistryToken,
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return auth.EmptyCredential, false, fmt.Errorf("parse %s: invalid auth for %s: %w", path, key, err)
+			}
+			user, pass, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return auth.EmptyCredential, false, fmt.Errorf("parse %s: invalid auth for %s", path, key)
+			}
+			cred.Username, cred.Password = user, pass
+		}
+		return cred, true, nil
+	}
+	return auth.EmptyCredential, false, nil
+}
+
+func credentialFromFile(path, host string) (auth.Credential, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return auth.EmptyCredential, false, nil
+		}
+		return auth.EmptyCredential, false, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return auth.EmptyCredential, false, fmt.Errorf("%s:%d: expected \"<registry> <username> <password>\"", path, line)
+		}
+		if normalizeRegistryHost(fields[0]) == host {
+			return auth.Credential{Username: fields[1], Password: fields[2]}, true, nil
+		}
+	}
+	return auth.EmptyCredential, false, scanner.Err()
+}
+
+// normalizeRegistryHost reduces docker config keys such as "https://host:5000/v1/" to "host:5000".
+func normalizeRegistryHost(s string) string {
+	s = strings.TrimSpace(strings.ToLower(s))
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "https://"), "http://")
+	if idx := strings.Index(s, "/"); idx >= 0 {
+		s = s[:idx]
+	}
+	return s
+}
+
+// authClient returns an oras auth client that resolves credentials through c.
+func (c *registryCredentials) authClient() *auth.Client {
+	client := &auth.Client{
+		Client:     retry.DefaultClient,
+		Cache:      auth.NewCache(),
+		Credential: c.credential,
+	}
+	client.SetUserAgent("apollo-agent/" + version.Version)
+	return client
+}
+
+// SetRegistryTokens implements registryTokenSink.
+func (f *ociFetcherImpl) SetRegistryTokens(creds []gateway.RegistryCredential) {
+	f.creds.setGatewayTokens(creds)
+}
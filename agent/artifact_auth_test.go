@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// tokenRegistry is a minimal distribution registry that requires bearer tokens issued by its
+// own /token endpoint in exchange for basic credentials.
+type tokenRegistry struct {
+	*httptest.Server
+	user, pass string
+	token      string
+	blobs      map[string][]byte
+	manifest   ocispec.Descriptor
+	tokenCalls int
+}
+
+func newTokenRegistry(t *testing.T, tarBytes []byte) *tokenRegistry {
+	t.Helper()
+	configBytes := []byte("{}")
+	configDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeEmptyJSON, Digest: digest.FromBytes(configBytes), Size: int64(len(configBytes))}
+	layerDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(tarBytes), Size: int64(len(tarBytes))}
+	manifest := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Config: configDesc, Layers: []ocispec.Descriptor{layerDesc}}
+	manifest.SchemaVersion = 2
+	manifestBytes, _ := json.Marshal(manifest)
+	manifestDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifestBytes), Size: int64(len(manifestBytes))}
+	r := &tokenRegistry{
+		user:     "puller",
+		pass:     "s3cret",
+		token:    "registry-token",
+		manifest: manifestDesc,
+		blobs: map[string][]byte{
+			configDesc.Digest.String():   configBytes,
+			layerDesc.Digest.String():    tarBytes,
+			manifestDesc.Digest.String(): manifestBytes,
+		},
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *tokenRegistry) host() string {
+	return strings.TrimPrefix(r.URL, "http://")
+}
+
+func (r *tokenRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.tokenCalls++
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != r.user || pass != r.pass {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"token": r.token, "expires_in": 300})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer "+r.token {
+		w.Header().Set("Www-Authenticate", `Bearer realm="`+r.URL+`/token",service="stand-in",scope="repository:app:pull"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v2/app/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, req)
+		return
+	}
+	data, ok := r.blobs[parts[1]]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if parts[0] == "manifests" {
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+	}
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(data).String())
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if req.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(data)
+}
+
+func ensureFromRegistry(t *testing.T, reg *tokenRegistry, configure func(f *ociFetcherImpl)) (ociResult, error) {
+	t.Helper()
+	t.Setenv("APOLLO_OCI_PLAIN_HTTP_HOSTS", "127.0.0.1")
+	f := newOCIFetcher(logr.Discard(), t.TempDir()).(*ociFetcherImpl)
+	if configure != nil {
+		configure(f)
+	}
+	return f.Ensure(context.Background(), reg.host()+"/app@"+reg.manifest.Digest.String())
+}
+
+func TestEnsureOCIRegistryAuth(t *testing.T) {
+	tarBytes := makeTar(map[string]string{"bin/app": "echo private"})
+
+	t.Run("anonymous is rejected", func(t *testing.T) {
+		reg := newTokenRegistry(t, tarBytes)
+		if _, err := ensureFromRegistry(t, reg, nil); err == nil {
+			t.Fatalf("expected pull without credentials to fail")
+		}
+	})
+
+	t.Run("docker config", func(t *testing.T) {
+		reg := newTokenRegistry(t, tarBytes)
+		path := filepath.Join(t.TempDir(), "config.json")
+		cfg := `{"auths":{"http://` + reg.host() + `":{"auth":"` + base64.StdEncoding.EncodeToString([]byte(reg.user+":"+reg.pass)) + `"}}}`
+		if err := os.WriteFile(path, []byte(cfg), 0o600); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		t.Setenv("APOLLO_REGISTRY_AUTH_FILE", path)
+		res, err := ensureFromRegistry(t, reg, nil)
+		if err != nil || !res.verified {
+			t.Fatalf("expected authenticated pull, got verified=%v err=%v", res.verified, err)
+		}
+	})
+
+	t.Run("credentials file", func(t *testing.T) {
+		reg := newTokenRegistry(t, tarBytes)
+		path := filepath.Join(t.TempDir(), "credentials")
+		content := "# registry username password\n" + reg.host() + " " + reg.user + " " + reg.pass + "\n"
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("write credentials: %v", err)
+		}
+		t.Setenv("APOLLO_REGISTRY_CREDENTIALS_FILE", path)
+		if _, err := ensureFromRegistry(t, reg, nil); err != nil {
+			t.Fatalf("expected authenticated pull, got %v", err)
+		}
+	})
+
+	t.Run("gateway token", func(t *testing.T) {
+		reg := newTokenRegistry(t, tarBytes)
+		_, err := ensureFromRegistry(t, reg, func(f *ociFetcherImpl) {
+			f.SetRegistryTokens([]gateway.RegistryCredential{{Registry: reg.host(), AccessToken: reg.token}})
+		})
+		if err != nil {
+			t.Fatalf("expected pull with gateway token, got %v", err)
+		}
+		if reg.tokenCalls != 0 {
+			t.Fatalf("gateway token must be used directly, saw %d token endpoint calls", reg.tokenCalls)
+		}
+	})
+}
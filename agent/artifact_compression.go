@@ -0,0 +1,68 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	mediaTypeLayerNondistributable     = "application/vnd.oci.image.layer.nondistributable.v1.tar"
+	mediaTypeLayerNondistributableGzip = "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip"
+	mediaTypeLayerNondistributableZstd = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+	mediaTypeDockerLayer               = "application/vnd.docker.image.rootfs.diff.tar"
+	mediaTypeDockerLayerGzip           = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	zstdMaxWindow                      = 64 << 20
+)
+
+type layerCompression int
+
+const (
+	compressionNone layerCompression = iota
+	compressionGzip
+	compressionZstd
+)
+
+// layerCompressionFor maps a layer media type to its compression. Unknown media types are
+// rejected rather than guessed at, so a new compression is never misread as a plain tar.
+func layerCompressionFor(mediaType string) (layerCompression, error) {
+	switch strings.ToLower(strings.TrimSpace(mediaType)) {
+	case ocispec.MediaTypeImageLayer, mediaTypeLayerNondistributable, mediaTypeDockerLayer:
+		return compressionNone, nil
+	case ocispec.MediaTypeImageLayerGzip, mediaTypeLayerNondistributableGzip, mediaTypeDockerLayerGzip:
+		return compressionGzip, nil
+	case ocispec.MediaTypeImageLayerZstd, mediaTypeLayerNondistributableZstd:
+		return compressionZstd, nil
+	default:
+		return 0, extractError{reason: "UnsupportedMediaType", msg: fmt.Sprintf("unsupported layer media type %q", mediaType)}
+	}
+}
+
+// decompressLayer wraps r according to mediaType. The returned close func releases decoder resources.
+func decompressLayer(r io.Reader, mediaType string) (io.Reader, func(), error) {
+	compression, err := layerCompressionFor(mediaType)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch compression {
+	case compressionGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, func() { gz.Close() }, nil
+	case compressionZstd:
+		// Single-threaded, low-memory decoding keeps switch control-plane CPU and RAM bounded.
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	default:
+		return r, func() {}, nil
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/klauspost/compress/zstd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func zstdCompress(t *testing.T, data []byte) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	zw, err := zstd.NewWriter(buf)
+	if err != nil {
+		t.Fatalf("zstd writer: %v", err)
+	}
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("zstd write: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zstd close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestEnsureOCIZstdLayer(t *testing.T) {
+	layerBytes := zstdCompress(t, makeTar(map[string]string{"bin/app": "echo zstd"}))
+	restore := withOCIOverrides(t, func(ctx context.Context, src oras.Target, srcRef string, dst oras.Target, dstRef string, opts oras.CopyOptions) (ocispec.Descriptor, error) {
+		return pushSingleLayer(dst.(*oci.Store), dstRef, layerBytes, ocispec.MediaTypeImageLayerZstd)
+	})
+	defer restore()
+
+	f := newOCIFetcher(logr.Discard(), t.TempDir())
+	res, err := f.Ensure(context.Background(), singleLayerRef(layerBytes, ocispec.MediaTypeImageLayerZstd))
+	if err != nil {
+		t.Fatalf("ensure: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(res.rootfsPath, "bin", "app"))
+	if err != nil || string(data) != "echo zstd" {
+		t.Fatalf("expected extracted zstd payload, got %q err=%v", data, err)
+	}
+}
+
+func TestEnsureOCIRejectsUnknownCompression(t *testing.T) {
+	const mediaType = "application/vnd.oci.image.layer.v1.tar+lz4"
+	layerBytes := makeTar(map[string]string{"bin/app": "echo ok"})
+	restore := withOCIOverrides(t, func(ctx context.Context, src oras.Target, srcRef string, dst oras.Target, dstRef string, opts oras.CopyOptions) (ocispec.Descriptor, error) {
+		return pushSingleLayer(dst.(*oci.Store), dstRef, layerBytes, mediaType)
+	})
+	defer restore()
+
+	root := t.TempDir()
+	f := newOCIFetcher(logr.Discard(), root)
+	res, err := f.Ensure(context.Background(), singleLayerRef(layerBytes, mediaType))
+	if err == nil {
+		t.Fatalf("expected unknown compression to be rejected")
+	}
+	if res.verified || res.verifyReason != "UnsupportedMediaType" {
+		t.Fatalf("expected UnsupportedMediaType, got verified=%v reason=%q", res.verified, res.verifyReason)
+	}
+	if res.rootfsPath != "" {
+		t.Fatalf("nothing should be extracted for an unknown media type")
+	}
+}
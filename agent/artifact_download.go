@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/time/rate"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+const (
+	partialDirName         = "partial"
+	progressReportInterval = 10 * time.Second
+	minBandwidthBurst      = 32 << 10
+)
+
+// resumableSource wraps a registry so blob downloads are also appended to a partial file.
+// When an attempt is interrupted, the next one replays the partial bytes and asks the registry
+// for the remainder with a range request. The combined stream is still verified against the
+// blob digest by the destination store, so a corrupt partial file only costs one retry.
+type resumableSource struct {
+	*remote.Repository
+	dir      string
+	limiter  *rate.Limiter
+	progress *downloadProgress
+}
+
+func (s *resumableSource) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if isManifestMediaType(desc.MediaType) {
+		return s.Repository.Fetch(ctx, desc)
+	}
+	rc, err := s.Repository.Blobs().Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	partPath := filepath.Join(s.dir, desc.Digest.Encoded())
+	part, err := os.OpenFile(partPath, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	// Resume only when the server honours ranges (oras returns a seeker in that case).
+	var offset int64
+	if fi, err := part.Stat(); err == nil && fi.Size() > 0 && fi.Size() < desc.Size {
+		if seeker, ok := rc.(io.Seeker); ok {
+			if _, err := seeker.Seek(fi.Size(), io.SeekStart); err == nil {
+				offset = fi.Size()
+			}
+		}
+	}
+	if err := part.Truncate(offset); err == nil {
+		_, err = part.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		part.Close()
+		rc.Close()
+		return nil, err
+	}
+	s.progress.add(offset)
+
+	var body io.Reader = rc
+	if s.limiter != nil {
+		body = &rateLimitedReader{ctx: ctx, r: body, limiter: s.limiter}
+	}
+	body = io.TeeReader(body, &progressWriter{w: part, progress: s.progress})
+	return &partialReader{
+		Reader: io.MultiReader(io.NewSectionReader(part, 0, offset), body),
+		body:   rc,
+		part:   part,
+		path:   partPath,
+		size:   desc.Size,
+	}, nil
+}
+
+func isManifestMediaType(mediaType string) bool {
+	switch mediaType {
+	case ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageIndex,
+		"application/vnd.docker.distribution.manifest.v2+json", "application/vnd.docker.distribution.manifest.list.v2+json":
+		return true
+	}
+	return false
+}
+
+// partialReader drops its partial file once the whole blob has been read through it; the
+// destination store has then either committed the blob or rejected its digest.
+type partialReader struct {
+	io.Reader
+	body io.Closer
+	part *os.File
+	path string
+	size int64
+}
+
+func (r *partialReader) Close() error {
+	err := r.body.Close()
+	fi, statErr := r.part.Stat()
+	r.part.Close()
+	if statErr == nil && fi.Size() >= r.size {
+		os.Remove(r.path)
+	}
+	return err
+}
+
+type progressWriter struct {
+	w        io.Writer
+	progress *downloadProgress
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.progress.add(int64(n))
+	return n, err
+}
+
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if burst := r.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// bandwidthLimiter returns the agent-wide download limiter configured by
+// APOLLO_ARTIFACT_BANDWIDTH_BYTES_PER_SEC, or nil when downloads are unlimited. All downloads
+// share one limiter so concurrent fetches together stay under the cap.
+func (f *ociFetcherImpl) bandwidthLimiter() (*rate.Limiter, error) {
+	v := strings.TrimSpace(getenv("APOLLO_ARTIFACT_BANDWIDTH_BYTES_PER_SEC", ""))
+	limit := int64(0)
+	if v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid APOLLO_ARTIFACT_BANDWIDTH_BYTES_PER_SEC %q", v)
+		}
+		limit = n
+	}
+
+	f.limiterMu.Lock()
+	defer f.limiterMu.Unlock()
+	if limit == 0 {
+		f.limiter = nil
+		return nil, nil
+	}
+	burst := int(limit)
+	if burst < minBandwidthBurst {
+		burst = minBandwidthBurst
+	}
+	if f.limiter == nil {
+		f.limiter = rate.NewLimiter(rate.Limit(limit), burst)
+	} else if f.limiter.Limit() != rate.Limit(limit) {
+		f.limiter.SetLimit(rate.Limit(limit))
+		f.limiter.SetBurst(burst)
+	}
+	return f.limiter, nil
+}
+
+// downloadProgress counts blob bytes for one Ensure call and forwards them, at most every
+// progressReportInterval, to the reporter attached to the context. The reporter runs on its own
+// goroutine so the download never waits on it; while it is busy, newer counts replace the
+// pending one.
+type downloadProgress struct {
+	done    atomic.Int64
+	total   atomic.Int64
+	updates chan [2]int64
+
+	mu     sync.Mutex
+	last   time.Time
+	closed bool
+}
+
+type downloadProgressKey struct{}
+
+// withDownloadProgress attaches a reporter for interim artifact download progress to ctx.
+func withDownloadProgress(ctx context.Context, report func(done, total int64)) context.Context {
+	return context.WithValue(ctx, downloadProgressKey{}, report)
+}
+
+// newDownloadProgress starts forwarding to ctx's reporter, if any, until close is called.
+func newDownloadProgress(ctx context.Context) *downloadProgress {
+	p := &downloadProgress{}
+	report, _ := ctx.Value(downloadProgressKey{}).(func(done, total int64))
+	if report == nil {
+		return p
+	}
+	p.updates = make(chan [2]int64, 1)
+	go func(updates <-chan [2]int64) {
+		for u := range updates {
+			report(u[0], u[1])
+		}
+	}(p.updates)
+	return p
+}
+
+func (p *downloadProgress) setTotal(manifest ocispec.Manifest) {
+	total := manifest.Config.Size
+	for _, l := range manifest.Layers {
+		total += l.Size
+	}
+	p.total.Store(total)
+}
+
+func (p *downloadProgress) add(n int64) {
+	if n <= 0 {
+		return
+	}
+	done := p.done.Add(n)
+	if p.updates == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || time.Since(p.last) < progressReportInterval {
+		return
+	}
+	p.last = time.Now()
+	update := [2]int64{done, p.total.Load()}
+	select {
+	case p.updates <- update:
+	default:
+		// The reporter is still sending an earlier count; replace the one waiting behind it.
+		select {
+		case <-p.updates:
+		default:
+		}
+		p.updates <- update
+	}
+}
+
+// close stops further reports; the reporter goroutine exits after sending any pending count.
+func (p *downloadProgress) close() {
+	if p.updates == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.updates)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/time/rate"
+)
+
+// flakyRegistry serves one single-layer artifact and cuts the first layer download in half.
+type flakyRegistry struct {
+	*httptest.Server
+	blobs    map[string][]byte
+	layer    ocispec.Descriptor
+	manifest ocispec.Descriptor
+
+	mu     sync.Mutex
+	gets   int
+	ranges []string
+}
+
+func newFlakyRegistry(t *testing.T, layerBytes []byte) *flakyRegistry {
+	t.Helper()
+	configBytes := []byte("{}")
+	configDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeEmptyJSON, Digest: digest.FromBytes(configBytes), Size: int64(len(configBytes))}
+	layerDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(layerBytes), Size: int64(len(layerBytes))}
+	manifest := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Config: configDesc, Layers: []ocispec.Descriptor{layerDesc}}
+	manifest.SchemaVersion = 2
+	manifestBytes, _ := json.Marshal(manifest)
+	r := &flakyRegistry{
+		layer:    layerDesc,
+		manifest: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifestBytes), Size: int64(len(manifestBytes))},
+		blobs: map[string][]byte{
+			configDesc.Digest.String():               configBytes,
+			layerDesc.Digest.String():                layerBytes,
+			digest.FromBytes(manifestBytes).String(): manifestBytes,
+		},
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *flakyRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v2/app/"), "/")
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	data, ok := r.blobs[parts[1]]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if parts[0] == "manifests" {
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+	}
+	w.Header().Set("Docker-Content-Digest", parts[1])
+	if parts[1] == r.layer.Digest.String() && req.Method == http.MethodGet {
+		r.mu.Lock()
+		r.gets++
+		first := r.gets == 1
+		if rng := req.Header.Get("Range"); rng != "" {
+			r.ranges = append(r.ranges, rng)
+		}
+		r.mu.Unlock()
+		if first {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			_, _ = w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+	}
+	http.ServeContent(w, req, "", time.Time{}, strings.NewReader(string(data)))
+}
+
+func TestEnsureOCIResumesInterruptedDownload(t *testing.T) {
+	t.Setenv("APOLLO_OCI_PLAIN_HTTP_HOSTS", "127.0.0.1")
+	layerBytes := makeTar(map[string]string{"bin/app": strings.Repeat("payload ", 4096)})
+	reg := newFlakyRegistry(t, layerBytes)
+
+	reports := make(chan [2]int64, 16)
+	ctx := withDownloadProgress(context.Background(), func(done, total int64) {
+		reports <- [2]int64{done, total}
+	})
+	f := newOCIFetcher(logr.Discard(), t.TempDir())
+	res, err := f.Ensure(ctx, strings.TrimPrefix(reg.URL, "http://")+"/app@"+reg.manifest.Digest.String())
+	if err != nil {
+		t.Fatalf("ensure: %v", err)
+	}
+	if res.attempts != 2 {
+		t.Fatalf("expected the interrupted attempt to be retried once, got %d attempts", res.attempts)
+	}
+	want := "bytes=" + strconv.Itoa(len(layerBytes)/2) + "-"
+	if len(reg.ranges) != 1 || !strings.HasPrefix(reg.ranges[0], want) {
+		t.Fatalf("expected one resumed range request %q, got %v", want, reg.ranges)
+	}
+	total := int64(len(layerBytes)) + 2
+	if res.bytesDownloaded != total || res.bytesTotal != total {
+		t.Fatalf("progress = %d/%d, want %d/%d", res.bytesDownloaded, res.bytesTotal, total, total)
+	}
+	select {
+	case report := <-reports:
+		if report[1] != total {
+			t.Fatalf("expected interim progress reports against total %d, got %v", total, report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected an interim progress report")
+	}
+}
+
+func TestEnsureOCIDoesNotWaitForProgressReporter(t *testing.T) {
+	t.Setenv("APOLLO_OCI_PLAIN_HTTP_HOSTS", "127.0.0.1")
+	reg := newFlakyRegistry(t, makeTar(map[string]string{"bin/app": "payload"}))
+
+	// The reporter stands in for a gateway that never answers.
+	unblock := make(chan struct{})
+	defer close(unblock)
+	reported := make(chan struct{}, 1)
+	ctx := withDownloadProgress(context.Background(), func(done, total int64) {
+		select {
+		case reported <- struct{}{}:
+		default:
+		}
+		<-unblock
+	})
+	f := newOCIFetcher(logr.Discard(), t.TempDir())
+	ensured := make(chan error, 1)
+	go func() {
+		_, err := f.Ensure(ctx, strings.TrimPrefix(reg.URL, "http://")+"/app@"+reg.manifest.Digest.String())
+		ensured <- err
+	}()
+	select {
+	case err := <-ensured:
+		if err != nil {
+			t.Fatalf("ensure: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ensure waited on a blocked progress reporter")
+	}
+	select {
+	case <-reported:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the reporter to be called")
+	}
+}
+
+func TestBandwidthLimiterFromEnv(t *testing.T) {
+	f := newOCIFetcher(logr.Discard(), t.TempDir()).(*ociFetcherImpl)
+
+	if l, err := f.bandwidthLimiter(); err != nil || l != nil {
+		t.Fatalf("expected unlimited by default, got %v, %v", l, err)
+	}
+
+	t.Setenv("APOLLO_ARTIFACT_BANDWIDTH_BYTES_PER_SEC", "1048576")
+	l, err := f.bandwidthLimiter()
+	if err != nil || l == nil || l.Limit() != rate.Limit(1<<20) || l.Burst() != 1<<20 {
+		t.Fatalf("unexpected limiter %v, %v", l, err)
+	}
+	t.Setenv("APOLLO_ARTIFACT_BANDWIDTH_BYTES_PER_SEC", "1000")
+	if again, _ := f.bandwidthLimiter(); again != l || l.Limit() != 1000 || l.Burst() != minBandwidthBurst {
+		t.Fatalf("expected the shared limiter to be retuned, got limit=%v burst=%d", l.Limit(), l.Burst())
+	}
+
+	t.Setenv("APOLLO_ARTIFACT_BANDWIDTH_BYTES_PER_SEC", "fast")
+	if _, err := f.bandwidthLimiter(); err == nil {
+		t.Fatalf("expected invalid bandwidth limit to be rejected")
+	}
+}
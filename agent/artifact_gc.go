@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"oras.land/oras-go/v2/registry"
+)
+
+const (
+	defaultArtifactKeepPrevious = 2
+	artifactGCInterval          = time.Hour
+)
+
+var artifactDirPattern = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// artifactCollector is implemented by fetchers that can prune their on-disk cache.
+type artifactCollector interface {
+	GC(ctx context.Context, keep map[string]struct{}) (gcResult, error)
+}
+
+type gcResult struct {
+	removed        []string
+	skipped        []string
+	reclaimedBytes int64
+}
+
+// GC removes cached artifacts whose digest is not in keep. Entries whose lock is held
+// (an Ensure in progress) are skipped and retried on the next pass.
+func (f *ociFetcherImpl) GC(ctx context.Context, keep map[string]struct{}) (gcResult, error) {
+	var res gcResult
+	entries, err := os.ReadDir(f.root)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return res, nil
+		}
+		return res, err
+	}
+
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return res, ctx.Err()
+		}
+		if !entry.IsDir() || !artifactDirPattern.MatchString(entry.Name()) {
+			continue
+		}
+		digest := "sha256:" + entry.Name()
+		if _, ok := keep[digest]; ok {
+			continue
+		}
+
+		removed, size, err := removeArtifactDir(filepath.Join(f.root, entry.Name()))
+		if err != nil {
+			return res, err
+		}
+		if !removed {
+			res.skipped = append(res.skipped, digest)
+			continue
+		}
+		res.removed = append(res.removed, digest)
+		res.reclaimedBytes += size
+	}
+	return res, nil
+}
+
+// removeArtifactDir deletes baseDir while holding its lock. It returns false when the lock is busy.
+func removeArtifactDir(baseDir string) (bool, int64, error) {
+	lockFile, err := os.OpenFile(filepath.Join(baseDir, ".lock"), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return false, 0, err
+	}
+	defer lockFile.Close()
+	if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return false, 0, nil
+		}
+		return false, 0, err
+	}
+	defer unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
+
+	size := dirSize(baseDir)
+	if err := os.RemoveAll(baseDir); err != nil {
+		return false, 0, err
+	}
+	return true, size, nil
+}
+
+// lockArtifactDir creates baseDir and takes its exclusive lock. It retries when GC removed
+// the directory between open and flock, so the caller never holds a lock on an unlinked file.
+func lockArtifactDir(baseDir string) (*os.File, error) {
+	lockPath := filepath.Join(baseDir, ".lock")
+	for {
+		if err := os.MkdirAll(baseDir, 0o755); err != nil {
+			return nil, err
+		}
+		lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_EX); err != nil {
+			lockFile.Close()
+			return nil, err
+		}
+		held, herr := lockFile.Stat()
+		current, cerr := os.Stat(lockPath)
+		if herr == nil && cerr == nil && os.SameFile(held, current) {
+			return lockFile, nil
+		}
+		unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
+		lockFile.Close()
+	}
+}
+
+func dirSize(root string) int64 {
+	var total int64
+	_ = filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// recordArtifact makes digest the active artifact of mi, keeping up to keep previous digests for rollback.
+func recordArtifact(mi managedItem, digest string, keep int) managedItem {
+	if digest == "" || digest == mi.ArtifactDigest {
+		return mi
+	}
+	history := make([]string, 0, keep)
+	if mi.ArtifactDigest != "" {
+		history = append(history, mi.ArtifactDigest)
+	}
+	for _, d := range mi.PreviousArtifactDigests {
+		if d != digest && d != mi.ArtifactDigest {
+			history = append(history, d)
+		}
+	}
+	if len(history) > keep {
+		history = history[:keep]
+	}
+	mi.ArtifactDigest = digest
+	mi.PreviousArtifactDigests = history
+	if len(history) == 0 {
+		mi.PreviousArtifactDigests = nil
+	}
+	return mi
+}
+
+// artifactDigestFromRef returns the pinned digest of an OCI reference, or "" when it is not digest-pinned.
+func artifactDigestFromRef(ref string) string {
+	parsed, err := registry.ParseReference(strings.TrimSpace(ref))
+	if err != nil || !digestPattern.MatchString(parsed.Reference) {
+		return ""
+	}
+	return strings.ToLower(parsed.Reference)
+}
+
+// collectArtifacts prunes the artifact cache down to what managed items and the current desired
+// state reference. It runs when that set changes and at least every artifactGCInterval.
+func (a *agent) collectArtifacts(ctx context.Context, desiredDigests []string) {
+	collector, ok := a.oci.(artifactCollector)
+	if !ok {
+		return
+	}
+
+	keep := make(map[string]struct{})
+	for _, d := range desiredDigests {
+		keep[d] = struct{}{}
+	}
+	for _, mi := range a.managed {
+		if mi.ArtifactDigest != "" {
+			keep[mi.ArtifactDigest] = struct{}{}
+		}
+		for _, d := range mi.PreviousArtifactDigests {
+			keep[d] = struct{}{}
+		}
+		if mi.LastGood != nil && mi.LastGood.ArtifactDigest != "" {
+			keep[mi.LastGood.ArtifactDigest] = struct{}{}
+		}
+	}
+
+	keys := make([]string, 0, len(keep))
+	for d := range keep {
+		keys = append(keys, d)
+	}
+	sort.Strings(keys)
+	fingerprint := strings.Join(keys, ",")
+	if fingerprint == a.lastGCKeep && time.Since(a.lastGCAt) < artifactGCInterval {
+		return
+	}
+
+	res, err := collector.GC(ctx, keep)
+	if err != nil {
+		a.logger.Error(err, "artifact gc")
+		return
+	}
+	a.lastGCKeep = fingerprint
+	a.lastGCAt = time.Now()
+	if len(res.removed) > 0 || len(res.skipped) > 0 {
+		a.logger.Info("artifact gc", "kept", len(keep), "removed", len(res.removed), "skippedLocked", len(res.skipped), "reclaimedBytes", res.reclaimedBytes)
+	}
+	if len(res.skipped) > 0 {
+		// Retry locked entries on the next reconcile.
+		a.lastGCKeep = ""
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/sys/unix"
+)
+
+func seedArtifact(t *testing.T, root, hexChar string, size int) string {
+	t.Helper()
+	digestHex := strings.Repeat(hexChar, 64)
+	dir := filepath.Join(root, digestHex)
+	if err := os.MkdirAll(filepath.Join(dir, "rootfs"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "rootfs", "blob"), make([]byte, size), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, readyMarkerName), nil, 0o644); err != nil {
+		t.Fatalf("write ready: %v", err)
+	}
+	return "sha256:" + digestHex
+}
+
+func TestArtifactGCKeepsReferencedAndSkipsLocked(t *testing.T) {
+	root := t.TempDir()
+	current := seedArtifact(t, root, "a", 10)
+	previous := seedArtifact(t, root, "b", 20)
+	stale := seedArtifact(t, root, "c", 300)
+	locked := seedArtifact(t, root, "d", 40)
+	if err := os.MkdirAll(filepath.Join(root, "not-a-digest"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	lockFile, err := os.OpenFile(filepath.Join(root, strings.TrimPrefix(locked, "sha256:"), ".lock"), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		t.Fatalf("open lock: %v", err)
+	}
+	defer lockFile.Close()
+	if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_EX); err != nil {
+		t.Fatalf("flock: %v", err)
+	}
+
+	f := newOCIFetcher(logr.Discard(), root)
+	res, err := f.(artifactCollector).GC(context.Background(), map[string]struct{}{current: {}, previous: {}})
+	if err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if !reflect.DeepEqual(res.removed, []string{stale}) {
+		t.Fatalf("expected only %s removed, got %v", stale, res.removed)
+	}
+	if !reflect.DeepEqual(res.skipped, []string{locked}) {
+		t.Fatalf("expected %s skipped while locked, got %v", locked, res.skipped)
+	}
+	if res.reclaimedBytes != 300 {
+		t.Fatalf("expected 300 reclaimed bytes, got %d", res.reclaimedBytes)
+	}
+	for _, d := range []string{current, previous, locked} {
+		if !dirExists(filepath.Join(root, strings.TrimPrefix(d, "sha256:"))) {
+			t.Fatalf("expected %s to be kept", d)
+		}
+	}
+	if !dirExists(filepath.Join(root, "not-a-digest")) {
+		t.Fatalf("gc must ignore directories that are not digests")
+	}
+}
+
+func TestRecordArtifactKeepsPreviousDigests(t *testing.T) {
+	mi := managedItem{UnitName: "u"}
+	for _, d := range []string{"sha256:1", "sha256:2", "sha256:3", "sha256:2", "sha256:4"} {
+		mi = recordArtifact(mi, d, 2)
+	}
+	if mi.ArtifactDigest != "sha256:4" {
+		t.Fatalf("expected active sha256:4, got %s", mi.ArtifactDigest)
+	}
+	if !reflect.DeepEqual(mi.PreviousArtifactDigests, []string{"sha256:2", "sha256:3"}) {
+		t.Fatalf("unexpected history %v", mi.PreviousArtifactDigests)
+	}
+	if same := recordArtifact(mi, "sha256:4", 2); !reflect.DeepEqual(same, mi) {
+		t.Fatalf("re-recording the active digest must be a no-op")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxSymlinkHops = 40
+
+// Setuid policies for extracted files (APOLLO_ARTIFACT_SETUID_POLICY).
+const (
+	setuidPolicyStrip    = "strip"
+	setuidPolicyPreserve = "preserve"
+	setuidPolicyReject   = "reject"
+)
+
+func loadSetuidPolicy() (string, error) {
+	v := strings.ToLower(strings.TrimSpace(getenv("APOLLO_ARTIFACT_SETUID_POLICY", "")))
+	switch v {
+	case "":
+		return setuidPolicyStrip, nil
+	case setuidPolicyStrip, setuidPolicyPreserve, setuidPolicyReject:
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid APOLLO_ARTIFACT_SETUID_POLICY %q (want strip, preserve or reject)", v)
+	}
+}
+
+// entryMode applies the setuid policy to a tar header's mode.
+func entryMode(hdr *tar.Header, policy string) (os.FileMode, error) {
+	mode := hdr.FileInfo().Mode()
+	special := mode & (os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if special == 0 || policy == setuidPolicyStrip {
+		return mode.Perm(), nil
+	}
+	if policy == setuidPolicyReject {
+		return 0, extractError{reason: "SetuidNotAllowed", msg: fmt.Sprintf("rejecting %q with mode %s", hdr.Name, mode)}
+	}
+	return mode.Perm() | special, nil
+}
+
+// ensureNoSymlinkParents rejects entries whose parent directories inside dest are symlinks,
+// so extraction never writes through a link.
+func ensureNoSymlinkParents(dest, name string) error {
+	dir := filepath.Dir(name)
+	if dir == "." {
+		return nil
+	}
+	cur := dest
+	for _, part := range strings.Split(dir, string(os.PathSeparator)) {
+		cur = filepath.Join(cur, part)
+		info, err := os.Lstat(cur)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return extractError{reason: "InvalidPath", msg: fmt.Sprintf("rejecting %q: parent traverses symlink", name)}
+		}
+	}
+	return nil
+}
+
+// clearTarget removes a non-directory already at target so a new entry replaces it
+// instead of writing through an earlier symlink or hardlink.
+func clearTarget(target string) error {
+	info, err := os.Lstat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	return os.Remove(target)
+}
+
+// cleanLinkName validates a hardlink target, which tar records relative to the archive root.
+func cleanLinkName(hdr *tar.Header) (string, error) {
+	name := filepath.Clean(hdr.Linkname)
+	if name == "." || filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", extractError{reason: "InvalidLink", msg: fmt.Sprintf("rejecting hardlink %q -> %q outside rootfs", hdr.Name, hdr.Linkname)}
+	}
+	return name, nil
+}
+
+// extractHardlink links target to an already-extracted regular file inside dest.
+func extractHardlink(dest, target string, hdr *tar.Header) error {
+	linkName, err := cleanLinkName(hdr)
+	if err != nil {
+		return err
+	}
+	if err := ensureNoSymlinkParents(dest, linkName); err != nil {
+		return extractError{reason: "InvalidLink", msg: fmt.Sprintf("rejecting hardlink %q -> %q: target traverses symlink", hdr.Name, hdr.Linkname)}
+	}
+	source := filepath.Join(dest, linkName)
+	info, err := os.Lstat(source)
+	if err != nil || !info.Mode().IsRegular() {
+		return extractError{reason: "InvalidLink", msg: fmt.Sprintf("rejecting hardlink %q -> %q: target is not an extracted regular file", hdr.Name, hdr.Linkname)}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	if err := clearTarget(target); err != nil {
+		return err
+	}
+	return os.Link(source, target)
+}
+
+// extractSymlink creates a symlink. Absolute targets are rejected because the rootfs is not
+// chrooted; relative targets are checked by validateSymlinks once the whole layer is on disk.
+func extractSymlink(target string, hdr *tar.Header) error {
+	if hdr.Linkname == "" || filepath.IsAbs(hdr.Linkname) {
+		return extractError{reason: "InvalidLink", msg: fmt.Sprintf("rejecting symlink %q -> %q outside rootfs", hdr.Name, hdr.Linkname)}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	if err := clearTarget(target); err != nil {
+		return err
+	}
+	return os.Symlink(hdr.Linkname, target)
+}
+
+// validateSymlinks resolves every symlink under dest through the extracted tree and rejects
+// any whose target escapes dest. Links may be dangling, but only within dest.
+func validateSymlinks(dest string) error {
+	return filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(dest, path)
+		if err != nil {
+			return err
+		}
+		if err := resolveWithinRoot(dest, rel); err != nil {
+			return extractError{reason: "InvalidLink", msg: fmt.Sprintf("rejecting symlink %q: %v", rel, err)}
+		}
+		return nil
+	})
+}
+
+// resolveWithinRoot follows the symlink at rel (relative to root) component by component,
+// failing if resolution ever leaves root.
+func resolveWithinRoot(root, rel string) error {
+	var resolved []string
+	if dir := filepath.Dir(rel); dir != "." {
+		resolved = strings.Split(dir, string(os.PathSeparator))
+	}
+	link, err := os.Readlink(filepath.Join(root, rel))
+	if err != nil {
+		return err
+	}
+	pending := strings.Split(link, "/")
+	hops := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return fmt.Errorf("target escapes rootfs")
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		resolved = append(resolved, part)
+		cur := filepath.Join(append([]string{root}, resolved...)...)
+		info, err := os.Lstat(cur)
+		if err != nil {
+			// Missing components cannot be links; keep resolving lexically.
+			continue
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		hops++
+		if hops > maxSymlinkHops {
+			return fmt.Errorf("too many levels of symbolic links")
+		}
+		next, err := os.Readlink(cur)
+		if err != nil {
+			return err
+		}
+		if filepath.IsAbs(next) {
+			return fmt.Errorf("target escapes rootfs via absolute link %q", next)
+		}
+		resolved = resolved[:len(resolved)-1]
+		pending = append(strings.Split(next, "/"), pending...)
+	}
+	return nil
+}
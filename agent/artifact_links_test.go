@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	hdr  tar.Header
+	body string
+}
+
+func makeTarEntries(entries ...tarEntry) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.body))
+		if hdr.Mode == 0 {
+			hdr.Mode = 0o755
+		}
+		_ = tw.WriteHeader(&hdr)
+		_, _ = tw.Write([]byte(e.body))
+	}
+	_ = tw.Close()
+	return buf.Bytes()
+}
+
+func regEntry(name, body string) tarEntry {
+	return tarEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeReg}, body: body}
+}
+
+func symlinkEntry(name, target string) tarEntry {
+	return tarEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target}}
+}
+
+func hardlinkEntry(name, target string) tarEntry {
+	return tarEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: target}}
+}
+
+func TestExtractLayerSupportsContainedLinks(t *testing.T) {
+	dest := t.TempDir()
+	layer := makeTarEntries(
+		regEntry("lib/libfoo.so.1", "elf"),
+		symlinkEntry("lib/libfoo.so", "libfoo.so.1"),
+		symlinkEntry("bin/libdir", "../lib"),
+		hardlinkEntry("bin/libfoo-copy", "lib/libfoo.so.1"),
+		symlinkEntry("bin/dangling", "../share/missing"),
+	)
+	if _, err := extractLayer(bytes.NewReader(layer), "application/vnd.oci.image.layer.v1.tar", dest, setuidPolicyStrip); err != nil {
+		t.Fatalf("extract: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "lib", "libfoo.so"))
+	if err != nil || string(data) != "elf" {
+		t.Fatalf("expected symlink to resolve to library, got %q err=%v", data, err)
+	}
+	a, _ := os.Stat(filepath.Join(dest, "lib", "libfoo.so.1"))
+	b, _ := os.Stat(filepath.Join(dest, "bin", "libfoo-copy"))
+	if a == nil || b == nil || !os.SameFile(a, b) {
+		t.Fatalf("expected hardlink to share the library inode")
+	}
+}
+
+func TestExtractLayerRejectsEscapingLinks(t *testing.T) {
+	cases := []struct {
+		name       string
+		entries    []tarEntry
+		wantReason string
+	}{
+		{name: "absolute symlink", entries: []tarEntry{symlinkEntry("etc", "/etc")}, wantReason: "InvalidLink"},
+		{name: "relative escape", entries: []tarEntry{symlinkEntry("lib/up", "../../outside")}, wantReason: "InvalidLink"},
+		{name: "escape through link chain", entries: []tarEntry{symlinkEntry("self", "."), symlinkEntry("up", "self/self/..")}, wantReason: "InvalidLink"},
+		{name: "write through symlink", entries: []tarEntry{symlinkEntry("dir", "."), regEntry("dir/file", "x")}, wantReason: "InvalidPath"},
+		{name: "hardlink escape", entries: []tarEntry{hardlinkEntry("passwd", "../etc/passwd")}, wantReason: "InvalidLink"},
+		{name: "hardlink to symlink", entries: []tarEntry{symlinkEntry("l", "x"), hardlinkEntry("h", "l")}, wantReason: "InvalidLink"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "rootfs")
+			if err := os.MkdirAll(dest, 0o755); err != nil {
+				t.Fatalf("mkdir: %v", err)
+			}
+			_, err := extractLayer(bytes.NewReader(makeTarEntries(tc.entries...)), "application/vnd.oci.image.layer.v1.tar", dest, setuidPolicyStrip)
+			ee, ok := err.(extractError)
+			if !ok || ee.reason != tc.wantReason {
+				t.Fatalf("expected %s, got %v", tc.wantReason, err)
+			}
+		})
+	}
+}
+
+func TestExtractLayerSetuidPolicy(t *testing.T) {
+	layer := makeTarEntries(tarEntry{hdr: tar.Header{Name: "bin/su", Typeflag: tar.TypeReg, Mode: 0o4755}, body: "x"})
+	for _, tc := range []struct {
+		policy     string
+		wantSetuid bool
+		wantErr    bool
+	}{
+		{policy: setuidPolicyStrip},
+		{policy: setuidPolicyPreserve, wantSetuid: true},
+		{policy: setuidPolicyReject, wantErr: true},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			dest := t.TempDir()
+			_, err := extractLayer(bytes.NewReader(layer), "application/vnd.oci.image.layer.v1.tar", dest, tc.policy)
+			if tc.wantErr {
+				if ee, ok := err.(extractError); !ok || ee.reason != "SetuidNotAllowed" {
+					t.Fatalf("expected SetuidNotAllowed, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extract: %v", err)
+			}
+			info, err := os.Stat(filepath.Join(dest, "bin", "su"))
+			if err != nil {
+				t.Fatalf("stat: %v", err)
+			}
+			if got := info.Mode()&os.ModeSetuid != 0; got != tc.wantSetuid {
+				t.Fatalf("setuid=%v, want %v (mode %s)", got, tc.wantSetuid, info.Mode())
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/retry"
+)
+
+// ociMirror routes artifact pulls through the gateway's pull-through cache (APOLLO_OCI_MIRROR).
+// Requests keep the upstream repository path and name the upstream registry in the "ns" query
+// parameter; the device authenticates with the same headers it uses for the gateway API.
+type ociMirror struct {
+	host      string
+	plainHTTP bool
+	device    string
+	token     func() string
+	transport http.RoundTripper
+}
+
+// parseOCIMirror parses a mirror base URL such as "https://gateway:8443". transport carries the
+// gateway TLS settings; nil uses the default transport.
+func parseOCIMirror(raw, device string, token func() string, transport http.RoundTripper) (*ociMirror, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid OCI mirror %q: expected http(s)://host[:port]", raw)
+	}
+	return &ociMirror{host: u.Host, plainHTTP: u.Scheme == "http", device: device, token: token, transport: transport}, nil
+}
+
+// repository returns a mirror-backed repository for the upstream reference.
+func (m *ociMirror) repository(ref registry.Reference) (*remote.Repository, error) {
+	repo, err := newRemoteRepository(m.host + "/" + ref.Repository)
+	if err != nil {
+		return nil, err
+	}
+	repo.PlainHTTP = m.plainHTTP
+	repo.Client = &auth.Client{
+		Client: &http.Client{Transport: &mirrorTransport{base: retry.NewTransport(m.transport), upstream: ref.Registry, mirror: m}},
+		Cache:  auth.NewCache(),
+	}
+	return repo, nil
+}
+
+type mirrorTransport struct {
+	base     http.RoundTripper
+	upstream string
+	mirror   *ociMirror
+}
+
+func (t *mirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	q := req.URL.Query()
+	q.Set("ns", t.upstream)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("X-Device-Name", t.mirror.device)
+	if t.mirror.token != nil {
+		if token := t.mirror.token(); token != "" {
+			req.Header.Set("X-Device-Token", token)
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// SetMirror routes subsequent pulls through m; nil pulls straight from upstream.
+func (f *ociFetcherImpl) SetMirror(m *ociMirror) {
+	f.mirror = m
+}
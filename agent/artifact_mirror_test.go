@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+)
+
+func TestEnsureOCIPullsThroughMirror(t *testing.T) {
+	tarBytes := makeTar(map[string]string{"bin/app": "echo mirrored"})
+	content := newTokenRegistry(t, tarBytes)
+
+	const upstream = "registry.example.com"
+	var badRequests int
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("ns") != upstream || r.Header.Get("X-Device-Name") != "switch-1" || r.Header.Get("X-Device-Token") != "device-token" {
+			badRequests++
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.Header.Set("Authorization", "Bearer "+content.token)
+		content.serve(w, r)
+	}))
+	defer mirror.Close()
+
+	m, err := parseOCIMirror(mirror.URL, "switch-1", func() string { return "device-token" }, nil)
+	if err != nil {
+		t.Fatalf("parseOCIMirror: %v", err)
+	}
+	f := newOCIFetcher(logr.Discard(), t.TempDir()).(*ociFetcherImpl)
+	f.SetMirror(m)
+	res, err := f.Ensure(context.Background(), upstream+"/app@"+content.manifest.Digest.String())
+	if err != nil || !res.verified {
+		t.Fatalf("expected pull through mirror, got verified=%v err=%v", res.verified, err)
+	}
+	if badRequests != 0 {
+		t.Fatalf("mirror saw %d requests without ns/device headers", badRequests)
+	}
+}
+
+func TestParseOCIMirrorRejectsBareHost(t *testing.T) {
+	if _, err := parseOCIMirror("gateway:8080", "d", nil, nil); err == nil || !strings.Contains(err.Error(), "http(s)://") {
+		t.Fatalf("expected scheme to be required, got %v", err)
+	}
+}
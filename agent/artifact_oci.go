@@ -2,7 +2,6 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
@@ -12,12 +11,17 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
 	"oras.land/oras-go/v2"
 	"oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/content/oci"
@@ -35,6 +39,8 @@ const (
 var (
 	digestPattern = regexp.MustCompile(`^sha256:[A-Fa-f0-9]{64}$`)
 
+	// maxExtractEntries and maxExtractBytes apply unless APOLLO_ARTIFACT_MAX_EXTRACT_ENTRIES or
+	// APOLLO_ARTIFACT_MAX_EXTRACT_BYTES override them.
 	maxExtractEntries = defaultMaxExtractEntries
 	maxExtractBytes   = defaultMaxExtractBytes
 
@@ -60,11 +66,19 @@ type ociResult struct {
 	downloadMessage string
 	verifyReason    string
 	verifyMessage   string
+	// bytesDownloaded and bytesTotal cover the manifest's config and layer blobs.
+	bytesDownloaded int64
+	bytesTotal      int64
 }
 
 type ociFetcherImpl struct {
 	root   string
 	logger logr.Logger
+	creds  *registryCredentials
+	mirror *ociMirror
+
+	limiterMu sync.Mutex
+	limiter   *rate.Limiter
 }
 
 func newOCIFetcher(logger logr.Logger, root string) ociFetcher {
@@ -72,7 +86,7 @@ func newOCIFetcher(logger logr.Logger, root string) ociFetcher {
 	if r == "" {
 		r = defaultOCIArtifactRoot
 	}
-	return &ociFetcherImpl{root: r, logger: logger}
+	return &ociFetcherImpl{root: r, logger: logger, creds: newRegistryCredentials()}
 }
 
 func (f *ociFetcherImpl) Ensure(ctx context.Context, ref string) (ociResult, error) {
@@ -87,34 +101,38 @@ func (f *ociFetcherImpl) Ensure(ctx context.Context, ref string) (ociResult, err
 
 	digestHex := strings.TrimPrefix(parsedRef.Reference, "sha256:")
 	baseDir := filepath.Join(f.root, digestHex)
-	lockPath := filepath.Join(baseDir, ".lock")
 	readyPath := filepath.Join(baseDir, readyMarkerName)
 	rootfsPath := filepath.Join(baseDir, "rootfs")
 	metaPath := filepath.Join(baseDir, "meta.json")
 
-	if err := os.MkdirAll(baseDir, 0o755); err != nil {
-		return res, err
-	}
-
-	lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0o600)
+	lockFile, err := lockArtifactDir(baseDir)
 	if err != nil {
 		return res, err
 	}
 	defer lockFile.Close()
-	if err := unix.Flock(int(lockFile.Fd()), unix.LOCK_EX); err != nil {
-		return res, err
-	}
 	defer unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
 
 	if fileExists(readyPath) && dirExists(rootfsPath) {
-		res.rootfsPath = rootfsPath
 		res.digest = parsedRef.Reference
 		res.downloaded = true
-		res.verified = true
 		res.downloadReason = "ArtifactDownloaded"
 		res.downloadMessage = "artifact cached"
+		signedBy, err := f.cachedSignature(ctx, parsedRef, metaPath)
+		if err != nil {
+			res.lastError = errorString(err)
+			res.verifyMessage = res.lastError
+			if se, ok := err.(signatureError); ok {
+				res.verifyReason = se.reason
+			}
+			return res, err
+		}
+		res.rootfsPath = rootfsPath
+		res.verified = true
 		res.verifyReason = "ArtifactVerified"
 		res.verifyMessage = "artifact cached"
+		if signedBy != "" {
+			res.verifyMessage = fmt.Sprintf("artifact cached (signed by %s)", signedBy)
+		}
 		res.lastError = ""
 		return res, nil
 	}
@@ -124,23 +142,60 @@ func (f *ociFetcherImpl) Ensure(ctx context.Context, ref string) (ociResult, err
 		return res, err
 	}
 
-	repoRef := fmt.Sprintf("%s/%s", parsedRef.Registry, parsedRef.Repository)
-	repository, err := newRemoteRepository(repoRef)
+	policy, err := loadSpacePolicy()
 	if err != nil {
+		res.lastError = errorString(err)
+		return res, err
+	}
+	setuidPolicy, err := loadSetuidPolicy()
+	if err != nil {
+		res.lastError = errorString(err)
+		return res, err
+	}
+	limiter, err := f.bandwidthLimiter()
+	if err != nil {
+		res.lastError = errorString(err)
 		return res, err
 	}
-	repository.PlainHTTP = allowPlainHTTP(parsedRef.Registry)
+
+	repository, err := f.upstream(parsedRef)
+	if err != nil {
+		return res, err
+	}
+	// Content comes from the mirror when one is configured; signatures are still checked upstream.
+	source := repository
+	if f.mirror != nil {
+		if source, err = f.mirror.repository(parsedRef); err != nil {
+			return res, err
+		}
+	}
 
 	attempts := int32(0)
 	var desc ocispec.Descriptor
+	progress := newDownloadProgress(ctx)
+	defer progress.close()
+	partialDir := filepath.Join(baseDir, partialDirName)
+	resumable := &resumableSource{Repository: source, dir: partialDir, limiter: limiter, progress: progress}
+	copyOpts := oras.DefaultCopyOptions
+	copyOpts.MapRoot = f.spaceCheckedRoot(policy, progress.setTotal)
+	copyOpts.OnCopySkipped = func(_ context.Context, desc ocispec.Descriptor) error {
+		if !isManifestMediaType(desc.MediaType) {
+			progress.add(desc.Size)
+		}
+		return nil
+	}
+	var spaceErr spaceError
 	for attempt := 0; attempt < 3; attempt++ {
 		attempts++
 		res.lastAttemptTime = nowFunc().Format(time.RFC3339)
-		desc, err = orasCopy(ctx, repository, parsedRef.Reference, store, parsedRef.Reference, oras.DefaultCopyOptions)
+		// Each attempt recounts resumed and already-stored blobs.
+		progress.done.Store(0)
+		desc, err = orasCopy(ctx, resumable, parsedRef.Reference, store, parsedRef.Reference, copyOpts)
+		res.bytesDownloaded, res.bytesTotal = progress.done.Load(), progress.total.Load()
 		if err == nil {
 			break
 		}
-		if !isRetryable(err) {
+		if errors.As(err, &spaceErr) || !isRetryable(err) {
 			break
 		}
 		backoff := backoffDuration(attempt)
@@ -154,8 +209,13 @@ func (f *ociFetcherImpl) Ensure(ctx context.Context, ref string) (ociResult, err
 	res.attempts = attempts
 	if err != nil {
 		res.lastError = errorString(err)
+		if errors.As(err, &spaceErr) {
+			res.downloadReason = "InsufficientSpace"
+			res.downloadMessage = spaceErr.msg
+		}
 		return res, err
 	}
+	os.RemoveAll(partialDir)
 	res.downloaded = true
 	res.downloadReason = "ArtifactDownloaded"
 	res.downloadMessage = "artifact downloaded"
@@ -190,6 +250,43 @@ func (f *ociFetcherImpl) Ensure(ctx context.Context, ref string) (ociResult, err
 		return res, fmt.Errorf(res.lastError)
 	}
 	layer := manifest.Layers[0]
+	if _, err := layerCompressionFor(layer.MediaType); err != nil {
+		res.lastError = errorString(err)
+		res.verifyReason = "UnsupportedMediaType"
+		res.verifyMessage = res.lastError
+		return res, err
+	}
+
+	trustRoots, err := loadTrustRoots()
+	if err != nil {
+		res.lastError = errorString(err)
+		res.verifyReason = "TrustRootsInvalid"
+		res.verifyMessage = res.lastError
+		return res, err
+	}
+	signedBy := ""
+	if len(trustRoots) > 0 {
+		signedBy, err = verifyArtifactSignature(ctx, newSignatureSource(repository), desc, trustRoots)
+		if err != nil {
+			res.lastError = errorString(err)
+			res.verifyMessage = res.lastError
+			if se, ok := err.(signatureError); ok {
+				res.verifyReason = se.reason
+			}
+			return res, err
+		}
+	}
+
+	// The blobs are on disk now; make sure extraction still fits.
+	if err := f.checkSpace(policy, policy.expanded(layer.Size)); err != nil {
+		res.lastError = errorString(err)
+		if errors.As(err, &spaceErr) {
+			res.downloaded = false
+			res.downloadReason = "InsufficientSpace"
+			res.downloadMessage = spaceErr.msg
+		}
+		return res, err
+	}
 
 	layerReader, err := store.Fetch(ctx, layer)
 	if err != nil {
@@ -203,7 +300,7 @@ func (f *ociFetcherImpl) Ensure(ctx context.Context, ref string) (ociResult, err
 		res.lastError = errorString(err)
 		return res, err
 	}
-	size, err := extractLayer(layerReader, layer.MediaType, tmpRoot)
+	size, err := extractLayer(layerReader, layer.MediaType, tmpRoot, setuidPolicy)
 	if err != nil {
 		os.RemoveAll(tmpRoot)
 		res.lastError = errorString(err)
@@ -230,19 +327,14 @@ func (f *ociFetcherImpl) Ensure(ctx context.Context, ref string) (ociResult, err
 		return res, err
 	}
 
-	meta := struct {
-		Ref       string `json:"ref"`
-		Digest    string `json:"digest"`
-		Size      int64  `json:"size"`
-		FetchedAt string `json:"fetchedAt"`
-	}{
+	meta := artifactMeta{
 		Ref:       ref,
 		Digest:    parsedRef.Reference,
 		Size:      size,
 		FetchedAt: nowFunc().Format(time.RFC3339),
+		SignedBy:  signedBy,
 	}
-	metaBytes, _ := json.MarshalIndent(meta, "", "  ")
-	if err := os.WriteFile(metaPath, metaBytes, 0o644); err != nil {
+	if err := meta.write(metaPath); err != nil {
 		res.lastError = errorString(err)
 		return res, err
 	}
@@ -257,10 +349,86 @@ func (f *ociFetcherImpl) Ensure(ctx context.Context, ref string) (ociResult, err
 	res.verified = true
 	res.verifyReason = "ArtifactVerified"
 	res.verifyMessage = "artifact verified"
+	if signedBy != "" {
+		res.verifyMessage = fmt.Sprintf("artifact verified (signed by %s)", signedBy)
+	}
 	res.lastError = ""
 	return res, nil
 }
 
+// artifactMeta is written to meta.json next to an extracted artifact. SignedBy is the id of the
+// trusted key that verified it, empty when no trust roots were configured.
+type artifactMeta struct {
+	Ref       string `json:"ref"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	FetchedAt string `json:"fetchedAt"`
+	SignedBy  string `json:"signedBy,omitempty"`
+}
+
+func readArtifactMeta(path string) (artifactMeta, error) {
+	var meta artifactMeta
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return meta, err
+	}
+	return meta, json.Unmarshal(data, &meta)
+}
+
+func (m artifactMeta) write(path string) error {
+	data, _ := json.MarshalIndent(m, "", "  ")
+	return os.WriteFile(path, data, 0o644)
+}
+
+// upstream returns the registry repository of ref, authenticated with the device's credentials.
+func (f *ociFetcherImpl) upstream(ref registry.Reference) (*remote.Repository, error) {
+	repository, err := newRemoteRepository(fmt.Sprintf("%s/%s", ref.Registry, ref.Repository))
+	if err != nil {
+		return nil, err
+	}
+	repository.PlainHTTP = allowPlainHTTP(ref.Registry)
+	repository.Client = f.creds.authClient()
+	return repository, nil
+}
+
+// cachedSignature checks a cached artifact against the current trust roots. While the key that
+// verified it is still trusted nothing is fetched; otherwise, e.g. after that key was removed or
+// trust roots were configured after the download, its signature is verified upstream again and
+// the new key recorded.
+func (f *ociFetcherImpl) cachedSignature(ctx context.Context, ref registry.Reference, metaPath string) (string, error) {
+	trustRoots, err := loadTrustRoots()
+	if err != nil {
+		return "", signatureError{reason: "TrustRootsInvalid", msg: errorString(err)}
+	}
+	if len(trustRoots) == 0 {
+		return "", nil
+	}
+	meta, err := readArtifactMeta(metaPath)
+	if err != nil {
+		f.logger.V(1).Info("cached artifact has no readable metadata; verifying its signature again", "ref", ref.String(), "reason", err.Error())
+	}
+	for _, k := range trustRoots {
+		if meta.SignedBy != "" && k.id == meta.SignedBy {
+			return k.id, nil
+		}
+	}
+
+	repository, err := f.upstream(ref)
+	if err != nil {
+		return "", err
+	}
+	subject := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.Digest(ref.Reference)}
+	signedBy, err := verifyArtifactSignature(ctx, newSignatureSource(repository), subject, trustRoots)
+	if err != nil {
+		return "", err
+	}
+	meta.SignedBy = signedBy
+	if err := meta.write(metaPath); err != nil {
+		f.logger.Error(err, "record artifact signer", "path", metaPath)
+	}
+	return signedBy, nil
+}
+
 type extractError struct {
 	reason string
 	msg    string
@@ -273,16 +441,36 @@ func (e extractError) Error() string {
 	return e.reason
 }
 
-func extractLayer(r io.Reader, mediaType, dest string) (int64, error) {
-	var reader io.Reader = r
-	if strings.Contains(strings.ToLower(mediaType), "gzip") {
-		gz, err := gzip.NewReader(r)
-		if err != nil {
-			return 0, err
+// loadExtractLimits returns the entry and byte limits for extracting one layer.
+func loadExtractLimits() (int, int64, error) {
+	entries, size := maxExtractEntries, maxExtractBytes
+	if v := strings.TrimSpace(getenv("APOLLO_ARTIFACT_MAX_EXTRACT_ENTRIES", "")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return entries, size, fmt.Errorf("invalid APOLLO_ARTIFACT_MAX_EXTRACT_ENTRIES %q", v)
 		}
-		defer gz.Close()
-		reader = gz
+		entries = n
 	}
+	if v := strings.TrimSpace(getenv("APOLLO_ARTIFACT_MAX_EXTRACT_BYTES", "")); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return entries, size, fmt.Errorf("invalid APOLLO_ARTIFACT_MAX_EXTRACT_BYTES %q", v)
+		}
+		size = n
+	}
+	return entries, size, nil
+}
+
+func extractLayer(r io.Reader, mediaType, dest, setuidPolicy string) (int64, error) {
+	maxEntries, maxBytes, err := loadExtractLimits()
+	if err != nil {
+		return 0, err
+	}
+	reader, closeReader, err := decompressLayer(r, mediaType)
+	if err != nil {
+		return 0, err
+	}
+	defer closeReader()
 
 	tr := tar.NewReader(reader)
 	var total int64
@@ -297,8 +485,8 @@ func extractLayer(r io.Reader, mediaType, dest string) (int64, error) {
 		}
 
 		entries++
-		if entries > maxExtractEntries {
-			return total, extractError{reason: "ExtractLimitExceeded", msg: fmt.Sprintf("extraction aborted: too many entries (%d > %d)", entries, maxExtractEntries)}
+		if entries > maxEntries {
+			return total, extractError{reason: "ExtractLimitExceeded", msg: fmt.Sprintf("extraction aborted: too many entries (%d > %d)", entries, maxEntries)}
 		}
 
 		name := filepath.Clean(hdr.Name)
@@ -314,32 +502,71 @@ func extractLayer(r io.Reader, mediaType, dest string) (int64, error) {
 			return total, extractError{reason: "InvalidPath", msg: fmt.Sprintf("rejecting path outside rootfs: %q", hdr.Name)}
 		}
 
+		if err := ensureNoSymlinkParents(dest, name); err != nil {
+			return total, err
+		}
+
 		switch hdr.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(target, hdr.FileInfo().Mode().Perm()); err != nil {
+			mode, err := entryMode(hdr, setuidPolicy)
+			if err != nil {
+				return total, err
+			}
+			if err := clearTarget(target); err != nil {
 				return total, err
 			}
+			if err := os.MkdirAll(target, mode.Perm()); err != nil {
+				return total, err
+			}
+			if mode&^os.ModePerm != 0 {
+				if err := os.Chmod(target, mode); err != nil {
+					return total, err
+				}
+			}
 		case tar.TypeReg, tar.TypeRegA:
+			mode, err := entryMode(hdr, setuidPolicy)
+			if err != nil {
+				return total, err
+			}
 			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
 				return total, err
 			}
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err := clearTarget(target); err != nil {
+				return total, err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, mode.Perm())
 			if err != nil {
 				return total, err
 			}
 			n, err := io.Copy(f, tr)
 			f.Close()
 			total += n
-			if total > maxExtractBytes {
-				return total, extractError{reason: "ExtractLimitExceeded", msg: fmt.Sprintf("extraction aborted: size %d exceeds limit %d", total, maxExtractBytes)}
+			if total > maxBytes {
+				return total, extractError{reason: "ExtractLimitExceeded", msg: fmt.Sprintf("extraction aborted: size %d exceeds limit %d", total, maxBytes)}
 			}
 			if err != nil {
 				return total, err
 			}
+			if mode&^os.ModePerm != 0 {
+				if err := os.Chmod(target, mode); err != nil {
+					return total, err
+				}
+			}
+		case tar.TypeSymlink:
+			if err := extractSymlink(target, hdr); err != nil {
+				return total, err
+			}
+		case tar.TypeLink:
+			if err := extractHardlink(dest, target, hdr); err != nil {
+				return total, err
+			}
 		default:
 			return total, extractError{reason: "UnsupportedEntryType", msg: fmt.Sprintf("unsupported entry type %d for %q", hdr.Typeflag, hdr.Name)}
 		}
 	}
+	if err := validateSymlinks(dest); err != nil {
+		return total, err
+	}
 	return total, nil
 }
 
@@ -360,6 +587,10 @@ func isRetryable(err error) bool {
 	if errors.Is(err, context.DeadlineExceeded) {
 		return true
 	}
+	// Interrupted transfers resume from the partial blob on the next attempt.
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
 	var nerr net.Error
 	if errors.As(err, &nerr) && (nerr.Timeout() || nerr.Temporary()) {
 		return true
@@ -402,26 +633,28 @@ func errorString(err error) string {
 }
 
 func allowPlainHTTP(reg string) bool {
-	plainAll := strings.EqualFold(strings.TrimSpace(os.Getenv("APOLLO_OCI_PLAIN_HTTP")), "1") ||
-		strings.EqualFold(strings.TrimSpace(os.Getenv("APOLLO_OCI_PLAIN_HTTP")), "true")
+	plainAll := strings.EqualFold(strings.TrimSpace(getenv("APOLLO_OCI_PLAIN_HTTP", "")), "1") ||
+		strings.EqualFold(strings.TrimSpace(getenv("APOLLO_OCI_PLAIN_HTTP", "")), "true")
 
 	hostOnly := reg
 	if h, _, err := net.SplitHostPort(reg); err == nil {
 		hostOnly = h
 	}
 	hostOnly = strings.ToLower(hostOnly)
+	hostPort := strings.ToLower(reg)
 
 	if plainAll {
 		return true
 	}
 
-	allowlist := strings.FieldsFunc(strings.TrimSpace(os.Getenv("APOLLO_OCI_PLAIN_HTTP_HOSTS")), func(r rune) bool { return r == ',' })
+	allowlist := strings.FieldsFunc(strings.TrimSpace(getenv("APOLLO_OCI_PLAIN_HTTP_HOSTS", "")), func(r rune) bool { return r == ',' })
 	for _, h := range allowlist {
 		h = strings.ToLower(strings.TrimSpace(h))
 		if h == "" {
 			continue
 		}
-		if h == hostOnly {
+		// Entries may name a bare host (any port) or an exact host:port.
+		if h == hostOnly || h == hostPort {
 			return true
 		}
 	}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+)
+
+// prefetchArtifact downloads and verifies the item's prefetch artifact into the cache without
+// touching the running unit, so activation later only has to rewrite and restart it. It returns
+// the prefetched digest (to be kept by artifact GC), or "" when nothing was prefetched.
+func (a *agent) prefetchArtifact(ctx context.Context, item gateway.DesiredItem, observation *gateway.Observation) string {
+	pf := item.Spec.PrefetchArtifact
+	if pf == nil {
+		return ""
+	}
+	observation.PrefetchArtifactURL = pf.URL
+	if pf.Type != apiv1alpha1.ArtifactTypeOCI {
+		observation.ArtifactPrefetched = boolPtr(false)
+		observation.PrefetchReason = "NotApplicable"
+		observation.PrefetchMessage = "artifact type not oci"
+		return ""
+	}
+
+	result, err := a.oci.Ensure(ctx, pf.URL)
+	observeArtifact(result, err)
+	if err != nil {
+		a.logger.Error(err, "prefetch oci artifact", "namespace", item.Namespace, "name", item.Name, "ref", pf.URL)
+		observation.ArtifactPrefetched = boolPtr(false)
+		observation.PrefetchReason = "PrefetchFailed"
+		if !result.downloaded && result.downloadReason != "" {
+			observation.PrefetchReason = result.downloadReason
+		} else if !result.verified && result.verifyReason != "" {
+			observation.PrefetchReason = result.verifyReason
+		}
+		observation.PrefetchMessage = defaultString(result.lastError, err.Error())
+		return ""
+	}
+
+	digest := strings.ToLower(result.digest)
+	observation.ArtifactPrefetched = boolPtr(true)
+	observation.PrefetchReason = "ArtifactPrefetched"
+	observation.PrefetchMessage = "prefetched " + digest
+	return digest
+}
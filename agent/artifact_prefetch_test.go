@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/apollo/praetor/agent/systemd"
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+)
+
+type refOCI struct {
+	results map[string]ociResult
+	refs    []string
+}
+
+func (f *refOCI) Ensure(_ context.Context, ref string) (ociResult, error) {
+	f.refs = append(f.refs, ref)
+	res, ok := f.results[ref]
+	if !ok {
+		return ociResult{lastError: "not found", downloadReason: "FetchFailed"}, errors.New("not found")
+	}
+	return res, nil
+}
+
+func TestReconcilePrefetchesWithoutActivating(t *testing.T) {
+	restoreRunner := systemd.SetRunnerForTesting(&noopRunner{})
+	defer restoreRunner()
+	unitDir := t.TempDir()
+	restorePaths := systemd.SetBasePathsForTesting(unitDir, filepath.Join(t.TempDir(), "env"))
+	defer restorePaths()
+
+	next := "ghcr.io/app@sha256:" + strings.Repeat("b", 64)
+	missing := "ghcr.io/app@sha256:" + strings.Repeat("c", 64)
+	fetcher := &refOCI{results: map[string]ociResult{
+		next: {digest: "sha256:" + strings.Repeat("B", 64), downloaded: true, verified: true},
+	}}
+	a := &agent{
+		logger:    logr.Discard(),
+		managed:   make(map[string]managedItem),
+		statePath: filepath.Join(t.TempDir(), "state.json"),
+		oci:       fetcher,
+		client:    &http.Client{Timeout: 2 * time.Second},
+	}
+
+	item := func(prefetch string) gateway.DesiredItem {
+		return gateway.DesiredItem{
+			Namespace: "ns",
+			Name:      "proc",
+			SpecHash:  "hash-" + prefetch,
+			Spec: apiv1alpha1.DeviceProcessSpec{
+				Artifact:         apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"},
+				Execution:        apiv1alpha1.DeviceProcessExecution{Backend: apiv1alpha1.DeviceProcessBackendSystemd, Command: []string{"/opt/app/run"}},
+				PrefetchArtifact: &apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: prefetch},
+			},
+		}
+	}
+
+	obs, err := a.reconcile(context.Background(), &gateway.DesiredResponse{Items: []gateway.DesiredItem{item(next)}})
+	if err != nil {
+		t.Fatalf("reconcile error: %v", err)
+	}
+	o := obs[0]
+	if !derefBool(o.ArtifactPrefetched) || o.PrefetchArtifactURL != next {
+		t.Fatalf("expected %s prefetched, got prefetched=%v url=%q", next, derefBool(o.ArtifactPrefetched), o.PrefetchArtifactURL)
+	}
+	if want := "prefetched sha256:" + strings.Repeat("b", 64); o.PrefetchMessage != want {
+		t.Fatalf("prefetch message = %q, want %q", o.PrefetchMessage, want)
+	}
+	unit, err := os.ReadFile(filepath.Join(unitDir, systemd.PathsFor("ns", "proc").UnitName))
+	if err != nil {
+		t.Fatalf("read unit: %v", err)
+	}
+	if !strings.Contains(string(unit), "ExecStart=/opt/app/run") {
+		t.Fatalf("expected unit to keep running the current artifact, got:\n%s", unit)
+	}
+
+	obs, err = a.reconcile(context.Background(), &gateway.DesiredResponse{Items: []gateway.DesiredItem{item(missing)}})
+	if err != nil {
+		t.Fatalf("reconcile error: %v", err)
+	}
+	o = obs[0]
+	if derefBool(o.ArtifactPrefetched) || o.PrefetchReason != "FetchFailed" || o.PrefetchMessage != "not found" {
+		t.Fatalf("expected failed prefetch, got prefetched=%v reason=%q message=%q", derefBool(o.ArtifactPrefetched), o.PrefetchReason, o.PrefetchMessage)
+	}
+	if o.ErrorMessage != nil {
+		t.Fatalf("prefetch failure must not fail the running item, got %q", *o.ErrorMessage)
+	}
+	if len(fetcher.refs) != 2 {
+		t.Fatalf("expected only prefetch pulls, got %v", fetcher.refs)
+	}
+}
+
+func TestReconcileFetchesActiveArtifactBeforePrefetch(t *testing.T) {
+	restoreRunner := systemd.SetRunnerForTesting(&noopRunner{})
+	defer restoreRunner()
+	restorePaths := systemd.SetBasePathsForTesting(t.TempDir(), filepath.Join(t.TempDir(), "env"))
+	defer restorePaths()
+
+	active := "ghcr.io/app@sha256:" + strings.Repeat("a", 64)
+	next := "ghcr.io/app@sha256:" + strings.Repeat("b", 64)
+	fetcher := &refOCI{results: map[string]ociResult{
+		active: {digest: "sha256:" + strings.Repeat("a", 64), rootfsPath: t.TempDir(), downloaded: true, verified: true},
+		next:   {digest: "sha256:" + strings.Repeat("b", 64), downloaded: true, verified: true},
+	}}
+	a := &agent{
+		logger:    logr.Discard(),
+		managed:   make(map[string]managedItem),
+		statePath: filepath.Join(t.TempDir(), "state.json"),
+		oci:       fetcher,
+		client:    &http.Client{Timeout: 2 * time.Second},
+	}
+	item := gateway.DesiredItem{
+		Namespace: "ns",
+		Name:      "proc",
+		SpecHash:  "hash",
+		Spec: apiv1alpha1.DeviceProcessSpec{
+			Artifact:         apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: active},
+			Execution:        apiv1alpha1.DeviceProcessExecution{Backend: apiv1alpha1.DeviceProcessBackendSystemd, Command: []string{"bin/app"}},
+			PrefetchArtifact: &apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: next},
+		},
+	}
+	if _, err := a.reconcile(context.Background(), &gateway.DesiredResponse{Items: []gateway.DesiredItem{item}}); err != nil {
+		t.Fatalf("reconcile error: %v", err)
+	}
+	if len(fetcher.refs) != 2 || fetcher.refs[0] != active || fetcher.refs[1] != next {
+		t.Fatalf("expected the running artifact to be fetched before the prefetch, got %v", fetcher.refs)
+	}
+}
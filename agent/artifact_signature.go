@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+const (
+	// cosign-style "simple signing" signatures attached to the pinned manifest via the referrers API.
+	signatureArtifactType   = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	simpleSigningMediaType  = "application/vnd.dev.cosign.simplesigning.v1+json"
+	signatureAnnotation     = "dev.cosignproject.cosign/signature"
+	simpleSigningType       = "cosign container image signature"
+	maxSignatureReferrers   = 16
+	maxSignaturePayloadSize = 64 << 10
+)
+
+var (
+	errStopReferrers = errors.New("stop listing referrers")
+
+	// newSignatureSource is an injection point for tests (in-memory registry).
+	newSignatureSource = func(repo *remote.Repository) signatureSource {
+		return repo
+	}
+)
+
+// signatureSource lists referrers of a manifest and fetches their content.
+type signatureSource interface {
+	content.Fetcher
+	registry.ReferrerLister
+}
+
+// trustedKey is a public key the device accepts artifact signatures from.
+type trustedKey struct {
+	id  string
+	key crypto.PublicKey
+}
+
+// signatureError carries the ArtifactVerified reason for a signature failure.
+type signatureError struct {
+	reason string
+	msg    string
+}
+
+func (e signatureError) Error() string {
+	return e.msg
+}
+
+type simpleSigningPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// loadTrustRoots reads PEM public keys from APOLLO_OCI_TRUST_ROOTS (comma-separated files or directories).
+// An empty setting disables signature verification.
+func loadTrustRoots() ([]trustedKey, error) {
+	raw := strings.TrimSpace(getenv("APOLLO_OCI_TRUST_ROOTS", ""))
+	if raw == "" {
+		return nil, nil
+	}
+
+	var files []string
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		info, err := os.Stat(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trust root %s: %w", entry, err)
+		}
+		if !info.IsDir() {
+			files = append(files, entry)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(entry, "*.pem"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+
+	keys := make([]trustedKey, 0, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("trust root %s: %w", file, err)
+		}
+		parsed, err := parsePublicKeys(data)
+		if err != nil {
+			return nil, fmt.Errorf("trust root %s: %w", file, err)
+		}
+		keys = append(keys, parsed...)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found in APOLLO_OCI_TRUST_ROOTS=%q", raw)
+	}
+	return keys, nil
+}
+
+func parsePublicKeys(data []byte) ([]trustedKey, error) {
+	var keys []trustedKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch pub.(type) {
+		case *ecdsa.PublicKey, ed25519.PublicKey, *rsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", pub)
+		}
+		sum := sha256.Sum256(block.Bytes)
+		keys = append(keys, trustedKey{id: "sha256:" + hex.EncodeToString(sum[:])[:16], key: pub})
+	}
+	return keys, nil
+}
+
+// verifyArtifactSignature requires at least one referrer signature over subject made by a trusted key.
+// It returns the id of the key that verified.
+func verifyArtifactSignature(ctx context.Context, src signatureSource, subject ocispec.Descriptor, keys []trustedKey) (string, error) {
+	var referrers []ocispec.Descriptor
+	err := src.Referrers(ctx, subject, signatureArtifactType, func(page []ocispec.Descriptor) error {
+		referrers = append(referrers, page...)
+		if len(referrers) > maxSignatureReferrers {
+			referrers = referrers[:maxSignatureReferrers]
+			return errStopReferrers
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopReferrers) {
+		return "", fmt.Errorf("list signatures for %s: %w", subject.Digest, err)
+	}
+	if len(referrers) == 0 {
+		return "", signatureError{reason: "SignatureMissing", msg: fmt.Sprintf("no signatures found for %s", subject.Digest)}
+	}
+
+	var lastErr error
+	for _, ref := range referrers {
+		keyID, err := verifySignatureManifest(ctx, src, ref, subject, keys)
+		if err == nil {
+			return keyID, nil
+		}
+		lastErr = err
+	}
+	return "", signatureError{reason: "SignatureInvalid", msg: fmt.Sprintf("no trusted signature for %s: %v", subject.Digest, lastErr)}
+}
+
+func verifySignatureManifest(ctx context.Context, src signatureSource, desc ocispec.Descriptor, subject ocispec.Descriptor, keys []trustedKey) (string, error) {
+	manifestBytes, err := content.FetchAll(ctx, src, desc)
+	if err != nil {
+		return "", err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return "", err
+	}
+	if manifest.Subject == nil || manifest.Subject.Digest != subject.Digest {
+		return "", fmt.Errorf("signature %s does not reference %s", desc.Digest, subject.Digest)
+	}
+
+	// One signature manifest may carry several signatures (e.g. from a release and a
+	// countersigning key); any one made by a trusted key is enough.
+	lastErr := fmt.Errorf("signature %s has no simple-signing layer", desc.Digest)
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != simpleSigningMediaType || layer.Annotations[signatureAnnotation] == "" {
+			continue
+		}
+		keyID, err := verifySignatureLayer(ctx, src, layer, subject, keys)
+		if err == nil {
+			return keyID, nil
+		}
+		lastErr = fmt.Errorf("signature %s: %w", desc.Digest, err)
+	}
+	return "", lastErr
+}
+
+// verifySignatureLayer checks one simple-signing layer and returns the id of the key that made it.
+func verifySignatureLayer(ctx context.Context, src signatureSource, layer ocispec.Descriptor, subject ocispec.Descriptor, keys []trustedKey) (string, error) {
+	sig, err := base64.StdEncoding.DecodeString(layer.Annotations[signatureAnnotation])
+	if err != nil {
+		return "", fmt.Errorf("decode signature: %w", err)
+	}
+	if layer.Size > maxSignaturePayloadSize {
+		return "", fmt.Errorf("signature payload too large (%d bytes)", layer.Size)
+	}
+	payload, err := content.FetchAll(ctx, src, layer)
+	if err != nil {
+		return "", err
+	}
+	var claims simpleSigningPayload
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("decode signature payload: %w", err)
+	}
+	if claims.Critical.Type != simpleSigningType {
+		return "", fmt.Errorf("unexpected signature type %q", claims.Critical.Type)
+	}
+	if claims.Critical.Image.DockerManifestDigest != subject.Digest.String() {
+		return "", fmt.Errorf("signature payload digest %s does not match %s", claims.Critical.Image.DockerManifestDigest, subject.Digest)
+	}
+	for _, k := range keys {
+		if verifySignatureBytes(k.key, payload, sig) {
+			return k.id, nil
+		}
+	}
+	return "", errors.New("not made by a trusted key")
+}
+
+func verifySignatureBytes(pub crypto.PublicKey, payload, sig []byte) bool {
+	digest := sha256.Sum256(payload)
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, sig)
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil {
+			return true
+		}
+		return rsa.VerifyPSS(k, crypto.SHA256, digest[:], sig, nil) == nil
+	default:
+		return false
+	}
+}
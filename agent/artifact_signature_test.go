@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// memoryRegistry adapts an in-memory store to the referrers API used for signature discovery.
+type memoryRegistry struct {
+	*memory.Store
+}
+
+func (m memoryRegistry) Referrers(ctx context.Context, desc ocispec.Descriptor, artifactType string, fn func([]ocispec.Descriptor) error) error {
+	// A registry finds referrers by digest alone; subjects tagged with their digest resolve to
+	// the full descriptor the store indexes them by.
+	if full, err := m.Resolve(ctx, desc.Digest.String()); err == nil {
+		desc = full
+	}
+	preds, err := m.Predecessors(ctx, desc)
+	if err != nil {
+		return err
+	}
+	var out []ocispec.Descriptor
+	for _, p := range preds {
+		b, err := content.FetchAll(ctx, m.Store, p)
+		if err != nil {
+			return err
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return err
+		}
+		if artifactType != "" && manifest.ArtifactType != artifactType {
+			continue
+		}
+		p.ArtifactType = manifest.ArtifactType
+		out = append(out, p)
+	}
+	return fn(out)
+}
+
+func writeTrustRoot(t *testing.T, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal public key: %v", err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "release.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644); err != nil {
+		t.Fatalf("write trust root: %v", err)
+	}
+	return dir
+}
+
+func pushBlob(t *testing.T, store *memory.Store, mediaType string, data []byte) ocispec.Descriptor {
+	t.Helper()
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	if err := store.Push(context.Background(), desc, bytes.NewReader(data)); err != nil {
+		t.Fatalf("push %s: %v", mediaType, err)
+	}
+	return desc
+}
+
+// signSubject attaches a cosign-style simple-signing signature for subject to the store, with one
+// layer per key.
+func signSubject(t *testing.T, store *memory.Store, subject ocispec.Descriptor, keys ...*ecdsa.PrivateKey) {
+	t.Helper()
+	payload, _ := json.Marshal(map[string]any{
+		"critical": map[string]any{
+			"identity": map[string]string{"docker-reference": "ghcr.io/example/app"},
+			"image":    map[string]string{"docker-manifest-digest": subject.Digest.String()},
+			"type":     simpleSigningType,
+		},
+	})
+	payloadDesc := pushBlob(t, store, simpleSigningMediaType, payload)
+	var layers []ocispec.Descriptor
+	for _, key := range keys {
+		sum := sha256.Sum256(payload)
+		sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		layer := payloadDesc
+		layer.Annotations = map[string]string{signatureAnnotation: base64.StdEncoding.EncodeToString(sig)}
+		layers = append(layers, layer)
+	}
+	cfg := pushBlob(t, store, ocispec.MediaTypeEmptyJSON, []byte("{}"))
+	manifest := ocispec.Manifest{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: signatureArtifactType,
+		Config:       cfg,
+		Layers:       layers,
+		Subject:      &subject,
+	}
+	manifest.SchemaVersion = 2
+	b, _ := json.Marshal(manifest)
+	pushBlob(t, store, ocispec.MediaTypeImageManifest, b)
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+func TestVerifyArtifactSignature(t *testing.T) {
+	trusted := newKey(t)
+	untrusted := newKey(t)
+	t.Setenv("APOLLO_OCI_TRUST_ROOTS", writeTrustRoot(t, trusted))
+	keys, err := loadTrustRoots()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("loadTrustRoots: keys=%d err=%v", len(keys), err)
+	}
+
+	cases := []struct {
+		name       string
+		signer     *ecdsa.PrivateKey
+		cosigner   *ecdsa.PrivateKey
+		wantReason string
+	}{
+		{name: "trusted", signer: trusted},
+		{name: "unsigned", wantReason: "SignatureMissing"},
+		{name: "untrusted", signer: untrusted, wantReason: "SignatureInvalid"},
+		{name: "countersigned", signer: untrusted, cosigner: trusted},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := memory.New()
+			tarBytes := makeTar(map[string]string{"bin/app": "echo " + tc.name})
+			_, manifestBytes, subject := singleLayerManifest(tarBytes, ocispec.MediaTypeImageLayer)
+			pushBlob(t, store, ocispec.MediaTypeImageManifest, manifestBytes)
+			if tc.cosigner != nil {
+				signSubject(t, store, subject, tc.signer, tc.cosigner)
+			} else if tc.signer != nil {
+				signSubject(t, store, subject, tc.signer)
+			}
+
+			keyID, err := verifyArtifactSignature(context.Background(), memoryRegistry{store}, subject, keys)
+			if tc.wantReason == "" {
+				if err != nil {
+					t.Fatalf("expected signature to verify, got %v", err)
+				}
+				if keyID != keys[0].id {
+					t.Fatalf("expected key id %s, got %s", keys[0].id, keyID)
+				}
+				return
+			}
+			se, ok := err.(signatureError)
+			if !ok || se.reason != tc.wantReason {
+				t.Fatalf("expected %s, got %v", tc.wantReason, err)
+			}
+		})
+	}
+}
+
+func TestEnsureOCIRejectsUnsignedWhenTrustRootsConfigured(t *testing.T) {
+	t.Setenv("APOLLO_OCI_TRUST_ROOTS", writeTrustRoot(t, newKey(t)))
+	tarBytes := makeTar(map[string]string{"bin/app": "echo ok"})
+	restore := withOCIOverrides(t, func(ctx context.Context, src oras.Target, srcRef string, dst oras.Target, dstRef string, opts oras.CopyOptions) (ocispec.Descriptor, error) {
+		return pushSingleLayer(dst.(*oci.Store), dstRef, tarBytes, ocispec.MediaTypeImageLayer)
+	})
+	defer restore()
+	origSource := newSignatureSource
+	newSignatureSource = func(*remote.Repository) signatureSource { return memoryRegistry{memory.New()} }
+	defer func() { newSignatureSource = origSource }()
+
+	root := t.TempDir()
+	f := newOCIFetcher(logr.Discard(), root)
+	ref := singleLayerRef(tarBytes, ocispec.MediaTypeImageLayer)
+	res, err := f.Ensure(context.Background(), ref)
+	if err == nil {
+		t.Fatalf("expected unsigned artifact to be rejected")
+	}
+	if res.verified || res.verifyReason != "SignatureMissing" {
+		t.Fatalf("expected SignatureMissing, got verified=%v reason=%q", res.verified, res.verifyReason)
+	}
+	digestHex := strings.TrimPrefix(ref[strings.Index(ref, "@")+1:], "sha256:")
+	if fileExists(filepath.Join(root, digestHex, readyMarkerName)) {
+		t.Fatalf("unsigned artifact must not be marked READY")
+	}
+}
+
+func TestEnsureOCIRechecksCachedArtifactAgainstCurrentTrustRoots(t *testing.T) {
+	first, second := newKey(t), newKey(t)
+	tarBytes := makeTar(map[string]string{"bin/app": "echo ok"})
+	restore := withOCIOverrides(t, func(ctx context.Context, src oras.Target, srcRef string, dst oras.Target, dstRef string, opts oras.CopyOptions) (ocispec.Descriptor, error) {
+		return pushSingleLayer(dst.(*oci.Store), dstRef, tarBytes, ocispec.MediaTypeImageLayer)
+	})
+	defer restore()
+	signatures := memory.New()
+	_, manifestBytes, subject := singleLayerManifest(tarBytes, ocispec.MediaTypeImageLayer)
+	pushBlob(t, signatures, ocispec.MediaTypeImageManifest, manifestBytes)
+	if err := signatures.Tag(context.Background(), subject, subject.Digest.String()); err != nil {
+		t.Fatalf("tag subject: %v", err)
+	}
+	signSubject(t, signatures, subject, first)
+	lookups := 0
+	origSource := newSignatureSource
+	newSignatureSource = func(*remote.Repository) signatureSource {
+		lookups++
+		return memoryRegistry{signatures}
+	}
+	defer func() { newSignatureSource = origSource }()
+
+	root := t.TempDir()
+	f := newOCIFetcher(logr.Discard(), root)
+	ref := singleLayerRef(tarBytes, ocispec.MediaTypeImageLayer)
+	metaPath := filepath.Join(root, strings.TrimPrefix(subject.Digest.String(), "sha256:"), "meta.json")
+
+	// Cached before trust roots were configured: the first check verifies it upstream.
+	if _, err := f.Ensure(context.Background(), ref); err != nil {
+		t.Fatalf("ensure without trust roots: %v", err)
+	}
+	t.Setenv("APOLLO_OCI_TRUST_ROOTS", writeTrustRoot(t, first))
+	res, err := f.Ensure(context.Background(), ref)
+	if err != nil || !res.verified || lookups != 1 {
+		t.Fatalf("expected the cached artifact to be verified upstream once, got verified=%v lookups=%d err=%v", res.verified, lookups, err)
+	}
+	meta, err := readArtifactMeta(metaPath)
+	if err != nil || meta.SignedBy == "" {
+		t.Fatalf("expected the signer to be recorded, got %+v (%v)", meta, err)
+	}
+
+	// While that key is trusted the recorded signer is enough.
+	if _, err := f.Ensure(context.Background(), ref); err != nil || lookups != 1 {
+		t.Fatalf("expected no upstream lookup for a trusted signer, lookups=%d err=%v", lookups, err)
+	}
+
+	// Once it is no longer trusted the cached artifact is refused.
+	t.Setenv("APOLLO_OCI_TRUST_ROOTS", writeTrustRoot(t, second))
+	res, err = f.Ensure(context.Background(), ref)
+	if err == nil || res.verified || res.rootfsPath != "" || res.verifyReason != "SignatureInvalid" {
+		t.Fatalf("expected SignatureInvalid for a revoked signer, got verified=%v reason=%q err=%v", res.verified, res.verifyReason, err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+	"oras.land/oras-go/v2/content"
+)
+
+const (
+	defaultArtifactExpansionFactor = 4.0
+	defaultArtifactReserveBytes    = int64(256 << 20) // 256MiB
+	maxManifestSize                = int64(4 << 20)
+)
+
+// availableBytes reports free space for unprivileged writers on the filesystem holding path.
+// It is an injection point for tests.
+var availableBytes = func(path string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// spacePolicy bounds how much disk the artifact cache may use.
+type spacePolicy struct {
+	// expansion is the assumed ratio of extracted size to compressed layer size.
+	expansion float64
+	// reserve is the free space that must remain on the filesystem after a fetch.
+	reserve int64
+	// quota caps the total size of the artifact cache; 0 means unlimited.
+	quota int64
+}
+
+// spaceError reports that a fetch would exceed the free-space reserve or cache quota.
+type spaceError struct {
+	msg string
+}
+
+func (e spaceError) Error() string {
+	return e.msg
+}
+
+// loadSpacePolicy reads APOLLO_ARTIFACT_EXPANSION_FACTOR, APOLLO_ARTIFACT_RESERVE_BYTES and
+// APOLLO_ARTIFACT_CACHE_QUOTA_BYTES.
+func loadSpacePolicy() (spacePolicy, error) {
+	p := spacePolicy{expansion: defaultArtifactExpansionFactor, reserve: defaultArtifactReserveBytes}
+	if v := strings.TrimSpace(getenv("APOLLO_ARTIFACT_EXPANSION_FACTOR", "")); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 1 {
+			return p, fmt.Errorf("invalid APOLLO_ARTIFACT_EXPANSION_FACTOR %q: must be a number >= 1", v)
+		}
+		p.expansion = f
+	}
+	if v := strings.TrimSpace(getenv("APOLLO_ARTIFACT_RESERVE_BYTES", "")); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("invalid APOLLO_ARTIFACT_RESERVE_BYTES %q", v)
+		}
+		p.reserve = n
+	}
+	if v := strings.TrimSpace(getenv("APOLLO_ARTIFACT_CACHE_QUOTA_BYTES", "")); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("invalid APOLLO_ARTIFACT_CACHE_QUOTA_BYTES %q", v)
+		}
+		p.quota = n
+	}
+	return p, nil
+}
+
+// expanded estimates the on-disk size of extracting a layer of the given compressed size.
+func (p spacePolicy) expanded(size int64) int64 {
+	return int64(float64(size) * p.expansion)
+}
+
+// checkSpace fails when writing need more bytes under f.root would eat into the reserve
+// or push the cache past its quota.
+func (f *ociFetcherImpl) checkSpace(p spacePolicy, need int64) error {
+	avail, err := availableBytes(f.root)
+	if err != nil {
+		return fmt.Errorf("stat artifact filesystem: %w", err)
+	}
+	if avail-need < p.reserve {
+		return spaceError{msg: fmt.Sprintf("insufficient space: need %d bytes, %d available with %d reserved", need, avail, p.reserve)}
+	}
+	if p.quota > 0 {
+		used := dirSize(f.root)
+		if used+need > p.quota {
+			return spaceError{msg: fmt.Sprintf("artifact cache quota exceeded: %d bytes used + %d needed > quota %d", used, need, p.quota)}
+		}
+	}
+	return nil
+}
+
+// spaceCheckedRoot returns an oras MapRoot hook that checks space for the whole manifest
+// (blobs plus expanded layers) before any blob is downloaded. onManifest, if set, also sees
+// the parsed manifest.
+func (f *ociFetcherImpl) spaceCheckedRoot(p spacePolicy, onManifest func(ocispec.Manifest)) func(context.Context, content.ReadOnlyStorage, ocispec.Descriptor) (ocispec.Descriptor, error) {
+	return func(ctx context.Context, src content.ReadOnlyStorage, root ocispec.Descriptor) (ocispec.Descriptor, error) {
+		if root.MediaType != ocispec.MediaTypeImageManifest || root.Size > maxManifestSize {
+			return root, nil
+		}
+		manifestBytes, err := content.FetchAll(ctx, src, root)
+		if err != nil {
+			return root, err
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+			return root, err
+		}
+		if onManifest != nil {
+			onManifest(manifest)
+		}
+		need := root.Size + manifest.Config.Size
+		for _, l := range manifest.Layers {
+			need += l.Size + p.expanded(l.Size)
+		}
+		return root, f.checkSpace(p, need)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func TestEnsureOCIInsufficientSpaceBeforeDownload(t *testing.T) {
+	tarBytes := makeTar(map[string]string{"bin/app": "echo ok"})
+	pulled := false
+	restore := withOCIOverrides(t, func(ctx context.Context, src oras.Target, srcRef string, dst oras.Target, dstRef string, opts oras.CopyOptions) (ocispec.Descriptor, error) {
+		remote := memory.New()
+		_, manifestBytes, manifestDesc := singleLayerManifest(tarBytes, ocispec.MediaTypeImageLayer)
+		if err := remote.Push(ctx, manifestDesc, bytes.NewReader(manifestBytes)); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if _, err := opts.MapRoot(ctx, remote, manifestDesc); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		pulled = true
+		return pushSingleLayer(dst.(*oci.Store), dstRef, tarBytes, ocispec.MediaTypeImageLayer)
+	})
+	defer restore()
+	availableBytes = func(string) (int64, error) { return 100 << 20, nil }
+
+	f := newOCIFetcher(logr.Discard(), t.TempDir())
+	res, err := f.Ensure(context.Background(), singleLayerRef(tarBytes, ocispec.MediaTypeImageLayer))
+	if err == nil {
+		t.Fatalf("expected insufficient space error")
+	}
+	if pulled {
+		t.Fatalf("blobs must not be downloaded when space is insufficient")
+	}
+	if res.downloaded || res.downloadReason != "InsufficientSpace" {
+		t.Fatalf("expected InsufficientSpace, got downloaded=%v reason=%q", res.downloaded, res.downloadReason)
+	}
+	if res.attempts != 1 {
+		t.Fatalf("space errors must not be retried, got %d attempts", res.attempts)
+	}
+}
+
+func TestEnsureOCICacheQuotaExceeded(t *testing.T) {
+	t.Setenv("APOLLO_ARTIFACT_CACHE_QUOTA_BYTES", "64")
+	tarBytes := makeTar(map[string]string{"bin/app": "echo ok"})
+	restore := withOCIOverrides(t, func(ctx context.Context, src oras.Target, srcRef string, dst oras.Target, dstRef string, opts oras.CopyOptions) (ocispec.Descriptor, error) {
+		return pushSingleLayer(dst.(*oci.Store), dstRef, tarBytes, ocispec.MediaTypeImageLayer)
+	})
+	defer restore()
+
+	f := newOCIFetcher(logr.Discard(), t.TempDir())
+	res, err := f.Ensure(context.Background(), singleLayerRef(tarBytes, ocispec.MediaTypeImageLayer))
+	if err == nil {
+		t.Fatalf("expected quota error")
+	}
+	if res.downloaded || res.downloadReason != "InsufficientSpace" {
+		t.Fatalf("expected InsufficientSpace, got downloaded=%v reason=%q", res.downloaded, res.downloadReason)
+	}
+}
+
+func TestLoadSpacePolicyRejectsInvalid(t *testing.T) {
+	t.Setenv("APOLLO_ARTIFACT_EXPANSION_FACTOR", "0.5")
+	if _, err := loadSpacePolicy(); err == nil {
+		t.Fatalf("expected expansion factor < 1 to be rejected")
+	}
+}
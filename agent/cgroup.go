@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+)
+
+const (
+	defaultCgroupRoot            = "/sys/fs/cgroup"
+	defaultResourceSampleSeconds = 60
+	terminationOOMKilled         = "OOMKilled"
+)
+
+// unitSlice holds the units the agent writes, which do not set Slice=.
+const unitSlice = "system.slice"
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted. Overridable in tests.
+var cgroupRoot = defaultCgroupRoot
+
+// resourceSampler reads the cgroup v2 accounting of managed units. Each unit is sampled at most
+// once per interval, so reports do not rewrite every process's status on each pass. A nil
+// sampler never samples. It is safe for concurrent reconcile workers.
+type resourceSampler struct {
+	interval time.Duration
+	logger   logr.Logger
+
+	mu     sync.Mutex
+	last   map[string]unitSample
+	warned bool
+}
+
+type unitSample struct {
+	at    time.Time
+	stats gateway.ResourceObservation
+}
+
+func newResourceSampler(logger logr.Logger, interval time.Duration) *resourceSampler {
+	if interval <= 0 {
+		return nil
+	}
+	return &resourceSampler{interval: interval, logger: logger, last: make(map[string]unitSample)}
+}
+
+// sample returns the unit's counters when a sample is due, or nil. CPUMillicores is the average
+// since the previous sample; it is left at zero when the unit restarted in between.
+func (s *resourceSampler) sample(unit string) *gateway.ResourceObservation {
+	if s == nil {
+		return nil
+	}
+	now := nowFunc()
+	s.mu.Lock()
+	prev, seen := s.last[unit]
+	s.mu.Unlock()
+	if seen && now.Sub(prev.at) < s.interval {
+		return nil
+	}
+
+	stats, err := readUnitResources(unit)
+	if err != nil {
+		s.mu.Lock()
+		warn := !s.warned
+		s.warned = true
+		s.mu.Unlock()
+		if warn {
+			s.logger.Error(err, "read unit resource usage; is cgroup v2 mounted?", "unit", unit, "root", cgroupRoot)
+		}
+		return nil
+	}
+	if elapsed := now.Sub(prev.at); seen && elapsed > 0 && stats.CPUUsageMicroseconds >= prev.stats.CPUUsageMicroseconds {
+		stats.CPUMillicores = (stats.CPUUsageMicroseconds - prev.stats.CPUUsageMicroseconds) * 1000 / elapsed.Microseconds()
+	}
+
+	s.mu.Lock()
+	s.last[unit] = unitSample{at: now, stats: stats}
+	s.mu.Unlock()
+	return &stats
+}
+
+// latest returns the unit's most recent sample, or nil.
+func (s *resourceSampler) latest(unit string) *gateway.ResourceObservation {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last, ok := s.last[unit]; ok {
+		stats := last.stats
+		return &stats
+	}
+	return nil
+}
+
+// forget drops the samples of a unit the agent no longer manages.
+func (s *resourceSampler) forget(unit string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.last, unit)
+}
+
+// readUnitResources reads a unit's cgroup v2 counters. cpu.stat must exist; the memory files are
+// missing when the memory controller is not enabled for the slice, and memory.peak needs
+// Linux 5.19 or later.
+func readUnitResources(unit string) (gateway.ResourceObservation, error) {
+	var res gateway.ResourceObservation
+	dir := filepath.Join(cgroupRoot, unitSlice, unit)
+	usage, ok, err := readCgroupKey(filepath.Join(dir, "cpu.stat"), "usage_usec")
+	if err != nil {
+		return res, err
+	}
+	if !ok {
+		return res, fmt.Errorf("%s: no usage_usec", filepath.Join(dir, "cpu.stat"))
+	}
+	res.CPUUsageMicroseconds = usage
+	res.MemoryCurrentBytes, _ = readCgroupValue(filepath.Join(dir, "memory.current"))
+	res.MemoryPeakBytes, _ = readCgroupValue(filepath.Join(dir, "memory.peak"))
+	for _, name := range []string{"memory.high", "memory.max"} {
+		if limit, ok := readCgroupValue(filepath.Join(dir, name)); ok && (res.MemoryLimitBytes == 0 || limit < res.MemoryLimitBytes) {
+			res.MemoryLimitBytes = limit
+		}
+	}
+	res.OOMKills, _, _ = readCgroupKey(filepath.Join(dir, "memory.events"), "oom_kill")
+	return res, nil
+}
+
+// readCgroupValue reads a single-value cgroup file. "max" (no limit) and missing files read as
+// not set.
+func readCgroupValue(path string) (int64, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return v, err == nil
+}
+
+// readCgroupKey reads one key of a flat-keyed cgroup file such as cpu.stat.
+func readCgroupKey(path, key string) (int64, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			v, err := strconv.ParseInt(fields[1], 10, 64)
+			return v, err == nil, err
+		}
+	}
+	return 0, false, scanner.Err()
+}
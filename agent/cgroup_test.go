@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apollo/praetor/agent/systemd"
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+)
+
+// oomRunner reports the unit OOM-killed until it is started again.
+type oomRunner struct {
+	calls   [][]string
+	started bool
+}
+
+func (r *oomRunner) Run(_ context.Context, _ string, args ...string) ([]byte, error) {
+	r.calls = append(r.calls, append([]string{}, args...))
+	switch {
+	case args[0] == "enable":
+		r.started = true
+	case args[0] == "show" && r.started:
+		return []byte(activeShow + "Result=success\n"), nil
+	case args[0] == "show":
+		return []byte(inactiveShow + "Result=oom-kill\n"), nil
+	}
+	return nil, nil
+}
+
+func writeCgroup(t *testing.T, unit string, files map[string]string) {
+	t.Helper()
+	dir := filepath.Join(cgroupRoot, unitSlice, unit)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir cgroup: %v", err)
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+}
+
+func TestResourceSamplerReadsCgroupV2(t *testing.T) {
+	origRoot, origNow := cgroupRoot, nowFunc
+	defer func() { cgroupRoot, nowFunc = origRoot, origNow }()
+	cgroupRoot = t.TempDir()
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	nowFunc = func() time.Time { return now }
+
+	writeCgroup(t, "apollo-ns-app.service", map[string]string{
+		"cpu.stat":       "usage_usec 2000000\nuser_usec 1500000\nsystem_usec 500000\n",
+		"memory.current": "104857600\n",
+		"memory.peak":    "157286400\n",
+		"memory.high":    "max\n",
+		"memory.max":     "536870912\n",
+		"memory.events":  "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n",
+	})
+	s := newResourceSampler(logr.Discard(), time.Minute)
+	got := s.sample("apollo-ns-app.service")
+	want := gateway.ResourceObservation{CPUUsageMicroseconds: 2000000, MemoryCurrentBytes: 104857600, MemoryPeakBytes: 157286400, MemoryLimitBytes: 536870912, OOMKills: 1}
+	if got == nil || *got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	if s.sample("apollo-ns-app.service") != nil {
+		t.Fatalf("expected no sample before the interval passes")
+	}
+
+	now = now.Add(time.Minute)
+	writeCgroup(t, "apollo-ns-app.service", map[string]string{"cpu.stat": "usage_usec 17000000\n"})
+	if got := s.sample("apollo-ns-app.service"); got == nil || got.CPUMillicores != 250 {
+		t.Fatalf("expected 250 millicores over the minute, got %+v", got)
+	}
+	if got := s.latest("apollo-ns-app.service"); got == nil || got.CPUUsageMicroseconds != 17000000 {
+		t.Fatalf("expected the latest sample to be kept, got %+v", got)
+	}
+	if s.sample("apollo-ns-missing.service") != nil || newResourceSampler(logr.Discard(), 0).sample("apollo-ns-app.service") != nil {
+		t.Fatalf("expected no sample without a cgroup or with sampling disabled")
+	}
+}
+
+func TestReconcileReportsOOMKillAndResources(t *testing.T) {
+	restorePaths := systemd.SetBasePathsForTesting(filepath.Join(t.TempDir(), "units"), filepath.Join(t.TempDir(), "env"))
+	defer restorePaths()
+	runner := &oomRunner{}
+	restoreRunner := systemd.SetRunnerForTesting(runner)
+	defer restoreRunner()
+	origRoot := cgroupRoot
+	defer func() { cgroupRoot = origRoot }()
+	cgroupRoot = t.TempDir()
+
+	item := rollbackItem("sha256:1", apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"}, "/opt/app/run")
+	paths := systemd.PathsFor(item.Namespace, item.Name)
+	unit, env, err := renderUnitFiles(item, paths.EnvPath)
+	if err != nil {
+		t.Fatalf("render unit: %v", err)
+	}
+	if _, err := systemd.EnsureUnit(context.Background(), paths.UnitName, unit, paths.EnvPath, env); err != nil {
+		t.Fatalf("write unit: %v", err)
+	}
+	writeCgroup(t, paths.UnitName, map[string]string{"cpu.stat": "usage_usec 1000\n", "memory.current": "4096\n"})
+
+	ag := &agent{
+		logger:       logr.Discard(),
+		lastObserved: map[string]string{},
+		managed:      map[string]managedItem{"ns/proc": {UnitName: paths.UnitName}},
+		statePath:    filepath.Join(t.TempDir(), "state.json"),
+		oci:          &refOCI{results: map[string]ociResult{}},
+		resources:    newResourceSampler(logr.Discard(), time.Minute),
+	}
+	obs, err := ag.reconcile(context.Background(), &gateway.DesiredResponse{Items: []gateway.DesiredItem{item}})
+	if err != nil || len(obs) != 1 {
+		t.Fatalf("reconcile: obs=%d err=%v", len(obs), err)
+	}
+	if obs[0].TerminationReason != "OOMKilled" {
+		t.Fatalf("expected the OOM kill to be reported, got %q", obs[0].TerminationReason)
+	}
+	if !runner.started || obs[0].Healthy == nil || !*obs[0].Healthy {
+		t.Fatalf("expected the unit to be started again, got %+v", obs[0])
+	}
+	if r := obs[0].Resources; r == nil || r.MemoryCurrentBytes != 4096 {
+		t.Fatalf("expected the restarted unit's resources, got %+v", r)
+	}
+
+	obs, _ = ag.reconcile(context.Background(), &gateway.DesiredResponse{Items: []gateway.DesiredItem{item}})
+	if obs[0].TerminationReason != "" || obs[0].Resources != nil {
+		t.Fatalf("expected neither the OOM kill nor a sample to repeat, got %q %+v", obs[0].TerminationReason, obs[0].Resources)
+	}
+}
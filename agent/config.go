@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	defaultAgentConfigPath = "/etc/apollo/agent.yaml"
+	agentConfigAPIVersion  = "azure.com/v1alpha1"
+	agentConfigKind        = "AgentConfig"
+)
+
+// agentConfig is the agent configuration file, in YAML or JSON. Every field stands for an
+// APOLLO_* environment variable, which takes precedence over the file when it is set.
+type agentConfig struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	DeviceName string `json:"deviceName,omitempty"`
+	// StateFile is APOLLO_AGENT_STATE_FILE.
+	StateFile string           `json:"stateFile,omitempty"`
+	Gateway   gatewayConfig    `json:"gateway,omitempty"`
+	Auth      authConfig       `json:"auth,omitempty"`
+	Desired   desiredConfig    `json:"desired,omitempty"`
+	Artifacts artifactConfig   `json:"artifacts,omitempty"`
+	Registry  registryConfig   `json:"registry,omitempty"`
+	Reconcile reconcileConfig  `json:"reconcile,omitempty"`
+	Systemd   systemdConfig    `json:"systemd,omitempty"`
+	Resources resourcesConfig  `json:"resources,omitempty"`
+	Rollback  rollbackConfig   `json:"rollback,omitempty"`
+	Status    statusConfig     `json:"status,omitempty"`
+	Metrics   metricsConfig    `json:"metrics,omitempty"`
+	Upgrade   selfUpdateConfig `json:"upgrade,omitempty"`
+}
+
+type gatewayConfig struct {
+	URL            string `json:"url,omitempty"`
+	CAFile         string `json:"caFile,omitempty"`
+	ClientCertFile string `json:"clientCertFile,omitempty"`
+	ClientKeyFile  string `json:"clientKeyFile,omitempty"`
+	ServerName     string `json:"serverName,omitempty"`
+	// PollIntervalSeconds applies until the gateway sends its own poll interval.
+	PollIntervalSeconds *int64 `json:"pollIntervalSeconds,omitempty"`
+	WatchSeconds        *int64 `json:"watchSeconds,omitempty"`
+}
+
+type authConfig struct {
+	DeviceToken       string `json:"deviceToken,omitempty"`
+	DeviceTokenSecret string `json:"deviceTokenSecret,omitempty"`
+	DeviceTokenFile   string `json:"deviceTokenFile,omitempty"`
+	BootstrapToken    string `json:"bootstrapToken,omitempty"`
+	CredentialsDir    string `json:"credentialsDir,omitempty"`
+	SpecPublicKeyFile string `json:"specPublicKeyFile,omitempty"`
+}
+
+type desiredConfig struct {
+	MaxStalenessSeconds *int64 `json:"maxStalenessSeconds,omitempty"`
+	StaleAction         string `json:"staleAction,omitempty"`
+}
+
+type artifactConfig struct {
+	Root                 string   `json:"root,omitempty"`
+	KeepPrevious         *int64   `json:"keepPrevious,omitempty"`
+	Mirror               string   `json:"mirror,omitempty"`
+	BandwidthBytesPerSec *int64   `json:"bandwidthBytesPerSec,omitempty"`
+	ExpansionFactor      *float64 `json:"expansionFactor,omitempty"`
+	ReserveBytes         *int64   `json:"reserveBytes,omitempty"`
+	CacheQuotaBytes      *int64   `json:"cacheQuotaBytes,omitempty"`
+	SetuidPolicy         string   `json:"setuidPolicy,omitempty"`
+	MaxExtractEntries    *int64   `json:"maxExtractEntries,omitempty"`
+	MaxExtractBytes      *int64   `json:"maxExtractBytes,omitempty"`
+}
+
+type registryConfig struct {
+	PlainHTTP       *bool    `json:"plainHTTP,omitempty"`
+	PlainHTTPHosts  []string `json:"plainHTTPHosts,omitempty"`
+	AuthFile        string   `json:"authFile,omitempty"`
+	CredentialsFile string   `json:"credentialsFile,omitempty"`
+	TrustRoots      []string `json:"trustRoots,omitempty"`
+}
+
+type reconcileConfig struct {
+	Workers            *int64 `json:"workers,omitempty"`
+	ItemTimeoutSeconds *int64 `json:"itemTimeoutSeconds,omitempty"`
+}
+
+type systemdConfig struct {
+	// Client is auto, dbus or systemctl.
+	Client string `json:"client,omitempty"`
+}
+
+type resourcesConfig struct {
+	// SampleSeconds is how often each unit's cgroup usage is reported; 0 disables it.
+	SampleSeconds *int64 `json:"sampleSeconds,omitempty"`
+}
+
+type rollbackConfig struct {
+	GraceSeconds *int64 `json:"graceSeconds,omitempty"`
+}
+
+type statusConfig struct {
+	Socket string `json:"socket,omitempty"`
+}
+
+type metricsConfig struct {
+	Addr     string `json:"addr,omitempty"`
+	Textfile string `json:"textfile,omitempty"`
+}
+
+type selfUpdateConfig struct {
+	DeadlineSeconds *int64 `json:"deadlineSeconds,omitempty"`
+}
+
+// reloadableSettings are read each time they are used, so SIGHUP can change them without
+// restarting the agent or the units it manages.
+var reloadableSettings = map[string]bool{
+	"APOLLO_POLL_INTERVAL_SECONDS":            true,
+	"APOLLO_OCI_PLAIN_HTTP":                   true,
+	"APOLLO_OCI_PLAIN_HTTP_HOSTS":             true,
+	"APOLLO_REGISTRY_AUTH_FILE":               true,
+	"APOLLO_REGISTRY_CREDENTIALS_FILE":        true,
+	"APOLLO_OCI_TRUST_ROOTS":                  true,
+	"APOLLO_ARTIFACT_BANDWIDTH_BYTES_PER_SEC": true,
+	"APOLLO_ARTIFACT_EXPANSION_FACTOR":        true,
+	"APOLLO_ARTIFACT_RESERVE_BYTES":           true,
+	"APOLLO_ARTIFACT_CACHE_QUOTA_BYTES":       true,
+	"APOLLO_ARTIFACT_SETUID_POLICY":           true,
+	"APOLLO_ARTIFACT_MAX_EXTRACT_ENTRIES":     true,
+	"APOLLO_ARTIFACT_MAX_EXTRACT_BYTES":       true,
+}
+
+// configured holds the settings from the configuration file; getenv falls back to them.
+var configured settingsStore
+
+type settingsStore struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+func (s *settingsStore) get(key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.values[key]
+}
+
+func (s *settingsStore) set(values map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = values
+}
+
+// reload takes the reloadable settings from next and keeps the rest. It returns the keys it
+// changed and the keys whose change waits for a restart.
+func (s *settingsStore) reload(next map[string]string) (applied, pending []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	merged := make(map[string]string, len(next))
+	for key, val := range s.values {
+		merged[key] = val
+	}
+	keys := make(map[string]bool, len(merged)+len(next))
+	for key := range merged {
+		keys[key] = true
+	}
+	for key := range next {
+		keys[key] = true
+	}
+	for key := range keys {
+		if merged[key] == next[key] {
+			continue
+		}
+		if !reloadableSettings[key] {
+			pending = append(pending, key)
+			continue
+		}
+		applied = append(applied, key)
+		if next[key] == "" {
+			delete(merged, key)
+		} else {
+			merged[key] = next[key]
+		}
+	}
+	s.values = merged
+	sort.Strings(applied)
+	sort.Strings(pending)
+	return applied, pending
+}
+
+// loadAgentConfig reads and validates the configuration file at path.
+func loadAgentConfig(path string) (*agentConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg agentConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+func (c *agentConfig) validate() error {
+	if c.APIVersion != agentConfigAPIVersion || c.Kind != agentConfigKind {
+		return fmt.Errorf("unsupported apiVersion/kind %q/%q (want %s/%s)", c.APIVersion, c.Kind, agentConfigAPIVersion, agentConfigKind)
+	}
+	if c.Gateway.URL != "" {
+		u, err := url.Parse(c.Gateway.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("gateway.url %q must be an http(s) URL", c.Gateway.URL)
+		}
+	}
+	for field, v := range map[string]*int64{
+		"gateway.pollIntervalSeconds": c.Gateway.PollIntervalSeconds,
+		"upgrade.deadlineSeconds":     c.Upgrade.DeadlineSeconds,
+		"reconcile.workers":           c.Reconcile.Workers,
+		"artifacts.maxExtractEntries": c.Artifacts.MaxExtractEntries,
+		"artifacts.maxExtractBytes":   c.Artifacts.MaxExtractBytes,
+	} {
+		if v != nil && *v <= 0 {
+			return fmt.Errorf("%s must be positive", field)
+		}
+	}
+	for field, v := range map[string]*int64{
+		"gateway.watchSeconds":           c.Gateway.WatchSeconds,
+		"desired.maxStalenessSeconds":    c.Desired.MaxStalenessSeconds,
+		"artifacts.keepPrevious":         c.Artifacts.KeepPrevious,
+		"artifacts.bandwidthBytesPerSec": c.Artifacts.BandwidthBytesPerSec,
+		"artifacts.reserveBytes":         c.Artifacts.ReserveBytes,
+		"artifacts.cacheQuotaBytes":      c.Artifacts.CacheQuotaBytes,
+		"rollback.graceSeconds":          c.Rollback.GraceSeconds,
+		"reconcile.itemTimeoutSeconds":   c.Reconcile.ItemTimeoutSeconds,
+		"resources.sampleSeconds":        c.Resources.SampleSeconds,
+	} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("%s must not be negative", field)
+		}
+	}
+	if f := c.Artifacts.ExpansionFactor; f != nil && *f < 1 {
+		return fmt.Errorf("artifacts.expansionFactor must be >= 1")
+	}
+	switch c.Artifacts.SetuidPolicy {
+	case "", setuidPolicyStrip, setuidPolicyPreserve, setuidPolicyReject:
+	default:
+		return fmt.Errorf("artifacts.setuidPolicy %q (want strip, preserve or reject)", c.Artifacts.SetuidPolicy)
+	}
+	if _, err := parseStaleAction(c.Desired.StaleAction); err != nil {
+		return fmt.Errorf("desired.staleAction: %w", err)
+	}
+	if _, err := parseSystemdClient(c.Systemd.Client); err != nil {
+		return fmt.Errorf("systemd.client: %w", err)
+	}
+	for _, h := range c.Registry.PlainHTTPHosts {
+		if h = strings.TrimSpace(h); h == "" || strings.ContainsAny(h, ",/") {
+			return fmt.Errorf("registry.plainHTTPHosts entry %q must be a host or host:port", h)
+		}
+	}
+	return nil
+}
+
+// settings flattens the configuration into the APOLLO_* variables it stands for.
+func (c *agentConfig) settings() map[string]string {
+	s := make(map[string]string)
+	str := func(key, val string) {
+		if val = strings.TrimSpace(val); val != "" {
+			s[key] = val
+		}
+	}
+	num := func(key string, v *int64) {
+		if v != nil {
+			s[key] = strconv.FormatInt(*v, 10)
+		}
+	}
+
+	str("APOLLO_DEVICE_NAME", c.DeviceName)
+	str("APOLLO_AGENT_STATE_FILE", c.StateFile)
+
+	str("APOLLO_GATEWAY_URL", c.Gateway.URL)
+	str("APOLLO_GATEWAY_CA_FILE", c.Gateway.CAFile)
+	str("APOLLO_GATEWAY_CLIENT_CERT_FILE", c.Gateway.ClientCertFile)
+	str("APOLLO_GATEWAY_CLIENT_KEY_FILE", c.Gateway.ClientKeyFile)
+	str("APOLLO_GATEWAY_SERVER_NAME", c.Gateway.ServerName)
+	num("APOLLO_POLL_INTERVAL_SECONDS", c.Gateway.PollIntervalSeconds)
+	num("APOLLO_DESIRED_WATCH_SECONDS", c.Gateway.WatchSeconds)
+
+	str("APOLLO_DEVICE_TOKEN", c.Auth.DeviceToken)
+	str("APOLLO_DEVICE_TOKEN_SECRET", c.Auth.DeviceTokenSecret)
+	str("APOLLO_DEVICE_TOKEN_FILE", c.Auth.DeviceTokenFile)
+	str("APOLLO_BOOTSTRAP_TOKEN", c.Auth.BootstrapToken)
+	str("APOLLO_CREDENTIALS_DIR", c.Auth.CredentialsDir)
+	str("APOLLO_SPEC_PUBLIC_KEY_FILE", c.Auth.SpecPublicKeyFile)
+
+	num("APOLLO_DESIRED_MAX_STALENESS_SECONDS", c.Desired.MaxStalenessSeconds)
+	str("APOLLO_DESIRED_STALE_ACTION", c.Desired.StaleAction)
+
+	str("APOLLO_ARTIFACT_ROOT", c.Artifacts.Root)
+	num("APOLLO_ARTIFACT_KEEP_PREVIOUS", c.Artifacts.KeepPrevious)
+	str("APOLLO_OCI_MIRROR", c.Artifacts.Mirror)
+	num("APOLLO_ARTIFACT_BANDWIDTH_BYTES_PER_SEC", c.Artifacts.BandwidthBytesPerSec)
+	if f := c.Artifacts.ExpansionFactor; f != nil {
+		s["APOLLO_ARTIFACT_EXPANSION_FACTOR"] = strconv.FormatFloat(*f, 'g', -1, 64)
+	}
+	num("APOLLO_ARTIFACT_RESERVE_BYTES", c.Artifacts.ReserveBytes)
+	num("APOLLO_ARTIFACT_CACHE_QUOTA_BYTES", c.Artifacts.CacheQuotaBytes)
+	str("APOLLO_ARTIFACT_SETUID_POLICY", c.Artifacts.SetuidPolicy)
+	num("APOLLO_ARTIFACT_MAX_EXTRACT_ENTRIES", c.Artifacts.MaxExtractEntries)
+	num("APOLLO_ARTIFACT_MAX_EXTRACT_BYTES", c.Artifacts.MaxExtractBytes)
+
+	if p := c.Registry.PlainHTTP; p != nil {
+		s["APOLLO_OCI_PLAIN_HTTP"] = strconv.FormatBool(*p)
+	}
+	str("APOLLO_OCI_PLAIN_HTTP_HOSTS", strings.Join(c.Registry.PlainHTTPHosts, ","))
+	str("APOLLO_REGISTRY_AUTH_FILE", c.Registry.AuthFile)
+	str("APOLLO_REGISTRY_CREDENTIALS_FILE", c.Registry.CredentialsFile)
+	str("APOLLO_OCI_TRUST_ROOTS", strings.Join(c.Registry.TrustRoots, ","))
+
+	num("APOLLO_RECONCILE_WORKERS", c.Reconcile.Workers)
+	num("APOLLO_RECONCILE_ITEM_TIMEOUT_SECONDS", c.Reconcile.ItemTimeoutSeconds)
+	str("APOLLO_SYSTEMD_CLIENT", c.Systemd.Client)
+	num("APOLLO_RESOURCE_SAMPLE_SECONDS", c.Resources.SampleSeconds)
+	num("APOLLO_ROLLBACK_GRACE_SECONDS", c.Rollback.GraceSeconds)
+	str("APOLLO_STATUS_SOCKET", c.Status.Socket)
+	str("APOLLO_METRICS_ADDR", c.Metrics.Addr)
+	str("APOLLO_METRICS_TEXTFILE", c.Metrics.Textfile)
+	num("APOLLO_SELF_UPDATE_DEADLINE_SECONDS", c.Upgrade.DeadlineSeconds)
+	return s
+}
+
+// installConfig loads the configuration file and makes its settings visible to getenv. An
+// explicit path must exist; otherwise the default path is used when present. It returns the
+// path loaded, or "" when there is none.
+func installConfig(explicit string) (string, error) {
+	path := strings.TrimSpace(explicit)
+	if path == "" {
+		if _, err := os.Stat(defaultAgentConfigPath); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return "", nil
+			}
+			return "", err
+		}
+		path = defaultAgentConfigPath
+	}
+	cfg, err := loadAgentConfig(path)
+	if err != nil {
+		return "", err
+	}
+	configured.set(cfg.settings())
+	return path, nil
+}
+
+// reloadConfig re-reads path and applies the settings that are safe to change while running;
+// an invalid file leaves the current settings in place.
+func reloadConfig(logger logr.Logger, path string) error {
+	cfg, err := loadAgentConfig(path)
+	if err != nil {
+		return err
+	}
+	applied, pending := configured.reload(cfg.settings())
+	logger.Info("configuration reloaded", "path", path, "applied", applied)
+	if len(pending) > 0 {
+		logger.Info("configuration changes take effect after an agent restart", "settings", pending)
+	}
+	return nil
+}
+
+// watchConfigReloads reloads the configuration file on every signal from hup until ctx ends.
+func watchConfigReloads(ctx context.Context, logger logr.Logger, path string, hup <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		if path == "" {
+			logger.Info("no configuration file to reload")
+			continue
+		}
+		if err := reloadConfig(logger, path); err != nil {
+			logger.Error(err, "configuration reload failed; keeping the current settings")
+		}
+	}
+}
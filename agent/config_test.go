@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const testAgentConfig = `apiVersion: azure.com/v1alpha1
+kind: AgentConfig
+deviceName: switch-1
+stateFile: /var/lib/apollo/agent/state.json
+gateway:
+  url: https://gateway.example:8443
+  pollIntervalSeconds: 30
+artifacts:
+  root: /data/artifacts
+  maxExtractEntries: 5
+registry:
+  plainHTTPHosts: [registry.lab]
+`
+
+func TestConfigFileFeedsSettingsAndReloadsSafeFields(t *testing.T) {
+	defer configured.set(nil)
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	writeConfig(t, path, testAgentConfig)
+
+	if got, err := installConfig(path); err != nil || got != path {
+		t.Fatalf("install config: %q, %v", got, err)
+	}
+	if getenv("APOLLO_GATEWAY_URL", "") != "https://gateway.example:8443" || getenv("APOLLO_ARTIFACT_ROOT", "") != "/data/artifacts" {
+		t.Fatalf("expected the file to supply gateway URL and artifact root")
+	}
+	if d := (&agent{}).desiredPollInterval(); d != 30*time.Second {
+		t.Fatalf("expected the configured poll interval, got %s", d)
+	}
+	if entries, _, err := loadExtractLimits(); err != nil || entries != 5 {
+		t.Fatalf("expected the configured extraction limit, got %d, %v", entries, err)
+	}
+	if !allowPlainHTTP("registry.lab:5000") || allowPlainHTTP("registry.other") {
+		t.Fatalf("expected the configured plain-http allowlist")
+	}
+	t.Setenv("APOLLO_DEVICE_NAME", "from-env")
+	if got := getenv("APOLLO_DEVICE_NAME", ""); got != "from-env" {
+		t.Fatalf("expected the environment to override the file, got %q", got)
+	}
+
+	writeConfig(t, path, strings.NewReplacer(
+		"[registry.lab]", "[registry.other]",
+		"/data/artifacts", "/mnt/artifacts",
+	).Replace(testAgentConfig))
+	hup := make(chan os.Signal, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchConfigReloads(ctx, logr.Discard(), path, hup)
+		close(done)
+	}()
+	hup <- os.Interrupt
+	deadline := time.Now().Add(5 * time.Second)
+	for !allowPlainHTTP("registry.other") {
+		if time.Now().After(deadline) {
+			t.Fatalf("SIGHUP did not reload the plain-http allowlist")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if allowPlainHTTP("registry.lab") {
+		t.Fatalf("expected the old allowlist entry to be dropped")
+	}
+	if got := getenv("APOLLO_ARTIFACT_ROOT", ""); got != "/data/artifacts" {
+		t.Fatalf("expected the artifact root to wait for a restart, got %q", got)
+	}
+
+	writeConfig(t, path, strings.Replace(testAgentConfig, "maxExtractEntries: 5", "maxExtractEntries: 0", 1))
+	if err := reloadConfig(logr.Discard(), path); err == nil {
+		t.Fatalf("expected an invalid file to be rejected")
+	}
+	if entries, _, _ := loadExtractLimits(); entries != 5 {
+		t.Fatalf("expected a rejected reload to keep the current settings, got %d", entries)
+	}
+}
+
+func TestConfigFileValidation(t *testing.T) {
+	for name, body := range map[string]string{
+		"version":        strings.Replace(testAgentConfig, "v1alpha1", "v2", 1),
+		"unknown field":  testAgentConfig + "pollInterval: 10\n",
+		"gateway url":    strings.Replace(testAgentConfig, "https://gateway.example:8443", "gateway.example", 1),
+		"stale action":   testAgentConfig + "desired:\n  staleAction: restart\n",
+		"systemd client": testAgentConfig + "systemd:\n  client: busctl\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "agent.yaml")
+			writeConfig(t, path, body)
+			if _, err := loadAgentConfig(path); err == nil {
+				t.Fatalf("expected the config to be rejected")
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "agent.json")
+	writeConfig(t, path, `{"apiVersion": "azure.com/v1alpha1", "kind": "AgentConfig", "registry": {"plainHTTP": true}}`)
+	cfg, err := loadAgentConfig(path)
+	if err != nil {
+		t.Fatalf("expected JSON to be accepted: %v", err)
+	}
+	if got := cfg.settings()["APOLLO_OCI_PLAIN_HTTP"]; got != "true" {
+		t.Fatalf("expected plainHTTP to map to APOLLO_OCI_PLAIN_HTTP, got %q", got)
+	}
+}
+
+func writeConfig(t *testing.T, path, body string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// defaultDesiredWatchSeconds keeps long-polls under the 60s idle timeout common to proxies.
+	defaultDesiredWatchSeconds = 55
+	// desiredWatchRetry is how long the agent polls before trying a watch again on a gateway
+	// that did not honour one.
+	desiredWatchRetry = 5 * time.Minute
+	desiredWaitParam  = "waitSeconds"
+	desiredWaitHeader = "X-Desired-Wait-Seconds"
+)
+
+type watchResult struct {
+	fetch desiredFetch
+	err   error
+}
+
+// desiredWatcher runs one long-poll at a time off the main loop so heartbeats and drift
+// correction keep their cadence. It only touches the network; results are applied by the loop.
+type desiredWatcher struct {
+	agent   *agent
+	results chan watchResult
+	retry   <-chan time.Time
+	active  bool
+}
+
+func newDesiredWatcher(a *agent) *desiredWatcher {
+	return &desiredWatcher{agent: a, results: make(chan watchResult, 1)}
+}
+
+// start issues the next long-poll for changes to etag, unless watches are disabled.
+func (w *desiredWatcher) start(ctx context.Context, etag string) {
+	w.retry = nil
+	if w.agent.desiredWatch <= 0 {
+		return
+	}
+	w.active = true
+	go func() {
+		res, err := w.agent.fetchDesired(ctx, etag, w.agent.desiredWatch)
+		w.results <- watchResult{fetch: res, err: err}
+	}()
+}
+
+// handle applies a long-poll result. It reports whether the watch is still usable; if not, the
+// agent polls until the retry timer fires.
+func (w *desiredWatcher) handle(ctx context.Context, res watchResult) bool {
+	a := w.agent
+	w.active = false
+	switch {
+	case res.err != nil:
+		a.logger.Error(res.err, "watch desired failed; polling until it recovers")
+		w.retry = time.After(a.retryDelay(res.err, maxBackoff))
+		return false
+	case res.fetch.wait == 0:
+		a.logger.Info("gateway does not support desired watches; polling", "retryIn", desiredWatchRetry.String())
+		w.retry = time.After(desiredWatchRetry)
+		return false
+	}
+	if err := a.applyDesired(ctx, res.fetch); err != nil {
+		a.logger.Error(err, "apply watched desired state")
+	}
+	w.start(ctx, a.lastETag)
+	return true
+}
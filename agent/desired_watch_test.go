@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+)
+
+func TestDesiredWatcherAppliesChangesAndFallsBackToPolling(t *testing.T) {
+	var watchSupported atomic.Bool
+	watchSupported.Store(true)
+	waits := make(chan string, 4)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		waits <- r.URL.Query().Get(desiredWaitParam)
+		if watchSupported.Load() {
+			w.Header().Set(desiredWaitHeader, r.URL.Query().Get(desiredWaitParam))
+		}
+		w.Header().Set("ETag", `"etag-2"`)
+		_ = json.NewEncoder(w).Encode(gateway.DesiredResponse{DeviceName: "switch-1", HeartbeatIntervalSeconds: 20})
+	}))
+	defer gw.Close()
+
+	ag := &agent{
+		deviceName:   "switch-1",
+		gatewayURL:   gw.URL,
+		client:       gw.Client(),
+		logger:       logr.Discard(),
+		lastETag:     `"etag-1"`,
+		lastObserved: map[string]string{},
+		managed:      map[string]managedItem{},
+		statePath:    filepath.Join(t.TempDir(), "state.json"),
+		heartbeat:    15 * time.Second,
+		oci:          &refOCI{results: map[string]ociResult{}},
+		desiredWatch: 7 * time.Second,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watcher := newDesiredWatcher(ag)
+	next := func() watchResult {
+		t.Helper()
+		select {
+		case res := <-watcher.results:
+			return res
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no watch result")
+		}
+		return watchResult{}
+	}
+
+	watcher.start(ctx, ag.lastETag)
+	first := next()
+	// A gateway that ignores waitSeconds does not echo it; the follow-up watch sees that.
+	watchSupported.Store(false)
+	if !watcher.handle(ctx, first) {
+		t.Fatalf("expected the watch to stay open")
+	}
+	if ag.lastETag != `"etag-2"` || ag.lastDesired == nil || ag.heartbeat != 20*time.Second || !watcher.active {
+		t.Fatalf("watched desired state not applied: etag=%q heartbeat=%s active=%v", ag.lastETag, ag.heartbeat, watcher.active)
+	}
+	if wait := <-waits; wait != "7" {
+		t.Fatalf("expected the watch to request waitSeconds=7, got %q", wait)
+	}
+
+	if watcher.handle(ctx, next()) || watcher.active || watcher.retry == nil {
+		t.Fatalf("expected fallback to polling with a retry scheduled")
+	}
+}
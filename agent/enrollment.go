@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apollo/praetor/gateway"
+)
+
+const (
+	credentialCertName    = "device.crt"
+	credentialKeyName     = "device.key"
+	pendingEnrollmentName = "enrollment.json"
+	enrollPollInterval    = 5 * time.Second
+	enrollRetryInterval   = time.Minute
+)
+
+// credentialPaths returns the certificate and key files enrollment maintains in dir.
+func credentialPaths(dir string) (string, string) {
+	return filepath.Join(dir, credentialCertName), filepath.Join(dir, credentialKeyName)
+}
+
+// pendingEnrollment is persisted while a request waits for approval. The bootstrap token was
+// consumed by the request, so after a restart the agent resumes waiting instead of asking again.
+type pendingEnrollment struct {
+	Name    string `json:"name"`
+	Key     string `json:"key"`
+	Renewal bool   `json:"renewal,omitempty"`
+}
+
+// enroller obtains the device certificate from the gateway with a single-use bootstrap token and
+// renews it over mTLS before it expires.
+type enroller struct {
+	agent          *agent
+	dir            string
+	bootstrapToken string
+	pollInterval   time.Duration
+}
+
+func newEnroller(a *agent, dir, bootstrapToken string) *enroller {
+	return &enroller{agent: a, dir: dir, bootstrapToken: bootstrapToken, pollInterval: enrollPollInterval}
+}
+
+// ensure blocks until the device holds an unexpired certificate, enrolling when it has none.
+func (e *enroller) ensure(ctx context.Context) error {
+	cert, err := e.certificate()
+	if err != nil {
+		return err
+	}
+	if cert != nil && nowFunc().Before(cert.NotAfter) {
+		return nil
+	}
+	pending, err := e.loadPending()
+	if err != nil {
+		return err
+	}
+	if pending == nil && e.bootstrapToken == "" {
+		return fmt.Errorf("no valid device certificate in %s; set APOLLO_BOOTSTRAP_TOKEN to enroll", e.dir)
+	}
+	return e.enroll(ctx, false)
+}
+
+// renewLoop renews the certificate once two thirds of its lifetime has passed.
+func (e *enroller) renewLoop(ctx context.Context) {
+	for {
+		if wait := e.renewIn(); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+		if err := e.enroll(ctx, true); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			e.agent.logger.Error(err, "renew device certificate")
+			e.agent.sleepWithJitter(ctx, enrollRetryInterval)
+		}
+	}
+}
+
+func (e *enroller) renewIn() time.Duration {
+	if pending, err := e.loadPending(); err == nil && pending != nil {
+		return 0
+	}
+	cert, err := e.certificate()
+	if err != nil || cert == nil {
+		return enrollRetryInterval
+	}
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(lifetime - lifetime/3).Sub(nowFunc())
+}
+
+// enroll resumes a pending request or submits a new one, then waits for the certificate.
+func (e *enroller) enroll(ctx context.Context, renewal bool) error {
+	pending, err := e.loadPending()
+	if err != nil {
+		return err
+	}
+	if pending == nil {
+		if pending, err = e.request(ctx, renewal); err != nil {
+			return err
+		}
+	}
+	return e.await(ctx, pending)
+}
+
+func (e *enroller) request(ctx context.Context, renewal bool) (*pendingEnrollment, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: e.agent.deviceName}}, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(gateway.EnrollRequest{CSR: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}))})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url(""), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// Renewals authenticate with the current client certificate.
+	if !renewal {
+		req.Header.Set(gateway.BootstrapTokenHeader, e.bootstrapToken)
+	}
+	resp, err := e.agent.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("enroll: status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	var created gateway.EnrollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return nil, err
+	}
+
+	pending := &pendingEnrollment{Name: created.Name, Key: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})), Renewal: renewal}
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(e.dir, pendingEnrollmentName), data, 0o600); err != nil {
+		return nil, err
+	}
+	e.agent.logger.Info("device enrollment requested; waiting for approval", "enrollment", created.Name, "renewal", renewal)
+	return pending, nil
+}
+
+// await polls the enrollment until a certificate is issued, then installs it with its key.
+func (e *enroller) await(ctx context.Context, pending *pendingEnrollment) error {
+	for {
+		status, err := e.poll(ctx, pending.Name)
+		switch {
+		case errors.Is(err, errEnrollmentGone):
+			e.clearPending()
+			return fmt.Errorf("enrollment %s no longer exists", pending.Name)
+		case err != nil:
+			e.agent.logger.Error(err, "poll device enrollment", "enrollment", pending.Name)
+		case status.Denied:
+			e.clearPending()
+			return fmt.Errorf("enrollment %s denied: %s", pending.Name, status.Message)
+		case status.Certificate != "":
+			return e.install(pending, []byte(status.Certificate))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(e.pollInterval):
+		}
+	}
+}
+
+var errEnrollmentGone = errors.New("enrollment not found")
+
+func (e *enroller) poll(ctx context.Context, name string) (gateway.EnrollResponse, error) {
+	var status gateway.EnrollResponse
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url(name), nil)
+	if err != nil {
+		return status, err
+	}
+	resp, err := e.agent.client.Do(req)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		return status, err
+	case http.StatusNotFound:
+		return status, errEnrollmentGone
+	default:
+		return status, fmt.Errorf("poll enrollment: status %d", resp.StatusCode)
+	}
+}
+
+// install writes the key before the certificate: the TLS key pair only switches once both
+// match, so a crash in between keeps presenting the previous certificate.
+func (e *enroller) install(pending *pendingEnrollment, certPEM []byte) error {
+	if _, err := tls.X509KeyPair(certPEM, []byte(pending.Key)); err != nil {
+		e.clearPending()
+		return fmt.Errorf("issued certificate does not match the requested key: %w", err)
+	}
+	certFile, keyFile := credentialPaths(e.dir)
+	if err := writeFileAtomic(keyFile, []byte(pending.Key), 0o600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(certFile, certPEM, 0o644); err != nil {
+		return err
+	}
+	e.clearPending()
+	// Drop connections authenticated with the previous certificate.
+	e.agent.client.CloseIdleConnections()
+	e.agent.logger.Info("device certificate installed", "enrollment", pending.Name, "renewal", pending.Renewal)
+	return nil
+}
+
+// certificate returns the stored device certificate, or nil when there is none.
+func (e *enroller) certificate() (*x509.Certificate, error) {
+	certFile, _ := credentialPaths(e.dir)
+	data, err := os.ReadFile(certFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM certificate in %s", certFile)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func (e *enroller) loadPending() (*pendingEnrollment, error) {
+	data, err := os.ReadFile(filepath.Join(e.dir, pendingEnrollmentName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pending pendingEnrollment
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return nil, fmt.Errorf("read pending enrollment: %w", err)
+	}
+	return &pending, nil
+}
+
+func (e *enroller) clearPending() {
+	if err := os.Remove(filepath.Join(e.dir, pendingEnrollmentName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		e.agent.logger.Error(err, "remove pending enrollment")
+	}
+}
+
+func (e *enroller) url(name string) string {
+	u := fmt.Sprintf("%s/v1/devices/%s/enroll", e.agent.gatewayURL, e.agent.deviceName)
+	if name != "" {
+		u += "/" + name
+	}
+	return u
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+)
+
+// enrollServer is a gateway that accepts one bootstrap token and signs the CSR once approved.
+type enrollServer struct {
+	t     *testing.T
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	csr      *x509.CertificateRequest
+	approved bool
+	posts    int
+}
+
+func (s *enrollServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/devices/dev/enroll":
+		s.posts++
+		if r.Header.Get(gateway.BootstrapTokenHeader) != "abc123.s3cret" || s.posts > 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req gateway.EnrollRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		block, _ := pem.Decode([]byte(req.CSR))
+		s.csr, _ = x509.ParseCertificateRequest(block.Bytes)
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(gateway.EnrollResponse{Name: "dev-1"})
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/devices/dev/enroll/dev-1":
+		resp := gateway.EnrollResponse{Name: "dev-1", Approved: s.approved}
+		if s.approved {
+			tmpl := &x509.Certificate{
+				SerialNumber: big.NewInt(2),
+				Subject:      s.csr.Subject,
+				NotBefore:    time.Now().Add(-time.Minute),
+				NotAfter:     time.Now().Add(time.Hour),
+				ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			}
+			der, err := x509.CreateCertificate(rand.Reader, tmpl, s.ca, s.csr.PublicKey, s.caKey)
+			if err != nil {
+				s.t.Errorf("sign: %v", err)
+			}
+			resp.Certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEnrollmentResumesPendingRequestAndInstallsCertificate(t *testing.T) {
+	ca, caKey, _, _ := issueTestCert(t, "device-ca", nil, nil, nil)
+	gw := &enrollServer{t: t, ca: ca, caKey: caKey}
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	ag := &agent{deviceName: "dev", gatewayURL: srv.URL, client: &http.Client{Timeout: 5 * time.Second}, logger: logr.Discard()}
+	e := newEnroller(ag, dir, "abc123.s3cret")
+	e.pollInterval = 10 * time.Millisecond
+
+	// The agent restarts while the request waits for approval.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if err := e.ensure(ctx); err == nil {
+		t.Fatalf("expected ensure to wait for approval")
+	}
+	cancel()
+	if _, err := os.Stat(filepath.Join(dir, pendingEnrollmentName)); err != nil {
+		t.Fatalf("expected the pending enrollment to be persisted: %v", err)
+	}
+
+	gw.mu.Lock()
+	gw.approved = true
+	gw.mu.Unlock()
+	restarted := newEnroller(ag, dir, "abc123.s3cret")
+	restarted.pollInterval = 10 * time.Millisecond
+	if err := restarted.ensure(context.Background()); err != nil {
+		t.Fatalf("resume enrollment: %v", err)
+	}
+	if gw.posts != 1 {
+		t.Fatalf("expected the consumed bootstrap token not to be sent again, got %d requests", gw.posts)
+	}
+
+	certFile, keyFile := credentialPaths(dir)
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("expected a matching certificate and key: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(pair.Certificate[0])
+	if leaf.Subject.CommonName != "dev" {
+		t.Fatalf("expected a certificate for dev, got %q", leaf.Subject.CommonName)
+	}
+	if _, err := os.Stat(filepath.Join(dir, pendingEnrollmentName)); !os.IsNotExist(err) {
+		t.Fatalf("expected the pending enrollment to be cleared, got %v", err)
+	}
+	// Renewal is due after two thirds of the hour-and-a-minute lifetime.
+	if wait := restarted.renewIn(); wait < 35*time.Minute || wait > 45*time.Minute {
+		t.Fatalf("expected renewal in about 42 minutes, got %s", wait)
+	}
+	if err := restarted.ensure(context.Background()); err != nil || gw.posts != 1 {
+		t.Fatalf("expected a valid certificate to need no enrollment, err=%v posts=%d", err, gw.posts)
+	}
+}
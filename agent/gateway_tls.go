@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/apollo/praetor/pkg/tlsutil"
+)
+
+// gatewayTLSConfig builds the TLS settings for talking to the gateway from
+// APOLLO_GATEWAY_CA_FILE, APOLLO_GATEWAY_CLIENT_CERT_FILE/APOLLO_GATEWAY_CLIENT_KEY_FILE and
+// APOLLO_GATEWAY_SERVER_NAME. With credentialsDir, the client certificate is the one issued by
+// enrollment, presented once it exists. It returns nil when nothing is set, leaving the system
+// defaults. The client certificate is reloaded when it is rotated on disk.
+func gatewayTLSConfig(credentialsDir string) (*tls.Config, error) {
+	caFile := strings.TrimSpace(getenv("APOLLO_GATEWAY_CA_FILE", ""))
+	certFile := strings.TrimSpace(getenv("APOLLO_GATEWAY_CLIENT_CERT_FILE", ""))
+	keyFile := strings.TrimSpace(getenv("APOLLO_GATEWAY_CLIENT_KEY_FILE", ""))
+	serverName := strings.TrimSpace(getenv("APOLLO_GATEWAY_SERVER_NAME", ""))
+	if caFile == "" && certFile == "" && keyFile == "" && serverName == "" && credentialsDir == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName}
+	if caFile != "" {
+		pool, err := tlsutil.LoadCertPool(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("APOLLO_GATEWAY_CA_FILE: %w", err)
+		}
+		cfg.RootCAs = pool
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("APOLLO_GATEWAY_CLIENT_CERT_FILE and APOLLO_GATEWAY_CLIENT_KEY_FILE must be set together")
+	}
+	if certFile != "" && credentialsDir != "" {
+		return nil, fmt.Errorf("APOLLO_GATEWAY_CLIENT_CERT_FILE and APOLLO_CREDENTIALS_DIR are mutually exclusive")
+	}
+	if credentialsDir != "" {
+		cfg.GetClientCertificate = tlsutil.WatchKeyPair(credentialPaths(credentialsDir)).GetClientCertificate
+	}
+	if certFile != "" {
+		keyPair, err := tlsutil.NewKeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = keyPair.GetClientCertificate
+	}
+	return cfg, nil
+}
+
+// gatewayTransport returns the transport for gateway requests, including artifact pulls through
+// the gateway mirror.
+func gatewayTransport(cfg *tls.Config) http.RoundTripper {
+	if cfg == nil {
+		return http.DefaultTransport
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	return t
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// issueTestCert returns PEM cert and key for cn signed by parent (self-signed CA when nil).
+func issueTestCert(t *testing.T, cn string, dnsNames []string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("issue %s: %v", cn, err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestGatewayTLSConfigPresentsClientCertificate(t *testing.T) {
+	ca, caKey, caPEM, _ := issueTestCert(t, "test-ca", nil, nil, nil)
+	_, _, serverPEM, serverKey := issueTestCert(t, "gateway", []string{"gateway.example"}, ca, caKey)
+	_, _, clientPEM, clientKey := issueTestCert(t, "switch-1", nil, ca, caKey)
+
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{"ca.crt": caPEM, "client.crt": clientPEM, "client.key": clientKey} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	// The gateway cert names gateway.example, not 127.0.0.1, so the server name must be set.
+	serverCert, _ := tls.X509KeyPair(serverPEM, serverKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	var seenCN string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenCN = r.TLS.PeerCertificates[0].Subject.CommonName
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	t.Setenv("APOLLO_GATEWAY_CA_FILE", filepath.Join(dir, "ca.crt"))
+	t.Setenv("APOLLO_GATEWAY_CLIENT_CERT_FILE", filepath.Join(dir, "client.crt"))
+	t.Setenv("APOLLO_GATEWAY_CLIENT_KEY_FILE", filepath.Join(dir, "client.key"))
+	t.Setenv("APOLLO_GATEWAY_SERVER_NAME", "gateway.example")
+	cfg, err := gatewayTLSConfig("")
+	if err != nil {
+		t.Fatalf("tls config: %v", err)
+	}
+	ag := &agent{deviceName: "switch-1", gatewayURL: srv.URL, client: &http.Client{Timeout: 5 * time.Second, Transport: gatewayTransport(cfg)}, logger: logr.Discard()}
+	res, err := ag.fetchDesired(context.Background(), `"etag"`, 0)
+	if err != nil || !res.notModified {
+		t.Fatalf("fetch over mTLS: notModified=%v err=%v", res.notModified, err)
+	}
+	if seenCN != "switch-1" {
+		t.Fatalf("expected the device certificate to be presented, got CN %q", seenCN)
+	}
+
+	t.Setenv("APOLLO_GATEWAY_CLIENT_KEY_FILE", "")
+	if _, err := gatewayTLSConfig(""); err == nil {
+		t.Fatalf("expected a client cert without a key to be rejected")
+	}
+}
+
+func TestDeviceTokenFileTakesPrecedenceOverHMACSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	ag := &agent{deviceName: "dev", deviceToken: "shared", deviceTokenSecret: "hmac-secret", deviceTokenFile: path, logger: logr.Discard()}
+	hmacToken := ag.computeDeviceToken()
+	if hmacToken == "" || hmacToken == "shared" {
+		t.Fatalf("expected the HMAC token while the file is missing, got %q", hmacToken)
+	}
+	if err := os.WriteFile(path, []byte("per-device\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := ag.computeDeviceToken(); got != "per-device" {
+		t.Fatalf("expected the token file to win over the HMAC secret, got %q", got)
+	}
+	ag.deviceTokenSecret = ""
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := ag.computeDeviceToken(); got != "shared" {
+		t.Fatalf("expected the shared token as last resort, got %q", got)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+)
+
+const (
+	defaultProbePeriodSeconds    = 30
+	defaultProbeTimeoutSeconds   = 5
+	defaultProbeSuccessThreshold = 1
+	defaultProbeFailureThreshold = 3
+)
+
+// probeFunc runs one exec health probe; tests swap it out.
+var probeFunc = runExecProbe
+
+// probeState tracks the exec health check of the spec a unit runs across reconcile passes. A
+// spec with a health check is healthy once SuccessThreshold probes in a row pass, and unhealthy
+// again after FailureThreshold probes in a row fail.
+type probeState struct {
+	SpecHash  string `json:"specHash"`
+	LastAt    string `json:"lastAt,omitempty"`
+	Successes int32  `json:"successes,omitempty"`
+	Failures  int32  `json:"failures,omitempty"`
+	Healthy   bool   `json:"healthy,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// passing reports whether item counts as healthy as far as its health check goes. Items without
+// one always pass.
+func (p *probeState) passing(item gateway.DesiredItem) bool {
+	if item.Spec.HealthCheck == nil {
+		return true
+	}
+	return p != nil && p.SpecHash == item.SpecHash && p.Healthy
+}
+
+// failure describes item's health check once it has failed FailureThreshold times in a row.
+func (p *probeState) failure(item gateway.DesiredItem) string {
+	hc := item.Spec.HealthCheck
+	if hc == nil || p == nil || p.SpecHash != item.SpecHash {
+		return ""
+	}
+	if _, _, _, threshold := probeSettings(hc); p.Failures < threshold {
+		return ""
+	}
+	return fmt.Sprintf("health check failed %d times in a row (%s)", p.Failures, p.LastError)
+}
+
+// probeSettings returns hc's period, timeout and thresholds with the API defaults filled in.
+func probeSettings(hc *apiv1alpha1.DeviceProcessHealthCheck) (time.Duration, time.Duration, int32, int32) {
+	orDefault := func(v, def int32) int32 {
+		if v <= 0 {
+			return def
+		}
+		return v
+	}
+	period := time.Duration(orDefault(hc.PeriodSeconds, defaultProbePeriodSeconds)) * time.Second
+	timeout := time.Duration(orDefault(hc.TimeoutSeconds, defaultProbeTimeoutSeconds)) * time.Second
+	return period, timeout, orDefault(hc.SuccessThreshold, defaultProbeSuccessThreshold), orDefault(hc.FailureThreshold, defaultProbeFailureThreshold)
+}
+
+// runHealthCheck probes item's exec health check if its period has elapsed since the last probe
+// and returns the updated state, or nil when item has no health check. Relative commands resolve
+// against the artifact rootfs like the process command does.
+func runHealthCheck(ctx context.Context, p *probeState, item gateway.DesiredItem, rootfs string) *probeState {
+	hc := item.Spec.HealthCheck
+	if hc == nil || len(hc.Exec.Command) == 0 {
+		return nil
+	}
+	if p == nil || p.SpecHash != item.SpecHash {
+		p = &probeState{SpecHash: item.SpecHash}
+	} else {
+		next := *p
+		p = &next
+	}
+	period, timeout, successThreshold, failureThreshold := probeSettings(hc)
+	now := nowFunc()
+	if last, err := time.Parse(time.RFC3339, p.LastAt); err == nil && now.Sub(last) < period {
+		return p
+	}
+	p.LastAt = now.UTC().Format(time.RFC3339)
+
+	command := hc.Exec.Command
+	var err error
+	if rootfs != "" {
+		command, err = resolveCommand(command, rootfs)
+	}
+	if err == nil {
+		err = probeFunc(ctx, command, timeout)
+	}
+	if err != nil {
+		p.Failures++
+		p.Successes = 0
+		p.LastError = err.Error()
+		if p.Failures >= failureThreshold {
+			p.Healthy = false
+		}
+		return p
+	}
+	p.Successes++
+	p.Failures = 0
+	p.LastError = ""
+	if p.Successes >= successThreshold {
+		p.Healthy = true
+	}
+	return p
+}
+
+// runExecProbe runs command and fails on a non-zero exit or when it outlasts timeout.
+func runExecProbe(ctx context.Context, command []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, command[0], command[1:]...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// tickInterval is the desired poll interval, shortened to the probe period while a spec with a
+// health check is inside its grace period so the probes run on schedule.
+func (a *agent) tickInterval() time.Duration {
+	interval := a.desiredPollInterval()
+	if a.rollbackGrace <= 0 || a.lastDesired == nil {
+		return interval
+	}
+	for _, item := range a.lastDesired.Items {
+		if item.Spec.HealthCheck == nil || a.managed[itemKey(item.Namespace, item.Name)].PendingSpecHash != item.SpecHash {
+			continue
+		}
+		if period, _, _, _ := probeSettings(item.Spec.HealthCheck); period < interval {
+			interval = period
+		}
+	}
+	return interval
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -14,14 +15,20 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/apollo/praetor/agent/systemd"
 	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
 	"github.com/apollo/praetor/gateway"
 	"github.com/apollo/praetor/pkg/log"
+	"github.com/apollo/praetor/pkg/specsign"
 	"github.com/apollo/praetor/pkg/version"
 	"github.com/go-logr/logr"
 	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
@@ -39,10 +46,35 @@ type managedItem struct {
 	LastActionAt          string `json:"lastActionAt,omitempty"`
 	LastActionSpecHash    string `json:"lastActionSpecHash,omitempty"`
 	LastActionDescription string `json:"lastActionDescription,omitempty"`
+	// ArtifactDigest is the OCI artifact the unit currently runs from; PreviousArtifactDigests
+	// (most recent first) are retained in the cache for rollback.
+	ArtifactDigest          string   `json:"artifactDigest,omitempty"`
+	PreviousArtifactDigests []string `json:"previousArtifactDigests,omitempty"`
+	// LastGood is the spec the unit last ran healthily through a full grace period; a new spec
+	// that fails to activate, or stops running before its grace period ends, is rolled back to it.
+	LastGood        *lastGoodSpec `json:"lastGood,omitempty"`
+	PendingSpecHash string        `json:"pendingSpecHash,omitempty"`
+	PendingSince    string        `json:"pendingSince,omitempty"`
+	// RolledBackSpecHash is the failed spec the unit was reverted from; it is not retried until
+	// the desired spec changes.
+	RolledBackSpecHash string `json:"rolledBackSpecHash,omitempty"`
+	RolledBackReason   string `json:"rolledBackReason,omitempty"`
+	// Generation is the DeviceProcess generation of the spec last applied; agents that verify
+	// specs refuse an older one.
+	Generation int64 `json:"generation,omitempty"`
+	// Probe is the running spec's health-check state.
+	Probe *probeState `json:"probe,omitempty"`
 }
 
 type agentState struct {
 	Managed map[string]managedItem `json:"managed"`
+	// LastDesired and LastETag let a restarted agent keep reconciling while the gateway is
+	// unreachable; DesiredConfirmedAt is when the gateway last served or confirmed them.
+	LastDesired        *gateway.DesiredResponse `json:"lastDesired,omitempty"`
+	LastETag           string                   `json:"lastETag,omitempty"`
+	DesiredConfirmedAt string                   `json:"desiredConfirmedAt,omitempty"`
+	// SetRevision is the revision of the last verified desired set; older sets are refused.
+	SetRevision int64 `json:"setRevision,omitempty"`
 }
 
 // ociFetcher abstracts OCI artifact resolution for testing.
@@ -55,6 +87,9 @@ type agent struct {
 	gatewayURL        string
 	deviceToken       string
 	deviceTokenSecret string
+	deviceTokenFile   string
+	specKeys          []ed25519.PublicKey
+	setRevision       int64
 	client            *http.Client
 	logger            logr.Logger
 	lastETag          string
@@ -65,24 +100,172 @@ type agent struct {
 	heartbeat         time.Duration
 	rnd               *rand.Rand
 	oci               ociFetcher
+	artifactKeep      int
+	rollbackGrace     time.Duration
+	// desiredMaxStaleness bounds how long cached desired state stays authoritative while the
+	// gateway is unreachable (0 means indefinitely); staleAction applies after that.
+	desiredMaxStaleness time.Duration
+	staleAction         string
+	desiredConfirmedAt  time.Time
+	desiredStale        bool
+	pollInterval        time.Duration
+	// desiredWatch is the long-poll wait requested from the gateway; 0 disables watches.
+	desiredWatch time.Duration
+	lastGCKeep   string
+	lastGCAt     time.Time
+	self         *selfUpdater
+	board        *statusBoard
+	// workers bounds how many items reconcile at once; itemTimeout (0 for none) bounds each.
+	workers     int
+	itemTimeout time.Duration
+	resources   *resourceSampler
+	// mu guards heartbeat, rnd and lastObserved, which the heartbeat loop and reconcile workers
+	// share with the main loop.
+	mu sync.Mutex
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		os.Exit(runStatusCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	// An upgraded binary that cannot get past startup must still be rolled back, so its upgrade
+	// record is handled before flags, configuration or anything else that can exit.
+	log.Setup()
+	var self *selfUpdater
+	if serviceInvocation(os.Args[1:]) {
+		self = startSelfUpdater(ctrllog.Log.WithName("agent"))
+	}
+
 	var deviceName string
 	var gatewayURL string
 	var deviceToken string
 	var deviceTokenSecret string
+	var configPath string
+	var showVersion bool
+	var dryRun bool
+	var dryRunReport bool
 
 	flag.StringVar(&deviceName, "device-name", getenv("APOLLO_DEVICE_NAME", ""), "Device identifier (env: APOLLO_DEVICE_NAME)")
 	flag.StringVar(&gatewayURL, "gateway-url", getenv("APOLLO_GATEWAY_URL", ""), "Gateway base URL (env: APOLLO_GATEWAY_URL)")
 	flag.StringVar(&deviceToken, "device-token", getenv("APOLLO_DEVICE_TOKEN", ""), "Shared device token (env: APOLLO_DEVICE_TOKEN)")
 	flag.StringVar(&deviceTokenSecret, "device-token-secret", getenv("APOLLO_DEVICE_TOKEN_SECRET", ""), "HMAC secret for device-bound token (env: APOLLO_DEVICE_TOKEN_SECRET)")
 
-	log.Setup()
+	flag.StringVar(&configPath, "config", getenv("APOLLO_AGENT_CONFIG", ""), "Agent configuration file, reloaded on SIGHUP (env: APOLLO_AGENT_CONFIG; default "+defaultAgentConfigPath+" when present)")
+	flag.BoolVar(&showVersion, "version", false, "Print the agent version and exit")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print what a reconcile would change against the current local state, then exit without changing anything")
+	flag.BoolVar(&dryRunReport, "dry-run-report", false, "With --dry-run, also report the plan to the gateway")
+
 	flag.Parse()
+	if showVersion {
+		fmt.Println(version.Version)
+		return
+	}
 
 	logger := ctrllog.Log.WithName("agent")
+	// Reloads are wired before anything else so a SIGHUP never takes the default action of
+	// terminating the agent.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	configPath, err := installConfig(configPath)
+	if err != nil {
+		logger.Error(err, "invalid agent configuration")
+		os.Exit(1)
+	}
+	// Flags default to the environment; the configuration file fills in what neither sets.
+	for _, f := range []struct {
+		val *string
+		key string
+	}{{&deviceName, "APOLLO_DEVICE_NAME"}, {&gatewayURL, "APOLLO_GATEWAY_URL"}, {&deviceToken, "APOLLO_DEVICE_TOKEN"}, {&deviceTokenSecret, "APOLLO_DEVICE_TOKEN_SECRET"}} {
+		if *f.val == "" {
+			*f.val = getenv(f.key, "")
+		}
+	}
+
 	statePath := getenv("APOLLO_AGENT_STATE_FILE", defaultStatePath)
+	artifactKeep, err := strconv.Atoi(getenv("APOLLO_ARTIFACT_KEEP_PREVIOUS", strconv.Itoa(defaultArtifactKeepPrevious)))
+	if err != nil || artifactKeep < 0 {
+		logger.Error(fmt.Errorf("invalid APOLLO_ARTIFACT_KEEP_PREVIOUS"), "must be a non-negative integer")
+		os.Exit(1)
+	}
+
+	rollbackGrace, err := strconv.Atoi(getenv("APOLLO_ROLLBACK_GRACE_SECONDS", strconv.Itoa(defaultRollbackGraceSeconds)))
+	if err != nil || rollbackGrace < 0 {
+		logger.Error(fmt.Errorf("invalid APOLLO_ROLLBACK_GRACE_SECONDS"), "must be a non-negative integer (0 disables rollback)")
+		os.Exit(1)
+	}
+
+	maxStaleness, err := strconv.Atoi(getenv("APOLLO_DESIRED_MAX_STALENESS_SECONDS", "0"))
+	if err != nil || maxStaleness < 0 {
+		logger.Error(fmt.Errorf("invalid APOLLO_DESIRED_MAX_STALENESS_SECONDS"), "must be a non-negative integer (0 keeps cached desired state authoritative)")
+		os.Exit(1)
+	}
+	watchSeconds, err := strconv.Atoi(getenv("APOLLO_DESIRED_WATCH_SECONDS", strconv.Itoa(defaultDesiredWatchSeconds)))
+	if err != nil || watchSeconds < 0 {
+		logger.Error(fmt.Errorf("invalid APOLLO_DESIRED_WATCH_SECONDS"), "must be a non-negative integer (0 polls only)")
+		os.Exit(1)
+	}
+	selfUpdateDeadline, err := strconv.Atoi(getenv("APOLLO_SELF_UPDATE_DEADLINE_SECONDS", strconv.Itoa(defaultSelfUpdateDeadlineSeconds)))
+	if err != nil || selfUpdateDeadline <= 0 {
+		logger.Error(fmt.Errorf("invalid APOLLO_SELF_UPDATE_DEADLINE_SECONDS"), "must be a positive integer")
+		os.Exit(1)
+	}
+	if _, err := configuredPollInterval(); err != nil {
+		logger.Error(err, "must be a positive integer")
+		os.Exit(1)
+	}
+	if _, _, err := loadExtractLimits(); err != nil {
+		logger.Error(err, "must be a positive integer")
+		os.Exit(1)
+	}
+	workers, err := strconv.Atoi(getenv("APOLLO_RECONCILE_WORKERS", strconv.Itoa(defaultReconcileWorkers)))
+	if err != nil || workers <= 0 {
+		logger.Error(fmt.Errorf("invalid APOLLO_RECONCILE_WORKERS"), "must be a positive integer")
+		os.Exit(1)
+	}
+	itemTimeout, err := strconv.Atoi(getenv("APOLLO_RECONCILE_ITEM_TIMEOUT_SECONDS", strconv.Itoa(defaultReconcileItemTimeoutSeconds)))
+	if err != nil || itemTimeout < 0 {
+		logger.Error(fmt.Errorf("invalid APOLLO_RECONCILE_ITEM_TIMEOUT_SECONDS"), "must be a non-negative integer (0 disables the per-item timeout)")
+		os.Exit(1)
+	}
+	staleAction, err := parseStaleAction(getenv("APOLLO_DESIRED_STALE_ACTION", staleActionHold))
+	if err != nil {
+		logger.Error(err, "set APOLLO_DESIRED_STALE_ACTION")
+		os.Exit(1)
+	}
+	resourceSample, err := strconv.Atoi(getenv("APOLLO_RESOURCE_SAMPLE_SECONDS", strconv.Itoa(defaultResourceSampleSeconds)))
+	if err != nil || resourceSample < 0 {
+		logger.Error(fmt.Errorf("invalid APOLLO_RESOURCE_SAMPLE_SECONDS"), "must be a non-negative integer (0 disables resource reporting)")
+		os.Exit(1)
+	}
+	systemdClient, err := parseSystemdClient(getenv("APOLLO_SYSTEMD_CLIENT", systemdClientAuto))
+	if err != nil {
+		logger.Error(err, "set APOLLO_SYSTEMD_CLIENT")
+		os.Exit(1)
+	}
+
+	// APOLLO_CREDENTIALS_DIR holds the certificate issued by enrollment; a bootstrap token alone
+	// enrolls into the default directory next to the state file.
+	bootstrapToken := strings.TrimSpace(getenv("APOLLO_BOOTSTRAP_TOKEN", ""))
+	credentialsDir := strings.TrimSpace(getenv("APOLLO_CREDENTIALS_DIR", ""))
+	if credentialsDir == "" && bootstrapToken != "" {
+		credentialsDir = filepath.Join(filepath.Dir(statePath), "credentials")
+	}
+
+	var specKeys []ed25519.PublicKey
+	if file := strings.TrimSpace(getenv("APOLLO_SPEC_PUBLIC_KEY_FILE", "")); file != "" {
+		if specKeys, err = specsign.LoadPublicKeys(file); err != nil {
+			logger.Error(err, "invalid APOLLO_SPEC_PUBLIC_KEY_FILE")
+			os.Exit(1)
+		}
+	}
+
+	tlsConfig, err := gatewayTLSConfig(credentialsDir)
+	if err != nil {
+		logger.Error(err, "invalid gateway TLS settings")
+		os.Exit(1)
+	}
+	transport := gatewayTransport(tlsConfig)
 
 	if deviceName == "" {
 		logger.Error(fmt.Errorf("missing device name"), "set --device-name or APOLLO_DEVICE_NAME")
@@ -93,31 +276,94 @@ func main() {
 		os.Exit(1)
 	}
 
+	board := newStatusBoard(deviceName, gatewayURL)
 	ag := &agent{
-		deviceName:        deviceName,
-		gatewayURL:        strings.TrimSuffix(gatewayURL, "/"),
-		deviceToken:       strings.TrimSpace(deviceToken),
-		deviceTokenSecret: strings.TrimSpace(deviceTokenSecret),
-		client:            &http.Client{Timeout: 10 * time.Second},
-		logger:            logger,
-		lastObserved:      make(map[string]string),
-		managed:           make(map[string]managedItem),
-		statePath:         statePath,
-		heartbeat:         time.Duration(defaultHeartbeatSeconds) * time.Second,
-		rnd:               rand.New(rand.NewSource(time.Now().UnixNano())),
-		oci:               nil,
-	}
-	ag.oci = newOCIFetcher(logger, "")
+		deviceName:          deviceName,
+		gatewayURL:          strings.TrimSuffix(gatewayURL, "/"),
+		deviceToken:         strings.TrimSpace(deviceToken),
+		deviceTokenSecret:   strings.TrimSpace(deviceTokenSecret),
+		deviceTokenFile:     strings.TrimSpace(getenv("APOLLO_DEVICE_TOKEN_FILE", "")),
+		specKeys:            specKeys,
+		client:              &http.Client{Timeout: 10 * time.Second, Transport: instrumentGateway(board.track(transport))},
+		logger:              logger,
+		lastObserved:        make(map[string]string),
+		managed:             make(map[string]managedItem),
+		statePath:           statePath,
+		heartbeat:           time.Duration(defaultHeartbeatSeconds) * time.Second,
+		rnd:                 rand.New(rand.NewSource(time.Now().UnixNano())),
+		oci:                 nil,
+		artifactKeep:        artifactKeep,
+		rollbackGrace:       time.Duration(rollbackGrace) * time.Second,
+		desiredMaxStaleness: time.Duration(maxStaleness) * time.Second,
+		staleAction:         staleAction,
+		desiredWatch:        time.Duration(watchSeconds) * time.Second,
+		board:               board,
+		workers:             workers,
+		itemTimeout:         time.Duration(itemTimeout) * time.Second,
+		resources:           newResourceSampler(logger, time.Duration(resourceSample)*time.Second),
+	}
+	fetcher := newOCIFetcher(logger, getenv("APOLLO_ARTIFACT_ROOT", "")).(*ociFetcherImpl)
+	if raw := getenv("APOLLO_OCI_MIRROR", ""); raw != "" {
+		mirror, err := parseOCIMirror(raw, deviceName, ag.computeDeviceToken, transport)
+		if err != nil {
+			logger.Error(err, "set APOLLO_OCI_MIRROR to the gateway base URL")
+			os.Exit(1)
+		}
+		fetcher.SetMirror(mirror)
+	}
+	ag.oci = fetcher
 
 	if err := ag.loadState(); err != nil {
 		logger.Error(err, "load agent state", "path", statePath)
 	}
 
-	logger.Info("agent starting", "device", deviceName, "gateway", gatewayURL, "version", version.Version, "commit", version.Commit)
+	logger.Info("agent starting", "device", deviceName, "gateway", gatewayURL, "config", configPath, "version", version.Version, "commit", version.Commit)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	closeBus, err := connectSystemd(ctx, logger, systemdClient)
+	if err != nil {
+		logger.Error(err, "APOLLO_SYSTEMD_CLIENT=dbus needs systemd on D-Bus")
+		os.Exit(1)
+	}
+	if closeBus != nil {
+		defer closeBus()
+	}
+
+	if dryRun {
+		os.Exit(ag.dryRun(ctx, os.Stdout, dryRunReport))
+	}
+
+	// Agent upgrades replace the binary this process was started from.
+	if self != nil {
+		self.deadline = time.Duration(selfUpdateDeadline) * time.Second
+		self.watchPending(ctx)
+		ag.self = self
+	}
+
+	go watchConfigReloads(ctx, logger, configPath, hup)
+	ag.startStatusServer(ctx, logger, getenv("APOLLO_STATUS_SOCKET", defaultStatusSocket))
+	if addr := strings.TrimSpace(getenv("APOLLO_METRICS_ADDR", "")); addr != "" {
+		go func() {
+			if err := serveMetrics(ctx, addr); err != nil {
+				logger.Error(err, "metrics listener stopped", "addr", addr)
+			}
+		}()
+	}
+	if path := strings.TrimSpace(getenv("APOLLO_METRICS_TEXTFILE", "")); path != "" {
+		go writeMetricsTextfile(ctx, logger, path, ag.heartbeat)
+	}
+
+	if credentialsDir != "" {
+		enroll := newEnroller(ag, credentialsDir, bootstrapToken)
+		if err := enroll.ensure(ctx); err != nil {
+			logger.Error(err, "device enrollment failed", "dir", credentialsDir)
+			os.Exit(1)
+		}
+		go enroll.renewLoop(ctx)
+	}
+
 	if err := ag.run(ctx); err != nil {
 		logger.Error(err, "agent stopped")
 		os.Exit(1)
@@ -125,56 +371,93 @@ func main() {
 }
 
 func (a *agent) run(ctx context.Context) error {
-	if err := a.pollDesired(ctx); err != nil {
-		return err
+	// Subscribe before the first reconcile so no state change falls between the two.
+	units := newUnitWatcher(ctx, a)
+	err := a.pollDesired(ctx)
+	// A gateway shedding load asks everyone to come back later; exiting would only bring this
+	// agent back sooner, together with every other restarted one.
+	for err != nil && a.lastDesired == nil && isGatewayBusy(err) {
+		a.logger.Info("gateway busy; retrying initial poll", "reason", err.Error())
+		a.sleepWithJitter(ctx, a.retryDelay(err, maxBackoff))
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = a.pollDesired(ctx)
+	}
+	if err != nil {
+		if a.lastDesired == nil {
+			return err
+		}
+		a.logger.Error(err, "initial poll failed; continuing from cached desired state", "age", a.desiredAge().Round(time.Second).String())
 	}
 
-	desiredTicker := time.NewTicker(5 * time.Second)
-	heartbeatTicker := time.NewTicker(a.heartbeat)
+	pollInterval := a.tickInterval()
+	desiredTicker := time.NewTicker(pollInterval)
 	defer desiredTicker.Stop()
-	defer heartbeatTicker.Stop()
+	go a.heartbeatLoop(ctx)
 
 	backoff := 2 * time.Second
+	watcher := newDesiredWatcher(a)
+	watcher.start(ctx, a.lastETag)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case res := <-watcher.results:
+			watcher.handle(ctx, res)
+		case <-watcher.retry:
+			watcher.start(ctx, a.lastETag)
+		case ev := <-units.events:
+			units.handle(ev)
+		case <-units.due:
+			units.fire(ctx)
 		case <-desiredTicker.C:
-			if err := a.pollDesired(ctx); err != nil {
-				a.logger.Error(err, "poll desired failed")
-				a.sleepWithJitter(ctx, backoff)
-				backoff = nextBackoff(backoff)
-				continue
+			// While a watch is open, changes arrive through it; the tick only corrects drift.
+			var err error
+			if watcher.active && a.lastDesired != nil {
+				err = a.reconcileAndReport(ctx, a.lastDesired)
+			} else {
+				err = a.pollDesired(ctx)
 			}
-			backoff = 2 * time.Second
-		case <-heartbeatTicker.C:
-			if err := a.sendReport(ctx, nil); err != nil {
-				a.logger.Error(err, "heartbeat report failed")
-				a.sleepWithJitter(ctx, backoff)
+			if err != nil {
+				a.logger.Error(err, "poll desired failed")
+				a.sleepWithJitter(ctx, a.retryDelay(err, backoff))
 				backoff = nextBackoff(backoff)
 				continue
 			}
 			backoff = 2 * time.Second
+			backoffSeconds.Set(0)
 		}
 
-		// Adjust heartbeat ticker if desired interval changed.
-		heartbeatTicker.Reset(a.heartbeat)
+		if next := a.tickInterval(); next != pollInterval {
+			pollInterval = next
+			desiredTicker.Reset(pollInterval)
+		}
 	}
 }
 
 func (a *agent) pollDesired(ctx context.Context) error {
-	desired, notModified, etag, err := a.fetchDesired(ctx)
+	res, err := a.fetchDesired(ctx, a.lastETag, 0)
 	if err != nil {
+		a.reconcileCached(ctx)
 		return err
 	}
-	if etag != "" {
-		a.lastETag = etag
+	return a.applyDesired(ctx, res)
+}
+
+// applyDesired records a response from the gateway and reconciles against it.
+func (a *agent) applyDesired(ctx context.Context, res desiredFetch) error {
+	if res.etag != "" {
+		a.lastETag = res.etag
 	}
+	a.desiredConfirmedAt = nowFunc()
+	a.desiredStale = false
 
+	desired := res.desired
 	if desired != nil {
 		a.lastDesired = desired
-	} else if notModified {
+	} else if res.notModified {
 		desired = a.lastDesired
 	}
 
@@ -182,10 +465,11 @@ func (a *agent) pollDesired(ctx context.Context) error {
 		return nil
 	}
 
-	if desired.HeartbeatIntervalSeconds > 0 {
-		a.heartbeat = time.Duration(desired.HeartbeatIntervalSeconds) * time.Second
-	}
+	a.applyIntervals(desired)
+	return a.reconcileAndReport(ctx, desired)
+}
 
+func (a *agent) reconcileAndReport(ctx context.Context, desired *gateway.DesiredResponse) error {
 	obs, err := a.reconcile(ctx, desired)
 	if err != nil {
 		return err
@@ -196,41 +480,67 @@ func (a *agent) pollDesired(ctx context.Context) error {
 	return a.sendReport(ctx, obs)
 }
 
-func (a *agent) fetchDesired(ctx context.Context) (*gateway.DesiredResponse, bool, string, error) {
+// desiredFetch is one GET desired response.
+type desiredFetch struct {
+	desired     *gateway.DesiredResponse
+	notModified bool
+	etag        string
+	// wait is the long-poll wait the gateway honoured; zero means it did not hold the request.
+	wait time.Duration
+}
+
+// fetchDesired gets desired state conditional on etag. A non-zero wait asks the gateway to hold
+// the request until desired state changes or the wait runs out.
+func (a *agent) fetchDesired(ctx context.Context, etag string, wait time.Duration) (desiredFetch, error) {
+	res := desiredFetch{etag: etag}
 	url := fmt.Sprintf("%s/v1/devices/%s/desired", a.gatewayURL, a.deviceName)
+	client := a.client
+	if wait > 0 {
+		url += fmt.Sprintf("?%s=%d", desiredWaitParam, int(wait/time.Second))
+		watchClient := *a.client
+		watchClient.Timeout += wait
+		client = &watchClient
+	}
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, false, a.lastETag, err
+		return res, err
 	}
-	if a.lastETag != "" {
-		req.Header.Set("If-None-Match", a.lastETag)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
 	}
 	if token := a.computeDeviceToken(); token != "" {
 		req.Header.Set("X-Device-Token", token)
 	}
 
-	resp, err := a.client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
-		return nil, false, a.lastETag, err
+		return res, err
 	}
 	defer resp.Body.Close()
 
-	etag := strings.TrimSpace(resp.Header.Get("ETag"))
-	if etag == "" {
-		etag = a.lastETag
+	if v := strings.TrimSpace(resp.Header.Get("ETag")); v != "" {
+		res.etag = v
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get(desiredWaitHeader)); err == nil && secs > 0 {
+		res.wait = time.Duration(secs) * time.Second
+	}
+	if err := checkRetryAfter(resp); err != nil {
+		return res, err
 	}
 
 	switch resp.StatusCode {
 	case http.StatusOK:
 		var desired gateway.DesiredResponse
 		if err := json.NewDecoder(resp.Body).Decode(&desired); err != nil {
-			return nil, false, etag, err
+			return res, err
 		}
-		return &desired, false, etag, nil
+		res.desired = &desired
+		return res, nil
 	case http.StatusNotModified:
-		return nil, true, etag, nil
+		res.notModified = true
+		return res, nil
 	default:
-		return nil, false, etag, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		return res, fmt.Errorf("unexpected status %d", resp.StatusCode)
 	}
 }
 
@@ -241,274 +551,371 @@ func (a *agent) reconcile(ctx context.Context, desired *gateway.DesiredResponse)
 	if a.oci == nil {
 		a.oci = newOCIFetcher(a.logger, "")
 	}
+	if sink, ok := a.oci.(registryTokenSink); ok {
+		sink.SetRegistryTokens(desired.RegistryCredentials)
+	}
+
+	setErr := a.verifySet(desired)
+	if setErr == nil && desired.Set != nil {
+		a.setRevision = desired.Set.Revision
+	}
 
 	obs := make([]gateway.Observation, 0, len(desired.Items))
 	managedNow := make(map[string]managedItem, len(desired.Items))
-
-	for i := range desired.Items {
+	var desiredDigests []string
+	for i, res := range a.reconcileItems(ctx, desired.Items, setErr == nil) {
 		item := desired.Items[i]
-		key := itemKey(item.Namespace, item.Name)
-		observation := gateway.Observation{
-			Namespace:        item.Namespace,
-			Name:             item.Name,
-			ObservedSpecHash: item.SpecHash,
-			PID:              0,
-			StartTime:        "",
-		}
-		paths := systemd.PathsFor(item.Namespace, item.Name)
-		currentManaged := carryManaged(a.managed[key], paths.UnitName)
-		appendAndContinue := func() {
-			obs = append(obs, observation)
-			managedNow[key] = currentManaged
+		obs = append(obs, res.observation)
+		if res.keep {
+			managedNow[itemKey(item.Namespace, item.Name)] = res.managed
 		}
+		desiredDigests = append(desiredDigests, res.digests...)
+	}
 
-		if item.Spec.RestartPolicy == apiv1alpha1.DeviceProcessRestartPolicyNever {
-			msg := "DaemonSet semantics: agent will start service when stopped even if Restart=no; RestartPolicy affects systemd only."
-			a.logger.Info("restartPolicy=Never does not disable runtime reconciliation", "namespace", item.Namespace, "name", item.Name, "unit", systemd.PathsFor(item.Namespace, item.Name).UnitName)
-			observation.WarningMessage = stringPtr(msg)
+	var kept []string
+	for key, managed := range a.managed {
+		if _, ok := managedNow[key]; ok || managed.UnitName == "" {
+			continue
+		}
+		if setErr != nil {
+			managedNow[key] = managed
+			kept = append(kept, key)
+			continue
 		}
 
-		if item.Spec.Execution.Backend != apiv1alpha1.DeviceProcessBackendSystemd {
-			a.logger.Info("unsupported backend, skipping", "namespace", item.Namespace, "name", item.Name, "backend", item.Spec.Execution.Backend)
-			observation.ProcessStarted = boolPtr(false)
-			observation.Healthy = boolPtr(false)
-			appendAndContinue()
+		ns, name, err := splitKey(key)
+		if err != nil {
+			a.logger.Error(err, "parse managed key", "key", key)
 			continue
 		}
 
-		if item.Spec.Artifact.Type != apiv1alpha1.ArtifactTypeOCI {
-			observation.ArtifactDigest = ""
-			observation.ArtifactDownloadAttempts = 0
-			observation.LastArtifactAttemptTime = ""
-			observation.ArtifactLastError = ""
-			observation.ArtifactDownloaded = boolPtr(false)
-			observation.ArtifactVerified = boolPtr(false)
-			observation.ArtifactDownloadReason = "NotApplicable"
-			observation.ArtifactDownloadMessage = "artifact type not oci"
-			observation.ArtifactVerifyReason = "NotApplicable"
-			observation.ArtifactVerifyMessage = "artifact type not oci"
-		}
-
-		if item.Spec.Artifact.Type == apiv1alpha1.ArtifactTypeOCI {
-			result, err := a.oci.Ensure(ctx, item.Spec.Artifact.URL)
-			observation.ArtifactDigest = result.digest
-			observation.ArtifactDownloadAttempts = result.attempts
-			observation.LastArtifactAttemptTime = result.lastAttemptTime
-			observation.ArtifactLastError = result.lastError
-			observation.ArtifactDownloaded = boolPtr(result.downloaded)
-			observation.ArtifactVerified = boolPtr(result.verified)
-			downloadReason := defaultString(result.downloadReason, "ArtifactDownloaded")
-			downloadMessage := defaultString(result.downloadMessage, "artifact downloaded")
-			verifyReason := defaultString(result.verifyReason, "ArtifactVerified")
-			verifyMessage := defaultString(result.verifyMessage, "artifact verified")
+		forgetItemMetrics(ns, name)
+		a.resources.forget(managed.UnitName)
+		paths := systemd.PathsFor(ns, name)
+		if err := stopAndDisableQuiet(ctx, a.logger, managed.UnitName); err != nil {
+			a.logger.Error(err, "stop/disable failed", "unit", managed.UnitName, "namespace", ns, "name", name)
+		}
 
-			if err != nil {
-				a.logger.Error(err, "ensure oci artifact", "namespace", item.Namespace, "name", item.Name, "ref", item.Spec.Artifact.URL)
-				if strings.TrimSpace(result.lastError) != "" {
-					observation.ErrorMessage = stringPtr(result.lastError)
-				} else {
-					observation.ErrorMessage = stringPtr(err.Error())
-				}
-				if downloadReason == "" {
-					downloadReason = "ArtifactDownloadFailed"
-				}
-				if strings.TrimSpace(downloadMessage) == "" {
-					downloadMessage = err.Error()
-				}
-				if verifyReason == "" {
-					verifyReason = "ArtifactVerifyFailed"
-				}
-				if strings.TrimSpace(verifyMessage) == "" {
-					verifyMessage = downloadMessage
-				}
-				observation.ProcessStarted = boolPtr(false)
-				observation.Healthy = boolPtr(false)
-				_ = stopAndDisableQuiet(ctx, a.logger, paths.UnitName)
-				observation.ArtifactDownloadReason = downloadReason
-				observation.ArtifactDownloadMessage = downloadMessage
-				observation.ArtifactVerifyReason = verifyReason
-				observation.ArtifactVerifyMessage = verifyMessage
-				appendAndContinue()
-				continue
+		unitRemoved, envRemoved, err := systemd.RemoveUnitWithDetails(ctx, managed.UnitName, paths.UnitPath, paths.EnvPath)
+		if err != nil {
+			a.logger.Error(err, "remove unit files failed", "unit", managed.UnitName, "namespace", ns, "name", name)
+		}
+		if unitRemoved {
+			if err := systemd.DaemonReload(ctx); err != nil {
+				a.logger.Error(err, "daemon-reload after removal failed", "unit", managed.UnitName, "namespace", ns, "name", name)
 			}
+		}
+		if unitRemoved || envRemoved {
+			a.logger.Info("removed unit artifacts", "namespace", ns, "name", name, "unit", managed.UnitName)
+		}
+	}
 
-			resolvedCmd, err := resolveCommand(item.Spec.Execution.Command, result.rootfsPath)
-			if err != nil {
+	if len(kept) > 0 {
+		sort.Strings(kept)
+		a.logger.Info("keeping units missing from an unverified desired set", "items", kept, "reason", setErr.Error())
+	}
+
+	a.managed = managedNow
+	if err := a.persistState(); err != nil {
+		a.logger.Error(err, "persist agent state", "path", a.statePath)
+	}
+	a.collectArtifacts(ctx, desiredDigests)
+	a.board.recordReconcile(a, desired, obs)
+	a.self.restartIfSwapped()
+
+	return obs, nil
+}
+
+// reconcileOne reconciles one desired item against its previous managed state. keep reports
+// whether the returned managed state should be recorded.
+func (a *agent) reconcileOne(ctx context.Context, item gateway.DesiredItem, prev managedItem, hadPrev, setVerified bool) (observation gateway.Observation, current managedItem, digests []string, keep bool) {
+	if err := a.verifySpec(item, prev, hadPrev, setVerified); err != nil {
+		return a.refuseSpec(item, err), prev, nil, hadPrev
+	}
+	if prev.RolledBackSpecHash != item.SpecHash {
+		prev.RolledBackSpecHash, prev.RolledBackReason = "", ""
+	}
+
+	start := time.Now()
+	if item.Spec.Execution.Backend == apiv1alpha1.DeviceProcessBackendAgent {
+		observation, current, digests = a.reconcileSelfUpdate(ctx, item, prev)
+	} else if prev.RolledBackSpecHash != "" && a.canRollBack(prev, item) {
+		// This spec already failed here; keep the last known-good one until the spec changes.
+		observation, current, digests = a.runLastGood(ctx, item, prev, hadPrev, prev.RolledBackReason)
+	} else {
+		var failure string
+		observation, current, digests, failure = a.reconcileItem(ctx, item, prev, hadPrev)
+		// A timed-out item is retried on the next pass rather than blamed on its spec.
+		if failure != "" && ctx.Err() == nil && a.canRollBack(current, item) {
+			a.logger.Info("rolling back failed upgrade", "namespace", item.Namespace, "name", item.Name, "specHash", item.SpecHash, "lastGood", current.LastGood.Item.SpecHash, "reason", failure)
+			_ = stopAndDisableQuiet(ctx, a.logger, current.UnitName)
+			var lastGoodDigests []string
+			observation, current, lastGoodDigests = a.runLastGood(ctx, item, current, false, failure)
+			digests = append(digests, lastGoodDigests...)
+		}
+	}
+	reconcileItemDuration.WithLabelValues(item.Namespace, item.Name).Observe(time.Since(start).Seconds())
+	if len(a.specKeys) > 0 {
+		observation.SpecVerified = boolPtr(true)
+	}
+	current.Generation = item.Generation
+	return observation, current, digests, true
+}
+
+// reconcileItem converges the unit for one desired item. A non-empty failure means the item's spec
+// could not be activated, so the caller may roll back to the last known-good spec.
+func (a *agent) reconcileItem(ctx context.Context, item gateway.DesiredItem, prev managedItem, hadPrev bool) (gateway.Observation, managedItem, []string, string) {
+	observation := gateway.Observation{
+		Namespace:        item.Namespace,
+		Name:             item.Name,
+		ObservedSpecHash: item.SpecHash,
+		PID:              0,
+		StartTime:        "",
+	}
+	paths := systemd.PathsFor(item.Namespace, item.Name)
+	currentManaged := carryManaged(prev, paths.UnitName)
+	var digests []string
+
+	if item.Spec.RestartPolicy == apiv1alpha1.DeviceProcessRestartPolicyNever {
+		msg := "DaemonSet semantics: agent will start service when stopped even if Restart=no; RestartPolicy affects systemd only."
+		a.logger.Info("restartPolicy=Never does not disable runtime reconciliation", "namespace", item.Namespace, "name", item.Name, "unit", systemd.PathsFor(item.Namespace, item.Name).UnitName)
+		observation.WarningMessage = stringPtr(msg)
+	}
+
+	if item.Spec.Execution.Backend != apiv1alpha1.DeviceProcessBackendSystemd {
+		a.logger.Info("unsupported backend, skipping", "namespace", item.Namespace, "name", item.Name, "backend", item.Spec.Execution.Backend)
+		observation.ProcessStarted = boolPtr(false)
+		observation.Healthy = boolPtr(false)
+		return observation, currentManaged, digests, ""
+	}
+
+	if item.Spec.Artifact.Type != apiv1alpha1.ArtifactTypeOCI {
+		observation.ArtifactDigest = ""
+		observation.ArtifactDownloadAttempts = 0
+		observation.LastArtifactAttemptTime = ""
+		observation.ArtifactLastError = ""
+		observation.ArtifactDownloaded = boolPtr(false)
+		observation.ArtifactVerified = boolPtr(false)
+		observation.ArtifactDownloadReason = "NotApplicable"
+		observation.ArtifactDownloadMessage = "artifact type not oci"
+		observation.ArtifactVerifyReason = "NotApplicable"
+		observation.ArtifactVerifyMessage = "artifact type not oci"
+	}
+
+	activeDigest, rootfs := "", ""
+	if item.Spec.Artifact.Type == apiv1alpha1.ArtifactTypeOCI {
+		if d := artifactDigestFromRef(item.Spec.Artifact.URL); d != "" {
+			digests = append(digests, d)
+		}
+		result, err := a.oci.Ensure(withDownloadProgress(ctx, a.progressReporter(ctx, item)), item.Spec.Artifact.URL)
+		observeArtifact(result, err)
+		observation.ArtifactDigest = result.digest
+		observation.ArtifactBytesDownloaded = result.bytesDownloaded
+		observation.ArtifactBytesTotal = result.bytesTotal
+		observation.ArtifactDownloadAttempts = result.attempts
+		observation.LastArtifactAttemptTime = result.lastAttemptTime
+		observation.ArtifactLastError = result.lastError
+		observation.ArtifactDownloaded = boolPtr(result.downloaded)
+		observation.ArtifactVerified = boolPtr(result.verified)
+		downloadReason := defaultString(result.downloadReason, "ArtifactDownloaded")
+		downloadMessage := defaultString(result.downloadMessage, "artifact downloaded")
+		verifyReason := defaultString(result.verifyReason, "ArtifactVerified")
+		verifyMessage := defaultString(result.verifyMessage, "artifact verified")
+
+		if err != nil {
+			a.logger.Error(err, "ensure oci artifact", "namespace", item.Namespace, "name", item.Name, "ref", item.Spec.Artifact.URL)
+			if strings.TrimSpace(result.lastError) != "" {
+				observation.ErrorMessage = stringPtr(result.lastError)
+			} else {
 				observation.ErrorMessage = stringPtr(err.Error())
-				observation.ProcessStarted = boolPtr(false)
-				observation.Healthy = boolPtr(false)
-				_ = stopAndDisableQuiet(ctx, a.logger, paths.UnitName)
-				observation.ArtifactDownloadReason = downloadReason
-				observation.ArtifactDownloadMessage = downloadMessage
-				observation.ArtifactVerifyReason = verifyReason
-				observation.ArtifactVerifyMessage = verifyMessage
-				appendAndContinue()
-				continue
 			}
-			item.Spec.Execution.Command = resolvedCmd
+			if downloadReason == "" {
+				downloadReason = "ArtifactDownloadFailed"
+			}
+			if strings.TrimSpace(downloadMessage) == "" {
+				downloadMessage = err.Error()
+			}
+			if verifyReason == "" {
+				verifyReason = "ArtifactVerifyFailed"
+			}
+			if strings.TrimSpace(verifyMessage) == "" {
+				verifyMessage = downloadMessage
+			}
+			observation.ProcessStarted = boolPtr(false)
+			observation.Healthy = boolPtr(false)
 			observation.ArtifactDownloadReason = downloadReason
 			observation.ArtifactDownloadMessage = downloadMessage
 			observation.ArtifactVerifyReason = verifyReason
 			observation.ArtifactVerifyMessage = verifyMessage
+			// Nothing has been touched yet: whatever runs keeps running, and the fetch is retried
+			// on the next pass. A registry or network blip must not roll back or block the spec.
+			return observation, currentManaged, digests, ""
 		}
 
-		unitContent, envContent, err := renderUnitFiles(item, paths.EnvPath)
+		resolvedCmd, err := resolveCommand(item.Spec.Execution.Command, result.rootfsPath)
 		if err != nil {
-			a.logger.Error(err, "render unit", "namespace", item.Namespace, "name", item.Name)
+			observation.ErrorMessage = stringPtr(err.Error())
 			observation.ProcessStarted = boolPtr(false)
 			observation.Healthy = boolPtr(false)
-			observation.ErrorMessage = stringPtr(err.Error())
 			_ = stopAndDisableQuiet(ctx, a.logger, paths.UnitName)
+			observation.ArtifactDownloadReason = downloadReason
+			observation.ArtifactDownloadMessage = downloadMessage
+			observation.ArtifactVerifyReason = verifyReason
+			observation.ArtifactVerifyMessage = verifyMessage
+			return observation, currentManaged, digests, err.Error()
+		}
+		item.Spec.Execution.Command = resolvedCmd
+		activeDigest, rootfs = strings.ToLower(result.digest), result.rootfsPath
+		observation.ArtifactDownloadReason = downloadReason
+		observation.ArtifactDownloadMessage = downloadMessage
+		observation.ArtifactVerifyReason = verifyReason
+		observation.ArtifactVerifyMessage = verifyMessage
+	}
 
-			// Strict failure behavior: do not keep stale artifacts around on invalid spec.
-			unitRemoved, _, removeErr := systemd.RemoveUnitWithDetails(ctx, paths.UnitName, paths.UnitPath, paths.EnvPath)
-			if removeErr != nil {
-				a.logger.Error(removeErr, "remove unit artifacts after render failure", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
-			} else if unitRemoved {
-				if err := systemd.DaemonReload(ctx); err != nil {
-					a.logger.Error(err, "daemon-reload after unit removal", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
-				}
+	// The prefetch only stages the next artifact; it waits until the running one is in place.
+	if d := a.prefetchArtifact(ctx, item, &observation); d != "" {
+		digests = append(digests, d)
+	}
+
+	unitContent, envContent, err := renderUnitFiles(item, paths.EnvPath)
+	if err != nil {
+		a.logger.Error(err, "render unit", "namespace", item.Namespace, "name", item.Name)
+		observation.ProcessStarted = boolPtr(false)
+		observation.Healthy = boolPtr(false)
+		observation.ErrorMessage = stringPtr(err.Error())
+		_ = stopAndDisableQuiet(ctx, a.logger, paths.UnitName)
+
+		// Strict failure behavior: do not keep stale artifacts around on invalid spec.
+		unitRemoved, _, removeErr := systemd.RemoveUnitWithDetails(ctx, paths.UnitName, paths.UnitPath, paths.EnvPath)
+		if removeErr != nil {
+			a.logger.Error(removeErr, "remove unit artifacts after render failure", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
+		} else if unitRemoved {
+			if err := systemd.DaemonReload(ctx); err != nil {
+				a.logger.Error(err, "daemon-reload after unit removal", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
 			}
-			appendAndContinue()
-			continue
 		}
+		return observation, currentManaged, digests, err.Error()
+	}
 
-		unitChanged, envChanged, err := systemd.EnsureUnitWithDetails(ctx, paths.UnitName, unitContent, paths.EnvPath, envContent)
-		if err != nil {
-			a.logger.Error(err, "ensure unit", "namespace", item.Namespace, "name", item.Name)
+	unitChanged, envChanged, err := systemd.EnsureUnitWithDetails(ctx, paths.UnitName, unitContent, paths.EnvPath, envContent)
+	if err != nil {
+		a.logger.Error(err, "ensure unit", "namespace", item.Namespace, "name", item.Name)
+		observation.ProcessStarted = boolPtr(false)
+		observation.Healthy = boolPtr(false)
+		observation.ErrorMessage = stringPtr(err.Error())
+		_ = stopAndDisableQuiet(ctx, a.logger, paths.UnitName)
+		return observation, currentManaged, digests, err.Error()
+	}
+
+	if unitChanged {
+		if err := systemd.DaemonReload(ctx); err != nil {
+			a.logger.Error(err, "daemon-reload failed", "namespace", item.Namespace, "name", item.Name)
+		}
+	}
+
+	currentManaged = recordArtifact(currentManaged, activeDigest, a.artifactKeep)
+
+	if !hadPrev {
+		if err := systemd.EnableAndStart(ctx, paths.UnitName); err != nil {
+			a.logger.Error(err, "enable/start failed", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
 			observation.ProcessStarted = boolPtr(false)
 			observation.Healthy = boolPtr(false)
 			observation.ErrorMessage = stringPtr(err.Error())
 			_ = stopAndDisableQuiet(ctx, a.logger, paths.UnitName)
-			appendAndContinue()
-			continue
+			return observation, currentManaged, digests, err.Error()
 		}
-
-		if unitChanged {
-			if err := systemd.DaemonReload(ctx); err != nil {
-				a.logger.Error(err, "daemon-reload failed", "namespace", item.Namespace, "name", item.Name)
-			}
+		currentManaged = markAction(currentManaged, item.SpecHash, "enable-and-start")
+	} else if unitChanged || envChanged {
+		if err := systemd.Restart(ctx, paths.UnitName); err != nil {
+			a.logger.Error(err, "restart failed", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
+			observation.ProcessStarted = boolPtr(false)
+			observation.Healthy = boolPtr(false)
+			observation.ErrorMessage = stringPtr(err.Error())
+			_ = stopAndDisableQuiet(ctx, a.logger, paths.UnitName)
+			return observation, currentManaged, digests, err.Error()
 		}
+		currentManaged = markAction(currentManaged, item.SpecHash, "restart")
+	}
 
-		prevManaged, hadPrev := a.managed[key]
-		currentManaged = carryManaged(prevManaged, paths.UnitName)
-
-		if !hadPrev {
-			if err := systemd.EnableAndStart(ctx, paths.UnitName); err != nil {
-				a.logger.Error(err, "enable/start failed", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
-				observation.ProcessStarted = boolPtr(false)
-				observation.Healthy = boolPtr(false)
-				observation.ErrorMessage = stringPtr(err.Error())
-				_ = stopAndDisableQuiet(ctx, a.logger, paths.UnitName)
-				appendAndContinue()
-				continue
-			}
-			currentManaged = markAction(currentManaged, item.SpecHash, "enable-and-start")
-		} else if unitChanged || envChanged {
-			if err := systemd.Restart(ctx, paths.UnitName); err != nil {
-				a.logger.Error(err, "restart failed", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
-				observation.ProcessStarted = boolPtr(false)
-				observation.Healthy = boolPtr(false)
-				observation.ErrorMessage = stringPtr(err.Error())
-				_ = stopAndDisableQuiet(ctx, a.logger, paths.UnitName)
-				appendAndContinue()
-				continue
+	pid, startTime, activeState, subState, err := systemd.Show(ctx, paths.UnitName)
+	if err != nil {
+		a.logger.Error(err, "show failed", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
+		observation.ProcessStarted = boolPtr(false)
+		observation.Healthy = boolPtr(false)
+		observation.ErrorMessage = stringPtr(err.Error())
+	} else {
+		// DaemonSet semantics: resource present => keep running.
+		desiredRunning := true
+		needStart := desiredRunning && (activeState != "active" || pid == 0)
+		attemptStart := needStart && shouldAttemptAction(currentManaged, item.SpecHash, 5*time.Second)
+		// A unit found stopped during its grace period failed to activate. Restarting it first
+		// would bring it back up and hide the crash from the rollback check.
+		crashed := needStart && a.activationPending(currentManaged, item)
+		if (attemptStart || crashed) && activeState != "active" {
+			// Starting the unit resets its result, so this is the only chance to see why it stopped.
+			if result, err := systemd.Result(ctx, paths.UnitName); err == nil && result == "oom-kill" {
+				a.logger.Info("unit was killed for running out of memory", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
+				observation.TerminationReason = terminationOOMKilled
 			}
-			currentManaged = markAction(currentManaged, item.SpecHash, "restart")
 		}
-
-		pid, startTime, activeState, subState, err := systemd.Show(ctx, paths.UnitName)
-		if err != nil {
-			a.logger.Error(err, "show failed", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
+		if crashed {
+			observeUnitState(item.Namespace, item.Name, activeState)
 			observation.ProcessStarted = boolPtr(false)
 			observation.Healthy = boolPtr(false)
-			observation.ErrorMessage = stringPtr(err.Error())
-		} else {
-			// DaemonSet semantics: resource present => keep running.
-			desiredRunning := true
-			needStart := desiredRunning && (activeState != "active" || pid == 0)
-			if needStart && shouldAttemptAction(currentManaged, item.SpecHash, 5*time.Second) {
-				var actionErr error
-				if activeState == "active" && pid == 0 {
-					actionErr = systemd.Restart(ctx, paths.UnitName)
-					currentManaged = markAction(currentManaged, item.SpecHash, "restart-drift")
-				} else {
-					actionErr = systemd.EnableAndStart(ctx, paths.UnitName)
-					currentManaged = markAction(currentManaged, item.SpecHash, "enable-and-start-drift")
-				}
-				if actionErr != nil {
-					a.logger.Error(actionErr, "drift correction failed", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
-					observation.ProcessStarted = boolPtr(false)
-					observation.Healthy = boolPtr(false)
-					observation.ErrorMessage = stringPtr(actionErr.Error())
-					_ = stopAndDisableQuiet(ctx, a.logger, paths.UnitName)
-				} else {
-					pid, startTime, activeState, subState, err = systemd.Show(ctx, paths.UnitName)
-					if err != nil {
-						a.logger.Error(err, "show after drift correction failed", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
-						observation.ErrorMessage = stringPtr(err.Error())
-					}
-				}
+			return observation, currentManaged, digests, a.stoppedWithinGrace()
+		}
+		if attemptStart {
+			var actionErr error
+			if activeState == "active" && pid == 0 {
+				actionErr = systemd.Restart(ctx, paths.UnitName)
+				currentManaged = markAction(currentManaged, item.SpecHash, "restart-drift")
+			} else {
+				actionErr = systemd.EnableAndStart(ctx, paths.UnitName)
+				currentManaged = markAction(currentManaged, item.SpecHash, "enable-and-start-drift")
 			}
-
-			processStarted := activeState == "active" && pid > 0
-			observation.ProcessStarted = boolPtr(processStarted)
-			observation.Healthy = boolPtr(processStarted)
-			if !processStarted {
-				// systemctl show may keep ExecMainStartTimestamp populated even after stop.
-				observation.PID = 0
-				observation.StartTime = ""
+			if actionErr != nil {
+				a.logger.Error(actionErr, "drift correction failed", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
+				observation.ProcessStarted = boolPtr(false)
+				observation.Healthy = boolPtr(false)
+				observation.ErrorMessage = stringPtr(actionErr.Error())
+				_ = stopAndDisableQuiet(ctx, a.logger, paths.UnitName)
 			} else {
-				observation.PID = pid
-				if !startTime.IsZero() {
-					observation.StartTime = startTime.UTC().Format(time.RFC3339)
-				} else {
-					observation.StartTime = ""
+				pid, startTime, activeState, subState, err = systemd.Show(ctx, paths.UnitName)
+				if err != nil {
+					a.logger.Error(err, "show after drift correction failed", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName)
+					observation.ErrorMessage = stringPtr(err.Error())
 				}
 			}
-
-			a.logger.V(1).Info("unit status", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName, "active", activeState, "sub", subState, "pid", pid, "start", startTime)
-		}
-
-		appendAndContinue()
-	}
-
-	for key, managed := range a.managed {
-		if _, ok := managedNow[key]; ok {
-			continue
-		}
-
-		ns, name, err := splitKey(key)
-		if err != nil {
-			a.logger.Error(err, "parse managed key", "key", key)
-			continue
-		}
-
-		paths := systemd.PathsFor(ns, name)
-		if err := stopAndDisableQuiet(ctx, a.logger, managed.UnitName); err != nil {
-			a.logger.Error(err, "stop/disable failed", "unit", managed.UnitName, "namespace", ns, "name", name)
 		}
 
-		unitRemoved, envRemoved, err := systemd.RemoveUnitWithDetails(ctx, managed.UnitName, paths.UnitPath, paths.EnvPath)
-		if err != nil {
-			a.logger.Error(err, "remove unit files failed", "unit", managed.UnitName, "namespace", ns, "name", name)
+		observeUnitState(item.Namespace, item.Name, activeState)
+		processStarted := activeState == "active" && pid > 0
+		if processStarted {
+			currentManaged.Probe = runHealthCheck(ctx, currentManaged.Probe, item, rootfs)
+		} else {
+			currentManaged.Probe = nil
 		}
-		if unitRemoved {
-			if err := systemd.DaemonReload(ctx); err != nil {
-				a.logger.Error(err, "daemon-reload after removal failed", "unit", managed.UnitName, "namespace", ns, "name", name)
+		observation.ProcessStarted = boolPtr(processStarted)
+		observation.Healthy = boolPtr(processStarted && currentManaged.Probe.passing(item))
+		if !processStarted {
+			// systemctl show may keep ExecMainStartTimestamp populated even after stop.
+			observation.PID = 0
+			observation.StartTime = ""
+		} else {
+			observation.PID = pid
+			observation.Resources = a.resources.sample(paths.UnitName)
+			if !startTime.IsZero() {
+				observation.StartTime = startTime.UTC().Format(time.RFC3339)
+			} else {
+				observation.StartTime = ""
 			}
 		}
-		if unitRemoved || envRemoved {
-			a.logger.Info("removed unit artifacts", "namespace", ns, "name", name, "unit", managed.UnitName)
-		}
-	}
 
-	a.managed = managedNow
-	if err := a.persistState(); err != nil {
-		a.logger.Error(err, "persist agent state", "path", a.statePath)
+		a.logger.V(1).Info("unit status", "namespace", item.Namespace, "name", item.Name, "unit", paths.UnitName, "active", activeState, "sub", subState, "pid", pid, "start", startTime)
 	}
 
-	return obs, nil
+	currentManaged, failure := a.trackActivation(currentManaged, item, observation.ProcessStarted != nil && *observation.ProcessStarted)
+	return observation, currentManaged, digests, failure
 }
 
 func renderUnitFiles(item gateway.DesiredItem, envPath string) (string, string, error) {
@@ -640,6 +1047,7 @@ func carryManaged(prev managedItem, unitName string) managedItem {
 }
 
 func markAction(mi managedItem, specHash, desc string) managedItem {
+	unitActions.WithLabelValues(desc).Inc()
 	mi.LastActionAt = time.Now().UTC().Format(time.RFC3339)
 	mi.LastActionSpecHash = specHash
 	mi.LastActionDescription = desc
@@ -673,7 +1081,10 @@ func stopAndDisableQuiet(ctx context.Context, logger logr.Logger, unitName strin
 }
 
 func (a *agent) persistState() error {
-	state := agentState{Managed: a.managed}
+	state := agentState{Managed: a.managed, LastDesired: a.lastDesired, LastETag: a.lastETag, SetRevision: a.setRevision}
+	if !a.desiredConfirmedAt.IsZero() {
+		state.DesiredConfirmedAt = a.desiredConfirmedAt.UTC().Format(time.RFC3339)
+	}
 	data, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
 		return err
@@ -687,6 +1098,15 @@ func (a *agent) loadState() error {
 		return err
 	}
 	a.managed = state.Managed
+	a.lastDesired = state.LastDesired
+	a.lastETag = state.LastETag
+	a.setRevision = state.SetRevision
+	if t, err := time.Parse(time.RFC3339, state.DesiredConfirmedAt); err == nil {
+		a.desiredConfirmedAt = t
+	}
+	if a.lastDesired != nil {
+		a.applyIntervals(a.lastDesired)
+	}
 	return nil
 }
 
@@ -774,17 +1194,44 @@ func (a *agent) sendReport(ctx context.Context, observations []gateway.Observati
 	}
 	defer resp.Body.Close()
 
+	if err := checkRetryAfter(resp); err != nil {
+		return err
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("report failed with status %d", resp.StatusCode)
 	}
 
+	a.mu.Lock()
 	for i := range observations {
 		obs := observations[i]
 		a.lastObserved[itemKey(obs.Namespace, obs.Name)] = obs.ObservedSpecHash
 	}
+	a.mu.Unlock()
+	a.self.confirm()
 	return nil
 }
 
+// progressReporter returns a download progress callback that sends interim reports for item,
+// so long downloads are visible before reconcile finishes.
+func (a *agent) progressReporter(ctx context.Context, item gateway.DesiredItem) func(done, total int64) {
+	return func(done, total int64) {
+		if a.gatewayURL == "" {
+			return
+		}
+		obs := gateway.Observation{
+			Namespace:               item.Namespace,
+			Name:                    item.Name,
+			ObservedSpecHash:        item.SpecHash,
+			ArtifactBytesDownloaded: done,
+			ArtifactBytesTotal:      total,
+			DownloadInProgress:      true,
+		}
+		if err := a.sendReport(ctx, []gateway.Observation{obs}); err != nil {
+			a.logger.V(1).Info("progress report failed", "namespace", item.Namespace, "name", item.Name, "error", err.Error())
+		}
+	}
+}
+
 func boolPtr(v bool) *bool {
 	return &v
 }
@@ -804,7 +1251,18 @@ func itemKey(ns, name string) string {
 	return ns + "/" + name
 }
 
+// computeDeviceToken prefers the per-device token file, since a device with a token Secret no
+// longer accepts the HMAC or shared token; those remain the fallback while the file is missing.
 func (a *agent) computeDeviceToken() string {
+	if a.deviceTokenFile != "" {
+		data, err := os.ReadFile(a.deviceTokenFile)
+		if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+			return strings.TrimSpace(string(data))
+		}
+		if err != nil {
+			a.logger.Error(err, "read device token file", "path", a.deviceTokenFile)
+		}
+	}
 	if a.deviceTokenSecret != "" {
 		h := hmac.New(func() hash.Hash { return sha256.New() }, []byte(a.deviceTokenSecret))
 		h.Write([]byte(a.deviceName))
@@ -814,8 +1272,8 @@ func (a *agent) computeDeviceToken() string {
 }
 
 func (a *agent) sleepWithJitter(ctx context.Context, base time.Duration) {
-	jitter := time.Duration(a.rnd.Int63n(int64(250 * time.Millisecond)))
-	d := base + jitter
+	d := base + a.jitter(250*time.Millisecond)
+	backoffSeconds.Set(d.Seconds())
 	select {
 	case <-time.After(d):
 	case <-ctx.Done():
@@ -830,9 +1288,13 @@ func nextBackoff(current time.Duration) time.Duration {
 	return n
 }
 
+// getenv reads an APOLLO_* setting from the environment, then the configuration file.
 func getenv(key, fallback string) string {
 	if val := os.Getenv(key); val != "" {
 		return val
 	}
+	if val := configured.get(key); val != "" {
+		return val
+	}
 	return fallback
 }
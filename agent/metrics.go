@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// metricsRegistry holds the agent's own metrics; runtimeRegistry adds Go and process metrics
+	// for the listener only, since the node exporter already reports its own under those names.
+	metricsRegistry = prometheus.NewRegistry()
+	runtimeRegistry = prometheus.NewRegistry()
+
+	gatewayRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "apollo_agent_gateway_request_duration_seconds",
+		Help:    "Latency of gateway requests by operation (poll, watch, report, enroll).",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"op"})
+	gatewayRequestFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "apollo_agent_gateway_request_failures_total",
+		Help: "Failed gateway requests by operation and HTTP status code (\"error\" when no response arrived).",
+	}, []string{"op", "code"})
+	backoffSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "apollo_agent_backoff_seconds",
+		Help: "Delay the agent is backing off for after a failed poll or report; 0 when healthy.",
+	})
+	reconcileItemDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "apollo_agent_reconcile_item_duration_seconds",
+		Help:    "Time spent reconciling one desired item, including artifact downloads.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 30, 120, 600},
+	}, []string{"namespace", "name"})
+	artifactDownloadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "apollo_agent_artifact_download_bytes_total",
+		Help: "Artifact blob bytes accounted by download passes, including content resumed from earlier attempts.",
+	})
+	artifactDownloadAttempts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "apollo_agent_artifact_download_attempts_total",
+		Help: "Artifact download attempts; cache hits do not count.",
+	})
+	artifactDownloadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "apollo_agent_artifact_download_errors_total",
+		Help: "Failed artifact downloads and verifications by reason.",
+	}, []string{"reason"})
+	unitActions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "apollo_agent_unit_actions_total",
+		Help: "systemd actions taken on managed units; actions ending in -drift are drift corrections.",
+	}, []string{"action"})
+	unitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "apollo_agent_unit_state",
+		Help: "1 for the systemd ActiveState each managed unit was last observed in.",
+	}, []string{"namespace", "name", "state"})
+)
+
+func init() {
+	runtimeRegistry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	metricsRegistry.MustRegister(
+		gatewayRequestDuration, gatewayRequestFailures, backoffSeconds, reconcileItemDuration,
+		artifactDownloadBytes, artifactDownloadAttempts, artifactDownloadErrors, unitActions, unitState,
+	)
+}
+
+// instrumentGateway wraps rt to record the latency and failures of gateway requests.
+func instrumentGateway(rt http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		op := gatewayOp(req)
+		start := time.Now()
+		resp, err := rt.RoundTrip(req)
+		gatewayRequestDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+		switch {
+		case err != nil:
+			gatewayRequestFailures.WithLabelValues(op, "error").Inc()
+		case resp.StatusCode >= http.StatusBadRequest:
+			gatewayRequestFailures.WithLabelValues(op, strconv.Itoa(resp.StatusCode)).Inc()
+		}
+		return resp, err
+	})
+}
+
+func gatewayOp(req *http.Request) string {
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/desired") && req.URL.Query().Has(desiredWaitParam):
+		return "watch"
+	case strings.HasSuffix(path, "/desired"):
+		return "poll"
+	case strings.HasSuffix(path, "/report"):
+		return "report"
+	case strings.Contains(path, "/enroll"):
+		return "enroll"
+	}
+	return "other"
+}
+
+// observeArtifact records the outcome of one artifact Ensure.
+func observeArtifact(res ociResult, err error) {
+	if res.attempts > 0 {
+		artifactDownloadAttempts.Add(float64(res.attempts))
+		artifactDownloadBytes.Add(float64(res.bytesDownloaded))
+	}
+	if err == nil {
+		return
+	}
+	reason := res.downloadReason
+	if res.downloaded && !res.verified {
+		reason = res.verifyReason
+	}
+	artifactDownloadErrors.WithLabelValues(defaultString(reason, "ArtifactDownloadFailed")).Inc()
+}
+
+// observeUnitState records the ActiveState last seen for an item's unit.
+func observeUnitState(namespace, name, state string) {
+	unitState.DeletePartialMatch(prometheus.Labels{"namespace": namespace, "name": name})
+	if state != "" {
+		unitState.WithLabelValues(namespace, name, state).Set(1)
+	}
+}
+
+// forgetItemMetrics drops the per-item series of an item that is no longer managed.
+func forgetItemMetrics(namespace, name string) {
+	labels := prometheus.Labels{"namespace": namespace, "name": name}
+	unitState.DeletePartialMatch(labels)
+	reconcileItemDuration.DeletePartialMatch(labels)
+}
+
+// serveMetrics exposes the registry on addr until ctx ends.
+func serveMetrics(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{metricsRegistry, runtimeRegistry}, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// writeMetricsTextfile rewrites path for the node exporter textfile collector every interval.
+func writeMetricsTextfile(ctx context.Context, logger logr.Logger, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := prometheus.WriteToTextfile(path, metricsRegistry); err != nil {
+			logger.Error(err, "write metrics textfile", "path", path)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
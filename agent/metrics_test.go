@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apollo/praetor/agent/systemd"
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsCoverReconcileGatewayAndArtifacts(t *testing.T) {
+	restorePaths := systemd.SetBasePathsForTesting(filepath.Join(t.TempDir(), "units"), filepath.Join(t.TempDir(), "env"))
+	defer restorePaths()
+	restoreRunner := systemd.SetRunnerForTesting(&fixedShowRunner{showOut: []byte(activeShow)})
+	defer restoreRunner()
+
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer gw.Close()
+	ag := &agent{
+		deviceName:   "switch-1",
+		gatewayURL:   gw.URL,
+		client:       &http.Client{Transport: instrumentGateway(http.DefaultTransport)},
+		logger:       logr.Discard(),
+		lastObserved: map[string]string{},
+		managed:      map[string]managedItem{},
+		statePath:    filepath.Join(t.TempDir(), "state.json"),
+		oci:          &refOCI{results: map[string]ociResult{}},
+	}
+
+	started := testutil.ToFloat64(unitActions.WithLabelValues("enable-and-start"))
+	item := rollbackItem("sha256:1", apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"}, "/opt/app/run")
+	item.Name = "metrics"
+	if _, err := ag.reconcile(context.Background(), &gateway.DesiredResponse{Items: []gateway.DesiredItem{item}}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if got := testutil.ToFloat64(unitActions.WithLabelValues("enable-and-start")) - started; got != 1 {
+		t.Fatalf("expected one enable-and-start action, got %v", got)
+	}
+	if got := testutil.ToFloat64(unitState.WithLabelValues("ns", "metrics", "active")); got != 1 {
+		t.Fatalf("expected the unit reported active, got %v", got)
+	}
+	if !hasItemSeries(t, "apollo_agent_reconcile_item_duration_seconds", "metrics") {
+		t.Fatalf("expected a reconcile duration series for the item")
+	}
+
+	failures := testutil.ToFloat64(gatewayRequestFailures.WithLabelValues("report", "503"))
+	if err := ag.sendReport(context.Background(), nil); err == nil {
+		t.Fatalf("expected the report to fail")
+	}
+	if got := testutil.ToFloat64(gatewayRequestFailures.WithLabelValues("report", "503")) - failures; got != 1 {
+		t.Fatalf("expected one failed report counted, got %v", got)
+	}
+
+	errs := testutil.ToFloat64(artifactDownloadErrors.WithLabelValues("InsufficientSpace"))
+	attempts := testutil.ToFloat64(artifactDownloadAttempts)
+	observeArtifact(ociResult{attempts: 3, bytesDownloaded: 10, downloadReason: "InsufficientSpace"}, errors.New("no space"))
+	observeArtifact(ociResult{downloaded: true, verified: true}, nil)
+	if got := testutil.ToFloat64(artifactDownloadErrors.WithLabelValues("InsufficientSpace")) - errs; got != 1 {
+		t.Fatalf("expected the download error counted by reason, got %v", got)
+	}
+	if got := testutil.ToFloat64(artifactDownloadAttempts) - attempts; got != 3 {
+		t.Fatalf("expected cache hits not to count as attempts, got %v", got)
+	}
+
+	textfile := filepath.Join(t.TempDir(), "apollo_agent.prom")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	writeMetricsTextfile(ctx, logr.Discard(), textfile, time.Minute)
+	data, err := os.ReadFile(textfile)
+	if err != nil {
+		t.Fatalf("read textfile: %v", err)
+	}
+	if !strings.Contains(string(data), `apollo_agent_unit_state{name="metrics",namespace="ns",state="active"} 1`) || strings.Contains(string(data), "go_goroutines") {
+		t.Fatalf("expected only agent metrics in the textfile, got:\n%s", data)
+	}
+
+	if _, err := ag.reconcile(context.Background(), &gateway.DesiredResponse{}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if hasItemSeries(t, "apollo_agent_unit_state", "metrics") || hasItemSeries(t, "apollo_agent_reconcile_item_duration_seconds", "metrics") {
+		t.Fatalf("expected a removed item's series to be dropped")
+	}
+}
+
+func hasItemSeries(t *testing.T, family, name string) bool {
+	t.Helper()
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != family {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "name" && l.GetValue() == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
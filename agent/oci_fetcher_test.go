@@ -36,7 +36,9 @@ func withOCIOverrides(t *testing.T, copyFn func(context.Context, oras.Target, st
 	origCopy := orasCopy
 	origRepo := newRemoteRepository
 	origNow := nowFunc
+	origAvail := availableBytes
 	orasCopy = copyFn
+	availableBytes = func(string) (int64, error) { return 1 << 40, nil }
 	newRemoteRepository = func(ref string) (*remote.Repository, error) {
 		return &remote.Repository{}, nil
 	}
@@ -46,18 +48,17 @@ func withOCIOverrides(t *testing.T, copyFn func(context.Context, oras.Target, st
 		orasCopy = origCopy
 		newRemoteRepository = origRepo
 		nowFunc = origNow
+		availableBytes = origAvail
 	}
 }
 
-func pushSingleLayer(store *oci.Store, dstRef string, tarBytes []byte, mediaType string) (ocispec.Descriptor, error) {
+// singleLayerManifest builds the manifest pushSingleLayer stores so tests can pin its digest up front.
+func singleLayerManifest(tarBytes []byte, mediaType string) (ocispec.Descriptor, []byte, ocispec.Descriptor) {
 	layerDesc := ocispec.Descriptor{
 		MediaType: mediaType,
 		Digest:    digest.FromBytes(tarBytes),
 		Size:      int64(len(tarBytes)),
 	}
-	if err := store.Push(context.Background(), layerDesc, bytes.NewReader(tarBytes)); err != nil {
-		return ocispec.Descriptor{}, err
-	}
 	manifest := ocispec.Manifest{Layers: []ocispec.Descriptor{layerDesc}}
 	manifestBytes, _ := json.Marshal(manifest)
 	manifestDesc := ocispec.Descriptor{
@@ -65,6 +66,19 @@ func pushSingleLayer(store *oci.Store, dstRef string, tarBytes []byte, mediaType
 		Digest:    digest.FromBytes(manifestBytes),
 		Size:      int64(len(manifestBytes)),
 	}
+	return layerDesc, manifestBytes, manifestDesc
+}
+
+func singleLayerRef(tarBytes []byte, mediaType string) string {
+	_, _, desc := singleLayerManifest(tarBytes, mediaType)
+	return "ghcr.io/example/app@" + desc.Digest.String()
+}
+
+func pushSingleLayer(store *oci.Store, dstRef string, tarBytes []byte, mediaType string) (ocispec.Descriptor, error) {
+	layerDesc, manifestBytes, manifestDesc := singleLayerManifest(tarBytes, mediaType)
+	if err := store.Push(context.Background(), layerDesc, bytes.NewReader(tarBytes)); err != nil {
+		return ocispec.Descriptor{}, err
+	}
 	if err := store.Push(context.Background(), manifestDesc, bytes.NewReader(manifestBytes)); err != nil {
 		return ocispec.Descriptor{}, err
 	}
@@ -137,16 +151,15 @@ func TestEnsureOCIBadRefRejected(t *testing.T) {
 }
 
 func TestEnsureOCIRejectsTraversal(t *testing.T) {
-	digestStr := "sha256:" + strings.Repeat("1", 64)
+	tarBytes := makeTar(map[string]string{"../escape.sh": "echo bad"})
 	restore := withOCIOverrides(t, func(ctx context.Context, src oras.Target, srcRef string, dst oras.Target, dstRef string, opts oras.CopyOptions) (ocispec.Descriptor, error) {
 		store := dst.(*oci.Store)
-		tarBytes := makeTar(map[string]string{"../escape.sh": "echo bad"})
 		return pushSingleLayer(store, dstRef, tarBytes, ocispec.MediaTypeImageLayer)
 	})
 	defer restore()
 
 	f := newOCIFetcher(logr.Discard(), t.TempDir())
-	res, err := f.Ensure(context.Background(), "ghcr.io/example/app@"+digestStr)
+	res, err := f.Ensure(context.Background(), singleLayerRef(tarBytes, ocispec.MediaTypeImageLayer))
 	if err == nil {
 		t.Fatalf("expected traversal error")
 	}
@@ -156,7 +169,7 @@ func TestEnsureOCIRejectsTraversal(t *testing.T) {
 }
 
 func TestEnsureOCIRetriesThenSucceeds(t *testing.T) {
-	digestStr := "sha256:" + strings.Repeat("2", 64)
+	tarBytes := makeTar(map[string]string{"bin/app": "echo ok"})
 	calls := 0
 	restore := withOCIOverrides(t, func(ctx context.Context, src oras.Target, srcRef string, dst oras.Target, dstRef string, opts oras.CopyOptions) (ocispec.Descriptor, error) {
 		calls++
@@ -164,13 +177,12 @@ func TestEnsureOCIRetriesThenSucceeds(t *testing.T) {
 			return ocispec.Descriptor{}, temporaryErr{msg: "temp"}
 		}
 		store := dst.(*oci.Store)
-		tarBytes := makeTar(map[string]string{"bin/app": "echo ok"})
 		return pushSingleLayer(store, dstRef, tarBytes, ocispec.MediaTypeImageLayer)
 	})
 	defer restore()
 
 	f := newOCIFetcher(logr.Discard(), t.TempDir())
-	res, err := f.Ensure(context.Background(), "ghcr.io/example/app@"+digestStr)
+	res, err := f.Ensure(context.Background(), singleLayerRef(tarBytes, ocispec.MediaTypeImageLayer))
 	if err != nil {
 		t.Fatalf("ensure failed: %v", err)
 	}
@@ -183,12 +195,11 @@ func TestEnsureOCIRetriesThenSucceeds(t *testing.T) {
 }
 
 func TestEnsureOCIMultiLayerFails(t *testing.T) {
-	digestStr := "sha256:" + strings.Repeat("3", 64)
+	manifest := ocispec.Manifest{Layers: []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromString("layer1"), Size: 1}, {MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromString("layer2"), Size: 1}}}
+	manifestBytes, _ := json.Marshal(manifest)
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifestBytes), Size: int64(len(manifestBytes))}
 	restore := withOCIOverrides(t, func(ctx context.Context, src oras.Target, srcRef string, dst oras.Target, dstRef string, opts oras.CopyOptions) (ocispec.Descriptor, error) {
 		store := dst.(*oci.Store)
-		manifest := ocispec.Manifest{Layers: []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromString("layer1"), Size: 1}, {MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromString("layer2"), Size: 1}}}
-		manifestBytes, _ := json.Marshal(manifest)
-		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifestBytes), Size: int64(len(manifestBytes))}
 		_ = store.Push(ctx, desc, bytes.NewReader(manifestBytes))
 		_ = store.Tag(ctx, desc, dstRef)
 		return desc, nil
@@ -196,7 +207,7 @@ func TestEnsureOCIMultiLayerFails(t *testing.T) {
 	defer restore()
 
 	f := newOCIFetcher(logr.Discard(), t.TempDir())
-	res, err := f.Ensure(context.Background(), "ghcr.io/example/app@"+digestStr)
+	res, err := f.Ensure(context.Background(), "ghcr.io/example/app@"+desc.Digest.String())
 	if err == nil {
 		t.Fatalf("expected multi-layer error")
 	}
@@ -208,27 +219,25 @@ func TestEnsureOCIMultiLayerFails(t *testing.T) {
 	}
 }
 
-func TestEnsureOCIRejectsSymlink(t *testing.T) {
-	digestStr := "sha256:" + strings.Repeat("4", 64)
+func TestEnsureOCIRejectsEscapingSymlink(t *testing.T) {
+	tarBytes := makeSymlinkTar("bin/app", "/etc/passwd")
 	restore := withOCIOverrides(t, func(ctx context.Context, src oras.Target, srcRef string, dst oras.Target, dstRef string, opts oras.CopyOptions) (ocispec.Descriptor, error) {
 		store := dst.(*oci.Store)
-		tarBytes := makeSymlinkTar("bin/app", "/etc/passwd")
 		return pushSingleLayer(store, dstRef, tarBytes, ocispec.MediaTypeImageLayer)
 	})
 	defer restore()
 
 	f := newOCIFetcher(logr.Discard(), t.TempDir())
-	res, err := f.Ensure(context.Background(), "ghcr.io/example/app@"+digestStr)
+	res, err := f.Ensure(context.Background(), singleLayerRef(tarBytes, ocispec.MediaTypeImageLayer))
 	if err == nil {
 		t.Fatalf("expected symlink rejection")
 	}
-	if res.verifyReason != "UnsupportedEntryType" {
-		t.Fatalf("expected UnsupportedEntryType, got %q", res.verifyReason)
+	if res.verifyReason != "InvalidLink" {
+		t.Fatalf("expected InvalidLink, got %q", res.verifyReason)
 	}
 }
 
 func TestEnsureOCIEntryLimit(t *testing.T) {
-	digestStr := "sha256:" + strings.Repeat("6", 64)
 	origEntries, origBytes := maxExtractEntries, maxExtractBytes
 	maxExtractEntries = 5
 	maxExtractBytes = defaultMaxExtractBytes
@@ -237,22 +246,24 @@ func TestEnsureOCIEntryLimit(t *testing.T) {
 		maxExtractBytes = origBytes
 	}()
 
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for i := 0; i < maxExtractEntries+1; i++ {
+		name := fmt.Sprintf("bin/app-%d", i)
+		_ = tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: 1, Typeflag: tar.TypeReg})
+		_, _ = tw.Write([]byte("x"))
+	}
+	_ = tw.Close()
+	tarBytes := buf.Bytes()
+
 	restore := withOCIOverrides(t, func(ctx context.Context, src oras.Target, srcRef string, dst oras.Target, dstRef string, opts oras.CopyOptions) (ocispec.Descriptor, error) {
 		store := dst.(*oci.Store)
-		buf := &bytes.Buffer{}
-		tw := tar.NewWriter(buf)
-		for i := 0; i < maxExtractEntries+1; i++ {
-			name := fmt.Sprintf("bin/app-%d", i)
-			_ = tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: 1, Typeflag: tar.TypeReg})
-			_, _ = tw.Write([]byte("x"))
-		}
-		_ = tw.Close()
-		return pushSingleLayer(store, dstRef, buf.Bytes(), ocispec.MediaTypeImageLayer)
+		return pushSingleLayer(store, dstRef, tarBytes, ocispec.MediaTypeImageLayer)
 	})
 	defer restore()
 
 	f := newOCIFetcher(logr.Discard(), t.TempDir())
-	res, err := f.Ensure(context.Background(), "ghcr.io/example/app@"+digestStr)
+	res, err := f.Ensure(context.Background(), singleLayerRef(tarBytes, ocispec.MediaTypeImageLayer))
 	if err == nil {
 		t.Fatalf("expected entry limit error")
 	}
@@ -290,7 +301,7 @@ func TestAllowPlainHTTP(t *testing.T) {
 				return &remote.Repository{}, nil
 			}
 			orasCopy = func(ctx context.Context, src oras.Target, srcRef string, dst oras.Target, dstRef string, opts oras.CopyOptions) (ocispec.Descriptor, error) {
-				if repo, ok := src.(*remote.Repository); ok {
+				if repo, ok := src.(*resumableSource); ok {
 					seenPlain = repo.PlainHTTP
 				}
 				return ocispec.Descriptor{}, errors.New("fail")
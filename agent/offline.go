@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// staleActionHold leaves units as they are, without drift correction, once cached desired
+	// state is older than the staleness limit.
+	staleActionHold = "hold"
+	// staleActionStop stops managed units once cached desired state is older than the staleness
+	// limit. Unit files and artifacts are kept so the units come back as soon as the gateway does.
+	staleActionStop = "stop"
+)
+
+// parseStaleAction validates APOLLO_DESIRED_STALE_ACTION.
+func parseStaleAction(v string) (string, error) {
+	switch v {
+	case "", staleActionHold:
+		return staleActionHold, nil
+	case staleActionStop:
+		return staleActionStop, nil
+	}
+	return "", fmt.Errorf("invalid APOLLO_DESIRED_STALE_ACTION %q (want %s or %s)", v, staleActionHold, staleActionStop)
+}
+
+// desiredAge is how long ago the gateway last confirmed the cached desired state.
+func (a *agent) desiredAge() time.Duration {
+	if a.desiredConfirmedAt.IsZero() {
+		return 0
+	}
+	return nowFunc().Sub(a.desiredConfirmedAt)
+}
+
+// reconcileCached keeps converging units against the last desired state while the gateway is
+// unreachable. Once that state is older than desiredMaxStaleness it is no longer authoritative
+// and staleAction decides what happens to the units instead.
+func (a *agent) reconcileCached(ctx context.Context) {
+	if a.lastDesired == nil {
+		return
+	}
+	if age := a.desiredAge(); a.desiredMaxStaleness > 0 && age > a.desiredMaxStaleness {
+		if !a.desiredStale {
+			a.logger.Info("cached desired state is stale; drift correction paused until the gateway is reachable",
+				"age", age.Round(time.Second).String(), "maxStaleness", a.desiredMaxStaleness.String(), "action", a.staleAction)
+			if a.staleAction == staleActionStop {
+				a.stopManagedUnits(ctx)
+			}
+		}
+		a.desiredStale = true
+		a.board.noteStale()
+		return
+	}
+
+	a.logger.V(1).Info("gateway unreachable; reconciling cached desired state", "age", a.desiredAge().Round(time.Second).String())
+	if _, err := a.reconcile(ctx, a.lastDesired); err != nil {
+		a.logger.Error(err, "reconcile cached desired state")
+	}
+}
+
+// stopManagedUnits stops every managed unit but keeps its files and bookkeeping. Pending grace
+// periods are reset so a stop by this policy is not mistaken for a failed activation.
+func (a *agent) stopManagedUnits(ctx context.Context) {
+	for key, mi := range a.managed {
+		if mi.UnitName == "" {
+			continue
+		}
+		if err := stopAndDisableQuiet(ctx, a.logger, mi.UnitName); err != nil {
+			a.logger.Error(err, "stop stale unit failed", "unit", mi.UnitName)
+		}
+		mi.PendingSpecHash, mi.PendingSince = "", ""
+		a.managed[key] = mi
+	}
+	if err := a.persistState(); err != nil {
+		a.logger.Error(err, "persist agent state", "path", a.statePath)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apollo/praetor/agent/systemd"
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+)
+
+func TestAgentReconcilesCachedDesiredWhileGatewayIsDown(t *testing.T) {
+	unitDir := filepath.Join(t.TempDir(), "units")
+	restorePaths := systemd.SetBasePathsForTesting(unitDir, filepath.Join(t.TempDir(), "env"))
+	defer restorePaths()
+	runner := &fixedShowRunner{showOut: []byte(activeShow)}
+	restoreRunner := systemd.SetRunnerForTesting(runner)
+	defer restoreRunner()
+
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	origNow := nowFunc
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = origNow }()
+
+	desired := gateway.DesiredResponse{
+		DeviceName:               "switch-1",
+		HeartbeatIntervalSeconds: 30,
+		Items:                    []gateway.DesiredItem{rollbackItem("v1", apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"}, "/opt/app/v1")},
+	}
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("ETag", `"etag-1"`)
+		_ = json.NewEncoder(w).Encode(desired)
+	}))
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	newAgent := func() *agent {
+		return &agent{
+			deviceName:          "switch-1",
+			gatewayURL:          gw.URL,
+			client:              gw.Client(),
+			logger:              logr.Discard(),
+			lastObserved:        map[string]string{},
+			managed:             map[string]managedItem{},
+			statePath:           statePath,
+			heartbeat:           15 * time.Second,
+			oci:                 &refOCI{results: map[string]ociResult{}},
+			desiredMaxStaleness: time.Hour,
+			staleAction:         staleActionStop,
+		}
+	}
+
+	if err := newAgent().pollDesired(context.Background()); err != nil {
+		t.Fatalf("online poll: %v", err)
+	}
+	gw.Close()
+
+	// A restart during the outage starts from the persisted desired state and re-verifies units.
+	unitPath := systemd.PathsFor("ns", "proc").UnitPath
+	if err := os.Remove(unitPath); err != nil {
+		t.Fatalf("remove unit: %v", err)
+	}
+	now = now.Add(30 * time.Minute)
+	ag := newAgent()
+	if err := ag.loadState(); err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if ag.lastETag != `"etag-1"` || ag.heartbeat != 30*time.Second || ag.desiredAge() != 30*time.Minute {
+		t.Fatalf("unexpected restored state etag=%q heartbeat=%s age=%s", ag.lastETag, ag.heartbeat, ag.desiredAge())
+	}
+	if err := ag.pollDesired(context.Background()); err == nil {
+		t.Fatalf("expected poll against a stopped gateway to fail")
+	}
+	if _, err := os.Stat(unitPath); err != nil {
+		t.Fatalf("expected drift correction to restore the unit offline: %v", err)
+	}
+
+	// Past the staleness limit the stop policy stops units once and keeps their files.
+	now = now.Add(time.Hour)
+	runner.calls = nil
+	for i := 0; i < 2; i++ {
+		_ = ag.pollDesired(context.Background())
+	}
+	var stops int
+	for _, call := range runner.calls {
+		if call[0] == "disable" {
+			stops++
+		}
+	}
+	if stops != 1 || !ag.desiredStale {
+		t.Fatalf("expected one stop once cached state went stale, got %d stops in %v", stops, runner.calls)
+	}
+	if _, err := os.Stat(unitPath); err != nil {
+		t.Fatalf("stale stop must keep unit files: %v", err)
+	}
+	if _, ok := ag.managed[itemKey("ns", "proc")]; !ok {
+		t.Fatalf("stale stop must keep managed state")
+	}
+}
+
+func TestParseStaleAction(t *testing.T) {
+	for in, want := range map[string]string{"": staleActionHold, "hold": staleActionHold, "stop": staleActionStop} {
+		if got, err := parseStaleAction(in); err != nil || got != want {
+			t.Fatalf("parseStaleAction(%q) = %q, %v", in, got, err)
+		}
+	}
+	if _, err := parseStaleAction("delete"); err == nil || !strings.Contains(err.Error(), "APOLLO_DESIRED_STALE_ACTION") {
+		t.Fatalf("expected invalid action to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/apollo/praetor/agent/systemd"
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+	"github.com/pmezard/go-difflib/difflib"
+	"oras.land/oras-go/v2/registry"
+)
+
+// Planned actions, in the terms reconcile acts in.
+const (
+	planCreate  = "create"
+	planRestart = "restart"
+	planStart   = "start"
+	planNone    = "none"
+	planRemove  = "remove"
+	planRefuse  = "refuse"
+	planHold    = "hold"
+	planFail    = "fail"
+	planSkip    = "skip"
+	planUpgrade = "upgrade-agent"
+)
+
+// itemPlan is what one reconcile pass would do for an item.
+type itemPlan struct {
+	Namespace string
+	Name      string
+	SpecHash  string
+	Action    string
+	Unit      string
+	// Changes lists what differs from the device: unit, env and artifact.
+	Changes []string
+	// Fetch is the artifact that would be downloaded, if it is not cached yet.
+	Fetch    string
+	Message  string
+	UnitDiff string
+	EnvDiff  string
+}
+
+// artifactCache is implemented by fetchers that can tell where an artifact is extracted and
+// whether it is cached, without fetching or locking anything.
+type artifactCache interface {
+	CachedRootfs(ref string) (string, bool)
+}
+
+// CachedRootfs returns the rootfs path of ref and whether it is cached and ready.
+func (f *ociFetcherImpl) CachedRootfs(ref string) (string, bool) {
+	parsed, err := registry.ParseReference(strings.TrimSpace(ref))
+	if err != nil || !digestPattern.MatchString(parsed.Reference) {
+		return "", false
+	}
+	baseDir := filepath.Join(f.root, strings.TrimPrefix(parsed.Reference, "sha256:"))
+	rootfs := filepath.Join(baseDir, "rootfs")
+	return rootfs, fileExists(filepath.Join(baseDir, readyMarkerName)) && dirExists(rootfs)
+}
+
+// plan works out what reconcile would do for desired against the current unit files, unit
+// states and artifact cache, without changing any of them. Removals come last, by key.
+func (a *agent) plan(ctx context.Context, desired *gateway.DesiredResponse) []itemPlan {
+	var plans []itemPlan
+	wanted := make(map[string]bool)
+	var setErr error
+	if desired != nil {
+		setErr = a.verifySet(desired)
+		for _, item := range desired.Items {
+			wanted[itemKey(item.Namespace, item.Name)] = true
+			plans = append(plans, a.planItem(ctx, item, setErr == nil))
+		}
+	}
+
+	keys := make([]string, 0, len(a.managed))
+	for key, mi := range a.managed {
+		if !wanted[key] && mi.UnitName != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ns, name, err := splitKey(key)
+		if err != nil {
+			continue
+		}
+		if setErr != nil {
+			plans = append(plans, itemPlan{Namespace: ns, Name: name, Action: planHold, Unit: a.managed[key].UnitName, Message: fmt.Sprintf("no longer desired, but %v; the unit is left alone", setErr)})
+			continue
+		}
+		paths := systemd.PathsFor(ns, name)
+		p := itemPlan{Namespace: ns, Name: name, Action: planRemove, Unit: a.managed[key].UnitName, Message: "no longer desired; stop, disable and delete the unit"}
+		if unit, ok := readCurrent(paths.UnitPath); ok {
+			p.Changes = append(p.Changes, "unit")
+			p.UnitDiff = unifiedDiff(paths.UnitPath, unit, "")
+		}
+		if env, ok := readCurrent(paths.EnvPath); ok {
+			p.Changes = append(p.Changes, "env")
+			p.EnvDiff = unifiedDiff(paths.EnvPath, env, "")
+		}
+		plans = append(plans, p)
+	}
+	return plans
+}
+
+func (a *agent) planItem(ctx context.Context, item gateway.DesiredItem, setVerified bool) itemPlan {
+	p := itemPlan{Namespace: item.Namespace, Name: item.Name, SpecHash: item.SpecHash}
+	prev, hadPrev := a.managed[itemKey(item.Namespace, item.Name)]
+	if err := a.verifySpec(item, prev, hadPrev, setVerified); err != nil {
+		p.Action, p.Message = planRefuse, fmt.Sprintf("spec signature: %v; the current unit is left alone", err)
+		return p
+	}
+
+	switch item.Spec.Execution.Backend {
+	case apiv1alpha1.DeviceProcessBackendAgent:
+		p.Action, p.Message = planUpgrade, "the agent binary is replaced if the artifact differs from it"
+		if _, cached := a.artifactRootfs(item.Spec.Artifact.URL); !cached {
+			p.Fetch, p.Changes = item.Spec.Artifact.URL, []string{"artifact"}
+		}
+		return p
+	case apiv1alpha1.DeviceProcessBackendSystemd:
+	default:
+		p.Action, p.Message = planSkip, fmt.Sprintf("unsupported backend %q", item.Spec.Execution.Backend)
+		return p
+	}
+
+	paths := systemd.PathsFor(item.Namespace, item.Name)
+	p.Unit = paths.UnitName
+	if prev.RolledBackSpecHash == item.SpecHash && a.canRollBack(prev, item) {
+		p.Action, p.Message = planHold, "spec was rolled back ("+prev.RolledBackReason+"); the last known-good spec keeps running"
+		return p
+	}
+
+	if item.Spec.Artifact.Type == apiv1alpha1.ArtifactTypeOCI {
+		rootfs, cached := a.artifactRootfs(item.Spec.Artifact.URL)
+		if !cached {
+			p.Fetch = item.Spec.Artifact.URL
+			p.Changes = append(p.Changes, "artifact")
+		}
+		cmd, err := resolveCommand(item.Spec.Execution.Command, rootfs)
+		if err != nil {
+			p.Action, p.Message = planFail, err.Error()
+			return p
+		}
+		item.Spec.Execution.Command = cmd
+	}
+
+	unitContent, envContent, err := renderUnitFiles(item, paths.EnvPath)
+	if err != nil {
+		p.Action, p.Message = planFail, fmt.Sprintf("render unit: %v; the unit would be stopped and deleted", err)
+		return p
+	}
+	unit, unitExists := readCurrent(paths.UnitPath)
+	env, envExists := readCurrent(paths.EnvPath)
+	unitChanged := !unitExists || unit != unitContent
+	envChanged := !envExists || env != envContent
+	if unitChanged {
+		p.Changes = append(p.Changes, "unit")
+		p.UnitDiff = unifiedDiff(paths.UnitPath, unit, unitContent)
+	}
+	if envChanged {
+		p.Changes = append(p.Changes, "env")
+		p.EnvDiff = unifiedDiff(paths.EnvPath, env, envContent)
+	}
+
+	switch {
+	case !hadPrev:
+		p.Action, p.Message = planCreate, "enable and start the unit"
+	case unitChanged || envChanged:
+		p.Action, p.Message = planRestart, "restart the unit on the new files"
+	default:
+		pid, _, activeState, _, err := systemd.Show(ctx, paths.UnitName)
+		switch {
+		case err != nil:
+			p.Action, p.Message = planStart, fmt.Sprintf("unit state unknown (%v); start it", err)
+		case activeState != "active" || pid == 0:
+			p.Action, p.Message = planStart, fmt.Sprintf("unit is %s; start it", activeState)
+		default:
+			p.Action = planNone
+		}
+	}
+	return p
+}
+
+// artifactRootfs returns where ref is extracted and whether it is already cached.
+func (a *agent) artifactRootfs(ref string) (string, bool) {
+	if cache, ok := a.oci.(artifactCache); ok {
+		return cache.CachedRootfs(ref)
+	}
+	return (&ociFetcherImpl{root: defaultOCIArtifactRoot}).CachedRootfs(ref)
+}
+
+// readCurrent returns the content of path and whether it exists.
+func readCurrent(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", !errors.Is(err, os.ErrNotExist)
+	}
+	return string(data), true
+}
+
+func unifiedDiff(path, from, to string) string {
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(from),
+		B:        splitLines(to),
+		FromFile: path,
+		ToFile:   path + " (planned)",
+		Context:  3,
+	})
+	return diff
+}
+
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// planObservations turns plans into plan-only observations for the gateway. Removed items have
+// no process left to report on.
+func planObservations(plans []itemPlan) []gateway.Observation {
+	var obs []gateway.Observation
+	for _, p := range plans {
+		if p.Action == planRemove {
+			continue
+		}
+		obs = append(obs, gateway.Observation{
+			Namespace: p.Namespace,
+			Name:      p.Name,
+			Plan:      &gateway.PlanObservation{SpecHash: p.SpecHash, Action: p.Action, Changes: p.Changes, Message: p.Message},
+		})
+	}
+	return obs
+}
+
+// printPlan writes the plan as a summary table followed by the artifact fetches and file diffs.
+func printPlan(w io.Writer, device string, plans []itemPlan) {
+	fmt.Fprintf(w, "Plan for %s (dry run, nothing was changed):\n\n", device)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ITEM\tACTION\tUNIT\tCHANGES\tMESSAGE")
+	for _, p := range plans {
+		changes := strings.Join(p.Changes, ",")
+		if changes == "" {
+			changes = "-"
+		}
+		fmt.Fprintf(tw, "%s/%s\t%s\t%s\t%s\t%s\n", p.Namespace, p.Name, p.Action, defaultString(p.Unit, "-"), changes, p.Message)
+	}
+	_ = tw.Flush()
+
+	for _, p := range plans {
+		if p.Fetch != "" {
+			fmt.Fprintf(w, "\nfetch %s for %s/%s\n", p.Fetch, p.Namespace, p.Name)
+		}
+	}
+	for _, p := range plans {
+		for _, diff := range []string{p.UnitDiff, p.EnvDiff} {
+			if diff != "" {
+				fmt.Fprintf(w, "\n%s", diff)
+			}
+		}
+	}
+}
+
+// dryRun fetches desired state once, prints what reconcile would do and, with report, sends the
+// plan to the gateway. Cached desired state stands in when the gateway cannot be reached. It
+// returns the process exit code.
+func (a *agent) dryRun(ctx context.Context, w io.Writer, report bool) int {
+	desired := a.lastDesired
+	res, err := a.fetchDesired(ctx, "", 0)
+	switch {
+	case err == nil && res.desired != nil:
+		desired = res.desired
+	case desired == nil:
+		a.logger.Error(err, "fetch desired state")
+		return 1
+	default:
+		a.logger.Error(err, "fetch desired state failed; planning against cached desired state", "age", a.desiredAge().Round(time.Second).String())
+	}
+
+	plans := a.plan(ctx, desired)
+	printPlan(w, a.deviceName, plans)
+	if report {
+		if err := a.sendReport(ctx, planObservations(plans)); err != nil {
+			a.logger.Error(err, "report plan")
+			return 1
+		}
+	}
+	return 0
+}
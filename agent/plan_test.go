@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apollo/praetor/agent/systemd"
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+)
+
+func TestDryRunPrintsPlanWithoutTouchingTheDevice(t *testing.T) {
+	unitDir := filepath.Join(t.TempDir(), "units")
+	restorePaths := systemd.SetBasePathsForTesting(unitDir, filepath.Join(t.TempDir(), "env"))
+	defer restorePaths()
+	runner := &fixedShowRunner{showOut: []byte(activeShow)}
+	restoreRunner := systemd.SetRunnerForTesting(runner)
+	defer restoreRunner()
+
+	ag := &agent{
+		deviceName:   "switch-1",
+		logger:       logr.Discard(),
+		lastObserved: map[string]string{},
+		managed:      map[string]managedItem{},
+		statePath:    filepath.Join(t.TempDir(), "state.json"),
+		oci:          newOCIFetcher(logr.Discard(), t.TempDir()),
+	}
+	fileArtifact := apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"}
+	proc := rollbackItem("sha256:1", fileArtifact, "/opt/app/run")
+	old := rollbackItem("sha256:2", fileArtifact, "/opt/old/run")
+	old.Name = "old"
+	if _, err := ag.reconcile(context.Background(), &gateway.DesiredResponse{Items: []gateway.DesiredItem{proc, old}}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	state, err := os.ReadFile(ag.statePath)
+	if err != nil {
+		t.Fatalf("read state: %v", err)
+	}
+	unitBefore, err := os.ReadFile(systemd.PathsFor("ns", "proc").UnitPath)
+	if err != nil {
+		t.Fatalf("read unit: %v", err)
+	}
+
+	changed := rollbackItem("sha256:3", fileArtifact, "/opt/app/run2")
+	ref := "ghcr.io/app@sha256:" + strings.Repeat("e", 64)
+	fresh := rollbackItem("sha256:4", apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: ref}, "bin/app")
+	fresh.Name = "fresh"
+	var reported gateway.ReportRequest
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			_ = json.NewDecoder(r.Body).Decode(&reported)
+			_ = json.NewEncoder(w).Encode(gateway.ReportResponse{Ack: true})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(gateway.DesiredResponse{DeviceName: "switch-1", Items: []gateway.DesiredItem{changed, fresh}})
+	}))
+	defer gw.Close()
+	ag.gatewayURL, ag.client = gw.URL, gw.Client()
+
+	runner.calls = nil
+	var out bytes.Buffer
+	if code := ag.dryRun(context.Background(), &out, true); code != 0 {
+		t.Fatalf("dry run exited %d", code)
+	}
+	for _, want := range []string{
+		"ns/proc   restart", "ns/fresh  create", "ns/old    remove",
+		"-ExecStart=/opt/app/run\n", "+ExecStart=/opt/app/run2\n",
+		"fetch " + ref, "+ExecStart=" + filepath.Join(ag.oci.(*ociFetcherImpl).root, strings.Repeat("e", 64), "rootfs", "bin/app"),
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %q in plan:\n%s", want, out.String())
+		}
+	}
+
+	for _, call := range runner.calls {
+		if len(call) > 0 && call[0] != "show" {
+			t.Fatalf("expected no systemd changes, got %v", call)
+		}
+	}
+	if after, _ := os.ReadFile(ag.statePath); !bytes.Equal(after, state) {
+		t.Fatalf("expected the agent state to be left alone")
+	}
+	if after, _ := os.ReadFile(systemd.PathsFor("ns", "proc").UnitPath); !bytes.Equal(after, unitBefore) {
+		t.Fatalf("expected the unit file to be left alone")
+	}
+	if _, err := os.Stat(systemd.PathsFor("ns", "fresh").UnitPath); !os.IsNotExist(err) {
+		t.Fatalf("expected no unit file for the new item, got %v", err)
+	}
+
+	if len(reported.Observations) != 2 {
+		t.Fatalf("expected plans for the two desired items, got %+v", reported.Observations)
+	}
+	for _, obs := range reported.Observations {
+		if obs.Plan == nil || obs.ObservedSpecHash != "" || obs.ProcessStarted != nil {
+			t.Fatalf("expected plan-only observations, got %+v", obs)
+		}
+	}
+	if p := reported.Observations[0].Plan; p.Action != planRestart || p.SpecHash != "sha256:3" || strings.Join(p.Changes, ",") != "unit" {
+		t.Fatalf("unexpected reported plan %+v", p)
+	}
+}
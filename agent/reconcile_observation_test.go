@@ -149,7 +149,7 @@ func TestReconcileNonOCIResetsArtifactFields(t *testing.T) {
 	}
 
 	// Switch to non-OCI and ensure fields are cleared/not applicable.
-	desired.Items = []gateway.DesiredItem{dispatchItem(apiv1alpha1.ArtifactTypeLocal, []string{"/usr/bin/app"})}
+	desired.Items = []gateway.DesiredItem{dispatchItem(apiv1alpha1.ArtifactTypeFile, []string{"/usr/bin/app"})}
 	obs, err := a.reconcile(context.Background(), desired)
 	if err != nil {
 		t.Fatalf("second reconcile: %v", err)
@@ -175,7 +175,7 @@ func TestReconcileNonOCIResetsArtifactFields(t *testing.T) {
 	}
 }
 
-func dispatchItem(artifactType apiv1alpha1.DeviceProcessArtifactType, cmd []string) gateway.DesiredItem {
+func dispatchItem(artifactType apiv1alpha1.ArtifactType, cmd []string) gateway.DesiredItem {
 	return gateway.DesiredItem{
 		Namespace: "ns",
 		Name:      "proc",
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/apollo/praetor/gateway"
+)
+
+const (
+	defaultReconcileWorkers            = 4
+	defaultReconcileItemTimeoutSeconds = 900
+)
+
+// itemResult is the outcome of reconciling one desired item.
+type itemResult struct {
+	observation gateway.Observation
+	managed     managedItem
+	digests     []string
+	keep        bool
+}
+
+// reconcileItems reconciles items on up to a.workers goroutines, each item under its own
+// deadline, so a slow artifact pull does not hold up the other units. Results are in item
+// order whatever order the items finish in.
+func (a *agent) reconcileItems(ctx context.Context, items []gateway.DesiredItem, setVerified bool) []itemResult {
+	results := make([]itemResult, len(items))
+	workers := a.workers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(items) {
+		workers = len(items)
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = a.reconcileWithDeadline(ctx, items[i], setVerified)
+			}
+		}()
+	}
+	for i := range items {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+func (a *agent) reconcileWithDeadline(ctx context.Context, item gateway.DesiredItem, setVerified bool) itemResult {
+	itemCtx := ctx
+	if a.itemTimeout > 0 {
+		var cancel context.CancelFunc
+		itemCtx, cancel = context.WithTimeout(ctx, a.itemTimeout)
+		defer cancel()
+	}
+	prev, hadPrev := a.managed[itemKey(item.Namespace, item.Name)]
+	var res itemResult
+	res.observation, res.managed, res.digests, res.keep = a.reconcileOne(itemCtx, item, prev, hadPrev, setVerified)
+	if errors.Is(itemCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		msg := fmt.Sprintf("reconcile timed out after %s; retrying on the next pass", a.itemTimeout)
+		a.logger.Info("item reconcile timed out", "namespace", item.Namespace, "name", item.Name, "timeout", a.itemTimeout.String())
+		res.observation.ErrorMessage = stringPtr(msg)
+		res.observation.Healthy = boolPtr(false)
+	}
+	return res
+}
+
+// heartbeatLoop sends heartbeats on their own schedule, so a long reconcile never makes the
+// device look disconnected. Failed heartbeats are retried with backoff.
+func (a *agent) heartbeatLoop(ctx context.Context) {
+	backoff := 2 * time.Second
+	timer := time.NewTimer(a.heartbeatInterval())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		wait := a.heartbeatInterval()
+		if err := a.sendReport(ctx, nil); err != nil {
+			a.logger.Error(err, "heartbeat report failed")
+			wait = a.retryDelay(err, backoff) + a.jitter(250*time.Millisecond)
+			backoff = nextBackoff(backoff)
+			backoffSeconds.Set(wait.Seconds())
+		} else {
+			backoff = 2 * time.Second
+		}
+		timer.Reset(wait)
+	}
+}
+
+func (a *agent) heartbeatInterval() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.heartbeat <= 0 {
+		return time.Duration(defaultHeartbeatSeconds) * time.Second
+	}
+	return a.heartbeat
+}
+
+// jitter returns a random duration in [0, max); the heartbeat and reconcile loops share a.rnd.
+func (a *agent) jitter(max time.Duration) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return time.Duration(a.rnd.Int63n(int64(max)))
+}
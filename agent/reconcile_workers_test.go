@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apollo/praetor/agent/systemd"
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+)
+
+// lockedRunner is a fixedShowRunner safe for concurrent reconcile workers; started is closed
+// once any unit is started.
+type lockedRunner struct {
+	mu      sync.Mutex
+	inner   fixedShowRunner
+	started chan struct{}
+	once    sync.Once
+}
+
+func (r *lockedRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(args) > 0 && args[0] == "enable" {
+		r.once.Do(func() { close(r.started) })
+	}
+	return r.inner.Run(ctx, name, args...)
+}
+
+// stallingOCI never finishes a pull until its context ends, and records whether another item
+// had started meanwhile.
+type stallingOCI struct {
+	started             <-chan struct{}
+	otherItemStartedYet atomic.Bool
+}
+
+func (f *stallingOCI) Ensure(ctx context.Context, _ string) (ociResult, error) {
+	select {
+	case <-f.started:
+		f.otherItemStartedYet.Store(true)
+	case <-ctx.Done():
+	}
+	<-ctx.Done()
+	return ociResult{lastError: ctx.Err().Error()}, ctx.Err()
+}
+
+func TestSlowPullDoesNotBlockOtherItemsOrHeartbeats(t *testing.T) {
+	restorePaths := systemd.SetBasePathsForTesting(filepath.Join(t.TempDir(), "units"), filepath.Join(t.TempDir(), "env"))
+	defer restorePaths()
+	runner := &lockedRunner{inner: fixedShowRunner{showOut: []byte(activeShow)}, started: make(chan struct{})}
+	restoreRunner := systemd.SetRunnerForTesting(runner)
+	defer restoreRunner()
+
+	var heartbeats atomic.Int32
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/report") {
+			heartbeats.Add(1)
+		}
+		_, _ = w.Write([]byte(`{"ack":true}`))
+	}))
+	defer gw.Close()
+
+	oci := &stallingOCI{started: runner.started}
+	ag := &agent{
+		deviceName:   "switch-1",
+		gatewayURL:   gw.URL,
+		client:       gw.Client(),
+		logger:       logr.Discard(),
+		lastObserved: map[string]string{},
+		managed:      map[string]managedItem{},
+		statePath:    filepath.Join(t.TempDir(), "state.json"),
+		oci:          oci,
+		rnd:          rand.New(rand.NewSource(1)),
+		heartbeat:    20 * time.Millisecond,
+		workers:      2,
+		itemTimeout:  300 * time.Millisecond,
+	}
+	slow := rollbackItem("sha256:1", apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: "ghcr.io/slow@sha256:" + strings.Repeat("a", 64)}, "bin/app")
+	slow.Name = "slow"
+	fast := rollbackItem("sha256:2", apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"}, "/opt/app/run")
+	fast.Name = "fast"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ag.heartbeatLoop(ctx)
+
+	obs, err := ag.reconcile(ctx, &gateway.DesiredResponse{Items: []gateway.DesiredItem{slow, fast}})
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if !oci.otherItemStartedYet.Load() {
+		t.Fatalf("expected the fast item to start while the slow pull was still running")
+	}
+	if len(obs) != 2 || obs[0].Name != "slow" || obs[1].Name != "fast" {
+		t.Fatalf("expected observations in desired order, got %+v", obs)
+	}
+	if obs[0].ErrorMessage == nil || !strings.Contains(*obs[0].ErrorMessage, "timed out after 300ms") {
+		t.Fatalf("expected the slow item to time out, got %+v", obs[0])
+	}
+	if obs[1].Healthy == nil || !*obs[1].Healthy {
+		t.Fatalf("expected the fast item to run, got %+v", obs[1])
+	}
+	if _, ok := ag.managed["ns/fast"]; !ok {
+		t.Fatalf("expected the fast item to be managed")
+	}
+	if got := heartbeats.Load(); got < 3 {
+		t.Fatalf("expected heartbeats to keep flowing during the slow reconcile, got %d", got)
+	}
+}
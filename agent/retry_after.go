@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apollo/praetor/gateway"
+)
+
+const defaultPollIntervalSeconds = 5
+
+// retryAfterError is returned when the gateway sheds load with 429 or 503.
+type retryAfterError struct {
+	status int
+	after  time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	if e.after <= 0 {
+		return fmt.Sprintf("gateway busy (status %d)", e.status)
+	}
+	return fmt.Sprintf("gateway busy (status %d), retry after %s", e.status, e.after)
+}
+
+// checkRetryAfter returns a retryAfterError for load-shedding responses and nil otherwise.
+func checkRetryAfter(resp *http.Response) error {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+	return &retryAfterError{status: resp.StatusCode, after: parseRetryAfter(resp.Header.Get("Retry-After"))}
+}
+
+func isGatewayBusy(err error) bool {
+	var busy *retryAfterError
+	return errors.As(err, &busy)
+}
+
+// parseRetryAfter accepts delay-seconds or an HTTP date; it returns 0 when v is absent or invalid.
+func parseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(nowFunc()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// retryDelay is how long to wait after a failed exchange with the gateway. A Retry-After is
+// spread by up to half again as jitter so the devices shed together do not return together;
+// other failures use the caller's backoff.
+func (a *agent) retryDelay(err error, backoff time.Duration) time.Duration {
+	var busy *retryAfterError
+	if !errors.As(err, &busy) || busy.after <= 0 {
+		return backoff
+	}
+	return busy.after + a.jitter(busy.after/2+1)
+}
+
+// applyIntervals adopts the heartbeat and poll intervals the gateway asked for.
+func (a *agent) applyIntervals(desired *gateway.DesiredResponse) {
+	if desired.HeartbeatIntervalSeconds > 0 {
+		a.mu.Lock()
+		a.heartbeat = time.Duration(desired.HeartbeatIntervalSeconds) * time.Second
+		a.mu.Unlock()
+	}
+	if desired.PollIntervalSeconds > 0 {
+		a.pollInterval = time.Duration(desired.PollIntervalSeconds) * time.Second
+	}
+}
+
+func (a *agent) desiredPollInterval() time.Duration {
+	if a.pollInterval <= 0 {
+		d, _ := configuredPollInterval()
+		return d
+	}
+	return a.pollInterval
+}
+
+// configuredPollInterval is the poll interval used until the gateway sends one, from
+// APOLLO_POLL_INTERVAL_SECONDS. An invalid setting falls back to the default.
+func configuredPollInterval() (time.Duration, error) {
+	def := time.Duration(defaultPollIntervalSeconds) * time.Second
+	v := strings.TrimSpace(getenv("APOLLO_POLL_INTERVAL_SECONDS", ""))
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return def, fmt.Errorf("invalid APOLLO_POLL_INTERVAL_SECONDS %q", v)
+	}
+	return time.Duration(n) * time.Second, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+)
+
+func TestFetchDesiredHonoursRetryAfterWithJitter(t *testing.T) {
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer gw.Close()
+	ag := &agent{deviceName: "switch-1", gatewayURL: gw.URL, client: gw.Client(), logger: logr.Discard(), rnd: rand.New(rand.NewSource(1))}
+
+	_, err := ag.fetchDesired(context.Background(), "", 0)
+	if !isGatewayBusy(err) {
+		t.Fatalf("expected a busy error, got %v", err)
+	}
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		d := ag.retryDelay(err, time.Second)
+		if d < 10*time.Second || d > 15*time.Second {
+			t.Fatalf("retry delay %s outside [10s, 15s]", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("expected jittered retry delays, got %v", seen)
+	}
+	if d := ag.retryDelay(context.DeadlineExceeded, 4*time.Second); d != 4*time.Second {
+		t.Fatalf("expected other errors to use the backoff, got %s", d)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	origNow := nowFunc
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = origNow }()
+
+	cases := map[string]time.Duration{
+		"":                              0,
+		"30":                            30 * time.Second,
+		"-1":                            0,
+		"soon":                          0,
+		"Sun, 01 Jun 2025 12:01:00 GMT": time.Minute,
+		"Sun, 01 Jun 2025 11:00:00 GMT": 0,
+	}
+	for in, want := range cases {
+		if got := parseRetryAfter(in); got != want {
+			t.Fatalf("parseRetryAfter(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestApplyIntervalsAdoptsServerPollInterval(t *testing.T) {
+	ag := &agent{}
+	if got := ag.desiredPollInterval(); got != defaultPollIntervalSeconds*time.Second {
+		t.Fatalf("expected default poll interval, got %s", got)
+	}
+	ag.applyIntervals(&gateway.DesiredResponse{HeartbeatIntervalSeconds: 20, PollIntervalSeconds: 45})
+	if ag.desiredPollInterval() != 45*time.Second || ag.heartbeat != 20*time.Second {
+		t.Fatalf("intervals not applied: poll=%s heartbeat=%s", ag.desiredPollInterval(), ag.heartbeat)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/apollo/praetor/gateway"
+)
+
+const defaultRollbackGraceSeconds = 120
+
+// lastGoodSpec is a desired item that ran through a full grace period on this device. Its
+// artifact digest is kept by artifact GC so the rootfs is still on disk when a rollback needs it.
+type lastGoodSpec struct {
+	Item           gateway.DesiredItem `json:"item"`
+	ArtifactDigest string              `json:"artifactDigest,omitempty"`
+}
+
+// canRollBack reports whether mi holds a known-good spec other than item to revert to.
+func (a *agent) canRollBack(mi managedItem, item gateway.DesiredItem) bool {
+	return a.rollbackGrace > 0 && mi.LastGood != nil && mi.LastGood.Item.SpecHash != item.SpecHash
+}
+
+// activationPending reports whether item's spec is inside its grace period with a known-good spec
+// to revert to, so a unit found stopped counts as a failed activation.
+func (a *agent) activationPending(mi managedItem, item gateway.DesiredItem) bool {
+	if !a.canRollBack(mi, item) || mi.PendingSpecHash != item.SpecHash {
+		return false
+	}
+	_, err := time.Parse(time.RFC3339, mi.PendingSince)
+	return err == nil
+}
+
+// stoppedWithinGrace is the failure for a unit that stopped running during its grace period.
+func (a *agent) stoppedWithinGrace() string {
+	return fmt.Sprintf("unit stopped running within %s of activation", a.rollbackGrace)
+}
+
+// runLastGood reconciles mi's last known-good spec in place of item, whose spec failed with reason.
+// The observation reports the known-good spec hash so the control plane does not count the failed
+// spec as rolled out.
+func (a *agent) runLastGood(ctx context.Context, item gateway.DesiredItem, mi managedItem, hadPrev bool, reason string) (gateway.Observation, managedItem, []string) {
+	lastGood := mi.LastGood.Item
+	observation, current, digests, failure := a.reconcileItem(ctx, lastGood, mi, hadPrev)
+	if failure != "" {
+		a.logger.Info("last known-good spec failed too", "namespace", item.Namespace, "name", item.Name, "specHash", lastGood.SpecHash, "reason", failure)
+	}
+	current.RolledBackSpecHash = item.SpecHash
+	current.RolledBackReason = reason
+	observation.RolledBack = boolPtr(true)
+	observation.RollbackMessage = fmt.Sprintf("spec %s failed: %s; reverted to %s", item.SpecHash, reason, lastGood.SpecHash)
+	return observation, current, digests
+}
+
+// trackActivation advances the grace-period bookkeeping after item's unit was observed. A spec
+// becomes last known-good once it has kept running, and passing its health check if it has one,
+// for the whole grace period; if it stops running or fails its health check before that, a
+// non-empty failure is returned. The pass that activates a spec only starts its grace period,
+// giving systemd a chance to bring it up.
+func (a *agent) trackActivation(mi managedItem, item gateway.DesiredItem, started bool) (managedItem, string) {
+	if a.rollbackGrace <= 0 {
+		return mi, ""
+	}
+	if mi.LastGood != nil && mi.LastGood.Item.SpecHash == item.SpecHash {
+		mi.PendingSpecHash, mi.PendingSince = "", ""
+		return mi, ""
+	}
+
+	now := nowFunc()
+	since, err := time.Parse(time.RFC3339, mi.PendingSince)
+	if mi.PendingSpecHash != item.SpecHash || err != nil {
+		mi.PendingSpecHash = item.SpecHash
+		mi.PendingSince = now.UTC().Format(time.RFC3339)
+		return mi, ""
+	}
+	if !started {
+		return mi, a.stoppedWithinGrace()
+	}
+	if failure := mi.Probe.failure(item); failure != "" {
+		return mi, fmt.Sprintf("%s within %s of activation", failure, a.rollbackGrace)
+	}
+	if now.Sub(since) >= a.rollbackGrace && mi.Probe.passing(item) {
+		mi.LastGood = &lastGoodSpec{Item: item, ArtifactDigest: mi.ArtifactDigest}
+		mi.PendingSpecHash, mi.PendingSince = "", ""
+	}
+	return mi, ""
+}
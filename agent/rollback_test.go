@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apollo/praetor/agent/systemd"
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+)
+
+const (
+	activeShow   = "MainPID=42\nExecMainStartTimestamp=n/a\nActiveState=active\nSubState=running\n"
+	inactiveShow = "MainPID=0\nExecMainStartTimestamp=n/a\nActiveState=failed\nSubState=failed\n"
+)
+
+func rollbackItem(hash string, artifact apiv1alpha1.DeviceProcessArtifact, command string) gateway.DesiredItem {
+	return gateway.DesiredItem{
+		Namespace: "ns",
+		Name:      "proc",
+		SpecHash:  hash,
+		Spec: apiv1alpha1.DeviceProcessSpec{
+			Artifact:  artifact,
+			Execution: apiv1alpha1.DeviceProcessExecution{Backend: apiv1alpha1.DeviceProcessBackendSystemd, Command: []string{command}},
+		},
+	}
+}
+
+func TestReconcileRollsBackFailedUpgrade(t *testing.T) {
+	unitDir := filepath.Join(t.TempDir(), "units")
+	restorePaths := systemd.SetBasePathsForTesting(unitDir, filepath.Join(t.TempDir(), "env"))
+	defer restorePaths()
+	runner := &fixedShowRunner{showOut: []byte(activeShow)}
+	restoreRunner := systemd.SetRunnerForTesting(runner)
+	defer restoreRunner()
+
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	origNow := nowFunc
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = origNow }()
+
+	broken := "ghcr.io/app@sha256:" + strings.Repeat("d", 64)
+	fetcher := &refOCI{results: map[string]ociResult{}}
+	ag := &agent{
+		logger:        logr.Discard(),
+		managed:       map[string]managedItem{},
+		statePath:     filepath.Join(t.TempDir(), "state.json"),
+		oci:           fetcher,
+		rollbackGrace: time.Minute,
+	}
+	reconcileOne := func(item gateway.DesiredItem) gateway.Observation {
+		t.Helper()
+		obs, err := ag.reconcile(context.Background(), &gateway.DesiredResponse{Items: []gateway.DesiredItem{item}})
+		if err != nil || len(obs) != 1 {
+			t.Fatalf("reconcile: obs=%d err=%v", len(obs), err)
+		}
+		return obs[0]
+	}
+	unitPath := systemd.PathsFor("ns", "proc").UnitPath
+	assertRunning := func(command string) {
+		t.Helper()
+		unit, err := os.ReadFile(unitPath)
+		if err != nil {
+			t.Fatalf("read unit: %v", err)
+		}
+		if !strings.Contains(string(unit), "ExecStart="+command+"\n") {
+			t.Fatalf("expected unit to run %s, got:\n%s", command, unit)
+		}
+	}
+
+	fileArtifact := apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"}
+	v1 := rollbackItem("v1", fileArtifact, "/opt/app/v1")
+	reconcileOne(v1)
+	now = now.Add(2 * time.Minute)
+	reconcileOne(v1)
+	if lg := ag.managed[itemKey("ns", "proc")].LastGood; lg == nil || lg.Item.SpecHash != "v1" {
+		t.Fatalf("expected v1 to become last known-good after the grace period, got %+v", lg)
+	}
+
+	// A spec whose artifact cannot be fetched yet leaves v1 running and is retried, not rolled back.
+	v2 := rollbackItem("v2", apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: broken}, "bin/app")
+	runner.calls = nil
+	o := reconcileOne(v2)
+	if o.RolledBack != nil || o.ErrorMessage == nil {
+		t.Fatalf("expected a fetch error without rollback, got rolledBack=%v err=%v", derefBool(o.RolledBack), o.ErrorMessage)
+	}
+	for _, call := range runner.calls {
+		if call[0] == "stop" || call[0] == "disable" {
+			t.Fatalf("expected the running unit to be left alone, got %v", runner.calls)
+		}
+	}
+	assertRunning("/opt/app/v1")
+	if mi := ag.managed[itemKey("ns", "proc")]; mi.RolledBackSpecHash != "" {
+		t.Fatalf("expected no rollback to be recorded for a fetch error, got %q", mi.RolledBackSpecHash)
+	}
+	reconcileOne(v2)
+	if len(fetcher.refs) != 2 {
+		t.Fatalf("expected the fetch to be retried, got %d pulls", len(fetcher.refs))
+	}
+
+	// A fetched artifact whose command cannot be activated reverts to v1.
+	fetcher.results[broken] = ociResult{digest: "sha256:" + strings.Repeat("d", 64), rootfsPath: t.TempDir(), downloaded: true, verified: true}
+	v2 = rollbackItem("v2b", apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: broken}, "../escape")
+	o = reconcileOne(v2)
+	if !derefBool(o.RolledBack) || o.ObservedSpecHash != "v1" || o.ErrorMessage != nil {
+		t.Fatalf("expected rollback to v1, got rolledBack=%v observed=%q err=%v", derefBool(o.RolledBack), o.ObservedSpecHash, o.ErrorMessage)
+	}
+	if !strings.Contains(o.RollbackMessage, "spec v2b failed") {
+		t.Fatalf("unexpected rollback message %q", o.RollbackMessage)
+	}
+	assertRunning("/opt/app/v1")
+
+	// The failed spec is not retried until the desired spec changes.
+	o = reconcileOne(v2)
+	if !derefBool(o.RolledBack) || len(fetcher.refs) != 3 {
+		t.Fatalf("expected to stay rolled back without refetching, got rolledBack=%v pulls=%d", derefBool(o.RolledBack), len(fetcher.refs))
+	}
+
+	// A spec that starts but stops running within the grace period is rolled back too.
+	v3 := rollbackItem("v3", fileArtifact, "/opt/app/v3")
+	o = reconcileOne(v3)
+	if o.RolledBack != nil {
+		t.Fatalf("activation pass must not roll back")
+	}
+	assertRunning("/opt/app/v3")
+	runner.showOut = []byte(inactiveShow)
+	now = now.Add(10 * time.Second)
+	o = reconcileOne(v3)
+	if !derefBool(o.RolledBack) || o.ObservedSpecHash != "v1" {
+		t.Fatalf("expected rollback to v1, got rolledBack=%v observed=%q", derefBool(o.RolledBack), o.ObservedSpecHash)
+	}
+	assertRunning("/opt/app/v1")
+	if mi := ag.managed[itemKey("ns", "proc")]; mi.RolledBackSpecHash != "v3" {
+		t.Fatalf("expected v3 recorded as rolled back, got %q", mi.RolledBackSpecHash)
+	}
+}
+
+// crashRunner reports the unit failed once crashed is set, until something starts it again.
+type crashRunner struct {
+	fixedShowRunner
+	crashed bool
+}
+
+func (r *crashRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "show":
+			if r.crashed {
+				r.calls = append(r.calls, append([]string{}, args...))
+				return []byte(inactiveShow), nil
+			}
+		case "enable", "start", "restart":
+			r.crashed = false
+		}
+	}
+	return r.fixedShowRunner.Run(ctx, name, args...)
+}
+
+// rollbackAgent returns an agent with a one-minute grace period that reconciles against runner,
+// and a function running one reconcile pass over a single item.
+func rollbackAgent(t *testing.T, runner systemd.Runner) (*agent, func(gateway.DesiredItem) gateway.Observation) {
+	t.Helper()
+	restorePaths := systemd.SetBasePathsForTesting(filepath.Join(t.TempDir(), "units"), filepath.Join(t.TempDir(), "env"))
+	t.Cleanup(restorePaths)
+	t.Cleanup(systemd.SetRunnerForTesting(runner))
+	ag := &agent{
+		logger:        logr.Discard(),
+		managed:       map[string]managedItem{},
+		statePath:     filepath.Join(t.TempDir(), "state.json"),
+		oci:           &refOCI{results: map[string]ociResult{}},
+		rollbackGrace: time.Minute,
+	}
+	return ag, func(item gateway.DesiredItem) gateway.Observation {
+		t.Helper()
+		obs, err := ag.reconcile(context.Background(), &gateway.DesiredResponse{Items: []gateway.DesiredItem{item}})
+		if err != nil || len(obs) != 1 {
+			t.Fatalf("reconcile: obs=%d err=%v", len(obs), err)
+		}
+		return obs[0]
+	}
+}
+
+func TestReconcileRollsBackCrashBeforeDriftRestart(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	origNow := nowFunc
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = origNow }()
+
+	runner := &crashRunner{fixedShowRunner: fixedShowRunner{showOut: []byte(activeShow)}}
+	ag, reconcileOne := rollbackAgent(t, runner)
+	fileArtifact := apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"}
+	v1 := rollbackItem("v1", fileArtifact, "/opt/app/v1")
+	reconcileOne(v1)
+	now = now.Add(2 * time.Minute)
+	reconcileOne(v1)
+
+	v2 := rollbackItem("v2", fileArtifact, "/opt/app/v2")
+	reconcileOne(v2)
+
+	// The new binary crashes; a drift restart would find it active again.
+	key := itemKey("ns", "proc")
+	mi := ag.managed[key]
+	mi.LastActionAt = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	ag.managed[key] = mi
+	runner.crashed = true
+	runner.calls = nil
+	now = now.Add(10 * time.Second)
+	o := reconcileOne(v2)
+	if !derefBool(o.RolledBack) || o.ObservedSpecHash != "v1" {
+		t.Fatalf("expected the crash to roll back to v1, got rolledBack=%v observed=%q", derefBool(o.RolledBack), o.ObservedSpecHash)
+	}
+	if mi := ag.managed[key]; mi.RolledBackSpecHash != "v2" {
+		t.Fatalf("expected v2 recorded as rolled back, got %q", mi.RolledBackSpecHash)
+	}
+	// The rollback stops the crashed unit before starting v1; nothing may start it before that.
+	for _, call := range runner.calls {
+		if call[0] == "disable" {
+			break
+		}
+		if call[0] == "enable" || call[0] == "restart" {
+			t.Fatalf("expected no drift start of the crashed spec, got %v", runner.calls)
+		}
+	}
+}
+
+func TestReconcileRollsBackFailingHealthCheck(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	origNow := nowFunc
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = origNow }()
+	var probes [][]string
+	probeErr := errors.New("exit status 1")
+	origProbe := probeFunc
+	probeFunc = func(_ context.Context, command []string, _ time.Duration) error {
+		probes = append(probes, command)
+		return probeErr
+	}
+	defer func() { probeFunc = origProbe }()
+
+	ag, reconcileOne := rollbackAgent(t, &fixedShowRunner{showOut: []byte(activeShow)})
+	fileArtifact := apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"}
+	healthCheck := &apiv1alpha1.DeviceProcessHealthCheck{
+		Exec:             apiv1alpha1.DeviceProcessExecAction{Command: []string{"/opt/app/check"}},
+		PeriodSeconds:    10,
+		FailureThreshold: 2,
+	}
+
+	// A passing health check reports the process healthy and lets the spec become known-good.
+	probeErr = nil
+	v1 := rollbackItem("v1", fileArtifact, "/opt/app/v1")
+	v1.Spec.HealthCheck = healthCheck
+	if o := reconcileOne(v1); !derefBool(o.Healthy) {
+		t.Fatalf("expected a passing probe to report healthy")
+	}
+	now = now.Add(2 * time.Minute)
+	reconcileOne(v1)
+	if lg := ag.managed[itemKey("ns", "proc")].LastGood; lg == nil || lg.Item.SpecHash != "v1" {
+		t.Fatalf("expected v1 to become last known-good, got %+v", lg)
+	}
+
+	// A running process whose probe keeps failing is rolled back once FailureThreshold is reached.
+	probeErr = errors.New("exit status 1")
+	v2 := rollbackItem("v2", fileArtifact, "/opt/app/v2")
+	v2.Spec.HealthCheck = healthCheck
+	o := reconcileOne(v2)
+	if o.RolledBack != nil || derefBool(o.Healthy) || !derefBool(o.ProcessStarted) {
+		t.Fatalf("expected a started, unhealthy process without rollback, got rolledBack=%v healthy=%v", derefBool(o.RolledBack), derefBool(o.Healthy))
+	}
+	probes = nil
+	now = now.Add(5 * time.Second)
+	if o = reconcileOne(v2); o.RolledBack != nil || len(probes) != 0 {
+		t.Fatalf("expected no probe before the period elapsed, got rolledBack=%v probes=%d", derefBool(o.RolledBack), len(probes))
+	}
+	now = now.Add(5 * time.Second)
+	o = reconcileOne(v2)
+	if !derefBool(o.RolledBack) || o.ObservedSpecHash != "v1" {
+		t.Fatalf("expected rollback to v1, got rolledBack=%v observed=%q", derefBool(o.RolledBack), o.ObservedSpecHash)
+	}
+	if !strings.Contains(o.RollbackMessage, "health check failed 2 times") {
+		t.Fatalf("unexpected rollback message %q", o.RollbackMessage)
+	}
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+)
+
+const (
+	defaultSelfUpdateDeadlineSeconds = 300
+	selfUpdateProbeTimeout           = 30 * time.Second
+	// selfUpdateMaxBoots bounds how often a swapped-in binary may start without reporting. One
+	// that crashes on startup is restarted by systemd and would otherwise loop until the deadline.
+	selfUpdateMaxBoots   = 3
+	previousBinarySuffix = ".previous"
+	// selfUpdateRecordSuffix names the upgrade record next to the binary, where it can be read
+	// before any configuration is loaded.
+	selfUpdateRecordSuffix = ".upgrade.json"
+)
+
+// execFunc replaces the running process image; tests swap it out.
+var execFunc = syscall.Exec
+
+// selfUpdate is the last agent binary swap. It is pending until the new binary reports to the
+// gateway; a swap that was reverted stays recorded so its spec is not retried until it changes.
+// A confirmed swap stays recorded too, so the installed digest is known without hashing the
+// binary.
+type selfUpdate struct {
+	SpecHash string `json:"specHash,omitempty"`
+	Digest   string `json:"digest"`
+	// PreviousDigest is the artifact the replaced binary came from, when the agent knew it.
+	PreviousDigest string `json:"previousDigest,omitempty"`
+	Deadline       string `json:"deadline,omitempty"`
+	Boots          int    `json:"boots,omitempty"`
+	RolledBack     bool   `json:"rolledBack,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+	Confirmed      bool   `json:"confirmed,omitempty"`
+	// Stamp is the size and modification time of the binary the record describes; a binary
+	// replaced by anything but the agent no longer matches it.
+	Stamp string `json:"stamp,omitempty"`
+}
+
+func (u *selfUpdate) pending() bool {
+	return u != nil && !u.RolledBack && !u.Confirmed
+}
+
+// selfUpdater replaces the agent's own binary with the one delivered by an agent backend item.
+// The previous binary is kept next to the running one and restored if the new binary does not
+// report within the deadline.
+type selfUpdater struct {
+	path      string
+	stateFile string
+	deadline  time.Duration
+	startedAt time.Time
+	logger    logr.Logger
+
+	mu      sync.Mutex
+	last    *selfUpdate
+	restart bool
+}
+
+// startSelfUpdater runs first thing in main, before flags or configuration are parsed, so a new
+// binary that exits during startup is still counted and rolled back. It returns nil when the
+// agent binary cannot be located.
+func startSelfUpdater(logger logr.Logger) *selfUpdater {
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		logger.Error(err, "locate agent binary; self-update disabled")
+		return nil
+	}
+	s, err := newSelfUpdater(logger, exe, exe+selfUpdateRecordSuffix, time.Duration(defaultSelfUpdateDeadlineSeconds)*time.Second)
+	if err != nil {
+		logger.Error(err, "load agent upgrade record; self-update disabled")
+		return nil
+	}
+	s.resume()
+	return s
+}
+
+// serviceInvocation reports whether args start the agent service, as opposed to a one-shot
+// --version or --dry-run run that must not count as a boot of an upgraded binary.
+func serviceInvocation(args []string) bool {
+	for _, arg := range args {
+		switch strings.TrimLeft(strings.SplitN(arg, "=", 2)[0], "-") {
+		case "version", "dry-run":
+			return false
+		}
+	}
+	return true
+}
+
+// newSelfUpdater manages the binary at path, recording swaps in stateFile.
+func newSelfUpdater(logger logr.Logger, path, stateFile string, deadline time.Duration) (*selfUpdater, error) {
+	s := &selfUpdater{path: path, stateFile: stateFile, deadline: deadline, startedAt: nowFunc(), logger: logger}
+	data, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var last selfUpdate
+	if err := json.Unmarshal(data, &last); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", stateFile, err)
+	}
+	s.last = &last
+	return s, nil
+}
+
+// resume counts a boot of a binary started from a pending swap. One that missed its deadline,
+// or keeps restarting, is rolled back to the previous binary.
+func (s *selfUpdater) resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.last.pending() {
+		return
+	}
+	s.last.Boots++
+	deadline, err := time.Parse(time.RFC3339, s.last.Deadline)
+	switch {
+	case err != nil || !nowFunc().Before(deadline):
+		s.rollbackLocked(fmt.Sprintf("new agent binary did not report by %s", s.last.Deadline))
+		return
+	case s.last.Boots > selfUpdateMaxBoots:
+		s.rollbackLocked(fmt.Sprintf("new agent binary restarted %d times without reporting", s.last.Boots-1))
+		return
+	}
+	if err := s.persistLocked(); err != nil {
+		s.logger.Error(err, "persist agent upgrade", "path", s.stateFile)
+	}
+	s.logger.Info("awaiting first report from new agent binary", "specHash", s.last.SpecHash, "deadline", s.last.Deadline)
+}
+
+// watchPending rolls back a pending swap that is still unconfirmed at its deadline.
+func (s *selfUpdater) watchPending(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.last.pending() || s.last.Boots == 0 {
+		return
+	}
+	deadline, err := time.Parse(time.RFC3339, s.last.Deadline)
+	if err != nil {
+		return
+	}
+	go s.watch(ctx, s.last, deadline.Sub(nowFunc()))
+}
+
+// watch rolls back pending if it is still unconfirmed after wait.
+func (s *selfUpdater) watch(ctx context.Context, pending *selfUpdate, wait time.Duration) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == pending && pending.pending() {
+		s.rollbackLocked(fmt.Sprintf("new agent binary did not report by %s", pending.Deadline))
+	}
+}
+
+// confirm records that the running binary reached the gateway, completing a pending swap.
+func (s *selfUpdater) confirm() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.last.pending() || s.last.Boots == 0 {
+		return
+	}
+	s.logger.Info("agent upgrade confirmed", "specHash", s.last.SpecHash, "digest", s.last.Digest)
+	s.last.Confirmed = true
+	if err := s.persistLocked(); err != nil {
+		s.logger.Error(err, "persist agent upgrade", "path", s.stateFile)
+	}
+}
+
+// rollbackLocked restores the previous binary and re-executes it. The swap is kept as rolled
+// back so the same spec is not installed again.
+func (s *selfUpdater) rollbackLocked(reason string) {
+	s.logger.Info("rolling back agent upgrade", "specHash", s.last.SpecHash, "digest", s.last.Digest, "reason", reason)
+	if err := copyExecutable(s.path+previousBinarySuffix, s.path); err != nil {
+		s.logger.Error(err, "restore previous agent binary", "path", s.path)
+		return
+	}
+	s.last.RolledBack = true
+	s.last.Reason = reason
+	s.last.Stamp = binaryStamp(s.path)
+	if err := s.persistLocked(); err != nil {
+		s.logger.Error(err, "persist agent upgrade", "path", s.stateFile)
+	}
+	if err := execFunc(s.path, os.Args, os.Environ()); err != nil {
+		s.logger.Error(err, "re-exec previous agent binary", "path", s.path)
+	}
+}
+
+// restartIfSwapped re-executes the agent after reconcile swapped its binary. systemd keeps
+// tracking the same PID across the exec.
+func (s *selfUpdater) restartIfSwapped() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.restart {
+		return
+	}
+	s.restart = false
+	s.logger.Info("restarting into new agent binary", "path", s.path, "specHash", s.last.SpecHash)
+	if err := execFunc(s.path, os.Args, os.Environ()); err != nil {
+		// Still the previous binary: nothing but the file on disk needs reverting.
+		s.logger.Error(err, "re-exec new agent binary", "path", s.path)
+		if err := copyExecutable(s.path+previousBinarySuffix, s.path); err != nil {
+			s.logger.Error(err, "restore previous agent binary", "path", s.path)
+		}
+		s.last.RolledBack = true
+		s.last.Reason = fmt.Sprintf("re-exec failed: %v", err)
+		s.last.Stamp = binaryStamp(s.path)
+		if err := s.persistLocked(); err != nil {
+			s.logger.Error(err, "persist agent upgrade", "path", s.stateFile)
+		}
+	}
+}
+
+// swap probes candidate and atomically installs it over the running binary, keeping the
+// current binary for rollback. The process is re-executed by restartIfSwapped.
+func (s *selfUpdater) swap(ctx context.Context, candidate string, item gateway.DesiredItem, digest string) error {
+	s.mu.Lock()
+	pending := ""
+	if s.last.pending() {
+		pending = s.last.SpecHash
+	}
+	previous := s.installedLocked()
+	s.mu.Unlock()
+	if pending != "" {
+		// The running binary is unconfirmed; it must not become the rollback target.
+		return fmt.Errorf("waiting for agent upgrade %s to report", pending)
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, selfUpdateProbeTimeout)
+	defer cancel()
+	if out, err := exec.CommandContext(probeCtx, candidate, "--version").CombinedOutput(); err != nil {
+		return fmt.Errorf("probe new agent binary: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if err := copyExecutable(s.path, s.path+previousBinarySuffix); err != nil {
+		return fmt.Errorf("keep previous agent binary: %w", err)
+	}
+	if err := copyExecutable(candidate, s.path); err != nil {
+		return fmt.Errorf("install new agent binary: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = &selfUpdate{
+		SpecHash:       item.SpecHash,
+		Digest:         digest,
+		PreviousDigest: previous,
+		Deadline:       nowFunc().Add(s.deadline).UTC().Format(time.RFC3339),
+		Stamp:          binaryStamp(s.path),
+	}
+	s.restart = true
+	if err := s.persistLocked(); err != nil {
+		// Without the record a broken binary could not be rolled back.
+		_ = copyExecutable(s.path+previousBinarySuffix, s.path)
+		s.last, s.restart = nil, false
+		return fmt.Errorf("persist agent upgrade: %w", err)
+	}
+	return nil
+}
+
+func (s *selfUpdater) persistLocked() error {
+	data, err := json.MarshalIndent(s.last, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.stateFile, data, 0o600)
+}
+
+// rolledBack returns why item's spec was reverted on this device, if it was.
+func (s *selfUpdater) rolledBack(item gateway.DesiredItem) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil || !s.last.RolledBack {
+		return "", false
+	}
+	if s.last.SpecHash != item.SpecHash {
+		// The spec changed since: the new one deserves its own attempt. The restored binary is
+		// still described when its artifact is known.
+		if s.last.PreviousDigest == "" {
+			s.last = nil
+			_ = os.Remove(s.stateFile)
+			return "", false
+		}
+		s.last = &selfUpdate{Digest: s.last.PreviousDigest, Confirmed: true, Stamp: s.last.Stamp}
+		if err := s.persistLocked(); err != nil {
+			s.logger.Error(err, "persist agent upgrade", "path", s.stateFile)
+		}
+		return "", false
+	}
+	return s.last.Reason, true
+}
+
+// installedLocked returns the artifact digest the binary at path was installed from, or "" when
+// the agent did not install it or it was replaced since.
+func (s *selfUpdater) installedLocked() string {
+	if s.last == nil || s.last.Stamp == "" || s.last.Stamp != binaryStamp(s.path) {
+		return ""
+	}
+	if s.last.RolledBack {
+		return s.last.PreviousDigest
+	}
+	return s.last.Digest
+}
+
+// runs reports whether the binary at path came from artifact digest. The upgrade record answers
+// without reading the binary; only a binary the agent did not install is compared byte for byte
+// with candidate, and a match is recorded so later passes skip the comparison.
+func (s *selfUpdater) runs(digest, candidate string) (bool, error) {
+	s.mu.Lock()
+	installed := s.installedLocked()
+	s.mu.Unlock()
+	if installed != "" {
+		return strings.EqualFold(installed, digest), nil
+	}
+	same, err := sameContent(s.path, candidate)
+	if err != nil || !same {
+		return same, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil || s.last.Confirmed {
+		s.last = &selfUpdate{Digest: digest, Confirmed: true, Stamp: binaryStamp(s.path)}
+		if err := s.persistLocked(); err != nil {
+			s.logger.Error(err, "persist agent upgrade", "path", s.stateFile)
+		}
+	}
+	return true, nil
+}
+
+// reconcileSelfUpdate converges the agent's own binary on item's artifact. Command names the
+// binary inside the artifact; agent items have no unit of their own.
+func (a *agent) reconcileSelfUpdate(ctx context.Context, item gateway.DesiredItem, prev managedItem) (gateway.Observation, managedItem, []string) {
+	observation := gateway.Observation{
+		Namespace:        item.Namespace,
+		Name:             item.Name,
+		ObservedSpecHash: item.SpecHash,
+	}
+	current := carryManaged(prev, "")
+	var digests []string
+	fail := func(msg string) (gateway.Observation, managedItem, []string) {
+		a.logger.Info("agent upgrade not applied", "namespace", item.Namespace, "name", item.Name, "specHash", item.SpecHash, "reason", msg)
+		observation.ProcessStarted = boolPtr(false)
+		observation.Healthy = boolPtr(false)
+		observation.ErrorMessage = stringPtr(msg)
+		return observation, current, digests
+	}
+
+	if a.self == nil {
+		return fail("agent self-update is disabled on this device")
+	}
+	pinned := artifactDigestFromRef(item.Spec.Artifact.URL)
+	if item.Spec.Artifact.Type != apiv1alpha1.ArtifactTypeOCI || pinned == "" {
+		return fail("agent upgrades need an oci artifact pinned by digest")
+	}
+	digests = append(digests, pinned)
+
+	result, err := a.oci.Ensure(withDownloadProgress(ctx, a.progressReporter(ctx, item)), item.Spec.Artifact.URL)
+	observeArtifact(result, err)
+	observation.ArtifactDigest = result.digest
+	observation.ArtifactBytesDownloaded = result.bytesDownloaded
+	observation.ArtifactBytesTotal = result.bytesTotal
+	observation.ArtifactDownloadAttempts = result.attempts
+	observation.LastArtifactAttemptTime = result.lastAttemptTime
+	observation.ArtifactLastError = result.lastError
+	observation.ArtifactDownloaded = boolPtr(result.downloaded)
+	observation.ArtifactVerified = boolPtr(result.verified)
+	observation.ArtifactDownloadReason = defaultString(result.downloadReason, "ArtifactDownloaded")
+	observation.ArtifactDownloadMessage = defaultString(result.downloadMessage, "artifact downloaded")
+	observation.ArtifactVerifyReason = defaultString(result.verifyReason, "ArtifactVerified")
+	observation.ArtifactVerifyMessage = defaultString(result.verifyMessage, "artifact verified")
+	if err != nil {
+		return fail(defaultString(result.lastError, err.Error()))
+	}
+	if !result.verified || !strings.EqualFold(result.digest, pinned) {
+		return fail(fmt.Sprintf("artifact digest %s does not match pinned %s", result.digest, pinned))
+	}
+	cmd, err := resolveCommand(item.Spec.Execution.Command, result.rootfsPath)
+	if err != nil {
+		return fail(err.Error())
+	}
+	current.ArtifactDigest = pinned
+	if d := a.prefetchArtifact(ctx, item, &observation); d != "" {
+		digests = append(digests, d)
+	}
+
+	if reason, ok := a.self.rolledBack(item); ok {
+		observation, current, digests = fail(reason)
+		observation.RolledBack = boolPtr(true)
+		observation.RollbackMessage = fmt.Sprintf("agent upgrade %s failed: %s; kept the previous agent binary", item.SpecHash, reason)
+		return observation, current, digests
+	}
+	running, err := a.self.runs(pinned, cmd[0])
+	if err != nil {
+		return fail(err.Error())
+	}
+	if running {
+		observation.ProcessStarted = boolPtr(true)
+		observation.Healthy = boolPtr(true)
+		observation.PID = int64(os.Getpid())
+		observation.StartTime = a.self.startedAt.UTC().Format(time.RFC3339)
+		return observation, current, digests
+	}
+	if err := a.self.swap(ctx, cmd[0], item, pinned); err != nil {
+		return fail(err.Error())
+	}
+	observation.ProcessStarted = boolPtr(false)
+	observation.Healthy = boolPtr(false)
+	observation.WarningMessage = stringPtr("restarting into agent " + pinned)
+	return observation, current, digests
+}
+
+// sameContent reports whether the files at a and b hold the same bytes.
+func sameContent(a, b string) (bool, error) {
+	sumA, err := fileSHA256(a)
+	if err != nil {
+		return false, err
+	}
+	sumB, err := fileSHA256(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(sumA, sumB), nil
+}
+
+// binaryStamp identifies the current contents of path cheaply, or is "" when it cannot be read.
+func binaryStamp(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+}
+
+func fileSHA256(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// copyExecutable replaces dst with an executable copy of src. The copy is written next to dst
+// and renamed over it, so dst is never seen half-written, even while it is running.
+func copyExecutable(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-agent-binary-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o755); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
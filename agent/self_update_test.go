@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+)
+
+func writeScript(t *testing.T, path, body string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func readString(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestSelfUpdateSwapsAndRollsBackWithoutReport(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	origNow, origExec := nowFunc, execFunc
+	nowFunc = func() time.Time { return now }
+	var execs []string
+	execFunc = func(path string, _ []string, _ []string) error {
+		execs = append(execs, path)
+		return nil
+	}
+	defer func() { nowFunc, execFunc = origNow, origExec }()
+
+	dir := t.TempDir()
+	self := filepath.Join(dir, "apollo-deviceprocess-agent")
+	writeScript(t, self, "echo v1")
+	v1 := readString(t, self)
+	rootfs := filepath.Join(dir, "rootfs")
+	writeScript(t, filepath.Join(rootfs, "bin", "agent"), "echo v2")
+	v2 := readString(t, filepath.Join(rootfs, "bin", "agent"))
+	writeScript(t, filepath.Join(rootfs, "bin", "broken"), "exit 1")
+
+	ref := "ghcr.io/apollo/agent@sha256:" + strings.Repeat("b", 64)
+	fetcher := &refOCI{results: map[string]ociResult{
+		ref: {rootfsPath: rootfs, digest: "sha256:" + strings.Repeat("b", 64), downloaded: true, verified: true},
+	}}
+	upgrade := func(hash, command string) gateway.DesiredItem {
+		return gateway.DesiredItem{Namespace: "ns", Name: "agent", SpecHash: hash, Spec: apiv1alpha1.DeviceProcessSpec{
+			Artifact:  apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: ref},
+			Execution: apiv1alpha1.DeviceProcessExecution{Backend: apiv1alpha1.DeviceProcessBackendAgent, Command: []string{command}},
+		}}
+	}
+	recordPath := self + selfUpdateRecordSuffix
+	start := func() *agent {
+		t.Helper()
+		s, err := newSelfUpdater(logr.Discard(), self, recordPath, time.Minute)
+		if err != nil {
+			t.Fatalf("newSelfUpdater: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		s.resume()
+		s.watchPending(ctx)
+		return &agent{
+			deviceName:   "switch-1",
+			logger:       logr.Discard(),
+			lastObserved: map[string]string{},
+			managed:      map[string]managedItem{},
+			statePath:    filepath.Join(dir, "state.json"),
+			oci:          fetcher,
+			self:         s,
+		}
+	}
+	reconcile := func(ag *agent, item gateway.DesiredItem) gateway.Observation {
+		t.Helper()
+		obs, err := ag.reconcile(context.Background(), &gateway.DesiredResponse{DeviceName: "switch-1", Items: []gateway.DesiredItem{item}})
+		if err != nil || len(obs) != 1 {
+			t.Fatalf("reconcile: %v %+v", err, obs)
+		}
+		return obs[0]
+	}
+
+	// A binary that fails its probe is never installed.
+	ag := start()
+	if obs := reconcile(ag, upgrade("broken", "bin/broken")); obs.ErrorMessage == nil || !strings.Contains(*obs.ErrorMessage, "probe") {
+		t.Fatalf("expected the probe to refuse the binary, got %+v", obs)
+	}
+	if readString(t, self) != v1 || len(execs) != 0 {
+		t.Fatalf("expected a failed probe to leave the agent alone, execs=%v", execs)
+	}
+
+	obs := reconcile(ag, upgrade("v2", "bin/agent"))
+	if obs.WarningMessage == nil || readString(t, self) != v2 || readString(t, self+previousBinarySuffix) != v1 {
+		t.Fatalf("expected the new binary swapped in with the old one kept, got %+v", obs)
+	}
+	if len(execs) != 1 || execs[0] != self {
+		t.Fatalf("expected the agent to re-exec itself, got %v", execs)
+	}
+
+	// The new binary starts but never reaches the gateway before the deadline.
+	now = now.Add(2 * time.Minute)
+	start()
+	if readString(t, self) != v1 || len(execs) != 2 {
+		t.Fatalf("expected the previous binary restored and re-executed, execs=%v", execs)
+	}
+	obs = reconcile(start(), upgrade("v2", "bin/agent"))
+	if obs.RolledBack == nil || !*obs.RolledBack || obs.Healthy == nil || *obs.Healthy {
+		t.Fatalf("expected the failed upgrade to be reported as rolled back, got %+v", obs)
+	}
+	if readString(t, self) != v1 || len(execs) != 2 {
+		t.Fatalf("expected the rolled back spec not to be retried, execs=%v", execs)
+	}
+
+	// A new spec gets its own attempt; this time the new binary reports in time.
+	ag = start()
+	reconcile(ag, upgrade("v2-retry", "bin/agent"))
+	if readString(t, self) != v2 || len(execs) != 3 {
+		t.Fatalf("expected a changed spec to be installed, execs=%v", execs)
+	}
+	ag = start()
+	if obs := reconcile(ag, upgrade("v2-retry", "bin/agent")); obs.Healthy == nil || !*obs.Healthy || obs.PID == 0 {
+		t.Fatalf("expected the new binary to report itself running, got %+v", obs)
+	}
+	ag.self.confirm()
+	now = now.Add(time.Hour)
+	ag = start()
+	if readString(t, self) != v2 || len(execs) != 3 {
+		t.Fatalf("expected a confirmed upgrade to stay, execs=%v", execs)
+	}
+
+	// The confirmed record names the installed artifact, so the binary is not read again.
+	writeScript(t, filepath.Join(rootfs, "bin", "agent"), "echo v2 rebuilt")
+	if obs := reconcile(ag, upgrade("v2-retry", "bin/agent")); obs.Healthy == nil || !*obs.Healthy || len(execs) != 3 {
+		t.Fatalf("expected the recorded install to be trusted, got %+v execs=%v", obs, execs)
+	}
+	// A binary replaced behind the agent's back no longer matches the record.
+	writeScript(t, self, "echo packaged")
+	if running, err := ag.self.runs("sha256:"+strings.Repeat("b", 64), filepath.Join(rootfs, "bin", "agent")); err != nil || running {
+		t.Fatalf("expected a replaced binary to be compared again, got running=%v err=%v", running, err)
+	}
+}
+
+func TestSelfUpdateRollsBackBinaryThatExitsDuringStartup(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	origNow, origExec := nowFunc, execFunc
+	nowFunc = func() time.Time { return now }
+	var execs int
+	execFunc = func(string, []string, []string) error {
+		execs++
+		return nil
+	}
+	defer func() { nowFunc, execFunc = origNow, origExec }()
+
+	dir := t.TempDir()
+	self := filepath.Join(dir, "apollo-deviceprocess-agent")
+	writeScript(t, self, "echo v2")
+	writeScript(t, self+previousBinarySuffix, "echo v1")
+	record := `{"specHash":"v2","digest":"sha256:b","deadline":"2025-03-01T12:05:00Z"}`
+	if err := os.WriteFile(self+selfUpdateRecordSuffix, []byte(record), 0o600); err != nil {
+		t.Fatalf("write record: %v", err)
+	}
+
+	// Each boot is counted before configuration is read, so exiting right after still counts.
+	for boot := 1; boot <= selfUpdateMaxBoots; boot++ {
+		s, err := newSelfUpdater(logr.Discard(), self, self+selfUpdateRecordSuffix, time.Minute)
+		if err != nil {
+			t.Fatalf("newSelfUpdater: %v", err)
+		}
+		s.resume()
+	}
+	if readString(t, self) != "#!/bin/sh\necho v2\n" || execs != 0 {
+		t.Fatalf("expected the new binary to get %d boots", selfUpdateMaxBoots)
+	}
+	s, _ := newSelfUpdater(logr.Discard(), self, self+selfUpdateRecordSuffix, time.Minute)
+	s.resume()
+	if readString(t, self) != "#!/bin/sh\necho v1\n" || execs != 1 {
+		t.Fatalf("expected a binary that keeps exiting to be rolled back, execs=%d", execs)
+	}
+
+	for args, want := range map[string]bool{"": true, "--device-name=a": true, "--version": false, "-dry-run": false} {
+		if got := serviceInvocation(strings.Fields(args)); got != want {
+			t.Fatalf("serviceInvocation(%q) = %v, want %v", args, got, want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/apollo/praetor/gateway"
+	"github.com/apollo/praetor/pkg/specsign"
+)
+
+// verifySpec checks that the control plane signed item's spec for this device, at a generation no
+// older than the one already applied. A lower generation is only accepted from a verified set,
+// where it means the DeviceProcess was recreated. It accepts everything when no key is pinned.
+func (a *agent) verifySpec(item gateway.DesiredItem, prev managedItem, hadPrev, setVerified bool) error {
+	if len(a.specKeys) == 0 {
+		return nil
+	}
+	if item.Spec.DeviceRef.Name != a.deviceName {
+		return fmt.Errorf("spec is for device %q", item.Spec.DeviceRef.Name)
+	}
+	if err := specsign.Verify(a.specKeys, item.Namespace, item.Name, item.Generation, &item.Spec, item.Signature); err != nil {
+		return err
+	}
+	if hadPrev && item.Generation < prev.Generation && !setVerified {
+		return fmt.Errorf("generation %d is older than generation %d already applied", item.Generation, prev.Generation)
+	}
+	return nil
+}
+
+// verifySet checks that the control plane signed the set of items desired lists for this device,
+// at a revision no older than one already applied. Units missing from desired are only removed
+// when it passes, so a gateway cannot make the agent drop processes by leaving them out. It
+// accepts everything when no key is pinned.
+func (a *agent) verifySet(desired *gateway.DesiredResponse) error {
+	if len(a.specKeys) == 0 {
+		return nil
+	}
+	if desired.Set == nil {
+		return fmt.Errorf("desired set is not signed")
+	}
+	if desired.Set.Revision < a.setRevision {
+		return fmt.Errorf("set revision %d is older than revision %d already applied", desired.Set.Revision, a.setRevision)
+	}
+	entries := make([]specsign.SetEntry, 0, len(desired.Items))
+	for _, item := range desired.Items {
+		entries = append(entries, specsign.SetEntry{Namespace: item.Namespace, Name: item.Name, Signature: item.Signature})
+	}
+	if err := specsign.VerifySet(a.specKeys, a.deviceName, desired.Set.Revision, entries, desired.Set.Signature); err != nil {
+		return fmt.Errorf("desired set: %w", err)
+	}
+	return nil
+}
+
+// refuseSpec reports a desired spec that failed verification. Whatever already runs for the
+// item is left alone: a forged spec must neither start nor replace anything.
+func (a *agent) refuseSpec(item gateway.DesiredItem, err error) gateway.Observation {
+	msg := fmt.Sprintf("refused spec %s: %v", item.SpecHash, err)
+	a.logger.Info("refusing desired spec", "namespace", item.Namespace, "name", item.Name, "specHash", item.SpecHash, "reason", err.Error())
+	return gateway.Observation{
+		Namespace:         item.Namespace,
+		Name:              item.Name,
+		ErrorMessage:      stringPtr(msg),
+		SpecVerified:      boolPtr(false),
+		SpecVerifyMessage: msg,
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apollo/praetor/agent/systemd"
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+	"github.com/apollo/praetor/pkg/specsign"
+	"github.com/go-logr/logr"
+)
+
+func TestReconcileRefusesUnsignedAndForgedSpecs(t *testing.T) {
+	unitDir := filepath.Join(t.TempDir(), "units")
+	restorePaths := systemd.SetBasePathsForTesting(unitDir, filepath.Join(t.TempDir(), "env"))
+	defer restorePaths()
+	runner := &fixedShowRunner{showOut: []byte(activeShow)}
+	restoreRunner := systemd.SetRunnerForTesting(runner)
+	defer restoreRunner()
+
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	ag := &agent{
+		deviceName:   "switch-1",
+		logger:       logr.Discard(),
+		lastObserved: map[string]string{},
+		managed:      map[string]managedItem{},
+		statePath:    filepath.Join(t.TempDir(), "state.json"),
+		oci:          &refOCI{results: map[string]ociResult{}},
+		specKeys:     []ed25519.PublicKey{pub},
+	}
+	signed := func(hash, command string, signer ed25519.PrivateKey) gateway.DesiredItem {
+		item := rollbackItem(hash, apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"}, command)
+		item.Spec.DeviceRef.Name = "switch-1"
+		if signer != nil {
+			item.Signature, _ = specsign.Sign(signer, item.Namespace, item.Name, item.Generation, &item.Spec)
+		}
+		return item
+	}
+	reconcile := func(item gateway.DesiredItem) gateway.Observation {
+		t.Helper()
+		obs, err := ag.reconcile(context.Background(), &gateway.DesiredResponse{DeviceName: "switch-1", Items: []gateway.DesiredItem{item}})
+		if err != nil || len(obs) != 1 {
+			t.Fatalf("reconcile: %v %+v", err, obs)
+		}
+		return obs[0]
+	}
+
+	if obs := reconcile(signed("v1", "/opt/app/v1", key)); obs.SpecVerified == nil || !*obs.SpecVerified {
+		t.Fatalf("expected the signed spec to be verified, got %+v", obs)
+	}
+	unitPath := systemd.PathsFor("ns", "proc").UnitPath
+	running, err := os.ReadFile(unitPath)
+	if err != nil {
+		t.Fatalf("expected the signed spec to be installed: %v", err)
+	}
+
+	forged := signed("v2", "/bin/evil", otherKey)
+	tampered := signed("v2", "/opt/app/v1", key)
+	tampered.Spec.Execution.Command = []string{"/bin/evil"}
+	for name, item := range map[string]gateway.DesiredItem{"unsigned": signed("v2", "/bin/evil", nil), "forged": forged, "tampered": tampered} {
+		runner.calls = nil
+		obs := reconcile(item)
+		if obs.SpecVerified == nil || *obs.SpecVerified || obs.SpecVerifyMessage == "" || obs.ErrorMessage == nil {
+			t.Fatalf("%s: expected the spec to be refused with a reason, got %+v", name, obs)
+		}
+		if len(runner.calls) != 0 {
+			t.Fatalf("%s: expected no systemd actions for a refused spec, got %v", name, runner.calls)
+		}
+		if now, _ := os.ReadFile(unitPath); string(now) != string(running) {
+			t.Fatalf("%s: expected the running unit to be left in place", name)
+		}
+		if _, ok := ag.managed["ns/proc"]; !ok {
+			t.Fatalf("%s: expected the running item to stay managed", name)
+		}
+	}
+
+	elsewhere := signed("v3", "/opt/app/v1", key)
+	elsewhere.Spec.DeviceRef.Name = "switch-2"
+	elsewhere.Signature, _ = specsign.Sign(key, elsewhere.Namespace, elsewhere.Name, elsewhere.Generation, &elsewhere.Spec)
+	if obs := reconcile(elsewhere); obs.SpecVerified == nil || *obs.SpecVerified {
+		t.Fatalf("expected a spec signed for another device to be refused, got %+v", obs)
+	}
+}
+
+func TestReconcileRemovesUnitsOnlyForVerifiedSets(t *testing.T) {
+	unitDir := filepath.Join(t.TempDir(), "units")
+	restorePaths := systemd.SetBasePathsForTesting(unitDir, filepath.Join(t.TempDir(), "env"))
+	defer restorePaths()
+	runner := &fixedShowRunner{showOut: []byte(activeShow)}
+	restoreRunner := systemd.SetRunnerForTesting(runner)
+	defer restoreRunner()
+
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	ag := &agent{
+		deviceName:   "switch-1",
+		logger:       logr.Discard(),
+		lastObserved: map[string]string{},
+		managed:      map[string]managedItem{},
+		statePath:    filepath.Join(t.TempDir(), "state.json"),
+		oci:          &refOCI{results: map[string]ociResult{}},
+		specKeys:     []ed25519.PublicKey{pub},
+	}
+	signed := func(generation int64, command string) gateway.DesiredItem {
+		item := rollbackItem(fmt.Sprintf("v%d", generation), apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"}, command)
+		item.Spec.DeviceRef.Name = "switch-1"
+		item.Generation = generation
+		item.Signature, _ = specsign.Sign(key, item.Namespace, item.Name, generation, &item.Spec)
+		return item
+	}
+	withSet := func(revision int64, items ...gateway.DesiredItem) *gateway.DesiredResponse {
+		var entries []specsign.SetEntry
+		for _, item := range items {
+			entries = append(entries, specsign.SetEntry{Namespace: item.Namespace, Name: item.Name, Signature: item.Signature})
+		}
+		set := &gateway.DesiredSet{Revision: revision, Signature: specsign.SignSet(key, "switch-1", revision, entries)}
+		return &gateway.DesiredResponse{DeviceName: "switch-1", Items: items, Set: set}
+	}
+
+	v2 := signed(2, "/opt/app/v2")
+	if _, err := ag.reconcile(context.Background(), withSet(10, v2)); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	unitPath := systemd.PathsFor("ns", "proc").UnitPath
+	if _, err := os.Stat(unitPath); err != nil {
+		t.Fatalf("expected the unit to be installed: %v", err)
+	}
+
+	trimmed := withSet(10, v2)
+	trimmed.Items = nil
+	for name, desired := range map[string]*gateway.DesiredResponse{
+		"unsigned": {DeviceName: "switch-1"},
+		"trimmed":  trimmed,
+		"replayed": withSet(9),
+	} {
+		if _, err := ag.reconcile(context.Background(), desired); err != nil {
+			t.Fatalf("%s: reconcile: %v", name, err)
+		}
+		if _, err := os.Stat(unitPath); err != nil {
+			t.Fatalf("%s: expected the unit to be left in place: %v", name, err)
+		}
+		if _, ok := ag.managed["ns/proc"]; !ok {
+			t.Fatalf("%s: expected the item to stay managed", name)
+		}
+	}
+
+	obs, _ := ag.reconcile(context.Background(), &gateway.DesiredResponse{DeviceName: "switch-1", Items: []gateway.DesiredItem{signed(1, "/opt/app/v1")}})
+	if obs[0].SpecVerified == nil || *obs[0].SpecVerified {
+		t.Fatalf("expected an older generation to be refused, got %+v", obs[0])
+	}
+	if obs, _ := ag.reconcile(context.Background(), withSet(11, signed(1, "/opt/app/v1"))); obs[0].SpecVerified == nil || !*obs[0].SpecVerified {
+		t.Fatalf("expected a recreated process in a verified set to be applied, got %+v", obs[0])
+	}
+
+	if _, err := ag.reconcile(context.Background(), withSet(12)); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if _, err := os.Stat(unitPath); !os.IsNotExist(err) {
+		t.Fatalf("expected a verified empty set to remove the unit, got %v", err)
+	}
+	if len(ag.managed) != 0 || ag.setRevision != 12 {
+		t.Fatalf("expected nothing managed at revision 12, got %v at %d", ag.managed, ag.setRevision)
+	}
+}
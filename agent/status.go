@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apollo/praetor/gateway"
+	"github.com/apollo/praetor/pkg/version"
+	"github.com/go-logr/logr"
+)
+
+const (
+	defaultStatusSocket = "/run/apollo/agent.sock"
+	statusSocketOff     = "off"
+	statusPath          = "/v1/status"
+)
+
+// agentStatus is what the local status API serves.
+type agentStatus struct {
+	Device       string           `json:"device"`
+	Version      string           `json:"version"`
+	Gateway      string           `json:"gateway"`
+	LastContact  string           `json:"lastContact,omitempty"`
+	LastError    string           `json:"lastError,omitempty"`
+	LastErrorAt  string           `json:"lastErrorAt,omitempty"`
+	DesiredETag  string           `json:"desiredETag,omitempty"`
+	DesiredStale bool             `json:"desiredStale,omitempty"`
+	ReconciledAt string           `json:"reconciledAt,omitempty"`
+	Items        []itemStatus     `json:"items"`
+	Artifacts    []cachedArtifact `json:"artifacts"`
+	// ArtifactsError is set when the artifact cache could not be listed.
+	ArtifactsError string      `json:"artifactsError,omitempty"`
+	Upgrade        *selfUpdate `json:"upgrade,omitempty"`
+}
+
+// itemStatus is one desired item together with what the agent last observed for it.
+type itemStatus struct {
+	Namespace   string               `json:"namespace"`
+	Name        string               `json:"name"`
+	SpecHash    string               `json:"specHash"`
+	Backend     string               `json:"backend"`
+	Artifact    string               `json:"artifact"`
+	Unit        string               `json:"unit,omitempty"`
+	Observation *gateway.Observation `json:"observation,omitempty"`
+	// Resources is the unit's latest cgroup sample, which observations carry only now and then.
+	Resources *gateway.ResourceObservation `json:"resources,omitempty"`
+}
+
+// cachedArtifact is one entry of the on-disk OCI artifact cache.
+type cachedArtifact struct {
+	Digest string   `json:"digest"`
+	Bytes  int64    `json:"bytes"`
+	UsedBy []string `json:"usedBy,omitempty"`
+}
+
+// artifactLister is implemented by fetchers that can enumerate their on-disk cache.
+type artifactLister interface {
+	List() ([]cachedArtifact, error)
+}
+
+// List returns the cached artifacts, largest first.
+func (f *ociFetcherImpl) List() ([]cachedArtifact, error) {
+	entries, err := os.ReadDir(f.root)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var out []cachedArtifact
+	for _, entry := range entries {
+		if !entry.IsDir() || !artifactDirPattern.MatchString(entry.Name()) {
+			continue
+		}
+		out = append(out, cachedArtifact{Digest: "sha256:" + entry.Name(), Bytes: dirSize(filepath.Join(f.root, entry.Name()))})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Bytes > out[j].Bytes })
+	return out, nil
+}
+
+// statusBoard keeps the agent's latest view of the world for the status API. The agent loop
+// records into it; the API reads copies under the lock.
+type statusBoard struct {
+	device  string
+	gateway string
+
+	mu           sync.Mutex
+	lastContact  time.Time
+	lastError    string
+	lastErrorAt  time.Time
+	etag         string
+	stale        bool
+	reconciledAt time.Time
+	items        []itemStatus
+	usedBy       map[string][]string
+}
+
+func newStatusBoard(device, gatewayURL string) *statusBoard {
+	return &statusBoard{device: device, gateway: gatewayURL}
+}
+
+// track wraps rt so every gateway round trip updates the last contact and last error.
+func (b *statusBoard) track(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := rt.RoundTrip(req)
+		now := nowFunc()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		switch {
+		case err != nil:
+			b.lastError, b.lastErrorAt = fmt.Sprintf("%s %s: %v", req.Method, req.URL.Path, err), now
+		case resp.StatusCode >= http.StatusBadRequest:
+			b.lastContact = now
+			b.lastError, b.lastErrorAt = fmt.Sprintf("%s %s: %s", req.Method, req.URL.Path, resp.Status), now
+		default:
+			b.lastContact = now
+		}
+		return resp, err
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// recordReconcile stores the outcome of a reconcile pass over desired.
+func (b *statusBoard) recordReconcile(a *agent, desired *gateway.DesiredResponse, observations []gateway.Observation) {
+	if b == nil {
+		return
+	}
+	byKey := make(map[string]gateway.Observation, len(observations))
+	for _, obs := range observations {
+		byKey[itemKey(obs.Namespace, obs.Name)] = obs
+	}
+	items := make([]itemStatus, 0, len(desired.Items))
+	for _, item := range desired.Items {
+		key := itemKey(item.Namespace, item.Name)
+		st := itemStatus{
+			Namespace: item.Namespace,
+			Name:      item.Name,
+			SpecHash:  item.SpecHash,
+			Backend:   string(item.Spec.Execution.Backend),
+			Artifact:  item.Spec.Artifact.URL,
+			Unit:      a.managed[key].UnitName,
+			Resources: a.resources.latest(a.managed[key].UnitName),
+		}
+		if obs, ok := byKey[key]; ok {
+			st.Observation = &obs
+		}
+		items = append(items, st)
+	}
+	usedBy := make(map[string][]string)
+	for key, mi := range a.managed {
+		if mi.ArtifactDigest != "" {
+			usedBy[mi.ArtifactDigest] = append(usedBy[mi.ArtifactDigest], key)
+		}
+		for _, d := range mi.PreviousArtifactDigests {
+			usedBy[d] = append(usedBy[d], key+" (previous)")
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.items = items
+	b.usedBy = usedBy
+	b.etag = a.lastETag
+	b.stale = a.desiredStale
+	b.reconciledAt = nowFunc()
+}
+
+// noteStale records that cached desired state stopped being authoritative.
+func (b *statusBoard) noteStale() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stale = true
+}
+
+// snapshot assembles the status served by the API.
+func (b *statusBoard) snapshot(artifacts artifactLister, upgrades *selfUpdater) agentStatus {
+	b.mu.Lock()
+	st := agentStatus{
+		Device:       b.device,
+		Version:      version.Version,
+		Gateway:      b.gateway,
+		LastContact:  formatTime(b.lastContact),
+		LastError:    b.lastError,
+		LastErrorAt:  formatTime(b.lastErrorAt),
+		DesiredETag:  b.etag,
+		DesiredStale: b.stale,
+		ReconciledAt: formatTime(b.reconciledAt),
+		Items:        append([]itemStatus(nil), b.items...),
+	}
+	usedBy := b.usedBy
+	b.mu.Unlock()
+
+	if artifacts != nil {
+		cached, err := artifacts.List()
+		if err != nil {
+			st.ArtifactsError = err.Error()
+		}
+		for i := range cached {
+			cached[i].UsedBy = append([]string(nil), usedBy[cached[i].Digest]...)
+			sort.Strings(cached[i].UsedBy)
+		}
+		st.Artifacts = cached
+	}
+	if upgrades != nil {
+		upgrades.mu.Lock()
+		if upgrades.last != nil {
+			last := *upgrades.last
+			st.Upgrade = &last
+		}
+		upgrades.mu.Unlock()
+	}
+	return st
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// serveStatus serves the read-only status API on a unix socket at path until ctx ends.
+func (a *agent) serveStatus(ctx context.Context, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// A socket left by a previous run would fail the listen.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		ln.Close()
+		return err
+	}
+	srv := &http.Server{Handler: a.statusHandler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (a *agent) statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(statusPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "status API is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		lister, _ := a.oci.(artifactLister)
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(a.board.snapshot(lister, a.self))
+	})
+	return mux
+}
+
+// startStatusServer runs the status API in the background; failures only cost the API.
+func (a *agent) startStatusServer(ctx context.Context, logger logr.Logger, path string) {
+	if path == statusSocketOff {
+		return
+	}
+	go func() {
+		if err := a.serveStatus(ctx, path); err != nil {
+			logger.Error(err, "status API stopped", "socket", path)
+		}
+	}()
+}
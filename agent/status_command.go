@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/apollo/praetor/gateway"
+)
+
+// runStatusCommand implements `status`: it queries the local status API of the running agent
+// and prints it. It returns the process exit code.
+func runStatusCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	// The socket may be configured in the agent's configuration file.
+	if _, err := installConfig(getenv("APOLLO_AGENT_CONFIG", "")); err != nil {
+		fmt.Fprintf(stderr, "ignoring agent configuration: %v\n", err)
+	}
+	socket := fs.String("socket", getenv("APOLLO_STATUS_SOCKET", defaultStatusSocket), "Status API socket (env: APOLLO_STATUS_SOCKET)")
+	asJSON := fs.Bool("json", false, "Print the raw status JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	st, raw, err := fetchStatus(*socket)
+	if err != nil {
+		fmt.Fprintf(stderr, "query agent status on %s: %v\n", *socket, err)
+		return 1
+	}
+	if *asJSON {
+		_, _ = stdout.Write(raw)
+		return 0
+	}
+	printStatus(stdout, st, nowFunc())
+	return 0
+}
+
+func fetchStatus(socket string) (agentStatus, []byte, error) {
+	var st agentStatus
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}},
+	}
+	resp, err := client.Get("http://agent" + statusPath)
+	if err != nil {
+		return st, nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return st, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return st, nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if err := json.Unmarshal(raw, &st); err != nil {
+		return st, nil, err
+	}
+	return st, raw, nil
+}
+
+func printStatus(w io.Writer, st agentStatus, now time.Time) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Device:\t%s (agent %s)\n", st.Device, st.Version)
+	fmt.Fprintf(tw, "Gateway:\t%s\n", st.Gateway)
+	fmt.Fprintf(tw, "Last contact:\t%s\n", ago(st.LastContact, now))
+	if st.LastError != "" {
+		fmt.Fprintf(tw, "Last error:\t%s (%s)\n", st.LastError, ago(st.LastErrorAt, now))
+	}
+	desired := fmt.Sprintf("%d item(s), reconciled %s", len(st.Items), ago(st.ReconciledAt, now))
+	if st.DesiredStale {
+		desired += ", STALE"
+	}
+	fmt.Fprintf(tw, "Desired:\t%s\n", desired)
+	if u := st.Upgrade; u != nil && u.Confirmed {
+		fmt.Fprintf(tw, "Agent binary:\tinstalled from %s\n", u.Digest)
+	} else if u != nil {
+		state := "awaiting first report until " + u.Deadline
+		if u.RolledBack {
+			state = "rolled back: " + u.Reason
+		}
+		fmt.Fprintf(tw, "Agent upgrade:\t%s %s\n", u.SpecHash, state)
+	}
+	_ = tw.Flush()
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ITEM\tBACKEND\tSTATE\tPID\tMEMORY\tSPEC\tMESSAGE")
+	for _, item := range st.Items {
+		state, pid, mem, msg := "unknown", "-", "-", ""
+		if obs := item.Observation; obs != nil {
+			state, msg = observationState(obs)
+			if obs.PID > 0 {
+				pid = fmt.Sprint(obs.PID)
+			}
+		}
+		if r := item.Resources; r != nil {
+			mem = humanBytes(r.MemoryCurrentBytes)
+			if r.OOMKills > 0 {
+				mem += fmt.Sprintf(" (%d OOM kills)", r.OOMKills)
+			}
+		}
+		fmt.Fprintf(tw, "%s/%s\t%s\t%s\t%s\t%s\t%s\t%s\n", item.Namespace, item.Name, item.Backend, state, pid, mem, shortDigest(item.SpecHash), msg)
+	}
+	_ = tw.Flush()
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ARTIFACT\tSIZE\tUSED BY")
+	for _, art := range st.Artifacts {
+		used := strings.Join(art.UsedBy, ", ")
+		if used == "" {
+			used = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", shortDigest(art.Digest), humanBytes(art.Bytes), used)
+	}
+	_ = tw.Flush()
+	if st.ArtifactsError != "" {
+		fmt.Fprintf(w, "artifact cache: %s\n", st.ArtifactsError)
+	}
+}
+
+// observationState summarises obs as a state word and the most relevant message.
+func observationState(obs *gateway.Observation) (string, string) {
+	msg := ""
+	switch {
+	case obs.ErrorMessage != nil:
+		msg = *obs.ErrorMessage
+	case obs.RollbackMessage != "":
+		msg = obs.RollbackMessage
+	case obs.WarningMessage != nil:
+		msg = *obs.WarningMessage
+	}
+	switch {
+	case obs.RolledBack != nil && *obs.RolledBack:
+		return "rolled-back", msg
+	case obs.SpecVerified != nil && !*obs.SpecVerified:
+		return "refused", msg
+	case obs.DownloadInProgress:
+		return "downloading", msg
+	case obs.Healthy != nil && *obs.Healthy:
+		return "running", msg
+	case obs.ProcessStarted != nil && *obs.ProcessStarted:
+		return "unhealthy", msg
+	case obs.ErrorMessage != nil:
+		return "failed", msg
+	}
+	return "stopped", msg
+}
+
+func ago(ts string, now time.Time) string {
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return "never"
+	}
+	return fmt.Sprintf("%s (%s ago)", ts, now.Sub(t).Round(time.Second))
+}
+
+func shortDigest(d string) string {
+	if i := strings.IndexByte(d, ':'); i >= 0 && len(d) > i+13 {
+		return d[:i+13]
+	}
+	return d
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apollo/praetor/agent/systemd"
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+)
+
+func TestStatusAPIServesReconcileStateAndCLIPrintsIt(t *testing.T) {
+	restorePaths := systemd.SetBasePathsForTesting(filepath.Join(t.TempDir(), "units"), filepath.Join(t.TempDir(), "env"))
+	defer restorePaths()
+	restoreRunner := systemd.SetRunnerForTesting(&fixedShowRunner{showOut: []byte(activeShow)})
+	defer restoreRunner()
+
+	cacheRoot := t.TempDir()
+	digestHex := strings.Repeat("a", 64)
+	if err := os.MkdirAll(filepath.Join(cacheRoot, digestHex, "rootfs"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(cacheRoot, digestHex, "rootfs", "app"), make([]byte, 2048), 0o755); err != nil {
+		t.Fatalf("write artifact: %v", err)
+	}
+
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer gw.Close()
+
+	board := newStatusBoard("switch-1", gw.URL)
+	ag := &agent{
+		deviceName:   "switch-1",
+		gatewayURL:   gw.URL,
+		client:       &http.Client{Transport: board.track(nil)},
+		logger:       logr.Discard(),
+		lastObserved: map[string]string{},
+		managed:      map[string]managedItem{"ns/proc": {UnitName: "apollo-ns-proc.service", ArtifactDigest: "sha256:" + digestHex}},
+		statePath:    filepath.Join(t.TempDir(), "state.json"),
+		oci:          newOCIFetcher(logr.Discard(), cacheRoot),
+		board:        board,
+	}
+	item := rollbackItem("sha256:feed", apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"}, "/opt/app/run")
+	if _, err := ag.reconcile(context.Background(), &gateway.DesiredResponse{DeviceName: "switch-1", Items: []gateway.DesiredItem{item}}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if err := ag.sendReport(context.Background(), nil); err == nil {
+		t.Fatalf("expected the busy gateway to fail the report")
+	}
+
+	// Unix socket paths are limited to ~108 bytes, which t.TempDir can exceed.
+	sockDir, err := os.MkdirTemp("", "apollo-status")
+	if err != nil {
+		t.Fatalf("mkdtemp: %v", err)
+	}
+	defer os.RemoveAll(sockDir)
+	socket := filepath.Join(sockDir, "agent.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ag.startStatusServer(ctx, logr.Discard(), socket)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status socket never appeared")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	st, _, err := fetchStatus(socket)
+	if err != nil {
+		t.Fatalf("fetch status: %v", err)
+	}
+	if len(st.Items) != 1 || st.Items[0].Observation == nil || st.Items[0].Observation.PID != 42 {
+		t.Fatalf("expected the item with its last observation, got %+v", st.Items)
+	}
+	if st.LastContact == "" || !strings.Contains(st.LastError, "503") {
+		t.Fatalf("expected the last gateway contact and error, got %q / %q", st.LastContact, st.LastError)
+	}
+	if len(st.Artifacts) != 1 || st.Artifacts[0].Bytes != 2048 || len(st.Artifacts[0].UsedBy) != 1 || st.Artifacts[0].UsedBy[0] != "ns/proc" {
+		t.Fatalf("expected the cached artifact with its user, got %+v", st.Artifacts)
+	}
+
+	rec := httptest.NewRecorder()
+	ag.statusHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, statusPath, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected the status API to be read-only, got %d", rec.Code)
+	}
+
+	var out, errOut bytes.Buffer
+	if code := runStatusCommand([]string{"--socket", socket}, &out, &errOut); code != 0 {
+		t.Fatalf("status command exited %d: %s", code, errOut.String())
+	}
+	for _, want := range []string{"switch-1", "ns/proc", "running", "42", "sha256:aaaaaaaaaaaa", "2.0 KiB", "503"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %q in status output:\n%s", want, out.String())
+		}
+	}
+}
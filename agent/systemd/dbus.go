@@ -0,0 +1,318 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	sdbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	// managedUnitPrefix is the name prefix of every unit PathsFor derives.
+	managedUnitPrefix = "apollo-"
+
+	// ownJobSettle is how long after one of our own jobs finishes the state changes it caused
+	// may still be arriving; Watch drops them so a start or stop is not mistaken for drift.
+	ownJobSettle = 2 * time.Second
+)
+
+var (
+	busMu      sync.RWMutex
+	defaultBus Bus
+
+	// ownJobs maps a unit to when the changes of our last job on it have settled; zero while
+	// the job runs.
+	ownJobsMu sync.Mutex
+	ownJobs   = map[string]time.Time{}
+)
+
+// Bus is the part of systemd's D-Bus API the agent uses. While one is installed, unit
+// operations and Show go through it instead of running systemctl. Pluggable for tests.
+type Bus interface {
+	// EnableUnitFiles and DisableUnitFiles change the install symlinks of units and, like
+	// systemctl, reload the manager when any changed.
+	EnableUnitFiles(ctx context.Context, units []string) error
+	DisableUnitFiles(ctx context.Context, units []string) error
+	// StartUnit, RestartUnit and StopUnit queue a job; its result ("done" on success) is sent
+	// on ch when it finishes.
+	StartUnit(ctx context.Context, unit string, ch chan<- string) error
+	RestartUnit(ctx context.Context, unit string, ch chan<- string) error
+	StopUnit(ctx context.Context, unit string, ch chan<- string) error
+	Reload(ctx context.Context) error
+	// UnitProperties returns the properties of unit on one of its interfaces, "Unit" or
+	// "Service".
+	UnitProperties(ctx context.Context, unit, iface string) (map[string]interface{}, error)
+	// SubscribeProperties delivers the PropertiesChanged signals of all units on ch, dropping
+	// them while ch is full.
+	SubscribeProperties(ch chan<- PropertiesChange) error
+	Close()
+}
+
+// PropertiesChange is one PropertiesChanged signal of a unit.
+type PropertiesChange struct {
+	Unit    string
+	Changed map[string]interface{}
+}
+
+// UnitEvent is a state change of a unit the agent manages.
+type UnitEvent struct {
+	Unit        string
+	ActiveState string
+	SubState    string
+}
+
+// ConnectBus connects to systemd over D-Bus and routes unit operations through the connection.
+// It returns a func that closes the connection and goes back to systemctl.
+func ConnectBus(ctx context.Context) (func(), error) {
+	conn, err := sdbus.NewWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect to systemd over D-Bus: %w", err)
+	}
+	b := &dbusBus{conn: conn}
+	setBus(b)
+	return func() {
+		dropBus(b)
+		b.Close()
+	}, nil
+}
+
+// SetBusForTesting installs b and returns a restore func.
+func SetBusForTesting(b Bus) func() {
+	busMu.Lock()
+	prev := defaultBus
+	defaultBus = b
+	busMu.Unlock()
+	return func() { setBus(prev) }
+}
+
+// Watch delivers state changes of the units the agent manages until ctx ends. Changes caused
+// by the agent's own jobs are dropped, except a unit failing. Without a bus there are no events
+// and it returns a nil channel.
+func Watch(ctx context.Context) (<-chan UnitEvent, error) {
+	b := currentBus()
+	if b == nil {
+		return nil, nil
+	}
+	changes := make(chan PropertiesChange, 64)
+	if err := b.SubscribeProperties(changes); err != nil {
+		return nil, fmt.Errorf("subscribe to unit changes: %w", err)
+	}
+	events := make(chan UnitEvent, 16)
+	go func() {
+		for {
+			var change PropertiesChange
+			select {
+			case <-ctx.Done():
+				return
+			case change = <-changes:
+			}
+			state, ok := change.Changed["ActiveState"].(string)
+			if !ok || !strings.HasPrefix(change.Unit, managedUnitPrefix) {
+				continue
+			}
+			sub, _ := change.Changed["SubState"].(string)
+			ev := UnitEvent{Unit: change.Unit, ActiveState: state, SubState: sub}
+			if causedByOwnJob(ev) {
+				continue
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+func setBus(b Bus) {
+	busMu.Lock()
+	defer busMu.Unlock()
+	defaultBus = b
+}
+
+func currentBus() Bus {
+	busMu.RLock()
+	defer busMu.RUnlock()
+	return defaultBus
+}
+
+// dropBus uninstalls b unless it was replaced meanwhile.
+func dropBus(b Bus) {
+	busMu.Lock()
+	defer busMu.Unlock()
+	if defaultBus == b {
+		defaultBus = nil
+	}
+}
+
+// viaBus runs op on the installed bus. It reports false when there is no bus, or when the
+// connection has closed, in which case the bus is dropped and the caller falls back to
+// systemctl.
+func viaBus(op func(Bus) error) (bool, error) {
+	b := currentBus()
+	if b == nil {
+		return false, nil
+	}
+	err := op(b)
+	if errors.Is(err, dbus.ErrClosed) {
+		dropBus(b)
+		return false, nil
+	}
+	return true, err
+}
+
+// runJob queues a job with queue and waits for it to finish.
+func runJob(ctx context.Context, queue func(context.Context, string, chan<- string) error, unitName string) error {
+	beginOwnJob(unitName)
+	defer endOwnJob(unitName)
+	ch := make(chan string, 1)
+	if err := queue(ctx, unitName, ch); err != nil {
+		return err
+	}
+	select {
+	case result := <-ch:
+		if result != "done" {
+			return fmt.Errorf("job %s", result)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func beginOwnJob(unit string) {
+	ownJobsMu.Lock()
+	defer ownJobsMu.Unlock()
+	ownJobs[unit] = time.Time{}
+}
+
+func endOwnJob(unit string) {
+	ownJobsMu.Lock()
+	defer ownJobsMu.Unlock()
+	ownJobs[unit] = time.Now().Add(ownJobSettle)
+}
+
+// causedByOwnJob reports whether ev arrived while one of our jobs on its unit ran or settled.
+// A failure is never attributed to the job, since it is what the watch exists to catch.
+func causedByOwnJob(ev UnitEvent) bool {
+	if ev.ActiveState == "failed" {
+		return false
+	}
+	ownJobsMu.Lock()
+	defer ownJobsMu.Unlock()
+	settled, ok := ownJobs[ev.Unit]
+	if !ok {
+		return false
+	}
+	if !settled.IsZero() && time.Now().After(settled) {
+		delete(ownJobs, ev.Unit)
+		return false
+	}
+	return true
+}
+
+// busShow reads the state Show reports from the unit's Unit and Service properties.
+func busShow(ctx context.Context, b Bus, unitName string) (int64, time.Time, string, string, error) {
+	unit, err := b.UnitProperties(ctx, unitName, "Unit")
+	if err != nil {
+		return 0, time.Time{}, "", "", err
+	}
+	service, err := b.UnitProperties(ctx, unitName, "Service")
+	if err != nil {
+		return 0, time.Time{}, "", "", err
+	}
+
+	var pid int64
+	switch v := service["MainPID"].(type) {
+	case uint32:
+		pid = int64(v)
+	case int64:
+		pid = v
+	}
+	var startTime time.Time
+	// systemctl shows timestamps to the second; match it so either client reports the same.
+	if usec, ok := service["ExecMainStartTimestamp"].(uint64); ok && usec > 0 {
+		startTime = time.UnixMicro(int64(usec)).Truncate(time.Second)
+	}
+	activeState, _ := unit["ActiveState"].(string)
+	subState, _ := unit["SubState"].(string)
+	return pid, startTime, activeState, subState, nil
+}
+
+// dbusBus is Bus on a go-systemd connection.
+type dbusBus struct {
+	conn *sdbus.Conn
+}
+
+func (b *dbusBus) EnableUnitFiles(ctx context.Context, units []string) error {
+	_, changes, err := b.conn.EnableUnitFilesContext(ctx, units, false, true)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+	return b.conn.ReloadContext(ctx)
+}
+
+func (b *dbusBus) DisableUnitFiles(ctx context.Context, units []string) error {
+	changes, err := b.conn.DisableUnitFilesContext(ctx, units, false)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+	return b.conn.ReloadContext(ctx)
+}
+
+func (b *dbusBus) StartUnit(ctx context.Context, unit string, ch chan<- string) error {
+	_, err := b.conn.StartUnitContext(ctx, unit, "replace", ch)
+	return err
+}
+
+func (b *dbusBus) RestartUnit(ctx context.Context, unit string, ch chan<- string) error {
+	_, err := b.conn.RestartUnitContext(ctx, unit, "replace", ch)
+	return err
+}
+
+func (b *dbusBus) StopUnit(ctx context.Context, unit string, ch chan<- string) error {
+	_, err := b.conn.StopUnitContext(ctx, unit, "replace", ch)
+	return err
+}
+
+func (b *dbusBus) Reload(ctx context.Context) error {
+	return b.conn.ReloadContext(ctx)
+}
+
+func (b *dbusBus) UnitProperties(ctx context.Context, unit, iface string) (map[string]interface{}, error) {
+	if iface == "Unit" {
+		return b.conn.GetUnitPropertiesContext(ctx, unit)
+	}
+	return b.conn.GetUnitTypePropertiesContext(ctx, unit, iface)
+}
+
+func (b *dbusBus) SubscribeProperties(ch chan<- PropertiesChange) error {
+	if err := b.conn.Subscribe(); err != nil {
+		return err
+	}
+	updates := make(chan *sdbus.PropertiesUpdate, cap(ch))
+	b.conn.SetPropertiesSubscriber(updates, make(chan error, 1))
+	go func() {
+		for u := range updates {
+			changed := make(map[string]interface{}, len(u.Changed))
+			for k, v := range u.Changed {
+				changed[k] = v.Value()
+			}
+			select {
+			case ch <- PropertiesChange{Unit: u.UnitName, Changed: changed}:
+			default:
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *dbusBus) Close() {
+	b.conn.Close()
+}
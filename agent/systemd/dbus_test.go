@@ -0,0 +1,179 @@
+package systemd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+type fakeBus struct {
+	calls  []string
+	props  map[string]map[string]interface{}
+	result string
+	err    error
+	subs   chan<- PropertiesChange
+}
+
+func (f *fakeBus) EnableUnitFiles(_ context.Context, units []string) error {
+	f.calls = append(f.calls, "enable "+units[0])
+	return f.err
+}
+
+func (f *fakeBus) DisableUnitFiles(_ context.Context, units []string) error {
+	f.calls = append(f.calls, "disable "+units[0])
+	return f.err
+}
+
+func (f *fakeBus) StartUnit(_ context.Context, unit string, ch chan<- string) error {
+	return f.job("start "+unit, ch)
+}
+
+func (f *fakeBus) RestartUnit(_ context.Context, unit string, ch chan<- string) error {
+	return f.job("restart "+unit, ch)
+}
+
+func (f *fakeBus) StopUnit(_ context.Context, unit string, ch chan<- string) error {
+	return f.job("stop "+unit, ch)
+}
+
+func (f *fakeBus) job(call string, ch chan<- string) error {
+	f.calls = append(f.calls, call)
+	if f.err != nil {
+		return f.err
+	}
+	ch <- f.result
+	return nil
+}
+
+func (f *fakeBus) Reload(context.Context) error {
+	f.calls = append(f.calls, "reload")
+	return f.err
+}
+
+func (f *fakeBus) UnitProperties(_ context.Context, _ string, iface string) (map[string]interface{}, error) {
+	return f.props[iface], f.err
+}
+
+func (f *fakeBus) SubscribeProperties(ch chan<- PropertiesChange) error {
+	f.subs = ch
+	return nil
+}
+
+func (f *fakeBus) Close() {}
+
+func TestBusOperations(t *testing.T) {
+	runner := &fakeRunner{}
+	defer SetRunnerForTesting(runner)()
+	bus := &fakeBus{result: "done", props: map[string]map[string]interface{}{
+		"Unit":    {"ActiveState": "active", "SubState": "running"},
+		"Service": {"MainPID": uint32(4321), "ExecMainStartTimestamp": uint64(1707834131500000)},
+	}}
+	defer SetBusForTesting(bus)()
+	ctx := context.Background()
+
+	if err := EnableAndStart(ctx, "apollo-unit.service"); err != nil {
+		t.Fatalf("enable and start: %v", err)
+	}
+	if err := StopAndDisable(ctx, "apollo-unit.service"); err != nil {
+		t.Fatalf("stop and disable: %v", err)
+	}
+	want := []string{"enable apollo-unit.service", "start apollo-unit.service", "disable apollo-unit.service", "stop apollo-unit.service"}
+	if len(bus.calls) != len(want) {
+		t.Fatalf("expected %v, got %v", want, bus.calls)
+	}
+	for i := range want {
+		if bus.calls[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, bus.calls)
+		}
+	}
+
+	pid, started, active, sub, err := Show(ctx, "apollo-unit.service")
+	if err != nil {
+		t.Fatalf("show: %v", err)
+	}
+	if pid != 4321 || active != "active" || sub != "running" {
+		t.Fatalf("unexpected state pid=%d active=%s sub=%s", pid, active, sub)
+	}
+	if !started.Equal(time.Date(2024, 2, 13, 14, 22, 11, 0, time.UTC)) {
+		t.Fatalf("expected the start time to the second, got %s", started)
+	}
+
+	bus.result = "failed"
+	if err := Restart(ctx, "apollo-unit.service"); err == nil {
+		t.Fatalf("expected a failed job to be an error")
+	}
+	if runner.lastArgs != nil {
+		t.Fatalf("expected no systemctl calls while the bus works, got %v", runner.lastArgs)
+	}
+
+	bus.err = dbus.ErrClosed
+	if err := Start(ctx, "apollo-unit.service"); err != nil {
+		t.Fatalf("start after the bus closed: %v", err)
+	}
+	if len(runner.lastArgs) == 0 || runner.lastArgs[0] != "start" {
+		t.Fatalf("expected a closed bus to fall back to systemctl, got %v", runner.lastArgs)
+	}
+	if currentBus() != nil {
+		t.Fatalf("expected the closed bus to be dropped")
+	}
+}
+
+func TestWatchFiltersManagedUnitStateChanges(t *testing.T) {
+	bus := &fakeBus{}
+	defer SetBusForTesting(bus)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := Watch(ctx)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	bus.subs <- PropertiesChange{Unit: "sshd.service", Changed: map[string]interface{}{"ActiveState": "failed"}}
+	bus.subs <- PropertiesChange{Unit: "apollo-ns-app.service", Changed: map[string]interface{}{"Result": "exit-code"}}
+	bus.subs <- PropertiesChange{Unit: "apollo-ns-app.service", Changed: map[string]interface{}{"ActiveState": "failed", "SubState": "failed"}}
+
+	select {
+	case ev := <-events:
+		if ev != (UnitEvent{Unit: "apollo-ns-app.service", ActiveState: "failed", SubState: "failed"}) {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected an event for the managed unit")
+	}
+
+	restore := SetBusForTesting(nil)
+	defer restore()
+	if events, err := Watch(ctx); events != nil || err != nil {
+		t.Fatalf("expected no events without a bus, got %v, %v", events, err)
+	}
+}
+
+func TestWatchDropsChangesCausedByOwnJobs(t *testing.T) {
+	bus := &fakeBus{result: "done"}
+	defer SetBusForTesting(bus)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := Watch(ctx)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	const unit = "apollo-ns-own.service"
+	if err := runJob(ctx, bus.RestartUnit, unit); err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	bus.subs <- PropertiesChange{Unit: unit, Changed: map[string]interface{}{"ActiveState": "deactivating", "SubState": "stop-sigterm"}}
+	bus.subs <- PropertiesChange{Unit: unit, Changed: map[string]interface{}{"ActiveState": "active", "SubState": "running"}}
+	bus.subs <- PropertiesChange{Unit: unit, Changed: map[string]interface{}{"ActiveState": "failed", "SubState": "failed"}}
+
+	select {
+	case ev := <-events:
+		if ev.ActiveState != "failed" {
+			t.Fatalf("expected the restart's own changes to be dropped, got %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the failure to be delivered")
+	}
+}
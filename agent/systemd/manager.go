@@ -114,6 +114,14 @@ func RemoveUnitWithDetails(ctx context.Context, unitName, unitPath string, envPa
 
 // EnableAndStart enables the unit and starts it.
 func EnableAndStart(ctx context.Context, unitName string) error {
+	if ok, err := viaBus(func(b Bus) error {
+		if err := b.EnableUnitFiles(ctx, []string{unitName}); err != nil {
+			return err
+		}
+		return runJob(ctx, b.StartUnit, unitName)
+	}); ok {
+		return wrapBusErr("enable --now "+unitName, err)
+	}
 	out, err := runSystemctl(ctx, "enable", "--now", unitName)
 	if err != nil {
 		return fmt.Errorf("systemctl enable --now %s: %w: %s", unitName, err, strings.TrimSpace(string(out)))
@@ -123,6 +131,9 @@ func EnableAndStart(ctx context.Context, unitName string) error {
 
 // Start starts the unit (without enabling it).
 func Start(ctx context.Context, unitName string) error {
+	if ok, err := viaBus(func(b Bus) error { return runJob(ctx, b.StartUnit, unitName) }); ok {
+		return wrapBusErr("start "+unitName, err)
+	}
 	out, err := runSystemctl(ctx, "start", unitName)
 	if err != nil {
 		return fmt.Errorf("systemctl start %s: %w: %s", unitName, err, strings.TrimSpace(string(out)))
@@ -132,6 +143,9 @@ func Start(ctx context.Context, unitName string) error {
 
 // Restart restarts the unit.
 func Restart(ctx context.Context, unitName string) error {
+	if ok, err := viaBus(func(b Bus) error { return runJob(ctx, b.RestartUnit, unitName) }); ok {
+		return wrapBusErr("restart "+unitName, err)
+	}
 	out, err := runSystemctl(ctx, "restart", unitName)
 	if err != nil {
 		return fmt.Errorf("systemctl restart %s: %w: %s", unitName, err, strings.TrimSpace(string(out)))
@@ -141,6 +155,14 @@ func Restart(ctx context.Context, unitName string) error {
 
 // StopAndDisable stops the unit and disables it.
 func StopAndDisable(ctx context.Context, unitName string) error {
+	if ok, err := viaBus(func(b Bus) error {
+		if err := b.DisableUnitFiles(ctx, []string{unitName}); err != nil {
+			return err
+		}
+		return runJob(ctx, b.StopUnit, unitName)
+	}); ok {
+		return wrapBusErr("disable --now "+unitName, err)
+	}
 	out, err := runSystemctl(ctx, "disable", "--now", unitName)
 	if err != nil {
 		return fmt.Errorf("systemctl disable --now %s: %w: %s", unitName, err, strings.TrimSpace(string(out)))
@@ -150,6 +172,9 @@ func StopAndDisable(ctx context.Context, unitName string) error {
 
 // DaemonReload reloads systemd units.
 func DaemonReload(ctx context.Context) error {
+	if ok, err := viaBus(func(b Bus) error { return b.Reload(ctx) }); ok {
+		return wrapBusErr("daemon-reload", err)
+	}
 	out, err := runSystemctl(ctx, "daemon-reload")
 	if err != nil {
 		return fmt.Errorf("systemctl daemon-reload: %w: %s", err, strings.TrimSpace(string(out)))
@@ -157,7 +182,7 @@ func DaemonReload(ctx context.Context) error {
 	return nil
 }
 
-// IsUnitNotFoundError returns true when a systemctl operation failed because the unit does not exist.
+// IsUnitNotFoundError returns true when a systemctl or D-Bus operation failed because the unit does not exist.
 func IsUnitNotFoundError(err error) bool {
 	if err == nil {
 		return false
@@ -167,11 +192,24 @@ func IsUnitNotFoundError(err error) bool {
 		strings.Contains(s, "not-found") ||
 		strings.Contains(s, "loaded: not-found") ||
 		strings.Contains(s, "does not exist") ||
+		strings.Contains(s, "not loaded") ||
 		strings.Contains(s, "unit file") && strings.Contains(s, "does not exist")
 }
 
 // Show returns runtime info for a unit.
 func Show(ctx context.Context, unitName string) (int64, time.Time, string, string, error) {
+	var (
+		pid                   int64
+		startTime             time.Time
+		activeState, subState string
+	)
+	if ok, err := viaBus(func(b Bus) (err error) {
+		pid, startTime, activeState, subState, err = busShow(ctx, b, unitName)
+		return err
+	}); ok {
+		return pid, startTime, activeState, subState, wrapBusErr("show "+unitName, err)
+	}
+
 	out, err := runSystemctl(ctx, "show", unitName, "-p", "MainPID", "-p", "ExecMainStartTimestamp", "-p", "ActiveState", "-p", "SubState")
 	if err != nil {
 		return 0, time.Time{}, "", "", fmt.Errorf("systemctl show %s: %w: %s", unitName, err, strings.TrimSpace(string(out)))
@@ -188,14 +226,37 @@ func Show(ctx context.Context, unitName string) (int64, time.Time, string, strin
 	}
 
 	pidStr := strings.TrimSpace(get("MainPID"))
-	pid, _ := strconv.ParseInt(pidStr, 10, 64)
+	pid, _ = strconv.ParseInt(pidStr, 10, 64)
 
 	startStr := strings.TrimSpace(get("ExecMainStartTimestamp"))
-	startTime, _ := parseTimestamp(startStr)
+	startTime, _ = parseTimestamp(startStr)
 
 	return pid, startTime, get("ActiveState"), get("SubState"), nil
 }
 
+// Result returns the result of the unit's last run, e.g. "success", "exit-code" or "oom-kill".
+func Result(ctx context.Context, unitName string) (string, error) {
+	var result string
+	if ok, err := viaBus(func(b Bus) error {
+		props, err := b.UnitProperties(ctx, unitName, "Service")
+		result, _ = props["Result"].(string)
+		return err
+	}); ok {
+		return result, wrapBusErr("show "+unitName, err)
+	}
+
+	out, err := runSystemctl(ctx, "show", unitName, "-p", "Result")
+	if err != nil {
+		return "", fmt.Errorf("systemctl show %s: %w: %s", unitName, err, strings.TrimSpace(string(out)))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "Result=") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Result=")), nil
+		}
+	}
+	return "", nil
+}
+
 // SetRunnerForTesting swaps the systemctl runner and returns a restore func.
 func SetRunnerForTesting(r Runner) func() {
 	prev := defaultRunner
@@ -219,6 +280,15 @@ func runSystemctl(ctx context.Context, args ...string) ([]byte, error) {
 	return defaultRunner.Run(ctx, "systemctl", args...)
 }
 
+// wrapBusErr names the systemctl equivalent of a failed D-Bus operation, so errors read the
+// same whichever client ran it.
+func wrapBusErr(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("systemd %s (D-Bus): %w", op, err)
+}
+
 func sanitizedBase(namespace, name string) string {
 	sanitize := func(s string) string {
 		s = strings.TrimSpace(strings.ToLower(s))
@@ -132,6 +132,7 @@ func TestIsUnitNotFoundErrorMatchesCommonMessages(t *testing.T) {
 		{msg: "Unit foo.service not-found", want: true},
 		{msg: "Loaded: not-found (Reason: No such file or directory)", want: true},
 		{msg: "Unit file foo.service does not exist.", want: true},
+		{msg: "Unit foo.service not loaded.", want: true},
 		{msg: "some other error", want: false},
 	}
 
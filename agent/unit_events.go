@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/apollo/praetor/agent/systemd"
+	"github.com/go-logr/logr"
+)
+
+// How the agent talks to systemd (APOLLO_SYSTEMD_CLIENT).
+const (
+	systemdClientAuto      = "auto"
+	systemdClientDBus      = "dbus"
+	systemdClientSystemctl = "systemctl"
+
+	// unitEventDebounce gathers the burst of signals one state change produces (stop, failed,
+	// auto-restart, ...) into a single reconcile.
+	unitEventDebounce = 250 * time.Millisecond
+	// unitEventMinInterval spaces out reconciles of a unit that keeps flapping.
+	unitEventMinInterval = 5 * time.Second
+)
+
+func parseSystemdClient(v string) (string, error) {
+	switch v = strings.ToLower(strings.TrimSpace(v)); v {
+	case "":
+		return systemdClientAuto, nil
+	case systemdClientAuto, systemdClientDBus, systemdClientSystemctl:
+		return v, nil
+	}
+	return "", fmt.Errorf("invalid systemd client %q (want auto, dbus or systemctl)", v)
+}
+
+// connectSystemd sets up the systemd client. With auto, D-Bus is used when systemd can be
+// reached over it and systemctl otherwise; with dbus, failing to connect is an error. It returns
+// a func that closes the connection, or nil when systemctl is used.
+func connectSystemd(ctx context.Context, logger logr.Logger, client string) (func(), error) {
+	if client == systemdClientSystemctl {
+		return nil, nil
+	}
+	closeBus, err := systemd.ConnectBus(ctx)
+	if err != nil {
+		if client == systemdClientDBus {
+			return nil, err
+		}
+		logger.Info("systemd D-Bus unavailable; using systemctl and polling for drift", "reason", err.Error())
+		return nil, nil
+	}
+	return closeBus, nil
+}
+
+// unitWatcher turns state changes of managed units into an immediate reconcile and report, so
+// a crashed unit is restarted and reported without waiting for the next poll. Without a D-Bus
+// connection it never fires and drift is corrected on the poll interval.
+type unitWatcher struct {
+	agent  *agent
+	events <-chan systemd.UnitEvent
+	due    <-chan time.Time
+	fired  time.Time
+}
+
+func newUnitWatcher(ctx context.Context, a *agent) *unitWatcher {
+	events, err := systemd.Watch(ctx)
+	if err != nil {
+		a.logger.Error(err, "watch unit state; drift is corrected on the poll interval")
+	}
+	return &unitWatcher{agent: a, events: events}
+}
+
+// handle schedules a reconcile when ev is about a managed unit.
+func (w *unitWatcher) handle(ev systemd.UnitEvent) {
+	if !w.agent.managesUnit(ev.Unit) {
+		return
+	}
+	w.agent.logger.Info("unit state changed", "unit", ev.Unit, "activeState", ev.ActiveState, "subState", ev.SubState)
+	if w.due == nil {
+		delay := unitEventDebounce
+		if wait := time.Until(w.fired.Add(unitEventMinInterval)); wait > delay {
+			delay = wait
+		}
+		w.due = time.After(delay)
+	}
+}
+
+// fire reconciles against the last desired state and reports the result. A stale desired state
+// is not authoritative, so while it is, unit changes are left alone like on the poll interval.
+func (w *unitWatcher) fire(ctx context.Context) {
+	w.due = nil
+	a := w.agent
+	if a.lastDesired == nil || a.desiredStale {
+		return
+	}
+	w.fired = time.Now()
+	if err := a.reconcileAndReport(ctx, a.lastDesired); err != nil {
+		a.logger.Error(err, "reconcile after unit state change")
+	}
+}
+
+func (a *agent) managesUnit(unit string) bool {
+	for _, mi := range a.managed {
+		if mi.UnitName == unit {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apollo/praetor/agent/systemd"
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/gateway"
+	"github.com/go-logr/logr"
+)
+
+// fakeBus is a systemd D-Bus with one unit: jobs change its state, and crash fails it and
+// signals the change like systemd would.
+type fakeBus struct {
+	mu     sync.Mutex
+	active bool
+	calls  []string
+	subs   chan<- systemd.PropertiesChange
+}
+
+func (f *fakeBus) EnableUnitFiles(context.Context, []string) error  { return nil }
+func (f *fakeBus) DisableUnitFiles(context.Context, []string) error { return nil }
+func (f *fakeBus) Reload(context.Context) error                     { return nil }
+func (f *fakeBus) Close()                                           {}
+
+func (f *fakeBus) StartUnit(_ context.Context, unit string, ch chan<- string) error {
+	return f.job("start "+unit, true, ch)
+}
+
+func (f *fakeBus) RestartUnit(_ context.Context, unit string, ch chan<- string) error {
+	return f.job("restart "+unit, true, ch)
+}
+
+func (f *fakeBus) StopUnit(_ context.Context, unit string, ch chan<- string) error {
+	return f.job("stop "+unit, false, ch)
+}
+
+func (f *fakeBus) job(call string, active bool, ch chan<- string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+	f.active = active
+	ch <- "done"
+	return nil
+}
+
+func (f *fakeBus) UnitProperties(_ context.Context, _ string, iface string) (map[string]interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if iface == "Service" {
+		if !f.active {
+			return map[string]interface{}{"MainPID": uint32(0)}, nil
+		}
+		return map[string]interface{}{"MainPID": uint32(42), "ExecMainStartTimestamp": uint64(1707834131000000)}, nil
+	}
+	if !f.active {
+		return map[string]interface{}{"ActiveState": "failed", "SubState": "failed"}, nil
+	}
+	return map[string]interface{}{"ActiveState": "active", "SubState": "running"}, nil
+}
+
+func (f *fakeBus) SubscribeProperties(ch chan<- systemd.PropertiesChange) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs = ch
+	return nil
+}
+
+func (f *fakeBus) crash(unit string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.active = false
+	f.subs <- systemd.PropertiesChange{Unit: unit, Changed: map[string]interface{}{"ActiveState": "failed", "SubState": "failed"}}
+}
+
+func (f *fakeBus) called(call string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.calls {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
+
+func TestUnitCrashIsCorrectedAndReportedWithoutWaitingForPoll(t *testing.T) {
+	restorePaths := systemd.SetBasePathsForTesting(filepath.Join(t.TempDir(), "units"), filepath.Join(t.TempDir(), "env"))
+	defer restorePaths()
+	bus := &fakeBus{active: true}
+	restoreBus := systemd.SetBusForTesting(bus)
+	defer restoreBus()
+
+	item := rollbackItem("sha256:1", apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"}, "/opt/app/run")
+	paths := systemd.PathsFor(item.Namespace, item.Name)
+	unit, env, err := renderUnitFiles(item, paths.EnvPath)
+	if err != nil {
+		t.Fatalf("render unit: %v", err)
+	}
+	if _, err := systemd.EnsureUnit(context.Background(), paths.UnitName, unit, paths.EnvPath, env); err != nil {
+		t.Fatalf("write unit: %v", err)
+	}
+
+	reports := make(chan gateway.ReportRequest, 8)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/report") {
+			var req gateway.ReportRequest
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			if len(req.Observations) > 0 {
+				reports <- req
+			}
+			return
+		}
+		_ = json.NewEncoder(w).Encode(gateway.DesiredResponse{DeviceName: "switch-1", PollIntervalSeconds: 3600, Items: []gateway.DesiredItem{item}})
+	}))
+	defer gw.Close()
+
+	ag := &agent{
+		deviceName:   "switch-1",
+		gatewayURL:   gw.URL,
+		client:       gw.Client(),
+		logger:       logr.Discard(),
+		lastObserved: map[string]string{},
+		managed: map[string]managedItem{"ns/proc": {
+			UnitName:     paths.UnitName,
+			LastActionAt: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+		}},
+		statePath: filepath.Join(t.TempDir(), "state.json"),
+		heartbeat: time.Hour,
+		rnd:       rand.New(rand.NewSource(1)),
+		oci:       &refOCI{results: map[string]ociResult{}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		_ = ag.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	next := func() gateway.Observation {
+		t.Helper()
+		select {
+		case req := <-reports:
+			return req.Observations[0]
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no report")
+		}
+		return gateway.Observation{}
+	}
+	if obs := next(); obs.PID != 42 {
+		t.Fatalf("expected the running unit to be reported, got %+v", obs)
+	}
+
+	bus.crash(paths.UnitName)
+	obs := next()
+	if !bus.called("start " + paths.UnitName) {
+		t.Fatalf("expected the crashed unit to be started")
+	}
+	if obs.Healthy == nil || !*obs.Healthy || obs.PID != 42 {
+		t.Fatalf("expected the restarted unit to be reported healthy, got %+v", obs)
+	}
+}
+
+func TestUnitWatcherLeavesStaleDesiredStateAloneAndSpacesOutFires(t *testing.T) {
+	restorePaths := systemd.SetBasePathsForTesting(filepath.Join(t.TempDir(), "units"), filepath.Join(t.TempDir(), "env"))
+	defer restorePaths()
+	bus := &fakeBus{}
+	restoreBus := systemd.SetBusForTesting(bus)
+	defer restoreBus()
+
+	item := rollbackItem("sha256:1", apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"}, "/opt/app/run")
+	paths := systemd.PathsFor(item.Namespace, item.Name)
+	ag := &agent{
+		deviceName:   "switch-1",
+		logger:       logr.Discard(),
+		lastObserved: map[string]string{},
+		managed:      map[string]managedItem{"ns/proc": {UnitName: paths.UnitName}},
+		lastDesired:  &gateway.DesiredResponse{DeviceName: "switch-1", Items: []gateway.DesiredItem{item}},
+		desiredStale: true,
+	}
+	w := &unitWatcher{agent: ag}
+	w.handle(systemd.UnitEvent{Unit: paths.UnitName, ActiveState: "failed", SubState: "failed"})
+	<-w.due
+	w.fire(context.Background())
+	if len(bus.calls) != 0 {
+		t.Fatalf("expected no unit jobs while the desired state is stale, got %v", bus.calls)
+	}
+
+	w.fired = time.Now()
+	w.handle(systemd.UnitEvent{Unit: paths.UnitName, ActiveState: "failed", SubState: "failed"})
+	select {
+	case <-w.due:
+		t.Fatalf("expected the next fire to wait for the minimum interval")
+	case <-time.After(4 * unitEventDebounce):
+	}
+}
@@ -10,14 +10,26 @@ const (
 	ConditionSpecObserved ConditionType = "SpecObserved"
 	// Spec warnings (e.g., semantic mismatches or deprecated fields)
 	ConditionSpecWarning ConditionType = "SpecWarning"
+	// Agent verification of the control plane's spec signature
+	ConditionSpecVerified ConditionType = "SpecVerified"
 	// Artifact lifecycle
 	ConditionArtifactDownloaded ConditionType = "ArtifactDownloaded"
 	ConditionArtifactVerified   ConditionType = "ArtifactVerified"
+	ConditionArtifactPrefetched ConditionType = "ArtifactPrefetched"
 	// Process lifecycle
 	ConditionProcessStarted ConditionType = "ProcessStarted"
 	ConditionHealthy        ConditionType = "Healthy"
+	// Device-local rollback to the last known-good spec
+	ConditionRolledBack ConditionType = "RolledBack"
+	// Memory use near the unit's limit, or processes killed for running out of memory
+	ConditionMemoryPressure ConditionType = "MemoryPressure"
 
 	// High-level rollout and availability
 	ConditionAvailable   ConditionType = "Available"
 	ConditionProgressing ConditionType = "Progressing"
+
+	// Device enrollment approval and issuance
+	ConditionApproved ConditionType = "Approved"
+	ConditionDenied   ConditionType = "Denied"
+	ConditionIssued   ConditionType = "Issued"
 )
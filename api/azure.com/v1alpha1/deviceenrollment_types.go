@@ -0,0 +1,58 @@
+// Copyright 2025 Apollo
+// SPDX-License-Identifier: Apache-2.0
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DeviceEnrollmentSpec is a device's request for a client certificate.
+// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="spec is immutable"
+type DeviceEnrollmentSpec struct {
+	// DeviceName is the device the issued certificate identifies.
+	// +kubebuilder:validation:MinLength=1
+	DeviceName string `json:"deviceName"`
+	// Request is a PEM-encoded PKCS#10 certificate signing request whose subject CN is DeviceName.
+	Request []byte `json:"request"`
+	// Renewal marks a request authenticated with the device's current certificate instead of a
+	// bootstrap token. The gateway approves renewals itself.
+	Renewal bool `json:"renewal,omitempty"`
+}
+
+// DeviceEnrollmentStatus carries the approval decision and the issued certificate.
+type DeviceEnrollmentStatus struct {
+	// Conditions hold Approved or Denied (set by an admin, or by the gateway for renewals) and
+	// Issued (set by the signer).
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Certificate is the PEM-encoded certificate issued for the request.
+	Certificate []byte `json:"certificate,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Namespaced
+//+kubebuilder:printcolumn:name="DEVICE",type=string,JSONPath=`.spec.deviceName`
+//+kubebuilder:printcolumn:name="RENEWAL",type=boolean,JSONPath=`.spec.renewal`
+//+kubebuilder:printcolumn:name="APPROVED",type=string,JSONPath=`.status.conditions[?(@.type=="Approved")].status`
+//+kubebuilder:printcolumn:name="ISSUED",type=string,JSONPath=`.status.conditions[?(@.type=="Issued")].status`
+//+kubebuilder:printcolumn:name="AGE",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// DeviceEnrollment is a device's request for a per-device client certificate, approved by an admin
+// much like a Kubernetes CertificateSigningRequest.
+type DeviceEnrollment struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DeviceEnrollmentSpec   `json:"spec"`
+	Status DeviceEnrollmentStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// DeviceEnrollmentList contains a list of DeviceEnrollment.
+type DeviceEnrollmentList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DeviceEnrollment `json:"items"`
+}
@@ -61,18 +61,21 @@ type DeviceProcessEnvVar struct {
 }
 
 // DeviceProcessBackend enumerates execution backends.
-// +kubebuilder:validation:Enum=systemd;initd;container
+// +kubebuilder:validation:Enum=systemd;initd;container;agent
 type DeviceProcessBackend string
 
 const (
 	DeviceProcessBackendSystemd   DeviceProcessBackend = "systemd"
 	DeviceProcessBackendInitd     DeviceProcessBackend = "initd"
 	DeviceProcessBackendContainer DeviceProcessBackend = "container"
+	// DeviceProcessBackendAgent upgrades the device agent itself: the agent replaces its own
+	// binary with Command from the artifact and re-executes. Only Command is used.
+	DeviceProcessBackendAgent DeviceProcessBackend = "agent"
 )
 
 // DeviceProcessExecution describes how the process is launched.
 type DeviceProcessExecution struct {
-	// Backend is the execution mechanism (systemd, initd, container).
+	// Backend is the execution mechanism (systemd, initd, container, agent).
 	Backend DeviceProcessBackend `json:"backend"`
 	// Command is the executable and required arguments.
 	// +kubebuilder:validation:MinItems=1
@@ -127,6 +130,7 @@ type DeviceProcessHealthCheck struct {
 }
 
 // DeviceProcessSpec defines the desired state of DeviceProcess.
+// +kubebuilder:validation:XValidation:rule="self.execution.backend != 'agent' || (self.artifact.type == 'oci' && self.artifact.url.contains('@sha256:'))",message="the agent backend needs an oci artifact pinned by digest"
 type DeviceProcessSpec struct {
 	// DeviceRef points to the device where this process should run.
 	DeviceRef DeviceRef `json:"deviceRef"`
@@ -144,6 +148,10 @@ type DeviceProcessSpec struct {
 	RestartPolicy DeviceProcessRestartPolicy `json:"restartPolicy,omitempty"`
 	// HealthCheck configures optional periodic health probes.
 	HealthCheck *DeviceProcessHealthCheck `json:"healthCheck,omitempty"`
+	// PrefetchArtifact is the next artifact the agent should download and verify ahead of activation.
+	// It is managed by DeviceProcessDeployment rollouts with prefetch enabled; the running process
+	// is not touched until Artifact itself changes.
+	PrefetchArtifact *DeviceProcessArtifact `json:"prefetchArtifact,omitempty"`
 }
 
 // DeviceProcessPhase represents lifecycle phase.
@@ -179,6 +187,13 @@ type DeviceProcessStatus struct {
 	LastArtifactAttemptTime string `json:"lastArtifactAttemptTime,omitempty"`
 	// ArtifactLastError captures the last fetch/verify error message, if any.
 	ArtifactLastError string `json:"artifactLastError,omitempty"`
+	// ArtifactBytesDownloaded is how many bytes of the artifact's blobs are on the device,
+	// including content resumed from earlier attempts.
+	ArtifactBytesDownloaded int64 `json:"artifactBytesDownloaded,omitempty"`
+	// ArtifactBytesTotal is the total size of the artifact's blobs, once the manifest is known.
+	ArtifactBytesTotal int64 `json:"artifactBytesTotal,omitempty"`
+	// PrefetchedArtifactURL is the prefetch artifact the agent has downloaded and verified, if any.
+	PrefetchedArtifactURL string `json:"prefetchedArtifactURL,omitempty"`
 	// PID is the process identifier on the target device.
 	PID int64 `json:"pid,omitempty"`
 	// StartTime is when the process started.
@@ -189,6 +204,51 @@ type DeviceProcessStatus struct {
 	RestartCount int32 `json:"restartCount,omitempty"`
 	// LastTerminationReason describes why the process last exited.
 	LastTerminationReason string `json:"lastTerminationReason,omitempty"`
+	// LastPlan is the most recent plan reported by an agent running in dry-run mode.
+	// +optional
+	LastPlan *DeviceProcessPlan `json:"lastPlan,omitempty"`
+	// Resources is the CPU and memory accounting of the process's unit, as last sampled by the
+	// agent from cgroup v2.
+	// +optional
+	Resources *DeviceProcessResources `json:"resources,omitempty"`
+}
+
+// DeviceProcessResources is the cgroup v2 accounting of a process's systemd unit.
+type DeviceProcessResources struct {
+	// CPUUsageMicroseconds is the CPU time the unit has used since it started.
+	CPUUsageMicroseconds int64 `json:"cpuUsageMicroseconds"`
+	// CPUMillicores is the average CPU use between the agent's last two samples.
+	// +optional
+	CPUMillicores int64 `json:"cpuMillicores,omitempty"`
+	// MemoryCurrentBytes is the memory the unit uses now.
+	MemoryCurrentBytes int64 `json:"memoryCurrentBytes"`
+	// MemoryPeakBytes is the most memory the unit has used. Kernels before 5.19 do not track it.
+	// +optional
+	MemoryPeakBytes int64 `json:"memoryPeakBytes,omitempty"`
+	// MemoryLimitBytes is the lower of the unit's memory.high and memory.max; unset when unlimited.
+	// +optional
+	MemoryLimitBytes int64 `json:"memoryLimitBytes,omitempty"`
+	// OOMKills is how many of the unit's processes the kernel has killed for running out of
+	// memory since the unit started.
+	OOMKills int64 `json:"oomKills"`
+	// ObservedAt is when the agent sampled the counters.
+	ObservedAt metav1.Time `json:"observedAt"`
+}
+
+// DeviceProcessPlan is what a dry-run agent would do to converge this process.
+type DeviceProcessPlan struct {
+	// SpecHash is the desired spec hash the plan was computed for.
+	SpecHash string `json:"specHash,omitempty"`
+	// Action is the planned action, e.g. create, restart, start, none or refuse.
+	Action string `json:"action"`
+	// Changes lists what differs from the device's current state: unit, env or artifact.
+	// +optional
+	Changes []string `json:"changes,omitempty"`
+	// Message explains the action.
+	// +optional
+	Message string `json:"message,omitempty"`
+	// ReportedAt is when the agent reported the plan.
+	ReportedAt metav1.Time `json:"reportedAt"`
 }
 
 //+kubebuilder:object:root=true
@@ -220,5 +280,5 @@ type DeviceProcessList struct {
 }
 
 func init() {
-	SchemeBuilder.Register(&DeviceProcess{}, &DeviceProcessList{}, &DeviceProcessDeployment{}, &DeviceProcessDeploymentList{})
+	SchemeBuilder.Register(&DeviceProcess{}, &DeviceProcessList{}, &DeviceProcessDeployment{}, &DeviceProcessDeploymentList{}, &DeviceEnrollment{}, &DeviceEnrollmentList{}, &DeviceProcessSet{}, &DeviceProcessSetList{})
 }
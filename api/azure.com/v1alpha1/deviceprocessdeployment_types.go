@@ -32,6 +32,10 @@ type DeviceProcessDeploymentStrategy struct {
 	Type DeviceProcessDeploymentStrategyType `json:"type,omitempty"`
 	// RollingUpdate holds settings for RollingUpdate strategy.
 	RollingUpdate *DeviceProcessRollingUpdate `json:"rollingUpdate,omitempty"`
+	// Prefetch delivers a new artifact to every target ahead of activation. Targets keep running
+	// the previous spec until they report the new artifact prefetched and the rollout advances them.
+	// Templates using the agent backend always roll out this way.
+	Prefetch bool `json:"prefetch,omitempty"`
 }
 
 // DeviceProcessTemplateMetadata carries labels for the templated DeviceProcess.
@@ -43,6 +47,7 @@ type DeviceProcessTemplateMetadata struct {
 }
 
 // DeviceProcessTemplateSpec matches DeviceProcessSpec without deviceRef.
+// +kubebuilder:validation:XValidation:rule="self.execution.backend != 'agent' || (self.artifact.type == 'oci' && self.artifact.url.contains('@sha256:'))",message="the agent backend needs an oci artifact pinned by digest"
 type DeviceProcessTemplateSpec struct {
 	// Artifact describes the artifact to fetch and run.
 	Artifact DeviceProcessArtifact `json:"artifact"`
@@ -91,6 +96,9 @@ type DeviceProcessDeploymentStatus struct {
 	NumberAvailable int32 `json:"numberAvailable,omitempty"`
 	// NumberUnavailable is the count of unavailable processes.
 	NumberUnavailable int32 `json:"numberUnavailable,omitempty"`
+	// NumberPrefetched is the count of targets holding the template artifact, either prefetched
+	// or already activated. Only reported when the update strategy enables prefetch.
+	NumberPrefetched int32 `json:"numberPrefetched,omitempty"`
 	// Conditions track rollout state.
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
@@ -100,6 +108,7 @@ type DeviceProcessDeploymentStatus struct {
 //+kubebuilder:resource:scope=Namespaced
 //+kubebuilder:printcolumn:name="DESIRED",type=integer,JSONPath=`.status.desiredNumberScheduled`
 //+kubebuilder:printcolumn:name="CURRENT",type=integer,JSONPath=`.status.currentNumberScheduled`
+//+kubebuilder:printcolumn:name="PREFETCHED",type=integer,JSONPath=`.status.numberPrefetched`,priority=1
 //+kubebuilder:printcolumn:name="UPDATED",type=integer,JSONPath=`.status.updatedNumberScheduled`
 //+kubebuilder:printcolumn:name="READY",type=integer,JSONPath=`.status.numberReady`
 //+kubebuilder:printcolumn:name="AVAILABLE",type=integer,JSONPath=`.status.numberAvailable`
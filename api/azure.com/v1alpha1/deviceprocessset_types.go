@@ -0,0 +1,42 @@
+// Copyright 2025 Apollo
+// SPDX-License-Identifier: Apache-2.0
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DeviceProcessSetSpec is the control plane's signature over the whole desired set of one device.
+type DeviceProcessSetSpec struct {
+	// Revision increases whenever the set or a spec signature in it changes. Agents refuse a set
+	// with a lower revision than one they already applied.
+	Revision int64 `json:"revision"`
+	// Signature is the base64 Ed25519 signature over the device name, Revision and the namespace,
+	// name and spec signature of every DeviceProcess for the device, sorted by namespace and name.
+	Signature string `json:"signature"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="REVISION",type=integer,JSONPath=`.spec.revision`
+//+kubebuilder:printcolumn:name="AGE",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// DeviceProcessSet is named after a device and written by the controller's spec signer. Agents
+// that pin the signing key only remove units once the set they were sent verifies, so a gateway
+// cannot make them drop processes by leaving items out.
+type DeviceProcessSet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec DeviceProcessSetSpec `json:"spec"`
+}
+
+//+kubebuilder:object:root=true
+
+// DeviceProcessSetList contains a list of DeviceProcessSet.
+type DeviceProcessSetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DeviceProcessSet `json:"items"`
+}
@@ -0,0 +1,33 @@
+// Copyright 2025 Apollo
+// SPDX-License-Identifier: Apache-2.0
+
+package v1alpha1
+
+// Per-device token Secrets are generated by the controller for each NetworkSwitch and read by the
+// gateway. They live next to the switch, are owned by it and are named DeviceTokenSecretPrefix
+// followed by the switch name.
+const (
+	DeviceTokenSecretPrefix = "device-token-"
+	// DeviceTokenSecretType is the Secret type of per-device token Secrets.
+	DeviceTokenSecretType = "azure.com/device-token"
+	// DeviceTokenLabel selects per-device token Secrets; its value is always "true".
+	DeviceTokenLabel = "azure.com/device-token"
+	// DeviceTokenDeviceAnnotation records the device a token Secret authenticates.
+	DeviceTokenDeviceAnnotation = "azure.com/device-name"
+
+	// DeviceTokenKey holds the current token. DeviceTokenPreviousKey holds the token it replaced,
+	// still accepted until the RFC3339 time in DeviceTokenPreviousExpiresKey.
+	DeviceTokenKey                = "token"
+	DeviceTokenPreviousKey        = "previous-token"
+	DeviceTokenPreviousExpiresKey = "previous-token-expires"
+	// DeviceTokenDisabledKey set to "true" revokes the device: the gateway refuses all of its
+	// requests, whatever credential they carry.
+	DeviceTokenDisabledKey = "disabled"
+
+	// DeviceTokenDisabledAnnotation on a NetworkSwitch, set to "true", disables its token Secret.
+	DeviceTokenDisabledAnnotation = "azure.com/device-token-disabled"
+	// DeviceTokenRotateAnnotation on a NetworkSwitch requests a rotation whenever its value
+	// changes; the Secret records the value handled in DeviceTokenRotationAnnotation.
+	DeviceTokenRotateAnnotation   = "azure.com/device-token-rotate"
+	DeviceTokenRotationAnnotation = "azure.com/device-token-rotation"
+)
@@ -10,6 +10,112 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceEnrollment) DeepCopyInto(out *DeviceEnrollment) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceEnrollment.
+func (in *DeviceEnrollment) DeepCopy() *DeviceEnrollment {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceEnrollment)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *DeviceEnrollment) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceEnrollmentList) DeepCopyInto(out *DeviceEnrollmentList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]DeviceEnrollment, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceEnrollmentList.
+func (in *DeviceEnrollmentList) DeepCopy() *DeviceEnrollmentList {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceEnrollmentList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *DeviceEnrollmentList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceEnrollmentSpec) DeepCopyInto(out *DeviceEnrollmentSpec) {
+	*out = *in
+	if in.Request != nil {
+		in, out := &in.Request, &out.Request
+		*out = make([]byte, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceEnrollmentSpec.
+func (in *DeviceEnrollmentSpec) DeepCopy() *DeviceEnrollmentSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceEnrollmentSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceEnrollmentStatus) DeepCopyInto(out *DeviceEnrollmentStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Certificate != nil {
+		in, out := &in.Certificate, &out.Certificate
+		*out = make([]byte, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceEnrollmentStatus.
+func (in *DeviceEnrollmentStatus) DeepCopy() *DeviceEnrollmentStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceEnrollmentStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DeviceProcess) DeepCopyInto(out *DeviceProcess) {
 	*out = *in
@@ -284,6 +390,43 @@ func (in *DeviceProcessList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceProcessPlan) DeepCopyInto(out *DeviceProcessPlan) {
+	*out = *in
+	if in.Changes != nil {
+		in, out := &in.Changes, &out.Changes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.ReportedAt.DeepCopyInto(&out.ReportedAt)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceProcessPlan.
+func (in *DeviceProcessPlan) DeepCopy() *DeviceProcessPlan {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceProcessPlan)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceProcessResources) DeepCopyInto(out *DeviceProcessResources) {
+	*out = *in
+	in.ObservedAt.DeepCopyInto(&out.ObservedAt)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceProcessResources.
+func (in *DeviceProcessResources) DeepCopy() *DeviceProcessResources {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceProcessResources)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DeviceProcessRollingUpdate) DeepCopyInto(out *DeviceProcessRollingUpdate) {
 	*out = *in
@@ -304,6 +447,79 @@ func (in *DeviceProcessRollingUpdate) DeepCopy() *DeviceProcessRollingUpdate {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceProcessSet) DeepCopyInto(out *DeviceProcessSet) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceProcessSet.
+func (in *DeviceProcessSet) DeepCopy() *DeviceProcessSet {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceProcessSet)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *DeviceProcessSet) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceProcessSetList) DeepCopyInto(out *DeviceProcessSetList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]DeviceProcessSet, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceProcessSetList.
+func (in *DeviceProcessSetList) DeepCopy() *DeviceProcessSetList {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceProcessSetList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *DeviceProcessSetList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceProcessSetSpec) DeepCopyInto(out *DeviceProcessSetSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceProcessSetSpec.
+func (in *DeviceProcessSetSpec) DeepCopy() *DeviceProcessSetSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceProcessSetSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DeviceProcessSpec) DeepCopyInto(out *DeviceProcessSpec) {
 	*out = *in
@@ -315,6 +531,11 @@ func (in *DeviceProcessSpec) DeepCopyInto(out *DeviceProcessSpec) {
 		*out = new(DeviceProcessHealthCheck)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.PrefetchArtifact != nil {
+		in, out := &in.PrefetchArtifact, &out.PrefetchArtifact
+		*out = new(DeviceProcessArtifact)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceProcessSpec.
@@ -345,6 +566,16 @@ func (in *DeviceProcessStatus) DeepCopyInto(out *DeviceProcessStatus) {
 		in, out := &in.LastTransitionTime, &out.LastTransitionTime
 		*out = (*in).DeepCopy()
 	}
+	if in.LastPlan != nil {
+		in, out := &in.LastPlan, &out.LastPlan
+		*out = new(DeviceProcessPlan)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = new(DeviceProcessResources)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceProcessStatus.
@@ -3,15 +3,22 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
 	"github.com/apollo/praetor/gateway"
 	"github.com/apollo/praetor/pkg/log"
 	"github.com/apollo/praetor/pkg/version"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"oras.land/oras-go/v2/registry/remote/auth"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
@@ -31,6 +38,19 @@ func main() {
 	var authTokenSecret string
 	var defaultHeartbeat int
 	var staleMultiplier int
+	var registrySecret string
+	var registryPlainHTTP string
+	var artifactCacheDir string
+	var artifactCacheMaxMB int64
+	var pollInterval int
+	var maxInflight int
+	var retryAfter int
+	var tlsCertFile string
+	var tlsKeyFile string
+	var tlsClientCAFile string
+	var tlsRequireClientCert bool
+	var enrollmentNamespace string
+	var deviceTokenSecrets bool
 
 	flag.StringVar(&addr, "addr", ":8080", "address to serve HTTP gateway")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
@@ -38,6 +58,19 @@ func main() {
 	flag.StringVar(&authTokenSecret, "device-token-secret", os.Getenv("APOLLO_GATEWAY_TOKEN_SECRET"), "Optional HMAC secret for per-device tokens")
 	flag.IntVar(&defaultHeartbeat, "default-heartbeat-seconds", 15, "Default heartbeat interval if none provided by agent")
 	flag.IntVar(&staleMultiplier, "stale-multiplier", 3, "Multiplier applied to heartbeat interval to decide staleness")
+	flag.IntVar(&pollInterval, "poll-interval-seconds", 5, "Desired poll interval advertised to agents; DeviceProcesses can override it per device with the "+gateway.PollIntervalAnnotation+" annotation")
+	flag.IntVar(&maxInflight, "max-inflight-requests", 0, "Maximum concurrent device requests before the gateway answers 429 (0 disables load shedding)")
+	flag.IntVar(&retryAfter, "retry-after-seconds", 10, "Retry-After sent with 429 responses when shedding load")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", os.Getenv("APOLLO_GATEWAY_TLS_CERT_FILE"), "Serve the device API over TLS with this certificate (reloaded when rotated)")
+	flag.StringVar(&tlsKeyFile, "tls-key-file", os.Getenv("APOLLO_GATEWAY_TLS_KEY_FILE"), "Private key for --tls-cert-file")
+	flag.StringVar(&tlsClientCAFile, "tls-client-ca-file", os.Getenv("APOLLO_GATEWAY_TLS_CLIENT_CA_FILE"), "Optional CA bundle for verifying device client certificates; the certificate CN/SAN must match the device in the path")
+	flag.BoolVar(&tlsRequireClientCert, "tls-require-client-cert", false, "Reject TLS handshakes without a verified client certificate")
+	flag.BoolVar(&deviceTokenSecrets, "device-token-secrets", false, "Authenticate devices with the per-device token Secrets generated by the controller; a device with a Secret no longer accepts the shared token or HMAC secret")
+	flag.StringVar(&enrollmentNamespace, "enrollment-namespace", os.Getenv("APOLLO_GATEWAY_ENROLLMENT_NAMESPACE"), "Enable device enrollment: bootstrap token Secrets are consumed from, and DeviceEnrollments created in, this namespace")
+	flag.StringVar(&registrySecret, "registry-credentials-secret", os.Getenv("APOLLO_GATEWAY_REGISTRY_SECRET"), "Optional namespace/name of a kubernetes.io/dockerconfigjson Secret used to mint per-device registry pull tokens")
+	flag.StringVar(&artifactCacheDir, "artifact-cache-dir", os.Getenv("APOLLO_GATEWAY_ARTIFACT_CACHE_DIR"), "Optional directory for the device-facing OCI pull-through cache served under /v2/")
+	flag.Int64Var(&artifactCacheMaxMB, "artifact-cache-max-mb", 10240, "Disk space of the artifact cache in MiB; least recently served content is evicted beyond it (0 disables the cap)")
+	flag.StringVar(&registryPlainHTTP, "registry-plain-http-hosts", os.Getenv("APOLLO_GATEWAY_REGISTRY_PLAIN_HTTP_HOSTS"), "Comma-separated registry hosts contacted over plain HTTP when minting tokens (dev only)")
 
 	log.Setup()
 	flag.Parse()
@@ -51,6 +84,10 @@ func main() {
 			BindAddress: "0", // disable metrics; HTTP server owns :8080
 		},
 		HealthProbeBindAddress: probeAddr,
+		// Only per-device token Secrets are cached; other Secrets are read directly when needed.
+		Cache: cache.Options{ByObject: map[client.Object]cache.ByObject{
+			&corev1.Secret{}: {Label: labels.SelectorFromSet(labels.Set{apiv1alpha1.DeviceTokenLabel: "true"})},
+		}},
 	})
 	if err != nil {
 		logger.Error(err, "unable to start manager")
@@ -82,6 +119,57 @@ func main() {
 		staleMultiplier,
 	)
 
+	if tlsCertFile != "" || tlsKeyFile != "" {
+		if err := gw.SetTLS(tlsCertFile, tlsKeyFile, tlsClientCAFile, tlsRequireClientCert); err != nil {
+			logger.Error(err, "unable to configure TLS")
+			os.Exit(1)
+		}
+	} else if tlsClientCAFile != "" || tlsRequireClientCert {
+		logger.Error(fmt.Errorf("client certificate settings need --tls-cert-file and --tls-key-file"), "unable to configure TLS")
+		os.Exit(1)
+	}
+	gw.SetPollInterval(time.Duration(pollInterval) * time.Second)
+	gw.SetLoadShedding(maxInflight, time.Duration(retryAfter)*time.Second)
+
+	if err := gw.WatchDeviceProcesses(ctx, mgr.GetCache()); err != nil {
+		logger.Error(err, "unable to watch DeviceProcesses for desired-state long-polls")
+		os.Exit(1)
+	}
+
+	if deviceTokenSecrets {
+		if err := gw.WatchDeviceTokens(ctx, mgr.GetCache()); err != nil {
+			logger.Error(err, "unable to watch device token Secrets")
+			os.Exit(1)
+		}
+	}
+	if enrollmentNamespace != "" {
+		gw.SetEnrollment(enrollmentNamespace, mgr.GetAPIReader())
+	}
+
+	var issuer *gateway.RegistryTokenIssuer
+	if registrySecret != "" {
+		ns, name, ok := strings.Cut(registrySecret, "/")
+		if !ok || ns == "" || name == "" {
+			logger.Error(fmt.Errorf("invalid --registry-credentials-secret %q", registrySecret), "expected namespace/name")
+			os.Exit(1)
+		}
+		issuer = gateway.NewRegistryTokenIssuer(
+			mgr.GetAPIReader(),
+			types.NamespacedName{Namespace: ns, Name: name},
+			strings.Split(registryPlainHTTP, ","),
+		)
+		gw.SetRegistryTokenIssuer(issuer)
+	}
+	if artifactCacheDir != "" {
+		var creds func(context.Context, string) (auth.Credential, error)
+		if issuer != nil {
+			creds = issuer.Credential
+		}
+		artifactCache := gateway.NewArtifactCache(artifactCacheDir, creds, strings.Split(registryPlainHTTP, ","))
+		artifactCache.SetMaxBytes(artifactCacheMaxMB << 20)
+		gw.SetArtifactCache(artifactCache)
+	}
+
 	if err := mgr.Add(gw); err != nil {
 		logger.Error(err, "unable to add gateway runnable")
 		os.Exit(1)
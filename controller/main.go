@@ -3,13 +3,19 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
 	"github.com/apollo/praetor/controller/reconcilers"
 	"github.com/apollo/praetor/pkg/log"
+	"github.com/apollo/praetor/pkg/specsign"
 	"github.com/apollo/praetor/pkg/version"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
@@ -27,9 +33,21 @@ func init() {
 func main() {
 	var metricsAddr string
 	var probeAddr string
+	var enrollmentCACertFile string
+	var enrollmentCAKeyFile string
+	var enrollmentValidity time.Duration
+	var deviceTokens bool
+	var deviceTokenGrace time.Duration
+	var specSigningKeyFile string
 
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.StringVar(&enrollmentCACertFile, "enrollment-ca-cert-file", os.Getenv("APOLLO_ENROLLMENT_CA_CERT_FILE"), "CA certificate used to sign approved DeviceEnrollments; enrollment signing is disabled when empty")
+	flag.StringVar(&enrollmentCAKeyFile, "enrollment-ca-key-file", os.Getenv("APOLLO_ENROLLMENT_CA_KEY_FILE"), "Private key for --enrollment-ca-cert-file")
+	flag.StringVar(&specSigningKeyFile, "spec-signing-key-file", os.Getenv("APOLLO_SPEC_SIGNING_KEY_FILE"), "PEM PKCS#8 Ed25519 key used to sign DeviceProcess specs for agents that pin its public key")
+	flag.BoolVar(&deviceTokens, "device-tokens", false, "Generate a per-device token Secret for every NetworkSwitch")
+	flag.DurationVar(&deviceTokenGrace, "device-token-rotation-grace", reconcilers.DefaultDeviceTokenRotationGrace, "How long a rotated-out device token is still accepted")
+	flag.DurationVar(&enrollmentValidity, "enrollment-certificate-validity", reconcilers.DefaultEnrollmentCertificateValidity, "Validity of issued device certificates")
 
 	log.Setup()
 	flag.Parse()
@@ -43,6 +61,10 @@ func main() {
 			BindAddress: metricsAddr,
 		},
 		HealthProbeBindAddress: probeAddr,
+		// The only Secrets the controller manages are device tokens; never cache the rest.
+		Cache: cache.Options{ByObject: map[client.Object]cache.ByObject{
+			&corev1.Secret{}: {Label: labels.SelectorFromSet(labels.Set{apiv1alpha1.DeviceTokenLabel: "true"})},
+		}},
 	})
 	if err != nil {
 		logger.Error(err, "unable to start manager")
@@ -60,6 +82,53 @@ func main() {
 		os.Exit(1)
 	}
 
+	if specSigningKeyFile != "" {
+		key, err := specsign.LoadPrivateKey(specSigningKeyFile)
+		if err != nil {
+			logger.Error(err, "unable to load spec signing key")
+			os.Exit(1)
+		}
+		if err := reconcilers.NewDeviceProcessSignerReconciler(mgr.GetClient(), key).SetupWithManager(mgr); err != nil {
+			logger.Error(err, "unable to create controller", "controller", "DeviceProcessSigner")
+			os.Exit(1)
+		}
+		if err := reconcilers.NewDeviceProcessSetReconciler(mgr.GetClient(), key).SetupWithManager(mgr); err != nil {
+			logger.Error(err, "unable to create controller", "controller", "DeviceProcessSet")
+			os.Exit(1)
+		}
+	}
+
+	if deviceTokens {
+		tokens := reconcilers.NewDeviceTokenReconciler(
+			mgr.GetClient(),
+			mgr.GetScheme(),
+			mgr.GetEventRecorderFor("devicetoken-controller"),
+			deviceTokenGrace,
+		)
+		if err := tokens.SetupWithManager(mgr); err != nil {
+			logger.Error(err, "unable to create controller", "controller", "DeviceToken")
+			os.Exit(1)
+		}
+	}
+
+	if enrollmentCACertFile != "" || enrollmentCAKeyFile != "" {
+		signer, err := reconcilers.NewDeviceEnrollmentReconciler(
+			mgr.GetClient(),
+			mgr.GetEventRecorderFor("deviceenrollment-signer"),
+			enrollmentCACertFile,
+			enrollmentCAKeyFile,
+			enrollmentValidity,
+		)
+		if err != nil {
+			logger.Error(err, "unable to load enrollment CA")
+			os.Exit(1)
+		}
+		if err := signer.SetupWithManager(mgr); err != nil {
+			logger.Error(err, "unable to create controller", "controller", "DeviceEnrollment")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		logger.Error(err, "unable to set up health check")
 		os.Exit(1)
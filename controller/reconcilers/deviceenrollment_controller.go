@@ -0,0 +1,146 @@
+package reconcilers
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	cond "github.com/apollo/praetor/pkg/conditions"
+	"github.com/apollo/praetor/pkg/tlsutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// DefaultEnrollmentCertificateValidity is how long issued device certificates are valid.
+const DefaultEnrollmentCertificateValidity = 30 * 24 * time.Hour
+
+// enrollmentBackdate tolerates device clocks running slightly behind the controller.
+const enrollmentBackdate = 5 * time.Minute
+
+//+kubebuilder:rbac:groups=azure.com,resources=deviceenrollments,verbs=get;list;watch
+//+kubebuilder:rbac:groups=azure.com,resources=deviceenrollments/status,verbs=get;update
+
+// DeviceEnrollmentReconciler signs approved DeviceEnrollments with the device CA. The issued
+// certificate identifies the device by subject CN and is valid for client authentication only.
+type DeviceEnrollmentReconciler struct {
+	client.Client
+	Recorder record.EventRecorder
+
+	ca       *x509.Certificate
+	caKey    crypto.Signer
+	validity time.Duration
+	now      func() time.Time
+}
+
+// NewDeviceEnrollmentReconciler loads the device CA from caCertFile/caKeyFile. The gateway must
+// trust the same CA (--tls-client-ca-file) for issued certificates to authenticate devices.
+func NewDeviceEnrollmentReconciler(c client.Client, recorder record.EventRecorder, caCertFile, caKeyFile string, validity time.Duration) (*DeviceEnrollmentReconciler, error) {
+	pair, err := tls.LoadX509KeyPair(caCertFile, caKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load enrollment CA: %w", err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse enrollment CA: %w", err)
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !ca.IsCA {
+		return nil, fmt.Errorf("enrollment CA %s is not a signing CA certificate", caCertFile)
+	}
+	if validity <= 0 {
+		validity = DefaultEnrollmentCertificateValidity
+	}
+	return &DeviceEnrollmentReconciler{Client: c, Recorder: recorder, ca: ca, caKey: signer, validity: validity, now: time.Now}, nil
+}
+
+// SetupWithManager wires the reconciler into the controller manager.
+func (r *DeviceEnrollmentReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&apiv1alpha1.DeviceEnrollment{}).
+		Complete(r)
+}
+
+// Reconcile issues a certificate once an enrollment is approved and not denied.
+func (r *DeviceEnrollmentReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	var enrollment apiv1alpha1.DeviceEnrollment
+	if err := r.Get(ctx, req.NamespacedName, &enrollment); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if len(enrollment.Status.Certificate) > 0 || !conditionTrue(enrollment.Status.Conditions, apiv1alpha1.ConditionApproved) ||
+		conditionTrue(enrollment.Status.Conditions, apiv1alpha1.ConditionDenied) {
+		return ctrl.Result{}, nil
+	}
+	if issued := cond.FindCondition(enrollment.Status.Conditions, apiv1alpha1.ConditionIssued); issued != nil && issued.Status == metav1.ConditionFalse {
+		// The request itself is invalid; signing will not succeed on retry.
+		return ctrl.Result{}, nil
+	}
+
+	certPEM, err := r.sign(&enrollment)
+	if err != nil {
+		cond.MarkFalse(&enrollment.Status.Conditions, apiv1alpha1.ConditionIssued, "InvalidRequest", err.Error())
+		r.Recorder.Event(&enrollment, corev1.EventTypeWarning, "InvalidRequest", err.Error())
+	} else {
+		enrollment.Status.Certificate = certPEM
+		cond.MarkTrue(&enrollment.Status.Conditions, apiv1alpha1.ConditionIssued, "Issued", fmt.Sprintf("certificate valid for %s", r.validity))
+		r.Recorder.Eventf(&enrollment, corev1.EventTypeNormal, "Issued", "issued certificate for device %s", enrollment.Spec.DeviceName)
+		logger.Info("issued device certificate", "device", enrollment.Spec.DeviceName, "renewal", enrollment.Spec.Renewal)
+	}
+	if err := r.Status().Update(ctx, &enrollment); err != nil {
+		if apierrors.IsConflict(err) {
+			return ctrl.Result{Requeue: true}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *DeviceEnrollmentReconciler) sign(enrollment *apiv1alpha1.DeviceEnrollment) ([]byte, error) {
+	csr, err := tlsutil.ParseDeviceCSR(enrollment.Spec.Request, enrollment.Spec.DeviceName)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := r.now()
+	notAfter := now.Add(r.validity)
+	if notAfter.After(r.ca.NotAfter) {
+		notAfter = r.ca.NotAfter
+	}
+	// Only the device name is taken from the request; any other requested subject fields,
+	// SANs or extensions are ignored.
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: enrollment.Spec.DeviceName},
+		NotBefore:    now.Add(-enrollmentBackdate),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, r.ca, csr.PublicKey, r.caKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+func conditionTrue(conditions []metav1.Condition, conditionType apiv1alpha1.ConditionType) bool {
+	c := cond.FindCondition(conditions, conditionType)
+	return c != nil && c.Status == metav1.ConditionTrue
+}
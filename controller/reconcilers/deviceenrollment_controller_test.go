@@ -0,0 +1,119 @@
+package reconcilers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	cond "github.com/apollo/praetor/pkg/conditions"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func writeEnrollmentCA(t *testing.T) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "device-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile, ca
+}
+
+func enrollmentRequest(t *testing.T, name, device, cn string, approved bool) *apiv1alpha1.DeviceEnrollment {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+	if err != nil {
+		t.Fatalf("create CSR: %v", err)
+	}
+	e := &apiv1alpha1.DeviceEnrollment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "enroll"},
+		Spec:       apiv1alpha1.DeviceEnrollmentSpec{DeviceName: device, Request: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})},
+	}
+	if approved {
+		cond.MarkTrue(&e.Status.Conditions, apiv1alpha1.ConditionApproved, "AdminApproved", "")
+	}
+	return e
+}
+
+func TestDeviceEnrollmentSignsOnlyApprovedRequests(t *testing.T) {
+	ctx := context.Background()
+	certFile, keyFile, ca := writeEnrollmentCA(t)
+	cl := fake.NewClientBuilder().WithScheme(testScheme(t)).
+		WithObjects(
+			enrollmentRequest(t, "approved", "leaf-a", "leaf-a", true),
+			enrollmentRequest(t, "pending", "leaf-b", "leaf-b", false),
+			enrollmentRequest(t, "mismatch", "leaf-c", "leaf-a", true)).
+		WithStatusSubresource(&apiv1alpha1.DeviceEnrollment{}).Build()
+	r, err := NewDeviceEnrollmentReconciler(cl, record.NewFakeRecorder(10), certFile, keyFile, time.Hour)
+	if err != nil {
+		t.Fatalf("new reconciler: %v", err)
+	}
+
+	get := func(name string) *apiv1alpha1.DeviceEnrollment {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "enroll", Name: name}}); err != nil {
+			t.Fatalf("reconcile %s: %v", name, err)
+		}
+		var e apiv1alpha1.DeviceEnrollment
+		if err := cl.Get(ctx, types.NamespacedName{Namespace: "enroll", Name: name}, &e); err != nil {
+			t.Fatalf("get %s: %v", name, err)
+		}
+		return &e
+	}
+
+	approved := get("approved")
+	block, _ := pem.Decode(approved.Status.Certificate)
+	if block == nil {
+		t.Fatalf("expected a certificate for the approved enrollment")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse issued certificate: %v", err)
+	}
+	if err := cert.CheckSignatureFrom(ca); err != nil || cert.Subject.CommonName != "leaf-a" {
+		t.Fatalf("expected a leaf-a certificate signed by the CA, got CN %q err %v", cert.Subject.CommonName, err)
+	}
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth || cert.NotAfter.After(time.Now().Add(time.Hour+time.Minute)) {
+		t.Fatalf("expected a client-auth certificate valid for an hour, got %v until %s", cert.ExtKeyUsage, cert.NotAfter)
+	}
+
+	if pending := get("pending"); len(pending.Status.Certificate) != 0 {
+		t.Fatalf("expected no certificate before approval")
+	}
+
+	mismatch := get("mismatch")
+	issued := cond.FindCondition(mismatch.Status.Conditions, apiv1alpha1.ConditionIssued)
+	if len(mismatch.Status.Certificate) != 0 || issued == nil || issued.Status != metav1.ConditionFalse || issued.Reason != "InvalidRequest" {
+		t.Fatalf("expected a CSR naming another device to be refused, got %+v", mismatch.Status)
+	}
+}
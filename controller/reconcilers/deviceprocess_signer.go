@@ -0,0 +1,158 @@
+package reconcilers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/pkg/specsign"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+//+kubebuilder:rbac:groups=azure.com,resources=deviceprocesssets,verbs=get;list;watch;create;patch
+
+// deviceRefIndex indexes DeviceProcesses by the device they run on, like the gateway does.
+const deviceRefIndex = "spec.deviceRef.name"
+
+// DeviceProcessSignerReconciler stamps every DeviceProcess spec with a signature agents verify
+// against a pinned public key. The gateway only relays the signature and never holds the key.
+type DeviceProcessSignerReconciler struct {
+	client.Client
+	key ed25519.PrivateKey
+}
+
+// NewDeviceProcessSignerReconciler signs specs with key.
+func NewDeviceProcessSignerReconciler(c client.Client, key ed25519.PrivateKey) *DeviceProcessSignerReconciler {
+	return &DeviceProcessSignerReconciler{Client: c, key: key}
+}
+
+// SetupWithManager wires the reconciler into the controller manager.
+func (r *DeviceProcessSignerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("deviceprocess-signer").
+		For(&apiv1alpha1.DeviceProcess{}, builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{}))).
+		Complete(r)
+}
+
+// Reconcile re-signs a DeviceProcess whose signature does not cover its current spec.
+func (r *DeviceProcessSignerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var proc apiv1alpha1.DeviceProcess
+	if err := r.Get(ctx, req.NamespacedName, &proc); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if proc.DeletionTimestamp != nil {
+		return ctrl.Result{}, nil
+	}
+	signature, err := specsign.Sign(r.key, proc.Namespace, proc.Name, proc.Generation, &proc.Spec)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if proc.Annotations[specsign.Annotation] == signature {
+		return ctrl.Result{}, nil
+	}
+
+	// The optimistic lock ensures the signature is for the spec that was read.
+	before := proc.DeepCopy()
+	if proc.Annotations == nil {
+		proc.Annotations = map[string]string{}
+	}
+	proc.Annotations[specsign.Annotation] = signature
+	if err := r.Patch(ctx, &proc, client.MergeFromWithOptions(before, client.MergeFromWithOptimisticLock{})); err != nil {
+		return ctrl.Result{}, err
+	}
+	log.FromContext(ctx).V(1).Info("signed DeviceProcess spec", "generation", proc.Generation)
+	return ctrl.Result{}, nil
+}
+
+// DeviceProcessSetReconciler keeps one DeviceProcessSet per device, signing the namespace, name
+// and spec signature of every DeviceProcess for it. Agents only remove units once the set they
+// were sent verifies.
+type DeviceProcessSetReconciler struct {
+	client.Client
+	key ed25519.PrivateKey
+	now func() time.Time
+}
+
+// NewDeviceProcessSetReconciler signs device sets with key.
+func NewDeviceProcessSetReconciler(c client.Client, key ed25519.PrivateKey) *DeviceProcessSetReconciler {
+	return &DeviceProcessSetReconciler{Client: c, key: key, now: time.Now}
+}
+
+// SetupWithManager wires the reconciler into the controller manager.
+func (r *DeviceProcessSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &apiv1alpha1.DeviceProcess{}, deviceRefIndex, func(obj client.Object) []string {
+		proc, ok := obj.(*apiv1alpha1.DeviceProcess)
+		if !ok || proc.Spec.DeviceRef.Name == "" {
+			return nil
+		}
+		return []string{proc.Spec.DeviceRef.Name}
+	}); err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("deviceprocessset-signer").
+		For(&apiv1alpha1.DeviceProcessSet{}).
+		Watches(&apiv1alpha1.DeviceProcess{}, handler.EnqueueRequestsFromMapFunc(func(_ context.Context, obj client.Object) []reconcile.Request {
+			proc, ok := obj.(*apiv1alpha1.DeviceProcess)
+			if !ok || proc.Spec.DeviceRef.Name == "" {
+				return nil
+			}
+			return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: proc.Spec.DeviceRef.Name}}}
+		}), builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{}))).
+		Complete(r)
+}
+
+// Reconcile re-signs the set of device req.Name when it no longer matches its DeviceProcesses.
+func (r *DeviceProcessSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	device := req.Name
+	var procs apiv1alpha1.DeviceProcessList
+	if err := r.List(ctx, &procs, client.MatchingFields{deviceRefIndex: device}); err != nil {
+		return ctrl.Result{}, err
+	}
+	entries := make([]specsign.SetEntry, 0, len(procs.Items))
+	for i := range procs.Items {
+		proc := &procs.Items[i]
+		entries = append(entries, specsign.SetEntry{Namespace: proc.Namespace, Name: proc.Name, Signature: proc.Annotations[specsign.Annotation]})
+	}
+
+	var set apiv1alpha1.DeviceProcessSet
+	err := r.Get(ctx, types.NamespacedName{Name: device}, &set)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	exists := err == nil
+	if exists && specsign.SignSet(r.key, device, set.Spec.Revision, entries) == set.Spec.Signature {
+		return ctrl.Result{}, nil
+	}
+
+	// Starting from the clock keeps revisions increasing even if the set is deleted and recreated.
+	revision := r.now().UnixMilli()
+	if set.Spec.Revision >= revision {
+		revision = set.Spec.Revision + 1
+	}
+	if !exists {
+		set.Name = device
+		set.Spec = apiv1alpha1.DeviceProcessSetSpec{Revision: revision, Signature: specsign.SignSet(r.key, device, revision, entries)}
+		if err := r.Create(ctx, &set); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else {
+		// The optimistic lock keeps the revision increasing across concurrent writers.
+		before := set.DeepCopy()
+		set.Spec = apiv1alpha1.DeviceProcessSetSpec{Revision: revision, Signature: specsign.SignSet(r.key, device, revision, entries)}
+		if err := r.Patch(ctx, &set, client.MergeFromWithOptions(before, client.MergeFromWithOptimisticLock{})); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	log.FromContext(ctx).V(1).Info("signed device process set", "device", device, "revision", revision, "items", len(entries))
+	return ctrl.Result{}, nil
+}
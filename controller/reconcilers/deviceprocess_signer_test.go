@@ -0,0 +1,102 @@
+package reconcilers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/pkg/specsign"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDeviceProcessSignerStampsCurrentSpec(t *testing.T) {
+	ctx := context.Background()
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	proc := &apiv1alpha1.DeviceProcess{
+		ObjectMeta: metav1.ObjectMeta{Name: "proc", Namespace: "default"},
+		Spec: apiv1alpha1.DeviceProcessSpec{
+			DeviceRef: apiv1alpha1.DeviceRef{Kind: apiv1alpha1.DeviceRefKindNetworkSwitch, Name: "leaf-a"},
+			Execution: apiv1alpha1.DeviceProcessExecution{Backend: apiv1alpha1.DeviceProcessBackendSystemd, Command: []string{"/opt/app"}},
+		},
+	}
+	cl := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(proc).Build()
+	r := NewDeviceProcessSignerReconciler(cl, key)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "proc"}}
+
+	sign := func() *apiv1alpha1.DeviceProcess {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatalf("reconcile: %v", err)
+		}
+		var got apiv1alpha1.DeviceProcess
+		if err := cl.Get(ctx, req.NamespacedName, &got); err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if err := specsign.Verify([]ed25519.PublicKey{pub}, got.Namespace, got.Name, got.Generation, &got.Spec, got.Annotations[specsign.Annotation]); err != nil {
+			t.Fatalf("expected a valid signature for the current spec: %v", err)
+		}
+		return &got
+	}
+
+	got := sign()
+	got.Spec.Execution.Command = []string{"/opt/app-v2"}
+	if err := cl.Update(ctx, got); err != nil {
+		t.Fatalf("update spec: %v", err)
+	}
+	sign()
+}
+
+func TestDeviceProcessSetSignsWholeDeviceSet(t *testing.T) {
+	ctx := context.Background()
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	proc := func(name, device, signature string) *apiv1alpha1.DeviceProcess {
+		return &apiv1alpha1.DeviceProcess{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: map[string]string{specsign.Annotation: signature}},
+			Spec:       apiv1alpha1.DeviceProcessSpec{DeviceRef: apiv1alpha1.DeviceRef{Kind: apiv1alpha1.DeviceRefKindNetworkSwitch, Name: device}},
+		}
+	}
+	cl := fake.NewClientBuilder().WithScheme(testScheme(t)).
+		WithObjects(proc("a", "leaf-a", "sig-a"), proc("b", "leaf-a", "sig-b"), proc("c", "leaf-b", "sig-c")).
+		WithIndex(&apiv1alpha1.DeviceProcess{}, deviceRefIndex, func(obj client.Object) []string {
+			return []string{obj.(*apiv1alpha1.DeviceProcess).Spec.DeviceRef.Name}
+		}).Build()
+	r := NewDeviceProcessSetReconciler(cl, key)
+	r.now = func() time.Time { return time.UnixMilli(1000) }
+
+	reconcileSet := func(want ...specsign.SetEntry) apiv1alpha1.DeviceProcessSet {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "leaf-a"}}); err != nil {
+			t.Fatalf("reconcile: %v", err)
+		}
+		var set apiv1alpha1.DeviceProcessSet
+		if err := cl.Get(ctx, types.NamespacedName{Name: "leaf-a"}, &set); err != nil {
+			t.Fatalf("get set: %v", err)
+		}
+		if err := specsign.VerifySet([]ed25519.PublicKey{pub}, "leaf-a", set.Spec.Revision, want, set.Spec.Signature); err != nil {
+			t.Fatalf("expected the set to cover %v: %v", want, err)
+		}
+		return set
+	}
+
+	first := reconcileSet(specsign.SetEntry{Namespace: "default", Name: "b", Signature: "sig-b"}, specsign.SetEntry{Namespace: "default", Name: "a", Signature: "sig-a"})
+	if first.Spec.Revision != 1000 {
+		t.Fatalf("expected the first revision to start from the clock, got %d", first.Spec.Revision)
+	}
+	if again := reconcileSet(specsign.SetEntry{Namespace: "default", Name: "a", Signature: "sig-a"}, specsign.SetEntry{Namespace: "default", Name: "b", Signature: "sig-b"}); again.Spec.Revision != first.Spec.Revision {
+		t.Fatalf("expected an unchanged set to keep its revision, got %d", again.Spec.Revision)
+	}
+
+	if err := cl.Delete(ctx, proc("b", "leaf-a", "sig-b")); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if next := reconcileSet(specsign.SetEntry{Namespace: "default", Name: "a", Signature: "sig-a"}); next.Spec.Revision != first.Spec.Revision+1 {
+		t.Fatalf("expected removing a process to bump the revision, got %d", next.Spec.Revision)
+	}
+}
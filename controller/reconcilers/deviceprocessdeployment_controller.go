@@ -165,6 +165,13 @@ func (r *DeviceProcessDeploymentReconciler) Reconcile(ctx context.Context, req c
 
 	logger.Info("reconciling deployment", "matchedDevices", len(devices))
 
+	var rollout *prefetchRollout
+	if stagesRollout(&deployment) {
+		if rollout, err = r.planPrefetchRollout(ctx, &deployment, devices); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
 	desiredNames := make(map[string]struct{}, len(devices))
 	createdCount := 0
 	ensuredCount := 0
@@ -174,7 +181,9 @@ func (r *DeviceProcessDeploymentReconciler) Reconcile(ctx context.Context, req c
 		name := deviceProcessName(deployment.Name, device.GetName())
 		desiredNames[name] = struct{}{}
 
-		created, err := r.applyDeviceProcess(ctx, &deployment, &device, name)
+		desired := buildDesiredDeviceProcess(ctx, &deployment, &device, name)
+		rollout.apply(desired)
+		created, err := r.applyDeviceProcess(ctx, &deployment, desired)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
@@ -195,6 +204,9 @@ func (r *DeviceProcessDeploymentReconciler) Reconcile(ctx context.Context, req c
 	if deletedCount > 0 {
 		r.Recorder.Eventf(&deployment, corev1.EventTypeNormal, "DeletedDeviceProcess", "Deleted %d stale DeviceProcess object(s)", deletedCount)
 	}
+	if rollout != nil && rollout.advanced > 0 {
+		r.Recorder.Eventf(&deployment, corev1.EventTypeNormal, "AdvancedRollout", "Activated prefetched artifact on %d DeviceProcess object(s)", rollout.advanced)
+	}
 
 	logger.Info("reconcile complete", "ensured", ensuredCount, "created", createdCount, "deleted", deletedCount)
 
@@ -205,8 +217,8 @@ func (r *DeviceProcessDeploymentReconciler) Reconcile(ctx context.Context, req c
 	return ctrl.Result{}, nil
 }
 
-func (r *DeviceProcessDeploymentReconciler) applyDeviceProcess(ctx context.Context, deployment *apiv1alpha1.DeviceProcessDeployment, device *unstructured.Unstructured, name string) (bool, error) {
-	key := types.NamespacedName{Name: name, Namespace: deployment.Namespace}
+func (r *DeviceProcessDeploymentReconciler) applyDeviceProcess(ctx context.Context, deployment *apiv1alpha1.DeviceProcessDeployment, desired *apiv1alpha1.DeviceProcess) (bool, error) {
+	key := types.NamespacedName{Name: desired.Name, Namespace: deployment.Namespace}
 	var existing apiv1alpha1.DeviceProcess
 	err := r.Get(ctx, key, &existing)
 	if err != nil && !apierrors.IsNotFound(err) {
@@ -214,7 +226,6 @@ func (r *DeviceProcessDeploymentReconciler) applyDeviceProcess(ctx context.Conte
 	}
 	created := apierrors.IsNotFound(err)
 
-	desired := buildDesiredDeviceProcess(ctx, deployment, device, name)
 	desired.SetResourceVersion("")
 
 	if err := controllerutil.SetControllerReference(deployment, desired, r.Scheme); err != nil {
@@ -331,6 +342,8 @@ func (r *DeviceProcessDeploymentReconciler) updateStatus(ctx context.Context, de
 	updated := int32(0)
 	ready := int32(0)
 	available := int32(0)
+	prefetched := int32(0)
+	prefetch := stagesRollout(deployment)
 
 	for i := range processList.Items {
 		proc := processList.Items[i]
@@ -338,6 +351,9 @@ func (r *DeviceProcessDeploymentReconciler) updateStatus(ctx context.Context, de
 		if desiredHash != "" && proc.Status.ObservedSpecHash == desiredHash {
 			updated++
 		}
+		if prefetch && holdsTemplateArtifact(&proc, deployment.Spec.Template.Spec.Artifact, desiredHash) {
+			prefetched++
+		}
 
 		if isProcessReady(&proc) {
 			ready++
@@ -359,6 +375,7 @@ func (r *DeviceProcessDeploymentReconciler) updateStatus(ctx context.Context, de
 	status.NumberReady = ready
 	status.NumberAvailable = available
 	status.NumberUnavailable = unavailable
+	status.NumberPrefetched = prefetched
 
 	// Conditions: Progressing and Available
 	if desired == 0 {
@@ -372,7 +389,11 @@ func (r *DeviceProcessDeploymentReconciler) updateStatus(ctx context.Context, de
 		}
 
 		if updated < desired || available < desired {
-			cond.MarkTrue(&status.Conditions, apiv1alpha1.ConditionProgressing, "Updating", fmt.Sprintf("updated=%d available=%d desired=%d", updated, available, desired))
+			msg := fmt.Sprintf("updated=%d available=%d desired=%d", updated, available, desired)
+			if prefetch {
+				msg = fmt.Sprintf("prefetched=%d %s", prefetched, msg)
+			}
+			cond.MarkTrue(&status.Conditions, apiv1alpha1.ConditionProgressing, "Updating", msg)
 		} else {
 			cond.MarkFalse(&status.Conditions, apiv1alpha1.ConditionProgressing, "Updated", "all device processes updated")
 		}
@@ -398,8 +419,12 @@ func isProcessReady(proc *apiv1alpha1.DeviceProcess) bool {
 	return connected != nil && connected.Status == metav1.ConditionTrue && healthy != nil && healthy.Status == metav1.ConditionTrue
 }
 
+// hashDeviceProcessSpec matches the spec hash the gateway serves and agents observe, which leaves
+// the prefetch artifact out.
 func hashDeviceProcessSpec(spec *apiv1alpha1.DeviceProcessSpec) string {
-	data, _ := json.Marshal(spec)
+	activation := *spec
+	activation.PrefetchArtifact = nil
+	data, _ := json.Marshal(&activation)
 	sum := sha256.Sum256(data)
 	return "sha256:" + hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,129 @@
+package reconcilers
+
+import (
+	"context"
+	"sort"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	cond "github.com/apollo/praetor/pkg/conditions"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const defaultMaxUnavailable = "10%"
+
+// prefetchRollout holds targets on their current spec while they prefetch the template artifact.
+// A target is advanced to the template once it reports the artifact prefetched and the rollout's
+// unavailability budget allows it; targets that are already unavailable advance without using budget.
+type prefetchRollout struct {
+	artifact apiv1alpha1.DeviceProcessArtifact
+	held     map[string]apiv1alpha1.DeviceProcessSpec
+	advanced int
+}
+
+// stagesRollout reports whether deployment advances targets through a prefetch rollout. Agent
+// upgrades always do: swapping the agent on every device at once could cut all of them off.
+func stagesRollout(deployment *apiv1alpha1.DeviceProcessDeployment) bool {
+	return deployment.Spec.UpdateStrategy.Prefetch || deployment.Spec.Template.Spec.Execution.Backend == apiv1alpha1.DeviceProcessBackendAgent
+}
+
+func (r *DeviceProcessDeploymentReconciler) planPrefetchRollout(ctx context.Context, deployment *apiv1alpha1.DeviceProcessDeployment, devices []unstructured.Unstructured) (*prefetchRollout, error) {
+	var processes apiv1alpha1.DeviceProcessList
+	if err := r.List(ctx, &processes, client.InNamespace(deployment.Namespace), client.MatchingLabels{deviceProcessDeploymentKey: deployment.Name}); err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*apiv1alpha1.DeviceProcess, len(processes.Items))
+	for i := range processes.Items {
+		existing[processes.Items[i].Name] = &processes.Items[i]
+	}
+
+	names := make([]string, 0, len(devices))
+	unavailable := 0
+	for i := range devices {
+		name := deviceProcessName(deployment.Name, devices[i].GetName())
+		names = append(names, name)
+		if proc, ok := existing[name]; !ok || !isProcessReady(proc) {
+			unavailable++
+		}
+	}
+	sort.Strings(names)
+
+	plan := &prefetchRollout{
+		artifact: deployment.Spec.Template.Spec.Artifact,
+		held:     make(map[string]apiv1alpha1.DeviceProcessSpec),
+	}
+	budget := rolloutMaxUnavailable(&deployment.Spec.UpdateStrategy, len(devices)) - unavailable
+	for _, name := range names {
+		proc, ok := existing[name]
+		// New targets have nothing running yet, so they start on the template directly.
+		if !ok || proc.Spec.Artifact == plan.artifact {
+			continue
+		}
+		if isArtifactPrefetched(proc, plan.artifact) {
+			if !isProcessReady(proc) {
+				plan.advanced++
+				continue
+			}
+			if budget > 0 {
+				budget--
+				plan.advanced++
+				continue
+			}
+		}
+		plan.held[name] = *proc.Spec.DeepCopy()
+	}
+	return plan, nil
+}
+
+// apply replaces dp's templated spec with its held spec plus the artifact to prefetch.
+// A nil plan leaves dp unchanged.
+func (p *prefetchRollout) apply(dp *apiv1alpha1.DeviceProcess) {
+	if p == nil {
+		return
+	}
+	spec, ok := p.held[dp.Name]
+	if !ok {
+		return
+	}
+	artifact := p.artifact
+	spec.PrefetchArtifact = &artifact
+	dp.Spec = spec
+}
+
+func rolloutMaxUnavailable(strategy *apiv1alpha1.DeviceProcessDeploymentStrategy, total int) int {
+	if strategy.Type == apiv1alpha1.DeviceProcessDeploymentStrategyRecreate {
+		return total
+	}
+	value := intstr.FromString(defaultMaxUnavailable)
+	if strategy.RollingUpdate != nil && strategy.RollingUpdate.MaxUnavailable != nil {
+		value = *strategy.RollingUpdate.MaxUnavailable
+	}
+	n, err := intstr.GetScaledValueFromIntOrPercent(&value, total, true)
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+func isArtifactPrefetched(proc *apiv1alpha1.DeviceProcess, artifact apiv1alpha1.DeviceProcessArtifact) bool {
+	if proc.Status.PrefetchedArtifactURL != artifact.URL {
+		return false
+	}
+	prefetched := cond.FindCondition(proc.Status.Conditions, apiv1alpha1.ConditionArtifactPrefetched)
+	return prefetched != nil && prefetched.Status == metav1.ConditionTrue
+}
+
+// holdsTemplateArtifact reports whether proc has the template artifact on the device, either
+// prefetched or downloaded for the template spec it already runs.
+func holdsTemplateArtifact(proc *apiv1alpha1.DeviceProcess, artifact apiv1alpha1.DeviceProcessArtifact, desiredHash string) bool {
+	if isArtifactPrefetched(proc, artifact) {
+		return true
+	}
+	if desiredHash == "" || proc.Status.ObservedSpecHash != desiredHash {
+		return false
+	}
+	downloaded := cond.FindCondition(proc.Status.Conditions, apiv1alpha1.ConditionArtifactDownloaded)
+	return downloaded != nil && downloaded.Status == metav1.ConditionTrue
+}
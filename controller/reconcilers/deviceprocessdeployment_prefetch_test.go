@@ -0,0 +1,156 @@
+package reconcilers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestPrefetchRolloutHoldsUntilPrefetchedAndBudgeted(t *testing.T) {
+	scheme := testScheme(t)
+	deployment := sampleDeployment("dpd", map[string]string{"role": "leaf"})
+	maxUnavailable := intstr.FromInt(1)
+	deployment.Spec.UpdateStrategy = apiv1alpha1.DeviceProcessDeploymentStrategy{
+		Type:          apiv1alpha1.DeviceProcessDeploymentStrategyRollingUpdate,
+		RollingUpdate: &apiv1alpha1.DeviceProcessRollingUpdate{MaxUnavailable: &maxUnavailable},
+		Prefetch:      true,
+	}
+	next := deployment.Spec.Template.Spec.Artifact
+	old := apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: "oci://example-old"}
+
+	existing := func(device string, prefetched bool) *apiv1alpha1.DeviceProcess {
+		proc := buildDesiredDeviceProcess(context.Background(), deployment, networkSwitch(device, map[string]string{"role": "leaf"}), deviceProcessName(deployment.Name, device))
+		proc.Spec.Artifact = old
+		proc.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(deployment, apiv1alpha1.SchemeGroupVersion.WithKind("DeviceProcessDeployment"))}
+		proc.Status.Phase = apiv1alpha1.DeviceProcessPhaseRunning
+		proc.Status.Conditions = []metav1.Condition{
+			{Type: string(apiv1alpha1.ConditionAgentConnected), Status: metav1.ConditionTrue, Reason: "AgentConnected"},
+			{Type: string(apiv1alpha1.ConditionHealthy), Status: metav1.ConditionTrue, Reason: "Healthy"},
+		}
+		if prefetched {
+			proc.Status.PrefetchedArtifactURL = next.URL
+			proc.Status.Conditions = append(proc.Status.Conditions, metav1.Condition{Type: string(apiv1alpha1.ConditionArtifactPrefetched), Status: metav1.ConditionTrue, Reason: "ArtifactPrefetched"})
+		}
+		return proc
+	}
+
+	// leaf-a and leaf-b have prefetched but only one fits the budget; leaf-c is still downloading.
+	cl := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(deployment,
+			networkSwitch("leaf-a", map[string]string{"role": "leaf"}),
+			networkSwitch("leaf-b", map[string]string{"role": "leaf"}),
+			networkSwitch("leaf-c", map[string]string{"role": "leaf"}),
+			existing("leaf-a", true), existing("leaf-b", true), existing("leaf-c", false)).
+		WithStatusSubresource(&apiv1alpha1.DeviceProcessDeployment{}).
+		Build()
+	reconciler := &DeviceProcessDeploymentReconciler{Client: cl, Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: deployment.Name, Namespace: deployment.Namespace}}
+	if _, err := reconciler.Reconcile(ctx, req); err != nil {
+		t.Fatalf("reconcile returned error: %v", err)
+	}
+
+	want := map[string]struct {
+		artifact apiv1alpha1.DeviceProcessArtifact
+		prefetch bool
+	}{
+		"dpd-leaf-a": {artifact: next},
+		"dpd-leaf-b": {artifact: old, prefetch: true},
+		"dpd-leaf-c": {artifact: old, prefetch: true},
+	}
+	for name, w := range want {
+		var proc apiv1alpha1.DeviceProcess
+		if err := cl.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, &proc); err != nil {
+			t.Fatalf("get %s: %v", name, err)
+		}
+		if proc.Spec.Artifact != w.artifact {
+			t.Fatalf("%s: artifact = %+v, want %+v", name, proc.Spec.Artifact, w.artifact)
+		}
+		if got := proc.Spec.PrefetchArtifact != nil && *proc.Spec.PrefetchArtifact == next; got != w.prefetch {
+			t.Fatalf("%s: prefetch artifact = %+v, want prefetch=%v", name, proc.Spec.PrefetchArtifact, w.prefetch)
+		}
+	}
+
+	var updated apiv1alpha1.DeviceProcessDeployment
+	if err := cl.Get(ctx, req.NamespacedName, &updated); err != nil {
+		t.Fatalf("get deployment: %v", err)
+	}
+	if updated.Status.NumberPrefetched != 2 {
+		t.Fatalf("NumberPrefetched = %d, want 2", updated.Status.NumberPrefetched)
+	}
+}
+
+func TestRolloutMaxUnavailable(t *testing.T) {
+	pct := intstr.FromString("25%")
+	cases := []struct {
+		name     string
+		strategy apiv1alpha1.DeviceProcessDeploymentStrategy
+		total    int
+		want     int
+	}{
+		{name: "default rounds up", strategy: apiv1alpha1.DeviceProcessDeploymentStrategy{Type: apiv1alpha1.DeviceProcessDeploymentStrategyRollingUpdate}, total: 3, want: 1},
+		{name: "percent", strategy: apiv1alpha1.DeviceProcessDeploymentStrategy{RollingUpdate: &apiv1alpha1.DeviceProcessRollingUpdate{MaxUnavailable: &pct}}, total: 8, want: 2},
+		{name: "recreate", strategy: apiv1alpha1.DeviceProcessDeploymentStrategy{Type: apiv1alpha1.DeviceProcessDeploymentStrategyRecreate}, total: 5, want: 5},
+	}
+	for _, tc := range cases {
+		if got := rolloutMaxUnavailable(&tc.strategy, tc.total); got != tc.want {
+			t.Fatalf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAgentUpgradeAlwaysStagesRollout(t *testing.T) {
+	scheme := testScheme(t)
+	deployment := sampleDeployment("agent", map[string]string{"role": "leaf"})
+	next := apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: "ghcr.io/apollo/agent@sha256:" + strings.Repeat("b", 64)}
+	deployment.Spec.Template.Spec.Artifact = next
+	deployment.Spec.Template.Spec.Execution = apiv1alpha1.DeviceProcessExecution{Backend: apiv1alpha1.DeviceProcessBackendAgent, Command: []string{"bin/apollo-deviceprocess-agent"}}
+	old := apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: "ghcr.io/apollo/agent@sha256:" + strings.Repeat("a", 64)}
+
+	proc := buildDesiredDeviceProcess(context.Background(), deployment, networkSwitch("leaf-a", map[string]string{"role": "leaf"}), deviceProcessName(deployment.Name, "leaf-a"))
+	proc.Spec.Artifact = old
+	proc.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(deployment, apiv1alpha1.SchemeGroupVersion.WithKind("DeviceProcessDeployment"))}
+	cl := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(deployment, networkSwitch("leaf-a", map[string]string{"role": "leaf"}), proc).
+		WithStatusSubresource(&apiv1alpha1.DeviceProcessDeployment{}).
+		Build()
+	reconciler := &DeviceProcessDeploymentReconciler{Client: cl, Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+
+	ctx := context.Background()
+	if _, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: deployment.Name, Namespace: deployment.Namespace}}); err != nil {
+		t.Fatalf("reconcile returned error: %v", err)
+	}
+	var got apiv1alpha1.DeviceProcess
+	if err := cl.Get(ctx, client.ObjectKeyFromObject(proc), &got); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got.Spec.Artifact != old || got.Spec.PrefetchArtifact == nil || *got.Spec.PrefetchArtifact != next {
+		t.Fatalf("expected the agent upgrade to be held for prefetch without prefetch enabled, got %+v", got.Spec)
+	}
+}
+
+func TestDesiredHashLeavesOutPrefetchArtifact(t *testing.T) {
+	spec := apiv1alpha1.DeviceProcessSpec{Artifact: apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: "ghcr.io/app@sha256:a"}}
+	staged := *spec.DeepCopy()
+	staged.PrefetchArtifact = &apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: "ghcr.io/app@sha256:b"}
+	if hashDeviceProcessSpec(&spec) != hashDeviceProcessSpec(&staged) {
+		t.Fatalf("expected a held target prefetching the template to keep its observed hash")
+	}
+	next := *spec.DeepCopy()
+	next.Artifact.URL = "ghcr.io/app@sha256:b"
+	if hashDeviceProcessSpec(&spec) == hashDeviceProcessSpec(&next) {
+		t.Fatalf("expected the active artifact to change the hash")
+	}
+}
@@ -0,0 +1,194 @@
+package reconcilers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// DefaultDeviceTokenRotationGrace is how long a rotated-out token is still accepted.
+const DefaultDeviceTokenRotationGrace = 24 * time.Hour
+
+const deviceTokenBytes = 32
+
+//+kubebuilder:rbac:groups=azure.com,resources=networkswitches,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update
+
+// DeviceTokenReconciler keeps a per-device token Secret for every NetworkSwitch. Rotation keeps
+// the previous token valid for a grace window so agents can be re-provisioned without an outage;
+// the disabled annotation revokes the device.
+type DeviceTokenReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	grace time.Duration
+	now   func() time.Time
+}
+
+// NewDeviceTokenReconciler constructs a reconciler accepting rotated-out tokens for grace.
+func NewDeviceTokenReconciler(c client.Client, scheme *runtime.Scheme, recorder record.EventRecorder, grace time.Duration) *DeviceTokenReconciler {
+	if grace < 0 {
+		grace = 0
+	}
+	return &DeviceTokenReconciler{Client: c, Scheme: scheme, Recorder: recorder, grace: grace, now: time.Now}
+}
+
+// SetupWithManager wires the reconciler into the controller manager.
+func (r *DeviceTokenReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("devicetoken").
+		For(newNetworkSwitch()).
+		Owns(&corev1.Secret{}).
+		Complete(r)
+}
+
+func newNetworkSwitch() *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(schema.GroupVersionKind{Group: "azure.com", Version: "v1alpha1", Kind: "NetworkSwitch"})
+	return obj
+}
+
+// Reconcile creates, rotates, disables and prunes the token Secret of one NetworkSwitch.
+func (r *DeviceTokenReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	device := newNetworkSwitch()
+	if err := r.Get(ctx, req.NamespacedName, device); err != nil {
+		// The Secret is owned by the switch and garbage collected with it.
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if device.GetDeletionTimestamp() != nil {
+		return ctrl.Result{}, nil
+	}
+	annotations := device.GetAnnotations()
+
+	key := types.NamespacedName{Namespace: req.Namespace, Name: apiv1alpha1.DeviceTokenSecretPrefix + req.Name}
+	var secret corev1.Secret
+	err := r.Get(ctx, key, &secret)
+	if apierrors.IsNotFound(err) {
+		token, err := newDeviceToken()
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		secret = corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      key.Name,
+				Namespace: key.Namespace,
+				Labels:    map[string]string{apiv1alpha1.DeviceTokenLabel: "true"},
+				Annotations: map[string]string{
+					apiv1alpha1.DeviceTokenDeviceAnnotation:   req.Name,
+					apiv1alpha1.DeviceTokenRotationAnnotation: annotations[apiv1alpha1.DeviceTokenRotateAnnotation],
+				},
+			},
+			Type: apiv1alpha1.DeviceTokenSecretType,
+			Data: map[string][]byte{apiv1alpha1.DeviceTokenKey: []byte(token)},
+		}
+		if annotations[apiv1alpha1.DeviceTokenDisabledAnnotation] == "true" {
+			secret.Data[apiv1alpha1.DeviceTokenDisabledKey] = []byte("true")
+		}
+		if err := controllerutil.SetControllerReference(device, &secret, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.Create(ctx, &secret); err != nil {
+			return ctrl.Result{}, client.IgnoreAlreadyExists(err)
+		}
+		r.Recorder.Eventf(device, corev1.EventTypeNormal, "DeviceTokenCreated", "created device token Secret %s", key.Name)
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	now := r.now()
+	changed := false
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	if len(secret.Data[apiv1alpha1.DeviceTokenKey]) == 0 {
+		token, err := newDeviceToken()
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		secret.Data[apiv1alpha1.DeviceTokenKey] = []byte(token)
+		changed = true
+	}
+
+	if rotate := annotations[apiv1alpha1.DeviceTokenRotateAnnotation]; rotate != secret.Annotations[apiv1alpha1.DeviceTokenRotationAnnotation] {
+		token, err := newDeviceToken()
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if r.grace > 0 {
+			secret.Data[apiv1alpha1.DeviceTokenPreviousKey] = secret.Data[apiv1alpha1.DeviceTokenKey]
+			secret.Data[apiv1alpha1.DeviceTokenPreviousExpiresKey] = []byte(now.Add(r.grace).UTC().Format(time.RFC3339))
+		}
+		secret.Data[apiv1alpha1.DeviceTokenKey] = []byte(token)
+		secret.Annotations[apiv1alpha1.DeviceTokenRotationAnnotation] = rotate
+		changed = true
+		r.Recorder.Eventf(device, corev1.EventTypeNormal, "DeviceTokenRotated", "rotated device token; the previous token is accepted for %s", r.grace)
+		logger.Info("rotated device token", "device", req.Name, "grace", r.grace.String())
+	}
+
+	disabled := annotations[apiv1alpha1.DeviceTokenDisabledAnnotation] == "true"
+	if disabled != (string(secret.Data[apiv1alpha1.DeviceTokenDisabledKey]) == "true") {
+		if disabled {
+			secret.Data[apiv1alpha1.DeviceTokenDisabledKey] = []byte("true")
+			r.Recorder.Event(device, corev1.EventTypeWarning, "DeviceTokenDisabled", "device disabled; the gateway refuses its requests")
+		} else {
+			delete(secret.Data, apiv1alpha1.DeviceTokenDisabledKey)
+			r.Recorder.Event(device, corev1.EventTypeNormal, "DeviceTokenEnabled", "device re-enabled")
+		}
+		changed = true
+	}
+
+	// Drop the previous token once its grace window has passed, and come back when it will.
+	var result ctrl.Result
+	if raw := string(secret.Data[apiv1alpha1.DeviceTokenPreviousExpiresKey]); raw != "" || len(secret.Data[apiv1alpha1.DeviceTokenPreviousKey]) > 0 {
+		expires, err := time.Parse(time.RFC3339, raw)
+		if err != nil || !now.Before(expires) {
+			delete(secret.Data, apiv1alpha1.DeviceTokenPreviousKey)
+			delete(secret.Data, apiv1alpha1.DeviceTokenPreviousExpiresKey)
+			changed = true
+		} else {
+			result.RequeueAfter = expires.Sub(now)
+		}
+	}
+
+	if !changed {
+		return result, nil
+	}
+	if err := r.Update(ctx, &secret); err != nil {
+		if apierrors.IsConflict(err) {
+			return ctrl.Result{Requeue: true}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	return result, nil
+}
+
+func newDeviceToken() (string, error) {
+	buf := make([]byte, deviceTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,77 @@
+package reconcilers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDeviceTokenCreateRotateDisableAndPrune(t *testing.T) {
+	ctx := context.Background()
+	scheme := testScheme(t)
+	device := networkSwitch("leaf-a", nil)
+	cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(device).Build()
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewDeviceTokenReconciler(cl, scheme, record.NewFakeRecorder(10), time.Hour)
+	r.now = func() time.Time { return now }
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "leaf-a"}}
+	reconcile := func() (ctrl.Result, *corev1.Secret) {
+		t.Helper()
+		res, err := r.Reconcile(ctx, req)
+		if err != nil {
+			t.Fatalf("reconcile: %v", err)
+		}
+		var secret corev1.Secret
+		if err := cl.Get(ctx, types.NamespacedName{Namespace: "default", Name: apiv1alpha1.DeviceTokenSecretPrefix + "leaf-a"}, &secret); err != nil {
+			t.Fatalf("get secret: %v", err)
+		}
+		return res, &secret
+	}
+	annotate := func(annotations map[string]string) {
+		t.Helper()
+		if err := cl.Get(ctx, req.NamespacedName, device); err != nil {
+			t.Fatalf("get switch: %v", err)
+		}
+		device.SetAnnotations(annotations)
+		if err := cl.Update(ctx, device); err != nil {
+			t.Fatalf("update switch: %v", err)
+		}
+	}
+
+	_, secret := reconcile()
+	first := string(secret.Data[apiv1alpha1.DeviceTokenKey])
+	if len(first) != 2*deviceTokenBytes || secret.Labels[apiv1alpha1.DeviceTokenLabel] != "true" ||
+		secret.Annotations[apiv1alpha1.DeviceTokenDeviceAnnotation] != "leaf-a" || len(secret.OwnerReferences) != 1 {
+		t.Fatalf("expected a labelled token Secret owned by the switch, got %+v", secret)
+	}
+	if _, again := reconcile(); string(again.Data[apiv1alpha1.DeviceTokenKey]) != first {
+		t.Fatalf("expected the token to be stable without a rotation request")
+	}
+
+	annotate(map[string]string{apiv1alpha1.DeviceTokenRotateAnnotation: "1"})
+	res, secret := reconcile()
+	if current := string(secret.Data[apiv1alpha1.DeviceTokenKey]); current == first || string(secret.Data[apiv1alpha1.DeviceTokenPreviousKey]) != first {
+		t.Fatalf("expected rotation to keep the previous token, got %+v", secret.Data)
+	}
+	if res.RequeueAfter != time.Hour {
+		t.Fatalf("expected a requeue at the end of the grace window, got %s", res.RequeueAfter)
+	}
+
+	annotate(map[string]string{apiv1alpha1.DeviceTokenRotateAnnotation: "1", apiv1alpha1.DeviceTokenDisabledAnnotation: "true"})
+	now = now.Add(2 * time.Hour)
+	_, secret = reconcile()
+	if string(secret.Data[apiv1alpha1.DeviceTokenDisabledKey]) != "true" {
+		t.Fatalf("expected the disabled annotation to revoke the device")
+	}
+	if _, ok := secret.Data[apiv1alpha1.DeviceTokenPreviousKey]; ok {
+		t.Fatalf("expected the previous token to be pruned after the grace window")
+	}
+}
@@ -0,0 +1,404 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/retry"
+)
+
+const (
+	deviceNameHeader      = "X-Device-Name"
+	upstreamQueryParam    = "ns"
+	maxCachedManifestSize = int64(4 << 20)
+)
+
+// ArtifactCache is a read-only, content-addressed OCI pull-through cache. Devices pull through it
+// by digest only; tags are never resolved. Upstream content is verified against its digest before
+// it is stored, so a cached file is always the exact bytes the digest names.
+type ArtifactCache struct {
+	dir       string
+	plainHTTP map[string]bool
+	client    *auth.Client
+
+	// maxBytes caps the cached content; least recently used content is evicted past it.
+	maxBytes int64
+	evictMu  sync.Mutex
+
+	mu    sync.Mutex
+	fills map[digest.Digest]*cacheFill
+}
+
+// cacheFill serializes fills of one digest; it is dropped once nobody waits on it.
+type cacheFill struct {
+	sync.Mutex
+	waiters int
+}
+
+// NewArtifactCache stores content under dir and fills it from upstream registries using creds
+// (nil for anonymous pulls). Registries in plainHTTPHosts are contacted over http.
+func NewArtifactCache(dir string, creds func(context.Context, string) (auth.Credential, error), plainHTTPHosts []string) *ArtifactCache {
+	plain := make(map[string]bool, len(plainHTTPHosts))
+	for _, h := range plainHTTPHosts {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			plain[h] = true
+		}
+	}
+	return &ArtifactCache{
+		dir:       dir,
+		plainHTTP: plain,
+		client:    &auth.Client{Client: retry.DefaultClient, Cache: auth.NewCache(), Credential: creds},
+		fills:     make(map[digest.Digest]*cacheFill),
+	}
+}
+
+// SetMaxBytes caps the disk space of cached content. Once a fill takes the cache past it, the
+// least recently served content is removed. Zero disables the cap.
+func (c *ArtifactCache) SetMaxBytes(n int64) {
+	c.maxBytes = n
+}
+
+// SetArtifactCache serves c under /v2/ for authenticated devices.
+func (g *Gateway) SetArtifactCache(c *ArtifactCache) {
+	g.artifactCache = c
+}
+
+func (c *ArtifactCache) path(d digest.Digest) string {
+	return filepath.Join(c.dir, "blobs", d.Algorithm().String(), d.Encoded())
+}
+
+// lockFill takes the fill lock of d and returns its unlock.
+func (c *ArtifactCache) lockFill(d digest.Digest) func() {
+	c.mu.Lock()
+	f, ok := c.fills[d]
+	if !ok {
+		f = &cacheFill{}
+		c.fills[d] = f
+	}
+	f.waiters++
+	c.mu.Unlock()
+
+	f.Lock()
+	return func() {
+		f.Unlock()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if f.waiters--; f.waiters == 0 {
+			delete(c.fills, d)
+		}
+	}
+}
+
+// touch marks path as just used, so eviction keeps it longest.
+func touch(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+// evict removes the least recently used content until the cache fits maxBytes again. keep,
+// the content just filled, is never removed, even when it alone exceeds the cap.
+func (c *ArtifactCache) evict(keep string) {
+	if c.maxBytes <= 0 {
+		return
+	}
+	c.evictMu.Lock()
+	defer c.evictMu.Unlock()
+
+	type cached struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var entries []cached
+	var total int64
+	_ = filepath.WalkDir(filepath.Join(c.dir, "blobs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".fill-") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, cached{path: path, size: info.Size(), used: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if total <= c.maxBytes {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+	for _, e := range entries {
+		if total <= c.maxBytes {
+			return
+		}
+		if e.path == keep {
+			continue
+		}
+		if err := os.Remove(e.path); err == nil || errors.Is(err, os.ErrNotExist) {
+			total -= e.size
+		}
+	}
+}
+
+func (c *ArtifactCache) repository(upstream, name string) (*remote.Repository, error) {
+	repo, err := remote.NewRepository(upstream + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	repo.PlainHTTP = c.plainHTTP[strings.ToLower(upstream)]
+	repo.Client = c.client
+	return repo, nil
+}
+
+// ensure returns the path of desc's content, fetching and verifying it from upstream on a miss.
+// Concurrent misses for the same digest share a single upstream fetch.
+func (c *ArtifactCache) ensure(ctx context.Context, upstream, name string, desc ocispec.Descriptor, manifest bool) (string, error) {
+	path := c.path(desc.Digest)
+	if _, err := os.Stat(path); err == nil {
+		touch(path)
+		return path, nil
+	}
+
+	unlock := c.lockFill(desc.Digest)
+	defer unlock()
+	if _, err := os.Stat(path); err == nil {
+		touch(path)
+		return path, nil
+	}
+
+	repo, err := c.repository(upstream, name)
+	if err != nil {
+		return "", err
+	}
+	var rc io.ReadCloser
+	if manifest {
+		want := desc.Digest
+		desc, rc, err = repo.Manifests().FetchReference(ctx, want.String())
+		if err == nil && (desc.Digest != want || desc.Size > maxCachedManifestSize) {
+			rc.Close()
+			err = fmt.Errorf("upstream manifest %s (%d bytes) rejected for %s", desc.Digest, desc.Size, want)
+		}
+	} else {
+		rc, err = repo.Blobs().Fetch(ctx, desc)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".fill-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	vr := content.NewVerifyReader(rc, desc)
+	if _, err := io.Copy(tmp, vr); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := vr.Verify(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	c.evict(path)
+	return path, nil
+}
+
+// readManifest loads a cached (or freshly filled) manifest.
+func (c *ArtifactCache) readManifest(ctx context.Context, upstream, name string, d digest.Digest) (ocispec.Manifest, []byte, error) {
+	var manifest ocispec.Manifest
+	path, err := c.ensure(ctx, upstream, name, ocispec.Descriptor{Digest: d}, true)
+	if err != nil {
+		return manifest, nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return manifest, nil, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, nil, fmt.Errorf("decode manifest %s: %w", d, err)
+	}
+	return manifest, data, nil
+}
+
+// handleRegistry serves GET/HEAD /v2/<name>/{manifests,blobs}/<digest>?ns=<upstream registry>.
+func (g *Gateway) handleRegistry(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "read-only cache")
+		return
+	}
+
+	device := strings.TrimSpace(r.Header.Get(deviceNameHeader))
+	if device == "" || !g.authorize(r, device) {
+		writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "device authentication required")
+		return
+	}
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/v2/")
+	var name, kind, ref string
+	for _, k := range []string{"manifests", "blobs"} {
+		if idx := strings.LastIndex(rest, "/"+k+"/"); idx > 0 {
+			name, kind, ref = rest[:idx], k, rest[idx+len(k)+2:]
+			break
+		}
+	}
+	upstream := strings.TrimSpace(r.URL.Query().Get(upstreamQueryParam))
+	if name == "" || upstream == "" {
+		writeRegistryError(w, http.StatusNotFound, "NAME_UNKNOWN", "expected /v2/<name>/{manifests,blobs}/<digest>?ns=<registry>")
+		return
+	}
+	d, err := digest.Parse(ref)
+	if err != nil {
+		writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "only digest references are served")
+		return
+	}
+
+	allowed, err := g.referencedManifests(ctx, device, upstream, name)
+	if err != nil {
+		g.log.Error(err, "list referenced artifacts", "device", device)
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", "failed to authorize")
+		return
+	}
+
+	cache := g.artifactCache
+	if kind == "manifests" {
+		if _, ok := allowed[d]; !ok {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest not referenced by this device")
+			return
+		}
+		manifest, data, err := cache.readManifest(ctx, upstream, name, d)
+		if err != nil {
+			g.log.Error(err, "fill manifest", "device", device, "upstream", upstream, "name", name, "digest", d)
+			writeRegistryError(w, http.StatusBadGateway, "UNKNOWN", "upstream fetch failed")
+			return
+		}
+		mediaType := manifest.MediaType
+		if mediaType == "" {
+			mediaType = ocispec.MediaTypeImageManifest
+		}
+		serveCached(w, r, cache.path(d), d, mediaType, int64(len(data)))
+		return
+	}
+
+	// Blobs are served only when they belong to a manifest the device is allowed to pull.
+	for m := range allowed {
+		manifest, _, err := cache.readManifest(ctx, upstream, name, m)
+		if err != nil {
+			g.log.Error(err, "fill manifest", "device", device, "upstream", upstream, "name", name, "digest", m)
+			continue
+		}
+		for _, desc := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+			if desc.Digest != d {
+				continue
+			}
+			path, err := cache.ensure(ctx, upstream, name, desc, false)
+			if err != nil {
+				g.log.Error(err, "fill blob", "device", device, "upstream", upstream, "name", name, "digest", d)
+				writeRegistryError(w, http.StatusBadGateway, "UNKNOWN", "upstream fetch failed")
+				return
+			}
+			serveCached(w, r, path, d, "application/octet-stream", desc.Size)
+			return
+		}
+	}
+	writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob not referenced by this device")
+}
+
+// referencedManifests returns the manifest digests the device's DeviceProcesses pin in upstream/name,
+// including the artifacts they prefetch.
+func (g *Gateway) referencedManifests(ctx context.Context, device, upstream, name string) (map[digest.Digest]struct{}, error) {
+	processes, err := g.listDeviceProcesses(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[digest.Digest]struct{})
+	for i := range processes {
+		for _, ref := range ociReferences(processes[i].Spec) {
+			if !strings.EqualFold(ref.Registry, upstream) || ref.Repository != name {
+				continue
+			}
+			if d, err := digest.Parse(ref.Reference); err == nil {
+				out[d] = struct{}{}
+			}
+		}
+	}
+	return out, nil
+}
+
+// ociReferences returns the parsed OCI references of spec's artifact and prefetch artifact; the
+// device pulls both.
+func ociReferences(spec apiv1alpha1.DeviceProcessSpec) []registry.Reference {
+	artifacts := []apiv1alpha1.DeviceProcessArtifact{spec.Artifact}
+	if spec.PrefetchArtifact != nil {
+		artifacts = append(artifacts, *spec.PrefetchArtifact)
+	}
+	var refs []registry.Reference
+	for _, artifact := range artifacts {
+		if artifact.Type != apiv1alpha1.ArtifactTypeOCI {
+			continue
+		}
+		if ref, err := registry.ParseReference(strings.TrimSpace(artifact.URL)); err == nil {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+func serveCached(w http.ResponseWriter, r *http.Request, path string, d digest.Digest, mediaType string, size int64) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "not cached")
+			return
+		}
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", "read cache")
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", d.String())
+	w.Header().Set("Etag", `"`+d.String()+`"`)
+	// ServeContent handles HEAD and Range requests.
+	http.ServeContent(w, r, "", time.Time{}, io.NewSectionReader(f, 0, size))
+}
+
+func writeRegistryError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": msg}},
+	})
+}
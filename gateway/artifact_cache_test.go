@@ -0,0 +1,197 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestArtifactCacheServesOnlyReferencedDigests(t *testing.T) {
+	layer := []byte("layer-bytes")
+	config := []byte("{}")
+	layerDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(layer), Size: int64(len(layer))}
+	configDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeEmptyJSON, Digest: digest.FromBytes(config), Size: int64(len(config))}
+	manifest := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Config: configDesc, Layers: []ocispec.Descriptor{layerDesc}}
+	manifest.SchemaVersion = 2
+	manifestBytes, _ := json.Marshal(manifest)
+	manifestDigest := digest.FromBytes(manifestBytes)
+	// The next release is only staged through a prefetch artifact.
+	nextLayer := []byte("next-layer-bytes")
+	nextLayerDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(nextLayer), Size: int64(len(nextLayer))}
+	nextManifest := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Config: configDesc, Layers: []ocispec.Descriptor{nextLayerDesc}}
+	nextManifest.SchemaVersion = 2
+	nextManifestBytes, _ := json.Marshal(nextManifest)
+	nextManifestDigest := digest.FromBytes(nextManifestBytes)
+	content := map[string][]byte{
+		manifestDigest.String():       manifestBytes,
+		layerDesc.Digest.String():     layer,
+		configDesc.Digest.String():    config,
+		nextManifestDigest.String():   nextManifestBytes,
+		nextLayerDesc.Digest.String(): nextLayer,
+	}
+
+	upstreamHits := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits++
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/team/app/"), "/")
+		data, ok := content[parts[len(parts)-1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if parts[0] == "manifests" {
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		}
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(data).String())
+		_, _ = w.Write(data)
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	proc := &apiv1alpha1.DeviceProcess{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "ns"},
+		Spec: apiv1alpha1.DeviceProcessSpec{
+			DeviceRef: apiv1alpha1.DeviceRef{Kind: apiv1alpha1.DeviceRefKindServer, Name: "dev"},
+			Artifact:  apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: upstreamHost + "/team/app@" + manifestDigest.String()},
+		},
+	}
+	staged := &apiv1alpha1.DeviceProcess{
+		ObjectMeta: metav1.ObjectMeta{Name: "staged", Namespace: "ns"},
+		Spec: apiv1alpha1.DeviceProcessSpec{
+			DeviceRef:        apiv1alpha1.DeviceRef{Kind: apiv1alpha1.DeviceRefKindServer, Name: "dev"},
+			Artifact:         apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/opt/app"},
+			PrefetchArtifact: &apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: upstreamHost + "/team/app@" + nextManifestDigest.String()},
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(proc, staged).
+		WithIndex(&apiv1alpha1.DeviceProcess{}, "spec.deviceRef.name", func(o client.Object) []string {
+			return []string{o.(*apiv1alpha1.DeviceProcess).Spec.DeviceRef.Name}
+		}).Build()
+	g := &Gateway{client: c, recorder: nopRecorder{}, authToken: "shared", authSecret: "secret"}
+	g.SetArtifactCache(NewArtifactCache(t.TempDir(), nil, []string{upstreamHost}))
+	srv := httptest.NewServer(http.HandlerFunc(g.handleRegistry))
+	defer srv.Close()
+
+	get := func(device, path string, header http.Header) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v2/team/app/"+path+"?ns="+upstreamHost, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set(deviceNameHeader, device)
+		req.Header.Set(deviceTokenHeader, computeDeviceToken("secret", "dev"))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, body := get("dev", "manifests/"+manifestDigest.String(), nil)
+	if resp.StatusCode != http.StatusOK || string(body) != string(manifestBytes) {
+		t.Fatalf("manifest: status %d body %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Type") != ocispec.MediaTypeImageManifest || resp.Header.Get("Docker-Content-Digest") != manifestDigest.String() {
+		t.Fatalf("unexpected manifest headers %v", resp.Header)
+	}
+
+	resp, body = get("dev", "blobs/"+layerDesc.Digest.String(), nil)
+	if resp.StatusCode != http.StatusOK || string(body) != string(layer) {
+		t.Fatalf("blob: status %d body %q", resp.StatusCode, body)
+	}
+	resp, body = get("dev", "manifests/"+nextManifestDigest.String(), nil)
+	if resp.StatusCode != http.StatusOK || string(body) != string(nextManifestBytes) {
+		t.Fatalf("prefetch manifest: status %d body %q", resp.StatusCode, body)
+	}
+	resp, body = get("dev", "blobs/"+nextLayerDesc.Digest.String(), nil)
+	if resp.StatusCode != http.StatusOK || string(body) != string(nextLayer) {
+		t.Fatalf("prefetch blob: status %d body %q", resp.StatusCode, body)
+	}
+	hits := upstreamHits
+
+	resp, body = get("dev", "blobs/"+layerDesc.Digest.String(), http.Header{"Range": {"bytes=6-"}})
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "bytes" {
+		t.Fatalf("range: status %d body %q", resp.StatusCode, body)
+	}
+	if upstreamHits != hits {
+		t.Fatalf("cached blob must not be refetched upstream")
+	}
+
+	if resp, _ := get("dev", "blobs/"+digest.FromString("other").String(), nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unreferenced blob: expected 404, got %d", resp.StatusCode)
+	}
+	if resp, _ := get("dev", "manifests/latest", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("tag reference: expected 404, got %d", resp.StatusCode)
+	}
+	if resp, _ := get("other-dev", "manifests/"+manifestDigest.String(), nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("token for another device: expected 401, got %d", resp.StatusCode)
+	}
+	if upstreamHits != hits {
+		t.Fatalf("rejected requests must not reach upstream")
+	}
+}
+
+func TestArtifactCacheEvictsLeastRecentlyUsedAndDropsFillLocks(t *testing.T) {
+	blobs := map[string][]byte{}
+	var descs []ocispec.Descriptor
+	for _, data := range []string{"aaaaaaaaaa", "bbbbbbbbbb", "cccccccccc"} {
+		d := digest.FromString(data)
+		blobs[d.String()] = []byte(data)
+		descs = append(descs, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: d, Size: int64(len(data))})
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := blobs[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	cache := NewArtifactCache(t.TempDir(), nil, []string{host})
+	cache.SetMaxBytes(25)
+	ctx := context.Background()
+	ensure := func(desc ocispec.Descriptor, used time.Time) string {
+		t.Helper()
+		path, err := cache.ensure(ctx, host, "team/app", desc, false)
+		if err != nil {
+			t.Fatalf("ensure %s: %v", desc.Digest, err)
+		}
+		if err := os.Chtimes(path, used, used); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	base := time.Now().Add(-time.Hour)
+	a := ensure(descs[0], base)
+	b := ensure(descs[1], base.Add(time.Minute))
+	// Serving a again makes b the least recently used.
+	ensure(descs[0], base.Add(2*time.Minute))
+	c := ensure(descs[2], base.Add(3*time.Minute))
+
+	for path, want := range map[string]bool{a: true, b: false, c: true} {
+		if _, err := os.Stat(path); (err == nil) != want {
+			t.Fatalf("%s: expected cached=%v, got err=%v", path, want, err)
+		}
+	}
+	if len(cache.fills) != 0 {
+		t.Fatalf("expected fill locks to be dropped after their fills, got %d", len(cache.fills))
+	}
+}
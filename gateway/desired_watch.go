@@ -0,0 +1,124 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+const (
+	// desiredWaitParam asks GET desired to hold the request while If-None-Match still matches.
+	desiredWaitParam = "waitSeconds"
+	// desiredWaitHeader echoes the wait the gateway honoured; agents treat its absence as a
+	// gateway without watch support and keep polling.
+	desiredWaitHeader     = "X-Desired-Wait-Seconds"
+	maxDesiredWaitSeconds = 300
+)
+
+// desiredNotifier wakes long-polls for a device when its DeviceProcesses or DeviceProcessSet
+// change.
+type desiredNotifier struct {
+	mu      sync.Mutex
+	waiters map[string]chan struct{}
+}
+
+func newDesiredNotifier() *desiredNotifier {
+	return &desiredNotifier{waiters: make(map[string]chan struct{})}
+}
+
+// changed returns a channel that is closed on the next notify for device. Callers subscribe
+// before computing desired state so a change in between is not missed.
+func (n *desiredNotifier) changed(device string) <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ch, ok := n.waiters[device]
+	if !ok {
+		ch = make(chan struct{})
+		n.waiters[device] = ch
+	}
+	return ch
+}
+
+func (n *desiredNotifier) notify(device string) {
+	if device == "" {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if ch, ok := n.waiters[device]; ok {
+		close(ch)
+		delete(n.waiters, device)
+	}
+}
+
+// WatchDeviceProcesses enables long-poll delivery of desired state. DeviceProcess and
+// DeviceProcessSet events from the informers wake the agents of the affected devices; without it
+// GET desired ignores waitSeconds and agents fall back to polling.
+func (g *Gateway) WatchDeviceProcesses(ctx context.Context, informers cache.Informers) error {
+	informer, err := informers.GetInformer(ctx, &apiv1alpha1.DeviceProcess{})
+	if err != nil {
+		return err
+	}
+	notifier := newDesiredNotifier()
+	if _, err := informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) { notifier.notify(deviceRefName(obj)) },
+		UpdateFunc: func(oldObj, newObj any) {
+			notifier.notify(deviceRefName(oldObj))
+			notifier.notify(deviceRefName(newObj))
+		},
+		DeleteFunc: func(obj any) { notifier.notify(deviceRefName(obj)) },
+	}); err != nil {
+		return err
+	}
+	sets, err := informers.GetInformer(ctx, &apiv1alpha1.DeviceProcessSet{})
+	if err != nil {
+		return err
+	}
+	if _, err := sets.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { notifier.notify(deviceSetName(obj)) },
+		UpdateFunc: func(_, newObj any) { notifier.notify(deviceSetName(newObj)) },
+	}); err != nil {
+		return err
+	}
+	g.desiredWatch = notifier
+	return nil
+}
+
+func deviceRefName(obj any) string {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if dp, ok := obj.(*apiv1alpha1.DeviceProcess); ok {
+		return dp.Spec.DeviceRef.Name
+	}
+	return ""
+}
+
+func deviceSetName(obj any) string {
+	if set, ok := obj.(*apiv1alpha1.DeviceProcessSet); ok {
+		return set.Name
+	}
+	return ""
+}
+
+// desiredWait returns how long GET desired may hold the request, or 0 when the caller did not
+// ask for a watch or the gateway has no informer to wake it.
+func (g *Gateway) desiredWait(r *http.Request) time.Duration {
+	if g.desiredWatch == nil {
+		return 0
+	}
+	secs, err := strconv.Atoi(r.URL.Query().Get(desiredWaitParam))
+	if err != nil || secs <= 0 {
+		return 0
+	}
+	if secs > maxDesiredWaitSeconds {
+		secs = maxDesiredWaitSeconds
+	}
+	return time.Duration(secs) * time.Second
+}
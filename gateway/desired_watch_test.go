@@ -0,0 +1,179 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDesiredLongPollWakesOnDeviceProcessChange(t *testing.T) {
+	ctx := context.Background()
+	scheme := testScheme(t)
+	proc := &apiv1alpha1.DeviceProcess{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "ns"},
+		Spec: apiv1alpha1.DeviceProcessSpec{
+			DeviceRef: apiv1alpha1.DeviceRef{Kind: apiv1alpha1.DeviceRefKindServer, Name: "dev"},
+			Execution: apiv1alpha1.DeviceProcessExecution{Backend: apiv1alpha1.DeviceProcessBackendSystemd, Command: []string{"/bin/true"}},
+			Artifact:  apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/bin/true"},
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(proc).
+		WithIndex(&apiv1alpha1.DeviceProcess{}, "spec.deviceRef.name", func(obj client.Object) []string {
+			return []string{obj.(*apiv1alpha1.DeviceProcess).Spec.DeviceRef.Name}
+		}).Build()
+	g := New(c, nopRecorder{}, "", "", "", 15*time.Second, 3)
+	informers := &informertest.FakeInformers{Scheme: scheme}
+	if err := g.WatchDeviceProcesses(ctx, informers); err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(g.handleDevice))
+	defer srv.Close()
+
+	get := func(etag, wait string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/devices/dev/desired"+wait, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("get desired: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	first := get("", "")
+	etag := first.Header.Get(desiredETagHeader)
+	if first.StatusCode != http.StatusOK || first.Header.Get(desiredWaitHeader) != "" {
+		t.Fatalf("plain GET: status=%d wait=%q", first.StatusCode, first.Header.Get(desiredWaitHeader))
+	}
+
+	// An unchanged device answers 304 once the wait runs out.
+	start := time.Now()
+	if resp := get(etag, "?waitSeconds=1"); resp.StatusCode != http.StatusNotModified || resp.Header.Get(desiredWaitHeader) != "1" || time.Since(start) < time.Second {
+		t.Fatalf("expected 304 after the wait, got %d after %s", resp.StatusCode, time.Since(start))
+	}
+
+	// A DeviceProcess event from the informer releases the held request with the new state.
+	done := make(chan *http.Response, 1)
+	go func() { done <- get(etag, "?waitSeconds=30") }()
+	time.Sleep(100 * time.Millisecond)
+	updated := proc.DeepCopy()
+	if err := c.Get(ctx, client.ObjectKeyFromObject(proc), updated); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	updated.Spec.Execution.Args = []string{"--verbose"}
+	if err := c.Update(ctx, updated); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	fi, err := informers.FakeInformerFor(ctx, &apiv1alpha1.DeviceProcess{})
+	if err != nil {
+		t.Fatalf("fake informer: %v", err)
+	}
+	fi.Update(proc, updated)
+
+	select {
+	case resp := <-done:
+		if resp.StatusCode != http.StatusOK || resp.Header.Get(desiredETagHeader) == etag {
+			t.Fatalf("expected new desired state, got %d etag=%q", resp.StatusCode, resp.Header.Get(desiredETagHeader))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("long-poll was not woken by the informer event")
+	}
+}
+
+func TestDesiredLongPollWakesWhenRegistryTokenIsRenewed(t *testing.T) {
+	ctx := context.Background()
+	scheme := testScheme(t)
+	var mints atomic.Int32
+	var registry *httptest.Server
+	registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.Header().Set("Www-Authenticate", `Bearer realm="`+registry.URL+`/token",service="stand-in"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/token":
+			n := mints.Add(1)
+			_ = json.NewEncoder(w).Encode(map[string]any{"access_token": fmt.Sprintf("token-%d", n), "expires_in": 2})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	proc := &apiv1alpha1.DeviceProcess{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "ns"},
+		Spec: apiv1alpha1.DeviceProcessSpec{
+			DeviceRef: apiv1alpha1.DeviceRef{Kind: apiv1alpha1.DeviceRefKindServer, Name: "dev"},
+			Execution: apiv1alpha1.DeviceProcessExecution{Backend: apiv1alpha1.DeviceProcessBackendSystemd, Command: []string{"bin/app"}},
+			Artifact:  apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: host + "/team/app@sha256:" + strings.Repeat("a", 64)},
+		},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "apollo"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"` + host + `":{"username":"gw","password":"pw"}}}`),
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(proc, secret).
+		WithIndex(&apiv1alpha1.DeviceProcess{}, "spec.deviceRef.name", func(obj client.Object) []string {
+			return []string{obj.(*apiv1alpha1.DeviceProcess).Spec.DeviceRef.Name}
+		}).Build()
+	g := New(c, nopRecorder{}, "", "", "", 15*time.Second, 3)
+	g.SetRegistryTokenIssuer(NewRegistryTokenIssuer(c, types.NamespacedName{Namespace: "apollo", Name: "registry"}, []string{host}))
+	if err := g.WatchDeviceProcesses(ctx, &informertest.FakeInformers{Scheme: scheme}); err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(g.handleDevice))
+	defer srv.Close()
+
+	get := func(etag, wait string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/devices/dev/desired"+wait, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("get desired: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	etag := get("", "").Header.Get(desiredETagHeader)
+	if mints.Load() != 1 {
+		t.Fatalf("expected one token, got %d mints", mints.Load())
+	}
+
+	// The token lives 2s, so the held request must answer with a new one after about 1s rather
+	// than at the end of its 30s wait.
+	start := time.Now()
+	resp := get(etag, "?waitSeconds=30")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(desiredETagHeader) == etag {
+		t.Fatalf("expected a renewed token, got %d etag=%q", resp.StatusCode, resp.Header.Get(desiredETagHeader))
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("held request outlived the token's half-life: answered after %s", elapsed)
+	}
+	if mints.Load() != 2 {
+		t.Fatalf("expected the token to be renewed once, got %d mints", mints.Load())
+	}
+}
@@ -0,0 +1,152 @@
+package gateway
+
+import (
+	"context"
+	"crypto/subtle"
+	"sync"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// deviceTokenStore caches per-device token Secrets from the informer, so authorizing a request
+// never reaches the API server.
+type deviceTokenStore struct {
+	mu       sync.RWMutex
+	bySecret map[types.NamespacedName]deviceTokenEntry
+	byDevice map[string]types.NamespacedName
+}
+
+type deviceTokenEntry struct {
+	device          string
+	token           []byte
+	previous        []byte
+	previousExpires time.Time
+	disabled        bool
+}
+
+func newDeviceTokenStore() *deviceTokenStore {
+	return &deviceTokenStore{
+		bySecret: make(map[types.NamespacedName]deviceTokenEntry),
+		byDevice: make(map[string]types.NamespacedName),
+	}
+}
+
+// WatchDeviceTokens authenticates devices with their per-device token Secrets. A device with a
+// Secret only accepts its current token, or the previous one until its grace window ends; the
+// shared token and HMAC secret no longer work for it. A disabled Secret refuses every request
+// for the device, including ones carrying a client certificate.
+func (g *Gateway) WatchDeviceTokens(ctx context.Context, informers cache.Informers) error {
+	informer, err := informers.GetInformer(ctx, &corev1.Secret{})
+	if err != nil {
+		return err
+	}
+	store := newDeviceTokenStore()
+	if _, err := informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    store.set,
+		UpdateFunc: func(_, newObj any) { store.set(newObj) },
+		DeleteFunc: store.remove,
+	}); err != nil {
+		return err
+	}
+	g.deviceTokens = store
+	return nil
+}
+
+func (s *deviceTokenStore) set(obj any) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+	key := types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}
+	device := secret.Annotations[apiv1alpha1.DeviceTokenDeviceAnnotation]
+	if secret.Labels[apiv1alpha1.DeviceTokenLabel] != "true" || device == "" || !ownedTokenSecret(secret, device) {
+		s.remove(obj)
+		return
+	}
+	entry := deviceTokenEntry{
+		device:   device,
+		token:    secret.Data[apiv1alpha1.DeviceTokenKey],
+		previous: secret.Data[apiv1alpha1.DeviceTokenPreviousKey],
+		disabled: string(secret.Data[apiv1alpha1.DeviceTokenDisabledKey]) == "true",
+	}
+	if expires, err := time.Parse(time.RFC3339, string(secret.Data[apiv1alpha1.DeviceTokenPreviousExpiresKey])); err == nil {
+		entry.previousExpires = expires
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.bySecret[key]; ok && old.device != device && s.byDevice[old.device] == key {
+		delete(s.byDevice, old.device)
+	}
+	s.bySecret[key] = entry
+	s.byDevice[device] = key
+}
+
+// ownedTokenSecret reports whether secret is the one the controller keeps for device: named after
+// it and controlled by its NetworkSwitch. Any other Secret carrying the label and annotation could
+// otherwise replace or revoke a device's token.
+func ownedTokenSecret(secret *corev1.Secret, device string) bool {
+	if secret.Name != apiv1alpha1.DeviceTokenSecretPrefix+device {
+		return false
+	}
+	owner := metav1.GetControllerOf(secret)
+	return owner != nil &&
+		owner.APIVersion == apiv1alpha1.SchemeGroupVersion.String() &&
+		owner.Kind == string(apiv1alpha1.DeviceRefKindNetworkSwitch) &&
+		owner.Name == device
+}
+
+func (s *deviceTokenStore) remove(obj any) {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+	key := types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.bySecret[key]; ok && s.byDevice[old.device] == key {
+		delete(s.byDevice, old.device)
+	}
+	delete(s.bySecret, key)
+}
+
+// lookup returns the token entry for device; ok is false for devices without a Secret, or when
+// per-device tokens are not enabled.
+func (s *deviceTokenStore) lookup(device string) (deviceTokenEntry, bool) {
+	if s == nil {
+		return deviceTokenEntry{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.byDevice[device]
+	if !ok {
+		return deviceTokenEntry{}, false
+	}
+	return s.bySecret[key], true
+}
+
+// disabled reports whether device has been revoked.
+func (s *deviceTokenStore) disabled(device string) bool {
+	entry, ok := s.lookup(device)
+	return ok && entry.disabled
+}
+
+// accepts reports whether token is the current token, or the previous one within its grace window.
+func (e deviceTokenEntry) accepts(token string, now time.Time) bool {
+	if token == "" || e.disabled {
+		return false
+	}
+	if len(e.token) > 0 && subtle.ConstantTimeCompare([]byte(token), e.token) == 1 {
+		return true
+	}
+	return len(e.previous) > 0 && now.Before(e.previousExpires) && subtle.ConstantTimeCompare([]byte(token), e.previous) == 1
+}
@@ -0,0 +1,118 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+)
+
+func deviceTokenSecret(device string, data map[string]string) *corev1.Secret {
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        apiv1alpha1.DeviceTokenSecretPrefix + device,
+			Namespace:   "default",
+			Labels:      map[string]string{apiv1alpha1.DeviceTokenLabel: "true"},
+			Annotations: map[string]string{apiv1alpha1.DeviceTokenDeviceAnnotation: device},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: apiv1alpha1.SchemeGroupVersion.String(),
+				Kind:       "NetworkSwitch",
+				Name:       device,
+				UID:        types.UID("uid-" + device),
+				Controller: boolPtr(true),
+			}},
+		},
+		Data: map[string][]byte{},
+	}
+	for k, v := range data {
+		s.Data[k] = []byte(v)
+	}
+	return s
+}
+
+func TestDeviceTokenSecretsReplaceSharedTokenAndRevoke(t *testing.T) {
+	ctx := context.Background()
+	g := pollGateway(t, pollProcess("a", nil))
+	g.authToken = "shared-token"
+	informers := &informertest.FakeInformers{Scheme: testScheme(t)}
+	if err := g.WatchDeviceTokens(ctx, informers); err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	fi, err := informers.FakeInformerFor(ctx, &corev1.Secret{})
+	if err != nil {
+		t.Fatalf("informer: %v", err)
+	}
+
+	status := func(token string, peer *x509.Certificate) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/v1/devices/dev/desired", nil)
+		req.Header.Set(deviceTokenHeader, token)
+		if peer != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{peer}}}
+		}
+		rec := httptest.NewRecorder()
+		g.handleDevice(rec, req)
+		return rec.Code
+	}
+
+	if code := status("shared-token", nil); code != http.StatusOK {
+		t.Fatalf("expected the shared token before dev has a Secret, got %d", code)
+	}
+
+	// Secrets the controller does not own for dev cannot set or revoke its token.
+	renamed := deviceTokenSecret("dev", map[string]string{apiv1alpha1.DeviceTokenDisabledKey: "true"})
+	renamed.Name, renamed.Namespace = "forged", "tenant"
+	unowned := deviceTokenSecret("dev", map[string]string{apiv1alpha1.DeviceTokenKey: "forged"})
+	unowned.Namespace, unowned.OwnerReferences = "tenant", nil
+	fi.Add(renamed)
+	fi.Add(unowned)
+	if code := status("shared-token", nil); code != http.StatusOK {
+		t.Fatalf("expected foreign Secrets to be ignored, got %d", code)
+	}
+	if code := status("forged", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected the token of an unowned Secret to be refused, got %d", code)
+	}
+
+	secret := deviceTokenSecret("dev", map[string]string{
+		apiv1alpha1.DeviceTokenKey:                "new",
+		apiv1alpha1.DeviceTokenPreviousKey:        "old",
+		apiv1alpha1.DeviceTokenPreviousExpiresKey: time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	})
+	fi.Add(secret)
+	for token, want := range map[string]int{"shared-token": http.StatusUnauthorized, "new": http.StatusOK, "old": http.StatusOK, "": http.StatusUnauthorized} {
+		if code := status(token, nil); code != want {
+			t.Fatalf("token %q: expected %d, got %d", token, want, code)
+		}
+	}
+
+	// Once the grace window ends only the current token is accepted.
+	rotated := secret.DeepCopy()
+	rotated.Data[apiv1alpha1.DeviceTokenPreviousExpiresKey] = []byte(time.Now().Add(-time.Second).UTC().Format(time.RFC3339))
+	fi.Update(secret, rotated)
+	if code := status("old", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected the previous token to expire, got %d", code)
+	}
+
+	// Disabling the device refuses even a valid client certificate.
+	disabled := rotated.DeepCopy()
+	disabled.Data[apiv1alpha1.DeviceTokenDisabledKey] = []byte("true")
+	fi.Update(rotated, disabled)
+	if code := status("new", &x509.Certificate{Subject: pkix.Name{CommonName: "dev"}}); code != http.StatusUnauthorized {
+		t.Fatalf("expected a disabled device to be refused, got %d", code)
+	}
+
+	fi.Delete(disabled)
+	if code := status("shared-token", nil); code != http.StatusOK {
+		t.Fatalf("expected the shared token again once the Secret is gone, got %d", code)
+	}
+}
@@ -0,0 +1,35 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestPlanObservationOnlyRecordsThePlan(t *testing.T) {
+	ctx := context.Background()
+	proc := pollProcess("a", nil)
+	proc.Status.Phase = apiv1alpha1.DeviceProcessPhaseRunning
+	proc.Status.ObservedSpecHash = "running"
+	c := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(proc).WithStatusSubresource(&apiv1alpha1.DeviceProcess{}).Build()
+	g := &Gateway{client: c, recorder: nopRecorder{}}
+
+	obs := Observation{Namespace: "ns", Name: "a", Plan: &PlanObservation{SpecHash: "next", Action: "restart", Changes: []string{"unit"}, Message: "restart the unit on the new files"}}
+	if err := g.updateStatusForObservation(ctx, "dev", obs, nil); err != nil {
+		t.Fatalf("updateStatusForObservation: %v", err)
+	}
+	var got apiv1alpha1.DeviceProcess
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "a"}, &got); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	plan := got.Status.LastPlan
+	if plan == nil || plan.SpecHash != "next" || plan.Action != "restart" || len(plan.Changes) != 1 || plan.ReportedAt.IsZero() {
+		t.Fatalf("expected the plan to be recorded, got %+v", plan)
+	}
+	if got.Status.Phase != apiv1alpha1.DeviceProcessPhaseRunning || got.Status.ObservedSpecHash != "running" || len(got.Status.Conditions) != 0 {
+		t.Fatalf("expected a plan to leave the rest of the status alone, got %+v", got.Status)
+	}
+}
@@ -0,0 +1,291 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/pkg/conditions"
+	"github.com/apollo/praetor/pkg/tlsutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// BootstrapTokenHeader carries a single-use bootstrap token, "<id>.<secret>", on enrollment.
+	BootstrapTokenHeader = "X-Bootstrap-Token"
+	// BootstrapTokenSecretPrefix names the Secret holding token <id>: bootstrap-token-<id>.
+	BootstrapTokenSecretPrefix = "bootstrap-token-"
+	// Keys of a bootstrap token Secret: the secret half of the token, the device it is bound to
+	// and an optional RFC3339 expiry.
+	BootstrapTokenSecretKey     = "token-secret"
+	BootstrapTokenDeviceKey     = "device"
+	BootstrapTokenExpirationKey = "expiration"
+
+	maxEnrollRequestBytes = 64 << 10
+	maxEnrollmentNameLen  = 253
+
+	// A device may request at most maxRenewalEnrollments renewals per renewalEnrollmentWindow.
+	// Renewals are approved automatically, so nothing else stops a device from piling them up.
+	maxRenewalEnrollments   = 3
+	renewalEnrollmentWindow = 24 * time.Hour
+)
+
+// EnrollRequest is the body of POST /v1/devices/{device}/enroll.
+type EnrollRequest struct {
+	// CSR is a PEM-encoded certificate signing request with the device name as subject CN.
+	CSR string `json:"csr"`
+}
+
+// EnrollResponse reports a DeviceEnrollment. Devices poll GET /v1/devices/{device}/enroll/{name}
+// until Certificate is set or the request is denied.
+type EnrollResponse struct {
+	Name        string `json:"name"`
+	Approved    bool   `json:"approved"`
+	Denied      bool   `json:"denied"`
+	Message     string `json:"message,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+}
+
+var (
+	errBootstrapTokenInvalid = errors.New("bootstrap token invalid")
+	errRenewalLimit          = errors.New("too many renewal requests; retry later")
+)
+
+// SetEnrollment enables device enrollment. Bootstrap token Secrets are read from namespace and
+// consumed on use; DeviceEnrollments are created there for admins to approve. reader should
+// bypass the cache so Secrets are never listed or watched.
+func (g *Gateway) SetEnrollment(namespace string, reader client.Reader) {
+	g.enrollNamespace = namespace
+	g.enrollReader = reader
+}
+
+// handleEnroll serves enrollment, which a device reaches before it holds a credential: new
+// devices authenticate with a bootstrap token, renewals with their current certificate. Polls
+// need no credential; enrollment names are unguessable and only return public certificates.
+func (g *Gateway) handleEnroll(w http.ResponseWriter, r *http.Request, device string, rest []string) {
+	if g.enrollNamespace == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		g.createEnrollment(r.Context(), w, r, device)
+	case len(rest) == 1 && r.Method == http.MethodGet:
+		g.getEnrollment(r.Context(), w, device, rest[0])
+	case len(rest) <= 1:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (g *Gateway) createEnrollment(ctx context.Context, w http.ResponseWriter, r *http.Request, device string) {
+	var req EnrollRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxEnrollRequestBytes)).Decode(&req); err != nil {
+		g.respondErr(ctx, w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if _, err := tlsutil.ParseDeviceCSR([]byte(req.CSR), device); err != nil {
+		g.respondErr(ctx, w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if g.deviceTokens.disabled(device) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	names, renewal := clientCertDevice(r)
+	var bootstrap *corev1.Secret
+	if renewal {
+		if !containsString(names, device) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := g.checkRenewalLimit(ctx, device); err != nil {
+			if errors.Is(err, errRenewalLimit) {
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+				return
+			}
+			g.respondErr(ctx, w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else {
+		var err error
+		if bootstrap, err = g.checkBootstrapToken(ctx, device, r.Header.Get(BootstrapTokenHeader)); err != nil {
+			if !errors.Is(err, errBootstrapTokenInvalid) {
+				g.log.Error(err, "check bootstrap token", "device", device)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	name, err := enrollmentName(device)
+	if err != nil {
+		g.respondErr(ctx, w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	enrollment := &apiv1alpha1.DeviceEnrollment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: g.enrollNamespace},
+		Spec:       apiv1alpha1.DeviceEnrollmentSpec{DeviceName: device, Request: []byte(req.CSR), Renewal: renewal},
+	}
+	if err := g.client.Create(ctx, enrollment); err != nil {
+		g.respondErr(ctx, w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// The token is spent only once its enrollment exists, so a failed create leaves the device
+	// able to retry. If another request spent it meanwhile, this enrollment is withdrawn.
+	if bootstrap != nil {
+		if err := g.consumeBootstrapToken(ctx, bootstrap); err != nil {
+			if delErr := g.client.Delete(ctx, enrollment); delErr != nil && !apierrors.IsNotFound(delErr) {
+				g.log.Error(delErr, "withdraw enrollment", "device", device, "enrollment", name)
+			}
+			if !errors.Is(err, errBootstrapTokenInvalid) {
+				g.log.Error(err, "consume bootstrap token", "device", device)
+				g.respondErr(ctx, w, http.StatusInternalServerError, "failed to consume bootstrap token")
+				return
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	// The device already proved its identity with a certificate admins approved; renewing it
+	// needs no second approval.
+	if renewal {
+		conditions.MarkTrue(&enrollment.Status.Conditions, apiv1alpha1.ConditionApproved, "AutoApprovedRenewal", "renewal authenticated with the device's current certificate")
+		if err := g.client.Status().Update(ctx, enrollment); err != nil {
+			g.respondErr(ctx, w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	g.log.Info("device enrollment requested", "device", device, "enrollment", name, "renewal", renewal)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(enrollResponse(enrollment))
+}
+
+func (g *Gateway) getEnrollment(ctx context.Context, w http.ResponseWriter, device, name string) {
+	var enrollment apiv1alpha1.DeviceEnrollment
+	err := g.enrollReader.Get(ctx, types.NamespacedName{Namespace: g.enrollNamespace, Name: name}, &enrollment)
+	if apierrors.IsNotFound(err) || (err == nil && enrollment.Spec.DeviceName != device) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		g.respondErr(ctx, w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(enrollResponse(&enrollment))
+}
+
+// checkRenewalLimit refuses a renewal when device already requested maxRenewalEnrollments
+// within renewalEnrollmentWindow.
+func (g *Gateway) checkRenewalLimit(ctx context.Context, device string) error {
+	var list apiv1alpha1.DeviceEnrollmentList
+	if err := g.enrollReader.List(ctx, &list, client.InNamespace(g.enrollNamespace)); err != nil {
+		return err
+	}
+	since := time.Now().Add(-renewalEnrollmentWindow)
+	recent := 0
+	for i := range list.Items {
+		e := &list.Items[i]
+		if e.Spec.DeviceName == device && e.Spec.Renewal && e.CreationTimestamp.Time.After(since) {
+			recent++
+		}
+	}
+	if recent >= maxRenewalEnrollments {
+		return errRenewalLimit
+	}
+	return nil
+}
+
+// checkBootstrapToken returns the Secret of token when it is valid for device.
+func (g *Gateway) checkBootstrapToken(ctx context.Context, device, token string) (*corev1.Secret, error) {
+	id, secret, ok := strings.Cut(strings.TrimSpace(token), ".")
+	if !ok || id == "" || secret == "" || strings.ContainsAny(id, "/.") {
+		return nil, errBootstrapTokenInvalid
+	}
+	var s corev1.Secret
+	if err := g.enrollReader.Get(ctx, types.NamespacedName{Namespace: g.enrollNamespace, Name: BootstrapTokenSecretPrefix + id}, &s); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, errBootstrapTokenInvalid
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(s.Data[BootstrapTokenSecretKey], []byte(secret)) != 1 || string(s.Data[BootstrapTokenDeviceKey]) != device {
+		return nil, errBootstrapTokenInvalid
+	}
+	if raw := string(s.Data[BootstrapTokenExpirationKey]); raw != "" {
+		expires, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: invalid %s: %w", s.Name, BootstrapTokenExpirationKey, err)
+		}
+		if !time.Now().Before(expires) {
+			return nil, errBootstrapTokenInvalid
+		}
+	}
+	return &s, nil
+}
+
+// consumeBootstrapToken deletes a checked token Secret, so each token enrolls at most one
+// request. The delete is conditional on the version read, so two requests racing with the same
+// token cannot both succeed.
+func (g *Gateway) consumeBootstrapToken(ctx context.Context, s *corev1.Secret) error {
+	uid, rv := s.UID, s.ResourceVersion
+	err := g.client.Delete(ctx, s, client.Preconditions{UID: &uid, ResourceVersion: &rv})
+	if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+		return errBootstrapTokenInvalid
+	}
+	return err
+}
+
+// enrollmentName derives an unguessable DeviceEnrollment name for device.
+func enrollmentName(device string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	suffix := hex.EncodeToString(buf)
+	if prefix := maxEnrollmentNameLen - len(suffix) - 1; len(device) > prefix {
+		device = strings.TrimRight(device[:prefix], ".-")
+	}
+	return device + "-" + suffix, nil
+}
+
+func enrollResponse(e *apiv1alpha1.DeviceEnrollment) EnrollResponse {
+	resp := EnrollResponse{Name: e.Name, Certificate: string(e.Status.Certificate)}
+	if c := conditions.FindCondition(e.Status.Conditions, apiv1alpha1.ConditionApproved); c != nil && c.Status == metav1.ConditionTrue {
+		resp.Approved = true
+	}
+	if c := conditions.FindCondition(e.Status.Conditions, apiv1alpha1.ConditionDenied); c != nil && c.Status == metav1.ConditionTrue {
+		resp.Denied, resp.Message = true, c.Message
+	}
+	if c := conditions.FindCondition(e.Status.Conditions, apiv1alpha1.ConditionIssued); c != nil && c.Status == metav1.ConditionFalse {
+		resp.Message = c.Message
+	}
+	return resp
+}
+
+func containsString(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
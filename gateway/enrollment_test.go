@@ -0,0 +1,210 @@
+package gateway
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/pkg/conditions"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func enrollmentGateway(t *testing.T, objs ...client.Object) (*Gateway, client.Client) {
+	t.Helper()
+	c := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(objs...).
+		WithStatusSubresource(&apiv1alpha1.DeviceEnrollment{}).Build()
+	g := New(c, nopRecorder{}, "", "shared-token", "", 15*time.Second, 3)
+	g.SetEnrollment("enroll", c)
+	return g, c
+}
+
+func bootstrapSecret(id, secret, device, expiration string) *corev1.Secret {
+	data := map[string][]byte{BootstrapTokenSecretKey: []byte(secret), BootstrapTokenDeviceKey: []byte(device)}
+	if expiration != "" {
+		data[BootstrapTokenExpirationKey] = []byte(expiration)
+	}
+	return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: BootstrapTokenSecretPrefix + id, Namespace: "enroll"}, Data: data}
+}
+
+func testCSR(t *testing.T, cn string) string {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+	if err != nil {
+		t.Fatalf("create CSR: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+func enroll(t *testing.T, g *Gateway, device, token, csr string, peer *x509.Certificate) (int, EnrollResponse) {
+	t.Helper()
+	body, _ := json.Marshal(EnrollRequest{CSR: csr})
+	req := httptest.NewRequest(http.MethodPost, "/v1/devices/"+device+"/enroll", strings.NewReader(string(body)))
+	if token != "" {
+		req.Header.Set(BootstrapTokenHeader, token)
+	}
+	if peer != nil {
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{peer}}}
+	}
+	rec := httptest.NewRecorder()
+	g.handleDevice(rec, req)
+	var resp EnrollResponse
+	if rec.Code == http.StatusCreated || rec.Code == http.StatusOK {
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+	}
+	return rec.Code, resp
+}
+
+func TestEnrollConsumesBootstrapTokenOnce(t *testing.T) {
+	ctx := context.Background()
+	g, c := enrollmentGateway(t,
+		bootstrapSecret("abc123", "s3cret", "dev", ""),
+		bootstrapSecret("old000", "s3cret", "dev", time.Now().Add(-time.Minute).Format(time.RFC3339)))
+
+	if code, _ := enroll(t, g, "other", "abc123.s3cret", testCSR(t, "other"), nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected a token bound to dev to be refused for another device, got %d", code)
+	}
+	if code, _ := enroll(t, g, "dev", "abc123.wrong", testCSR(t, "dev"), nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected a wrong secret to be refused, got %d", code)
+	}
+	if code, _ := enroll(t, g, "dev", "old000.s3cret", testCSR(t, "dev"), nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected an expired token to be refused, got %d", code)
+	}
+	if code, _ := enroll(t, g, "dev", "abc123.s3cret", testCSR(t, "someone-else"), nil); code != http.StatusBadRequest {
+		t.Fatalf("expected a CSR for another CN to be rejected, got %d", code)
+	}
+
+	code, created := enroll(t, g, "dev", "abc123.s3cret", testCSR(t, "dev"), nil)
+	if code != http.StatusCreated || created.Approved || !strings.HasPrefix(created.Name, "dev-") {
+		t.Fatalf("expected a pending enrollment, got %d %+v", code, created)
+	}
+	var secret corev1.Secret
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "enroll", Name: BootstrapTokenSecretPrefix + "abc123"}, &secret); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the bootstrap token Secret to be consumed, got %v", err)
+	}
+	if code, _ := enroll(t, g, "dev", "abc123.s3cret", testCSR(t, "dev"), nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected a used token to be refused, got %d", code)
+	}
+
+	// Once an admin approves and the signer issues, polling returns the certificate.
+	var enrollment apiv1alpha1.DeviceEnrollment
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "enroll", Name: created.Name}, &enrollment); err != nil {
+		t.Fatalf("get enrollment: %v", err)
+	}
+	conditions.MarkTrue(&enrollment.Status.Conditions, apiv1alpha1.ConditionApproved, "AdminApproved", "")
+	enrollment.Status.Certificate = []byte("CERT")
+	if err := c.Status().Update(ctx, &enrollment); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	poll := func(device string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		g.handleDevice(rec, httptest.NewRequest(http.MethodGet, "/v1/devices/"+device+"/enroll/"+created.Name, nil))
+		return rec
+	}
+	rec := poll("dev")
+	var status EnrollResponse
+	_ = json.Unmarshal(rec.Body.Bytes(), &status)
+	if rec.Code != http.StatusOK || !status.Approved || status.Certificate != "CERT" {
+		t.Fatalf("expected the issued certificate, got %d %+v", rec.Code, status)
+	}
+	if rec := poll("other"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected another device's enrollment to be hidden, got %d", rec.Code)
+	}
+}
+
+func TestEnrollRenewalWithClientCertificateIsAutoApproved(t *testing.T) {
+	ctx := context.Background()
+	g, c := enrollmentGateway(t)
+	peer := &x509.Certificate{Subject: pkix.Name{CommonName: "dev"}}
+
+	if code, _ := enroll(t, g, "other", "", testCSR(t, "other"), peer); code != http.StatusUnauthorized {
+		t.Fatalf("expected dev's certificate to be refused for another device, got %d", code)
+	}
+	code, created := enroll(t, g, "dev", "", testCSR(t, "dev"), peer)
+	if code != http.StatusCreated || !created.Approved {
+		t.Fatalf("expected an approved renewal, got %d %+v", code, created)
+	}
+	var enrollment apiv1alpha1.DeviceEnrollment
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "enroll", Name: created.Name}, &enrollment); err != nil {
+		t.Fatalf("get enrollment: %v", err)
+	}
+	if !enrollment.Spec.Renewal {
+		t.Fatalf("expected the enrollment to be marked as a renewal")
+	}
+}
+
+func TestEnrollKeepsBootstrapTokenWhenEnrollmentCannotBeCreated(t *testing.T) {
+	ctx := context.Background()
+	failCreate := true
+	c := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(bootstrapSecret("abc123", "s3cret", "dev", "")).
+		WithStatusSubresource(&apiv1alpha1.DeviceEnrollment{}).
+		WithInterceptorFuncs(interceptor.Funcs{Create: func(ctx context.Context, cl client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			if _, ok := obj.(*apiv1alpha1.DeviceEnrollment); ok && failCreate {
+				return apierrors.NewServiceUnavailable("etcd unavailable")
+			}
+			return cl.Create(ctx, obj, opts...)
+		}}).Build()
+	g := New(c, nopRecorder{}, "", "shared-token", "", 15*time.Second, 3)
+	g.SetEnrollment("enroll", c)
+
+	if code, _ := enroll(t, g, "dev", "abc123.s3cret", testCSR(t, "dev"), nil); code != http.StatusInternalServerError {
+		t.Fatalf("expected the failed create to surface, got %d", code)
+	}
+	var secret corev1.Secret
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "enroll", Name: BootstrapTokenSecretPrefix + "abc123"}, &secret); err != nil {
+		t.Fatalf("expected the bootstrap token to survive a failed create, got %v", err)
+	}
+	failCreate = false
+	if code, _ := enroll(t, g, "dev", "abc123.s3cret", testCSR(t, "dev"), nil); code != http.StatusCreated {
+		t.Fatalf("expected the retry to enroll, got %d", code)
+	}
+	if code, _ := enroll(t, g, "dev", "abc123.s3cret", testCSR(t, "dev"), nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected the token to be spent after enrolling, got %d", code)
+	}
+	var list apiv1alpha1.DeviceEnrollmentList
+	if err := c.List(ctx, &list, client.InNamespace("enroll")); err != nil || len(list.Items) != 1 {
+		t.Fatalf("expected exactly one enrollment, got %d (%v)", len(list.Items), err)
+	}
+}
+
+func TestEnrollRenewalsAreCappedPerDevice(t *testing.T) {
+	// The API server stamps creation times; the fake client does not.
+	c := fake.NewClientBuilder().WithScheme(testScheme(t)).WithStatusSubresource(&apiv1alpha1.DeviceEnrollment{}).
+		WithInterceptorFuncs(interceptor.Funcs{Create: func(ctx context.Context, cl client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			obj.SetCreationTimestamp(metav1.Now())
+			return cl.Create(ctx, obj, opts...)
+		}}).Build()
+	g := New(c, nopRecorder{}, "", "shared-token", "", 15*time.Second, 3)
+	g.SetEnrollment("enroll", c)
+	peer := &x509.Certificate{Subject: pkix.Name{CommonName: "dev"}}
+	for i := 0; i < maxRenewalEnrollments; i++ {
+		if code, _ := enroll(t, g, "dev", "", testCSR(t, "dev"), peer); code != http.StatusCreated {
+			t.Fatalf("renewal %d: expected 201, got %d", i, code)
+		}
+	}
+	if code, _ := enroll(t, g, "dev", "", testCSR(t, "dev"), peer); code != http.StatusTooManyRequests {
+		t.Fatalf("expected renewals beyond the cap to be refused, got %d", code)
+	}
+	other := &x509.Certificate{Subject: pkix.Name{CommonName: "other"}}
+	if code, _ := enroll(t, g, "other", "", testCSR(t, "other"), other); code != http.StatusCreated {
+		t.Fatalf("expected another device's renewal to be unaffected, got %d", code)
+	}
+}
@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+)
+
+const (
+	// PollIntervalAnnotation on a DeviceProcess overrides the gateway-wide poll interval for its
+	// device. When several processes on a device set it, the shortest interval wins.
+	PollIntervalAnnotation = "azure.com/poll-interval-seconds"
+
+	defaultRetryAfter = 10 * time.Second
+)
+
+// SetPollInterval sets the desired poll interval advertised to agents that have no per-device
+// override. Zero leaves the agent default in place.
+func (g *Gateway) SetPollInterval(d time.Duration) {
+	g.pollInterval = d
+}
+
+// SetLoadShedding caps concurrent device requests. Requests beyond maxInflight are rejected with
+// 429 and a Retry-After of retryAfter; agents add jitter so rejected devices spread out. A
+// maxInflight of zero disables shedding.
+func (g *Gateway) SetLoadShedding(maxInflight int, retryAfter time.Duration) {
+	if maxInflight <= 0 {
+		g.inflight = nil
+		return
+	}
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	g.inflight = make(chan struct{}, maxInflight)
+	g.retryAfter = retryAfter
+}
+
+// admit reserves an in-flight slot. The returned release is safe to call more than once, so
+// long-polls can give their slot back while they wait.
+func (g *Gateway) admit() (func(), bool) {
+	if g.inflight == nil {
+		return func() {}, true
+	}
+	select {
+	case g.inflight <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-g.inflight }) }, true
+	default:
+		return nil, false
+	}
+}
+
+func (g *Gateway) shed(w http.ResponseWriter, device string) {
+	g.log.V(1).Info("shedding device request", "device", device, "retryAfter", g.retryAfter.String())
+	w.Header().Set("Retry-After", strconv.Itoa(int(g.retryAfter/time.Second)))
+	http.Error(w, "gateway overloaded", http.StatusTooManyRequests)
+}
+
+// pollIntervalSeconds returns the poll interval for a device with the given processes.
+func (g *Gateway) pollIntervalSeconds(processes []apiv1alpha1.DeviceProcess) int {
+	interval := int(g.pollInterval / time.Second)
+	override := 0
+	for i := range processes {
+		v, err := strconv.Atoi(processes[i].Annotations[PollIntervalAnnotation])
+		if err != nil || v <= 0 {
+			continue
+		}
+		if override == 0 || v < override {
+			override = v
+		}
+	}
+	if override > 0 {
+		return override
+	}
+	return interval
+}
@@ -0,0 +1,134 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func pollProcess(name string, annotations map[string]string) *apiv1alpha1.DeviceProcess {
+	return &apiv1alpha1.DeviceProcess{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns", Annotations: annotations},
+		Spec: apiv1alpha1.DeviceProcessSpec{
+			DeviceRef: apiv1alpha1.DeviceRef{Kind: apiv1alpha1.DeviceRefKindServer, Name: "dev"},
+			Execution: apiv1alpha1.DeviceProcessExecution{Backend: apiv1alpha1.DeviceProcessBackendSystemd, Command: []string{"/bin/true"}},
+			Artifact:  apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/bin/true"},
+		},
+	}
+}
+
+func pollGateway(t *testing.T, objs ...client.Object) *Gateway {
+	t.Helper()
+	c := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(objs...).
+		WithIndex(&apiv1alpha1.DeviceProcess{}, "spec.deviceRef.name", func(obj client.Object) []string {
+			return []string{obj.(*apiv1alpha1.DeviceProcess).Spec.DeviceRef.Name}
+		}).Build()
+	return New(c, nopRecorder{}, "", "", "", 15*time.Second, 3)
+}
+
+func TestDesiredPollIntervalGlobalAndPerDevice(t *testing.T) {
+	ctx := context.Background()
+	g := pollGateway(t,
+		pollProcess("a", map[string]string{PollIntervalAnnotation: "30"}),
+		pollProcess("b", map[string]string{PollIntervalAnnotation: "20"}),
+		pollProcess("c", map[string]string{PollIntervalAnnotation: "soon"}))
+	g.SetPollInterval(60 * time.Second)
+
+	desired, _, err := g.computeDesired(ctx, "dev")
+	if err != nil {
+		t.Fatalf("compute desired: %v", err)
+	}
+	if desired.PollIntervalSeconds != 20 {
+		t.Fatalf("expected the shortest per-device override, got %d", desired.PollIntervalSeconds)
+	}
+
+	g = pollGateway(t, pollProcess("a", nil))
+	g.SetPollInterval(60 * time.Second)
+	desired, globalETag, _ := g.computeDesired(ctx, "dev")
+	if desired.PollIntervalSeconds != 60 {
+		t.Fatalf("expected the gateway-wide interval, got %d", desired.PollIntervalSeconds)
+	}
+	g.SetPollInterval(90 * time.Second)
+	if _, retuned, _ := g.computeDesired(ctx, "dev"); retuned == globalETag {
+		t.Fatalf("expected a new poll interval to change the ETag")
+	}
+}
+
+func TestDeviceRequestsAreShedWithRetryAfter(t *testing.T) {
+	g := pollGateway(t, pollProcess("a", nil))
+	g.SetLoadShedding(1, 7*time.Second)
+	g.desiredWatch = newDesiredNotifier()
+	srv := httptest.NewServer(http.HandlerFunc(g.handleDevice))
+	defer srv.Close()
+
+	get := func(etag, query string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/devices/dev/desired"+query, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("get desired: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	release, ok := g.admit()
+	if !ok {
+		t.Fatalf("expected a free slot")
+	}
+	if resp := get("", ""); resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "7" {
+		t.Fatalf("expected 429 with Retry-After 7, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	release()
+
+	resp := get("", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 once a slot is free, got %d", resp.StatusCode)
+	}
+
+	// A held long-poll gives its slot back, so it does not lock other devices out.
+	etag := resp.Header.Get(desiredETagHeader)
+	held, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/devices/dev/desired?waitSeconds=2", nil)
+	held.Header.Set("If-None-Match", etag)
+	go func() {
+		if resp, err := srv.Client().Do(held); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if resp := get("", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a held long-poll not to count as in flight, got %d", resp.StatusCode)
+	}
+
+	// A long-poll woken while the gateway is full is shed rather than recomputed over the limit.
+	woken := make(chan *http.Response, 1)
+	go func() { woken <- get(etag, "?waitSeconds=30") }()
+	time.Sleep(200 * time.Millisecond)
+	release, ok = g.admit()
+	if !ok {
+		t.Fatalf("expected the held long-poll to have given its slot back")
+	}
+	g.desiredWatch.notify("dev")
+	select {
+	case resp := <-woken:
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("expected a woken long-poll without a free slot to get 429, got %d", resp.StatusCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("woken long-poll did not answer")
+	}
+	release()
+	if resp := get("", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the slot to be free again, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,363 @@
+package gateway
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	defaultRegistryTokenTTL = 60 * time.Second
+	maxTokenResponseBytes   = 128 << 10
+
+	// registrySecretTTL bounds how long the credentials Secret is reused before it is read
+	// again; desired state is computed on every poll, which must not reach the API server.
+	registrySecretTTL = 30 * time.Second
+	// noTokenTTL is how long a registry that gets no token (missing from the Secret, or not
+	// using bearer auth) is remembered before it is tried again.
+	noTokenTTL = 5 * time.Minute
+)
+
+// RegistryCredential is a short-lived pull credential delivered to a device for one registry.
+type RegistryCredential struct {
+	Registry    string `json:"registry"`
+	AccessToken string `json:"accessToken"`
+	ExpiresAt   string `json:"expiresAt,omitempty"`
+	// refreshAt is when the gateway stops reusing the token and mints a new one.
+	refreshAt time.Time
+}
+
+// RegistryTokenIssuer exchanges the gateway's registry credentials (a kubernetes.io/dockerconfigjson
+// Secret) for bearer tokens scoped to pull only the repositories a device references, so devices
+// never hold long-lived registry passwords.
+type RegistryTokenIssuer struct {
+	reader    client.Reader
+	secret    types.NamespacedName
+	plainHTTP map[string]bool
+	http      *http.Client
+	now       func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]issuedToken
+
+	authsMu       sync.Mutex
+	auths         map[string]dockerAuthEntry
+	authsLoadedAt time.Time
+}
+
+// issuedToken is a minted token, or with an empty cred a registry that gets none.
+type issuedToken struct {
+	cred      RegistryCredential
+	issuedAt  time.Time
+	expiresAt time.Time
+}
+
+// fresh reports whether t can still be handed out: tokens until half their lifetime has
+// passed, negative entries until they expire.
+func (t issuedToken) fresh(now time.Time) bool {
+	if t.cred.AccessToken == "" {
+		return now.Before(t.expiresAt)
+	}
+	return now.Before(t.refreshAt())
+}
+
+// refreshAt is the end of the first half of t's lifetime.
+func (t issuedToken) refreshAt() time.Time {
+	return t.issuedAt.Add(t.expiresAt.Sub(t.issuedAt) / 2)
+}
+
+// credentialsRefreshAt is when the first of creds is replaced by a new token, which changes the
+// desired ETag. It is zero when creds is empty.
+func credentialsRefreshAt(creds []RegistryCredential) time.Time {
+	var at time.Time
+	for _, c := range creds {
+		if at.IsZero() || c.refreshAt.Before(at) {
+			at = c.refreshAt
+		}
+	}
+	return at
+}
+
+type dockerConfig struct {
+	Auths map[string]dockerAuthEntry `json:"auths"`
+}
+
+type dockerAuthEntry struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// NewRegistryTokenIssuer reads registry credentials from secret, at most every registrySecretTTL.
+// Registries in plainHTTPHosts are contacted over http (local development only).
+func NewRegistryTokenIssuer(reader client.Reader, secret types.NamespacedName, plainHTTPHosts []string) *RegistryTokenIssuer {
+	plain := make(map[string]bool, len(plainHTTPHosts))
+	for _, h := range plainHTTPHosts {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			plain[h] = true
+		}
+	}
+	return &RegistryTokenIssuer{
+		reader:    reader,
+		secret:    secret,
+		plainHTTP: plain,
+		http:      &http.Client{Timeout: 10 * time.Second},
+		now:       time.Now,
+		tokens:    make(map[string]issuedToken),
+	}
+}
+
+// SetRegistryTokenIssuer enables delivery of per-device registry tokens in desired responses.
+func (g *Gateway) SetRegistryTokenIssuer(issuer *RegistryTokenIssuer) {
+	g.registryTokens = issuer
+}
+
+// CredentialsFor returns one pull token per registry referenced by the device's OCI items,
+// including their prefetch artifacts.
+// Tokens are reused until half their lifetime has passed so desired ETags stay stable. When some
+// registries fail, the credentials of the others are returned along with the error.
+func (r *RegistryTokenIssuer) CredentialsFor(ctx context.Context, items []DesiredItem) ([]RegistryCredential, error) {
+	repos := make(map[string]map[string]struct{})
+	for i := range items {
+		for _, ref := range ociReferences(items[i].Spec) {
+			if repos[ref.Registry] == nil {
+				repos[ref.Registry] = make(map[string]struct{})
+			}
+			repos[ref.Registry][ref.Repository] = struct{}{}
+		}
+	}
+	if len(repos) == 0 {
+		return nil, nil
+	}
+
+	var (
+		auths    map[string]dockerAuthEntry
+		authsErr error
+		errs     []error
+	)
+	registries := make([]string, 0, len(repos))
+	for reg := range repos {
+		registries = append(registries, reg)
+	}
+	sort.Strings(registries)
+
+	out := make([]RegistryCredential, 0, len(registries))
+	for _, reg := range registries {
+		scopes := make([]string, 0, len(repos[reg]))
+		for repo := range repos[reg] {
+			scopes = append(scopes, "repository:"+repo+":pull")
+		}
+		sort.Strings(scopes)
+		key := reg + " " + strings.Join(scopes, " ")
+
+		now := r.now()
+		r.mu.Lock()
+		cached, ok := r.tokens[key]
+		r.mu.Unlock()
+		if ok && cached.fresh(now) {
+			if cached.cred.AccessToken != "" {
+				out = append(out, cached.cred)
+			}
+			continue
+		}
+
+		if auths == nil && authsErr == nil {
+			if auths, authsErr = r.loadAuths(ctx); authsErr != nil {
+				errs = append(errs, authsErr)
+			}
+		}
+		if authsErr != nil {
+			continue
+		}
+		token := ""
+		ttl := noTokenTTL
+		if entry, ok := auths[reg]; ok {
+			var err error
+			if token, ttl, err = r.fetchToken(ctx, reg, scopes, entry); err != nil {
+				errs = append(errs, fmt.Errorf("registry %s: %w", reg, err))
+				continue
+			}
+			if token == "" {
+				ttl = noTokenTTL
+			}
+		}
+		issued := issuedToken{issuedAt: now, expiresAt: now.Add(ttl)}
+		if token != "" {
+			issued.cred = RegistryCredential{Registry: reg, AccessToken: token, ExpiresAt: issued.expiresAt.UTC().Format(time.RFC3339), refreshAt: issued.refreshAt()}
+			out = append(out, issued.cred)
+		}
+		r.mu.Lock()
+		r.tokens[key] = issued
+		r.mu.Unlock()
+	}
+	return out, errors.Join(errs...)
+}
+
+// Credential returns the gateway's own credentials for host, for use as an oras auth.Client
+// Credential callback (e.g. when filling the artifact cache from upstream).
+func (r *RegistryTokenIssuer) Credential(ctx context.Context, host string) (auth.Credential, error) {
+	auths, err := r.loadAuths(ctx)
+	if err != nil {
+		return auth.EmptyCredential, err
+	}
+	entry, ok := auths[host]
+	if !ok {
+		return auth.EmptyCredential, nil
+	}
+	return auth.Credential{Username: entry.Username, Password: entry.Password, RefreshToken: entry.IdentityToken}, nil
+}
+
+// loadAuths returns the registry credentials, reading the Secret again once the copy is older
+// than registrySecretTTL. Failed reads are not cached.
+func (r *RegistryTokenIssuer) loadAuths(ctx context.Context) (map[string]dockerAuthEntry, error) {
+	r.authsMu.Lock()
+	defer r.authsMu.Unlock()
+	now := r.now()
+	if r.auths != nil && now.Sub(r.authsLoadedAt) < registrySecretTTL {
+		return r.auths, nil
+	}
+	auths, err := r.readAuths(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.auths, r.authsLoadedAt = auths, now
+	return auths, nil
+}
+
+func (r *RegistryTokenIssuer) readAuths(ctx context.Context) (map[string]dockerAuthEntry, error) {
+	var secret corev1.Secret
+	if err := r.reader.Get(ctx, r.secret, &secret); err != nil {
+		return nil, fmt.Errorf("get registry credentials secret %s: %w", r.secret, err)
+	}
+	data, ok := secret.Data[corev1.DockerConfigJsonKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no %s key", r.secret, corev1.DockerConfigJsonKey)
+	}
+	var cfg dockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", r.secret, err)
+	}
+	auths := make(map[string]dockerAuthEntry, len(cfg.Auths))
+	for host, entry := range cfg.Auths {
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+		host = strings.TrimSuffix(host, "/")
+		if entry.Auth != "" && entry.Username == "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("decode auth for %s: %w", host, err)
+			}
+			entry.Username, entry.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		auths[host] = entry
+	}
+	return auths, nil
+}
+
+// fetchToken follows the distribution token flow: challenge on /v2/, then request a token
+// from the advertised realm. Registries without bearer auth get no token.
+func (r *RegistryTokenIssuer) fetchToken(ctx context.Context, reg string, scopes []string, entry dockerAuthEntry) (string, time.Duration, error) {
+	scheme := "https"
+	if r.plainHTTP[strings.ToLower(reg)] {
+		scheme = "http"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+reg+"/v2/", nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		return "", 0, nil
+	}
+	realm, service, ok := parseBearerChallenge(resp.Header.Get("Www-Authenticate"))
+	if !ok {
+		return "", 0, nil
+	}
+
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid token realm %q: %w", realm, err)
+	}
+	q := tokenURL.Query()
+	if service != "" {
+		q.Set("service", service)
+	}
+	for _, s := range scopes {
+		q.Add("scope", s)
+	}
+	tokenURL.RawQuery = q.Encode()
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	if entry.Username != "" || entry.Password != "" {
+		req.SetBasicAuth(entry.Username, entry.Password)
+	}
+	resp, err = r.http.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxTokenResponseBytes)).Decode(&body); err != nil {
+		return "", 0, fmt.Errorf("decode token response: %w", err)
+	}
+	token := body.AccessToken
+	if token == "" {
+		token = body.Token
+	}
+	if token == "" {
+		return "", 0, fmt.Errorf("token endpoint returned no token")
+	}
+	ttl := defaultRegistryTokenTTL
+	if body.ExpiresIn > 0 {
+		ttl = time.Duration(body.ExpiresIn) * time.Second
+	}
+	return token, ttl, nil
+}
+
+func parseBearerChallenge(header string) (realm, service string, ok bool) {
+	scheme, params, found := strings.Cut(strings.TrimSpace(header), " ")
+	if !found || !strings.EqualFold(scheme, "bearer") {
+		return "", "", false
+	}
+	for _, part := range strings.Split(params, ",") {
+		k, v, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			continue
+		}
+		v = strings.Trim(v, `"`)
+		switch strings.ToLower(k) {
+		case "realm":
+			realm = v
+		case "service":
+			service = v
+		}
+	}
+	return realm, service, realm != ""
+}
@@ -0,0 +1,180 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRegistryTokenIssuerMintsScopedTokens(t *testing.T) {
+	var gotScopes []string
+	tokenCalls := 0
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.Header().Set("Www-Authenticate", `Bearer realm="`+srv.URL+`/token",service="stand-in"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/token":
+			tokenCalls++
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "gw" || pass != "pw" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			gotScopes = r.URL.Query()["scope"]
+			_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "short-lived", "expires_in": 120})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "apollo"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"` + host + `":{"username":"gw","password":"pw"}}}`),
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(secret).Build()
+	issuer := NewRegistryTokenIssuer(c, types.NamespacedName{Namespace: "apollo", Name: "registry"}, []string{host})
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	issuer.now = func() time.Time { return now }
+
+	items := []DesiredItem{
+		{Spec: apiv1alpha1.DeviceProcessSpec{Artifact: apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: host + "/team/app@sha256:" + strings.Repeat("a", 64)}}},
+		{Spec: apiv1alpha1.DeviceProcessSpec{Artifact: apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: "unconfigured.example/other@sha256:" + strings.Repeat("b", 64)}}},
+		{Spec: apiv1alpha1.DeviceProcessSpec{
+			Artifact:         apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeFile, URL: "/bin/true"},
+			PrefetchArtifact: &apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: host + "/team/next@sha256:" + strings.Repeat("c", 64)},
+		}},
+	}
+
+	creds, err := issuer.CredentialsFor(context.Background(), items)
+	if err != nil {
+		t.Fatalf("CredentialsFor: %v", err)
+	}
+	if len(creds) != 1 || creds[0].Registry != host || creds[0].AccessToken != "short-lived" {
+		t.Fatalf("unexpected credentials %+v", creds)
+	}
+	if len(gotScopes) != 2 || gotScopes[0] != "repository:team/app:pull" || gotScopes[1] != "repository:team/next:pull" {
+		t.Fatalf("token must be scoped to the device's repositories, got %v", gotScopes)
+	}
+
+	now = now.Add(30 * time.Second)
+	if _, err := issuer.CredentialsFor(context.Background(), items); err != nil {
+		t.Fatalf("CredentialsFor: %v", err)
+	}
+	if tokenCalls != 1 {
+		t.Fatalf("expected cached token before half-life, got %d mints", tokenCalls)
+	}
+
+	now = now.Add(40 * time.Second)
+	if _, err := issuer.CredentialsFor(context.Background(), items); err != nil {
+		t.Fatalf("CredentialsFor: %v", err)
+	}
+	if tokenCalls != 2 {
+		t.Fatalf("expected refresh after half-life, got %d mints", tokenCalls)
+	}
+}
+
+// countingReader counts the reads that reach the API server.
+type countingReader struct {
+	client.Reader
+	gets int
+}
+
+func (c *countingReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	c.gets++
+	return c.Reader.Get(ctx, key, obj, opts...)
+}
+
+func TestRegistryTokenIssuerCachesSecretAndMissesAndReturnsPartialCredentials(t *testing.T) {
+	var good, anonymous, broken *httptest.Server
+	probes := 0
+	good = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.Header().Set("Www-Authenticate", `Bearer realm="`+good.URL+`/token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"token": "good-token", "expires_in": 3600})
+	}))
+	defer good.Close()
+	anonymous = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes++
+	}))
+	defer anonymous.Close()
+	broken = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.Header().Set("Www-Authenticate", `Bearer realm="`+broken.URL+`/token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	hosts := []string{}
+	auths := map[string]any{}
+	for _, srv := range []*httptest.Server{good, anonymous, broken} {
+		host := strings.TrimPrefix(srv.URL, "http://")
+		hosts = append(hosts, host)
+		auths[host] = map[string]string{"username": "gw", "password": "pw"}
+	}
+	config, _ := json.Marshal(map[string]any{"auths": auths})
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "apollo"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: config},
+	}
+	reader := &countingReader{Reader: fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(secret).Build()}
+	issuer := NewRegistryTokenIssuer(reader, types.NamespacedName{Namespace: "apollo", Name: "registry"}, hosts)
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	issuer.now = func() time.Time { return now }
+
+	var items []DesiredItem
+	for _, host := range append(hosts, "unconfigured.example") {
+		items = append(items, DesiredItem{Spec: apiv1alpha1.DeviceProcessSpec{Artifact: apiv1alpha1.DeviceProcessArtifact{
+			Type: apiv1alpha1.ArtifactTypeOCI, URL: host + "/team/app@sha256:" + strings.Repeat("a", 64),
+		}}})
+	}
+
+	for poll := 0; poll < 3; poll++ {
+		creds, err := issuer.CredentialsFor(context.Background(), items)
+		if err == nil || !strings.Contains(err.Error(), hosts[2]) {
+			t.Fatalf("poll %d: expected the broken registry's error, got %v", poll, err)
+		}
+		if len(creds) != 1 || creds[0].AccessToken != "good-token" {
+			t.Fatalf("poll %d: expected the good registry's token alongside the error, got %+v", poll, creds)
+		}
+		now = now.Add(time.Second)
+	}
+	if reader.gets != 1 {
+		t.Fatalf("expected one Secret read within its TTL, got %d", reader.gets)
+	}
+	if probes != 1 {
+		t.Fatalf("expected a registry without bearer auth to be probed once, got %d", probes)
+	}
+
+	now = now.Add(noTokenTTL)
+	if _, err := issuer.CredentialsFor(context.Background(), items); err == nil {
+		t.Fatalf("expected the broken registry to keep failing")
+	}
+	if reader.gets != 2 || probes != 2 {
+		t.Fatalf("expected the Secret and the registry to be checked again once cached entries expire, got %d reads and %d probes", reader.gets, probes)
+	}
+}
@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/pkg/conditions"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestResourceObservationsSetMemoryPressure(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(pollProcess("a", nil)).WithStatusSubresource(&apiv1alpha1.DeviceProcess{}).Build()
+	events := record.NewFakeRecorder(10)
+	g := &Gateway{client: c, recorder: events}
+	report := func(obs Observation) apiv1alpha1.DeviceProcessStatus {
+		t.Helper()
+		obs.Namespace, obs.Name, obs.ProcessStarted, obs.Healthy = "ns", "a", boolPtr(true), boolPtr(true)
+		if err := g.updateStatusForObservation(ctx, "dev", obs, nil); err != nil {
+			t.Fatalf("updateStatusForObservation: %v", err)
+		}
+		var got apiv1alpha1.DeviceProcess
+		if err := c.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "a"}, &got); err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		return got.Status
+	}
+	pressure := func(st apiv1alpha1.DeviceProcessStatus) string {
+		cond := conditions.FindCondition(st.Conditions, apiv1alpha1.ConditionMemoryPressure)
+		if cond == nil {
+			return ""
+		}
+		return string(cond.Status) + "/" + cond.Reason
+	}
+	oomEvents := func() []string {
+		var out []string
+		for {
+			select {
+			case ev := <-events.Events:
+				if strings.HasPrefix(ev, "Warning OOMKilled ") {
+					out = append(out, ev)
+				}
+			default:
+				return out
+			}
+		}
+	}
+	const mib = 1 << 20
+
+	st := report(Observation{Resources: &ResourceObservation{CPUUsageMicroseconds: 5e6, CPUMillicores: 250, MemoryCurrentBytes: 100 * mib, MemoryPeakBytes: 120 * mib, MemoryLimitBytes: 512 * mib}})
+	if r := st.Resources; r == nil || r.MemoryCurrentBytes != 100*mib || r.CPUMillicores != 250 || r.ObservedAt.IsZero() {
+		t.Fatalf("expected the sample to be stored, got %+v", st.Resources)
+	}
+	if got := pressure(st); got != "False/NoMemoryPressure" {
+		t.Fatalf("expected no memory pressure, got %q", got)
+	}
+
+	if st = report(Observation{}); st.Resources == nil || st.Resources.MemoryCurrentBytes != 100*mib {
+		t.Fatalf("expected an observation without a sample to keep the last one, got %+v", st.Resources)
+	}
+
+	st = report(Observation{Resources: &ResourceObservation{MemoryCurrentBytes: 470 * mib, MemoryLimitBytes: 512 * mib}})
+	if got := pressure(st); got != "True/NearMemoryLimit" {
+		t.Fatalf("expected pressure near the limit, got %q", got)
+	}
+
+	st = report(Observation{Resources: &ResourceObservation{MemoryCurrentBytes: 200 * mib, MemoryLimitBytes: 512 * mib, OOMKills: 2}})
+	if got := pressure(st); got != "True/OOMKilled" {
+		t.Fatalf("expected OOM kills to set pressure, got %q", got)
+	}
+	if got := oomEvents(); len(got) != 1 || got[0] != "Warning OOMKilled 2 process(es) in the unit killed for running out of memory" {
+		t.Fatalf("expected one OOMKilled event, got %q", got)
+	}
+	report(Observation{Resources: &ResourceObservation{MemoryCurrentBytes: 210 * mib, MemoryLimitBytes: 512 * mib, OOMKills: 2}})
+	if got := oomEvents(); len(got) != 0 {
+		t.Fatalf("expected no event for OOM kills already reported, got %q", got)
+	}
+
+	st = report(Observation{TerminationReason: "OOMKilled"})
+	if st.LastTerminationReason != "OOMKilled" || pressure(st) != "True/OOMKilled" {
+		t.Fatalf("expected the OOM kill of the process to be recorded, got %q %q", st.LastTerminationReason, pressure(st))
+	}
+}
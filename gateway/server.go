@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -18,9 +19,11 @@ import (
 
 	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
 	"github.com/apollo/praetor/pkg/conditions"
+	"github.com/apollo/praetor/pkg/specsign"
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
@@ -45,13 +48,29 @@ type DesiredItem struct {
 	Generation int64                         `json:"generation"`
 	Spec       apiv1alpha1.DeviceProcessSpec `json:"spec"`
 	SpecHash   string                        `json:"specHash"`
+	// Signature is the control plane's signature over the spec, relayed from the DeviceProcess.
+	Signature string `json:"signature,omitempty"`
 }
 
 // DesiredResponse is returned to an agent polling for desired state.
 type DesiredResponse struct {
-	DeviceName               string        `json:"deviceName"`
-	HeartbeatIntervalSeconds int           `json:"heartbeatIntervalSeconds"`
-	Items                    []DesiredItem `json:"items"`
+	DeviceName               string `json:"deviceName"`
+	HeartbeatIntervalSeconds int    `json:"heartbeatIntervalSeconds"`
+	// PollIntervalSeconds is how often the agent should poll desired state when it is not
+	// watching; zero leaves the agent default in place.
+	PollIntervalSeconds int           `json:"pollIntervalSeconds,omitempty"`
+	Items               []DesiredItem `json:"items"`
+	// RegistryCredentials carries short-lived pull tokens for the registries the items reference.
+	RegistryCredentials []RegistryCredential `json:"registryCredentials,omitempty"`
+	// Set is the control plane's signature over all of Items, relayed from the device's
+	// DeviceProcessSet when one exists.
+	Set *DesiredSet `json:"set,omitempty"`
+}
+
+// DesiredSet signs the namespace, name and signature of every item sent to a device.
+type DesiredSet struct {
+	Revision  int64  `json:"revision"`
+	Signature string `json:"signature"`
 }
 
 // ReportRequest is sent by the agent with heartbeat and observations.
@@ -83,10 +102,62 @@ type Observation struct {
 	ArtifactDownloadMessage  string  `json:"artifactDownloadMessage,omitempty"`
 	ArtifactVerifyReason     string  `json:"artifactVerifyReason,omitempty"`
 	ArtifactVerifyMessage    string  `json:"artifactVerifyMessage,omitempty"`
+	ArtifactBytesDownloaded  int64   `json:"artifactBytesDownloaded,omitempty"`
+	ArtifactBytesTotal       int64   `json:"artifactBytesTotal,omitempty"`
+	// DownloadInProgress marks an interim report sent while the artifact is still downloading;
+	// only the byte counters are set and applied.
+	DownloadInProgress bool `json:"downloadInProgress,omitempty"`
+	// PrefetchArtifactURL and ArtifactPrefetched report the spec's prefetch artifact, when set.
+	PrefetchArtifactURL string `json:"prefetchArtifactURL,omitempty"`
+	ArtifactPrefetched  *bool  `json:"artifactPrefetched,omitempty"`
+	PrefetchReason      string `json:"prefetchReason,omitempty"`
+	PrefetchMessage     string `json:"prefetchMessage,omitempty"`
+	// RolledBack reports that the agent reverted to its last known-good spec after this spec failed.
+	RolledBack      *bool  `json:"rolledBack,omitempty"`
+	RollbackMessage string `json:"rollbackMessage,omitempty"`
+	// SpecVerified is set by agents that pin a spec signing key; false means the desired spec was
+	// refused, SpecVerifyMessage says why, and the previously running spec was left in place.
+	SpecVerified      *bool  `json:"specVerified,omitempty"`
+	SpecVerifyMessage string `json:"specVerifyMessage,omitempty"`
+	// Plan is sent by agents running in dry-run mode; it is recorded as the process's last plan
+	// and nothing else in the observation is applied.
+	Plan *PlanObservation `json:"plan,omitempty"`
+	// Resources is the unit's cgroup v2 accounting. Agents sample it periodically; observations
+	// without it leave the recorded sample in place.
+	Resources *ResourceObservation `json:"resources,omitempty"`
+	// TerminationReason says why the process last exited, when the agent knows; OOMKilled is the
+	// only reason reported so far.
+	TerminationReason string `json:"terminationReason,omitempty"`
+}
+
+// ResourceObservation is a sample of a unit's cgroup v2 CPU and memory counters.
+type ResourceObservation struct {
+	CPUUsageMicroseconds int64 `json:"cpuUsageMicroseconds"`
+	// CPUMillicores is the average CPU use since the agent's previous sample; zero on the first.
+	CPUMillicores      int64 `json:"cpuMillicores,omitempty"`
+	MemoryCurrentBytes int64 `json:"memoryCurrentBytes"`
+	MemoryPeakBytes    int64 `json:"memoryPeakBytes,omitempty"`
+	// MemoryLimitBytes is the lower of memory.high and memory.max; zero when unlimited.
+	MemoryLimitBytes int64 `json:"memoryLimitBytes,omitempty"`
+	OOMKills         int64 `json:"oomKills"`
+}
+
+// PlanObservation is what a dry-run agent would do for one item.
+type PlanObservation struct {
+	SpecHash string   `json:"specHash"`
+	Action   string   `json:"action"`
+	Changes  []string `json:"changes,omitempty"`
+	Message  string   `json:"message,omitempty"`
 }
 
 const runtimeSemanticsDaemonSet = "DaemonSet"
 
+const (
+	terminationOOMKilled = "OOMKilled"
+	// memoryPressurePercent is the share of its memory limit at which a unit is under pressure.
+	memoryPressurePercent = 90
+)
+
 // ReportResponse acknowledges a report.
 type ReportResponse struct {
 	Ack bool `json:"ack"`
@@ -110,6 +181,21 @@ type Gateway struct {
 	lastReport     map[string]time.Time
 	heartbeatHints map[string]int
 
+	registryTokens *RegistryTokenIssuer
+	artifactCache  *ArtifactCache
+	desiredWatch   *desiredNotifier
+
+	pollInterval time.Duration
+	inflight     chan struct{}
+	retryAfter   time.Duration
+
+	tlsConfig *tls.Config
+
+	enrollNamespace string
+	enrollReader    client.Reader
+
+	deviceTokens *deviceTokenStore
+
 	server *http.Server
 }
 
@@ -148,14 +234,22 @@ func (g *Gateway) Start(ctx context.Context) error {
 		_, _ = w.Write([]byte("ready"))
 	})
 	mux.HandleFunc("/v1/devices/", g.handleDevice)
+	if g.artifactCache != nil {
+		mux.HandleFunc("/v2/", g.handleRegistry)
+	}
 
-	g.server = &http.Server{Addr: g.addr, Handler: mux}
+	g.server = &http.Server{Addr: g.addr, Handler: mux, TLSConfig: g.tlsConfig}
 
 	go g.stalenessLoop(ctx)
 
 	errCh := make(chan error, 1)
 	go func() {
-		err := g.server.ListenAndServe()
+		var err error
+		if g.tlsConfig != nil {
+			err = g.server.ListenAndServeTLS("", "")
+		} else {
+			err = g.server.ListenAndServe()
+		}
 		if !errors.Is(err, http.ErrServerClosed) {
 			errCh <- err
 		}
@@ -195,18 +289,31 @@ func (g *Gateway) handleDevice(w http.ResponseWriter, r *http.Request) {
 	deviceName := parts[2]
 	action := parts[3]
 
+	// Enrolling devices have no credential yet; enrollment authenticates on its own terms.
+	if action == "enroll" {
+		g.handleEnroll(w, r, deviceName, parts[4:])
+		return
+	}
+
 	if !g.authorize(r, deviceName) {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	release, ok := g.admit()
+	if !ok {
+		g.shed(w, deviceName)
+		return
+	}
+	defer release()
+
 	switch action {
 	case "desired":
 		if r.Method != http.MethodGet {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		g.handleDesired(ctx, w, r, deviceName)
+		g.handleDesired(ctx, w, r, deviceName, release)
 	case "report":
 		if r.Method != http.MethodPost {
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -224,21 +331,35 @@ func (g *Gateway) handleDevice(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (g *Gateway) authorize(r *http.Request, _ string) bool {
-	header := strings.TrimSpace(r.Header.Get(deviceTokenHeader))
+func (g *Gateway) authorize(r *http.Request, device string) bool {
+	tokens, managed := g.deviceTokens.lookup(device)
+	if managed && tokens.disabled {
+		return false
+	}
 
-	// Preferred: per-device HMAC token when secret is configured.
-	if g.authSecret != "" {
-		device := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"), "v1/devices/")
-		if idx := strings.Index(device, "/"); idx >= 0 {
-			device = device[:idx]
-		}
-		if device != "" {
-			expected := computeDeviceToken(g.authSecret, device)
-			if hmac.Equal([]byte(header), []byte(expected)) {
+	// A verified client certificate is the device's identity; it cannot speak for other devices.
+	if names, ok := clientCertDevice(r); ok {
+		for _, name := range names {
+			if device != "" && name == device {
 				return true
 			}
 		}
+		return false
+	}
+
+	header := strings.TrimSpace(r.Header.Get(deviceTokenHeader))
+
+	// A per-device token replaces the fleet-wide credentials so it can be revoked on its own.
+	if managed {
+		return tokens.accepts(header, time.Now())
+	}
+
+	// Preferred: per-device HMAC token when secret is configured.
+	if g.authSecret != "" && device != "" {
+		expected := computeDeviceToken(g.authSecret, device)
+		if hmac.Equal([]byte(header), []byte(expected)) {
+			return true
+		}
 	}
 
 	// Fallback: shared token for dev/compat.
@@ -248,19 +369,80 @@ func (g *Gateway) authorize(r *http.Request, _ string) bool {
 	return header == g.authToken
 }
 
-func (g *Gateway) handleDesired(ctx context.Context, w http.ResponseWriter, r *http.Request, deviceName string) {
-	desired, etag, err := g.computeDesired(ctx, deviceName)
-	if err != nil {
-		g.respondErr(ctx, w, http.StatusInternalServerError, "failed to compute desired state")
-		g.log.Error(err, "compute desired", "device", deviceName)
-		return
+func (g *Gateway) handleDesired(ctx context.Context, w http.ResponseWriter, r *http.Request, deviceName string, release func()) {
+	g.recordDesiredHeartbeatIfEligible(deviceName)
+
+	// With waitSeconds, a request whose If-None-Match is current is held until the device's
+	// DeviceProcesses change, a registry token it was served is renewed, or the wait runs out.
+	wait := g.desiredWait(r)
+	var timeout <-chan time.Time
+	if wait > 0 {
+		w.Header().Set(desiredWaitHeader, strconv.Itoa(int(wait/time.Second)))
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
 	}
+	match := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	// release changes when a woken long-poll takes a new slot; give back whichever is held.
+	defer func() { release() }()
 
-	g.recordDesiredHeartbeatIfEligible(deviceName)
+	var desired *DesiredResponse
+	var etag string
+	for {
+		var changed <-chan struct{}
+		if wait > 0 {
+			changed = g.desiredWatch.changed(deviceName)
+		}
+		var err error
+		desired, etag, err = g.computeDesired(ctx, deviceName)
+		if err != nil {
+			g.respondErr(ctx, w, http.StatusInternalServerError, "failed to compute desired state")
+			g.log.Error(err, "compute desired", "device", deviceName)
+			return
+		}
+		if match == "" || match != etag || wait == 0 {
+			break
+		}
+		// Renewing a token changes the ETag; without waking, the agent would keep the old token
+		// past its half-life and possibly past its expiry.
+		var renew <-chan time.Time
+		var renewTimer *time.Timer
+		if at := credentialsRefreshAt(desired.RegistryCredentials); !at.IsZero() {
+			renewTimer = time.NewTimer(time.Until(at))
+			renew = renewTimer.C
+		}
+		// A held long-poll is idle; it must not count against the in-flight limit.
+		release()
+		woken := false
+		select {
+		case <-changed:
+			woken = true
+		case <-renew:
+			woken = true
+		case <-timeout:
+		case <-ctx.Done():
+		}
+		if renewTimer != nil {
+			renewTimer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !woken {
+			break
+		}
+		// Recomputing is real work again; it needs a slot like any other request.
+		next, ok := g.admit()
+		if !ok {
+			g.shed(w, deviceName)
+			return
+		}
+		release = next
+	}
 
 	w.Header().Set(desiredETagHeader, etag)
 
-	if match := strings.TrimSpace(r.Header.Get("If-None-Match")); match != "" && match == etag {
+	if match != "" && match == etag {
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
@@ -366,6 +548,7 @@ func (g *Gateway) computeDesired(ctx context.Context, deviceName string) (*Desir
 			Generation: proc.Generation,
 			Spec:       proc.Spec,
 			SpecHash:   specHash,
+			Signature:  proc.Annotations[specsign.Annotation],
 		})
 	}
 
@@ -387,10 +570,28 @@ func (g *Gateway) computeDesired(ctx context.Context, deviceName string) (*Desir
 	desired := &DesiredResponse{
 		DeviceName:               deviceName,
 		HeartbeatIntervalSeconds: heartbeat,
+		PollIntervalSeconds:      g.pollIntervalSeconds(processes),
 		Items:                    items,
 	}
 
-	etag := hashDesired(items)
+	var set apiv1alpha1.DeviceProcessSet
+	if err := g.client.Get(ctx, types.NamespacedName{Name: deviceName}, &set); err == nil {
+		desired.Set = &DesiredSet{Revision: set.Spec.Revision, Signature: set.Spec.Signature}
+	} else if !apierrors.IsNotFound(err) {
+		// Agents that verify sets keep their units until one is served; nothing else depends on it.
+		g.log.Error(err, "read device process set", "device", deviceName)
+	}
+
+	if g.registryTokens != nil {
+		creds, err := g.registryTokens.CredentialsFor(ctx, items)
+		if err != nil {
+			// Devices may still pull from caches or anonymous registries; keep serving desired state.
+			g.log.Error(err, "issue registry tokens", "device", deviceName)
+		}
+		desired.RegistryCredentials = creds
+	}
+
+	etag := hashDesired(items, desired.Set, desired.RegistryCredentials, desired.PollIntervalSeconds)
 	return desired, etag, nil
 }
 
@@ -426,6 +627,42 @@ func (g *Gateway) updateStatusForObservation(ctx context.Context, deviceName str
 
 		before := proc.DeepCopy()
 
+		if obs.DownloadInProgress {
+			proc.Status.ArtifactBytesDownloaded = obs.ArtifactBytesDownloaded
+			proc.Status.ArtifactBytesTotal = obs.ArtifactBytesTotal
+			if reflectDeepEqualStatus(before.Status, proc.Status) {
+				return nil
+			}
+			if err := g.client.Status().Patch(ctx, &proc, client.MergeFromWithOptions(before, client.MergeFromWithOptimisticLock{})); err != nil {
+				if apierrors.IsConflict(err) {
+					continue
+				}
+				return err
+			}
+			return nil
+		}
+
+		if plan := obs.Plan; plan != nil {
+			at := time.Now().UTC()
+			if reportedAt != nil {
+				at = reportedAt.UTC()
+			}
+			proc.Status.LastPlan = &apiv1alpha1.DeviceProcessPlan{
+				SpecHash:   plan.SpecHash,
+				Action:     plan.Action,
+				Changes:    plan.Changes,
+				Message:    plan.Message,
+				ReportedAt: metav1.NewTime(at),
+			}
+			if err := g.client.Status().Patch(ctx, &proc, client.MergeFromWithOptions(before, client.MergeFromWithOptimisticLock{})); err != nil {
+				if apierrors.IsConflict(err) {
+					continue
+				}
+				return err
+			}
+			return nil
+		}
+
 		if proc.Status.Phase == "" {
 			proc.Status.Phase = apiv1alpha1.DeviceProcessPhasePending
 		}
@@ -496,10 +733,16 @@ func (g *Gateway) updateStatusForObservation(ctx context.Context, deviceName str
 			}
 		}
 
+		setArtifactPrefetched(&proc.Status, obs)
+		rolledBackChanged := setRolledBack(&proc.Status, obs)
+		specRejectedChanged := setSpecVerified(&proc.Status, obs)
+
 		proc.Status.ArtifactDigest = strings.TrimSpace(obs.ArtifactDigest)
 		proc.Status.ArtifactDownloadAttempts = obs.ArtifactDownloadAttempts
 		proc.Status.LastArtifactAttemptTime = strings.TrimSpace(obs.LastArtifactAttemptTime)
 		proc.Status.ArtifactLastError = strings.TrimSpace(obs.ArtifactLastError)
+		proc.Status.ArtifactBytesDownloaded = obs.ArtifactBytesDownloaded
+		proc.Status.ArtifactBytesTotal = obs.ArtifactBytesTotal
 
 		processStartedChanged := false
 		if obs.ProcessStarted != nil {
@@ -561,6 +804,8 @@ func (g *Gateway) updateStatusForObservation(ctx context.Context, deviceName str
 			healthChanged = true
 		}
 
+		oomMessage := setResources(&proc.Status, obs, reportedAt)
+
 		proc.Status.PID = obs.PID
 		if strings.TrimSpace(obs.StartTime) == "" {
 			proc.Status.StartTime = nil
@@ -597,6 +842,12 @@ func (g *Gateway) updateStatusForObservation(ctx context.Context, deviceName str
 		if specWarningChanged && obs.WarningMessage != nil && strings.TrimSpace(*obs.WarningMessage) != "" {
 			g.recorder.Event(&proc, corev1.EventTypeWarning, "SpecWarning", strings.TrimSpace(*obs.WarningMessage))
 		}
+		if rolledBackChanged {
+			g.recorder.Event(&proc, corev1.EventTypeWarning, "RolledBack", strings.TrimSpace(obs.RollbackMessage))
+		}
+		if specRejectedChanged {
+			g.recorder.Event(&proc, corev1.EventTypeWarning, "SpecRejected", strings.TrimSpace(obs.SpecVerifyMessage))
+		}
 		if processStartedChanged && obs.ProcessStarted != nil && *obs.ProcessStarted {
 			g.recorder.Event(&proc, corev1.EventTypeNormal, "ProcessStarted", "process started")
 		}
@@ -607,6 +858,9 @@ func (g *Gateway) updateStatusForObservation(ctx context.Context, deviceName str
 			}
 			g.recorder.Event(&proc, eventType, "Healthy", "process health reported")
 		}
+		if oomMessage != "" {
+			g.recorder.Event(&proc, corev1.EventTypeWarning, terminationOOMKilled, oomMessage)
+		}
 
 		return nil
 	}
@@ -801,14 +1055,145 @@ func setAgentConnected(status *apiv1alpha1.DeviceProcessStatus, connected bool,
 	return beforeCopy.Status != after.Status || beforeCopy.Reason != after.Reason || beforeCopy.Message != after.Message
 }
 
+// setArtifactPrefetched records the agent's prefetch result. Once the spec no longer carries a
+// prefetch artifact (the rollout activated it or moved on), the recorded prefetch is cleared.
+func setArtifactPrefetched(status *apiv1alpha1.DeviceProcessStatus, obs Observation) {
+	if obs.ArtifactPrefetched == nil {
+		if status.PrefetchedArtifactURL == "" && conditions.FindCondition(status.Conditions, apiv1alpha1.ConditionArtifactPrefetched) == nil {
+			return
+		}
+		status.PrefetchedArtifactURL = ""
+		conditions.MarkFalse(&status.Conditions, apiv1alpha1.ConditionArtifactPrefetched, "NoPrefetch", "no artifact pending prefetch")
+		return
+	}
+	url := strings.TrimSpace(obs.PrefetchArtifactURL)
+	msg := strings.TrimSpace(obs.PrefetchMessage)
+	if *obs.ArtifactPrefetched {
+		status.PrefetchedArtifactURL = url
+		conditions.MarkTrue(&status.Conditions, apiv1alpha1.ConditionArtifactPrefetched, defaultString(obs.PrefetchReason, "ArtifactPrefetched"), defaultString(msg, "prefetched "+url))
+		return
+	}
+	status.PrefetchedArtifactURL = ""
+	conditions.MarkFalse(&status.Conditions, apiv1alpha1.ConditionArtifactPrefetched, defaultString(obs.PrefetchReason, "PrefetchFailed"), defaultString(msg, "prefetch of "+url+" failed"))
+}
+
+// setRolledBack mirrors the agent's rollback state into the RolledBack condition and reports
+// whether the process was newly rolled back.
+func setRolledBack(status *apiv1alpha1.DeviceProcessStatus, obs Observation) bool {
+	existing := conditions.FindCondition(status.Conditions, apiv1alpha1.ConditionRolledBack)
+	wasRolledBack := existing != nil && existing.Status == metav1.ConditionTrue
+	if obs.RolledBack == nil || !*obs.RolledBack {
+		if wasRolledBack {
+			conditions.MarkFalse(&status.Conditions, apiv1alpha1.ConditionRolledBack, "NotRolledBack", "running the desired spec")
+		}
+		return false
+	}
+	conditions.MarkTrue(&status.Conditions, apiv1alpha1.ConditionRolledBack, "RolledBack", defaultString(obs.RollbackMessage, "reverted to last known-good spec"))
+	return !wasRolledBack
+}
+
+// setSpecVerified records the agent's signature check; it returns true when a spec was newly
+// refused.
+func setSpecVerified(status *apiv1alpha1.DeviceProcessStatus, obs Observation) bool {
+	if obs.SpecVerified == nil {
+		return false
+	}
+	existing := conditions.FindCondition(status.Conditions, apiv1alpha1.ConditionSpecVerified)
+	if *obs.SpecVerified {
+		conditions.MarkTrue(&status.Conditions, apiv1alpha1.ConditionSpecVerified, "SignatureVerified", "spec signature verified by the agent")
+		return false
+	}
+	msg := defaultString(obs.SpecVerifyMessage, "spec signature rejected")
+	changed := existing == nil || existing.Status != metav1.ConditionFalse || existing.Message != msg
+	conditions.MarkFalse(&status.Conditions, apiv1alpha1.ConditionSpecVerified, "SignatureRejected", msg)
+	return changed
+}
+
+// setResources records the resource sample and termination reason in obs, and the
+// MemoryPressure condition they imply. It returns a message when obs shows new OOM kills.
+func setResources(status *apiv1alpha1.DeviceProcessStatus, obs Observation, reportedAt *time.Time) string {
+	reason := strings.TrimSpace(obs.TerminationReason)
+	if reason != "" {
+		status.LastTerminationReason = reason
+	}
+	r := obs.Resources
+	if r == nil && reason != terminationOOMKilled {
+		return ""
+	}
+
+	var prevKills int64
+	if status.Resources != nil {
+		prevKills = status.Resources.OOMKills
+	}
+	if r != nil {
+		at := time.Now().UTC()
+		if reportedAt != nil {
+			at = reportedAt.UTC()
+		}
+		status.Resources = &apiv1alpha1.DeviceProcessResources{
+			CPUUsageMicroseconds: r.CPUUsageMicroseconds,
+			CPUMillicores:        r.CPUMillicores,
+			MemoryCurrentBytes:   r.MemoryCurrentBytes,
+			MemoryPeakBytes:      r.MemoryPeakBytes,
+			MemoryLimitBytes:     r.MemoryLimitBytes,
+			OOMKills:             r.OOMKills,
+			ObservedAt:           metav1.NewTime(at),
+		}
+	}
+
+	switch {
+	case reason == terminationOOMKilled:
+		msg := "the process was killed for running out of memory"
+		conditions.MarkTrue(&status.Conditions, apiv1alpha1.ConditionMemoryPressure, terminationOOMKilled, msg)
+		return msg
+	case r.OOMKills > 0:
+		msg := fmt.Sprintf("%d process(es) in the unit killed for running out of memory", r.OOMKills)
+		conditions.MarkTrue(&status.Conditions, apiv1alpha1.ConditionMemoryPressure, terminationOOMKilled, msg)
+		// The counter restarts with the unit, so any change to a non-zero count is a new kill.
+		if r.OOMKills != prevKills {
+			return msg
+		}
+	case r.MemoryLimitBytes > 0 && r.MemoryCurrentBytes*100 >= r.MemoryLimitBytes*memoryPressurePercent:
+		conditions.MarkTrue(&status.Conditions, apiv1alpha1.ConditionMemoryPressure, "NearMemoryLimit",
+			fmt.Sprintf("using %s of its %s memory limit", binaryBytes(r.MemoryCurrentBytes), binaryBytes(r.MemoryLimitBytes)))
+	default:
+		conditions.MarkFalse(&status.Conditions, apiv1alpha1.ConditionMemoryPressure, "NoMemoryPressure", "memory use is below the unit's limit")
+	}
+	return ""
+}
+
+func binaryBytes(n int64) string {
+	return resource.NewQuantity(n, resource.BinarySI).String()
+}
+
+func defaultString(v, fallback string) string {
+	if v = strings.TrimSpace(v); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// hashSpec hashes what activates on the device. The prefetch artifact is left out: staging a
+// download must not look like a new spec to the agent's rollback grace tracking. Changing it
+// still bumps the generation, and with it the desired ETag.
 func hashSpec(spec *apiv1alpha1.DeviceProcessSpec) string {
-	data, _ := json.Marshal(spec)
+	activation := *spec
+	activation.PrefetchArtifact = nil
+	data, _ := json.Marshal(&activation)
 	sum := sha256.Sum256(data)
 	return "sha256:" + hex.EncodeToString(sum[:])
 }
 
-func hashDesired(items []DesiredItem) string {
+func hashDesired(items []DesiredItem, set *DesiredSet, creds []RegistryCredential, pollIntervalSeconds int) string {
 	b := strings.Builder{}
+	b.WriteString(strconv.Itoa(pollIntervalSeconds))
+	b.WriteByte(';')
+	if set != nil {
+		b.WriteString(strconv.FormatInt(set.Revision, 10))
+		b.WriteByte('/')
+		b.WriteString(set.Signature)
+		b.WriteByte(';')
+	}
 	for i := range items {
 		item := items[i]
 		b.WriteString(item.Namespace)
@@ -818,6 +1203,18 @@ func hashDesired(items []DesiredItem) string {
 		b.WriteString(strconv.FormatInt(item.Generation, 10))
 		b.WriteByte('/')
 		b.WriteString(item.SpecHash)
+		if item.Signature != "" {
+			// A spec signed after it was first served must still reach agents that verify it.
+			b.WriteByte('/')
+			b.WriteString(item.Signature)
+		}
+		b.WriteByte(';')
+	}
+	// Rotated tokens change the ETag so agents pick them up before the old ones expire.
+	for _, c := range creds {
+		b.WriteString(c.Registry)
+		b.WriteByte('=')
+		b.WriteString(c.AccessToken)
 		b.WriteByte(';')
 	}
 	sum := sha256.Sum256([]byte(b.String()))
@@ -834,11 +1231,24 @@ func reflectDeepEqualStatus(a, b apiv1alpha1.DeviceProcessStatus) bool {
 		a.ArtifactDownloadAttempts == b.ArtifactDownloadAttempts &&
 		a.LastArtifactAttemptTime == b.LastArtifactAttemptTime &&
 		a.ArtifactLastError == b.ArtifactLastError &&
+		a.ArtifactBytesDownloaded == b.ArtifactBytesDownloaded &&
+		a.ArtifactBytesTotal == b.ArtifactBytesTotal &&
+		a.PrefetchedArtifactURL == b.PrefetchedArtifactURL &&
 		a.PID == b.PID &&
 		equalTimePtr(a.StartTime, b.StartTime) &&
 		equalTimePtr(a.LastTransitionTime, b.LastTransitionTime) &&
 		a.RestartCount == b.RestartCount &&
-		a.LastTerminationReason == b.LastTerminationReason
+		a.LastTerminationReason == b.LastTerminationReason &&
+		resourcesEqual(a.Resources, b.Resources)
+}
+
+func resourcesEqual(a, b *apiv1alpha1.DeviceProcessResources) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	x, y := *a, *b
+	x.ObservedAt, y.ObservedAt = metav1.Time{}, metav1.Time{}
+	return x == y && a.ObservedAt.Equal(&b.ObservedAt)
 }
 
 func conditionsEqual(a, b []metav1.Condition) bool {
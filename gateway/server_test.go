@@ -186,3 +186,22 @@ func TestPhaseMappingFromObservation(t *testing.T) {
 		t.Fatalf("expected phase Failed, got %q", got3.Status.Phase)
 	}
 }
+
+func TestSpecHashLeavesOutPrefetchArtifact(t *testing.T) {
+	spec := apiv1alpha1.DeviceProcessSpec{Artifact: apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: "ghcr.io/app@sha256:a"}}
+	staged := *spec.DeepCopy()
+	staged.PrefetchArtifact = &apiv1alpha1.DeviceProcessArtifact{Type: apiv1alpha1.ArtifactTypeOCI, URL: "ghcr.io/app@sha256:b"}
+	if hashSpec(&spec) != hashSpec(&staged) {
+		t.Fatalf("expected a prefetch not to change the spec hash")
+	}
+	if staged.PrefetchArtifact == nil {
+		t.Fatalf("hashing must not clear the prefetch artifact")
+	}
+
+	// The generation bump of the prefetch still changes the ETag, so agents pick it up.
+	before := hashDesired([]DesiredItem{{Namespace: "ns", Name: "p", Generation: 1, SpecHash: hashSpec(&spec)}}, nil, nil, 5)
+	after := hashDesired([]DesiredItem{{Namespace: "ns", Name: "p", Generation: 2, SpecHash: hashSpec(&staged)}}, nil, nil, 5)
+	if before == after {
+		t.Fatalf("expected the desired ETag to change with the prefetch")
+	}
+}
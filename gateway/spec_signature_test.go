@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+	"github.com/apollo/praetor/pkg/specsign"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDesiredRelaysSpecSignature(t *testing.T) {
+	ctx := context.Background()
+	g := pollGateway(t, pollProcess("a", nil))
+	_, unsignedETag, err := g.computeDesired(ctx, "dev")
+	if err != nil {
+		t.Fatalf("compute desired: %v", err)
+	}
+
+	g = pollGateway(t, pollProcess("a", map[string]string{specsign.Annotation: "c2lnbmF0dXJl"}))
+	desired, signedETag, err := g.computeDesired(ctx, "dev")
+	if err != nil {
+		t.Fatalf("compute desired: %v", err)
+	}
+	if desired.Items[0].Signature != "c2lnbmF0dXJl" {
+		t.Fatalf("expected the signature annotation to be relayed, got %q", desired.Items[0].Signature)
+	}
+	if signedETag == unsignedETag {
+		t.Fatalf("expected signing a spec to change the ETag")
+	}
+}
+
+func TestDesiredRelaysDeviceProcessSet(t *testing.T) {
+	ctx := context.Background()
+	g := pollGateway(t, pollProcess("a", nil))
+	desired, unsetETag, err := g.computeDesired(ctx, "dev")
+	if err != nil || desired.Set != nil {
+		t.Fatalf("expected no set without a DeviceProcessSet, got %+v %v", desired.Set, err)
+	}
+
+	set := &apiv1alpha1.DeviceProcessSet{ObjectMeta: metav1.ObjectMeta{Name: "dev"}, Spec: apiv1alpha1.DeviceProcessSetSpec{Revision: 7, Signature: "c2V0"}}
+	g = pollGateway(t, pollProcess("a", nil), set)
+	desired, setETag, err := g.computeDesired(ctx, "dev")
+	if err != nil {
+		t.Fatalf("compute desired: %v", err)
+	}
+	if desired.Set == nil || desired.Set.Revision != 7 || desired.Set.Signature != "c2V0" {
+		t.Fatalf("expected the device's set to be relayed, got %+v", desired.Set)
+	}
+	if setETag == unsetETag {
+		t.Fatalf("expected a new set to change the ETag")
+	}
+}
+
+func TestRefusedSpecIsReported(t *testing.T) {
+	ctx := context.Background()
+	proc := pollProcess("a", nil)
+	c := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(proc).WithStatusSubresource(&apiv1alpha1.DeviceProcess{}).Build()
+	g := &Gateway{client: c, recorder: nopRecorder{}}
+
+	msg := "refused spec abc: spec signature does not match"
+	obs := Observation{Namespace: "ns", Name: "a", ErrorMessage: &msg, SpecVerified: boolPtr(false), SpecVerifyMessage: msg}
+	if err := g.updateStatusForObservation(ctx, "dev", obs, nil); err != nil {
+		t.Fatalf("updateStatusForObservation: %v", err)
+	}
+	var got apiv1alpha1.DeviceProcess
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "ns", Name: "a"}, &got); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	cond := findCondition(got.Status.Conditions, apiv1alpha1.ConditionSpecVerified)
+	if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != "SignatureRejected" || cond.Message != msg {
+		t.Fatalf("expected SpecVerified=False with the agent's reason, got %+v", cond)
+	}
+	if got.Status.Phase != apiv1alpha1.DeviceProcessPhaseFailed {
+		t.Fatalf("expected phase Failed, got %s", got.Status.Phase)
+	}
+}
@@ -0,0 +1,64 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/apollo/praetor/pkg/tlsutil"
+)
+
+// SetTLS serves the device API over TLS from certFile/keyFile, reloading them when they are
+// rotated on disk. With clientCAFile, client certificates signed by that bundle are verified and
+// identify the device: a request carrying one must be for the device it names. requireClientCert
+// rejects handshakes without a certificate; otherwise devices may still use X-Device-Token.
+func (g *Gateway) SetTLS(certFile, keyFile, clientCAFile string, requireClientCert bool) error {
+	keyPair, err := tlsutil.NewKeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: keyPair.GetCertificate}
+	if clientCAFile == "" {
+		if requireClientCert {
+			return fmt.Errorf("requiring client certificates needs a client CA bundle")
+		}
+		g.tlsConfig = cfg
+		return nil
+	}
+
+	clientCAs, err := tlsutil.NewCAPool(clientCAFile)
+	if err != nil {
+		return err
+	}
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	base := cfg.Clone()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := clientCAs.Pool()
+		if err != nil {
+			return nil, err
+		}
+		c := base.Clone()
+		c.ClientCAs = pool
+		return c, nil
+	}
+	g.tlsConfig = cfg
+	return nil
+}
+
+// clientCertDevice returns the device names a verified client certificate speaks for: its
+// subject CN and DNS SANs. ok is false when the request carries no verified certificate.
+func clientCertDevice(r *http.Request) (names []string, ok bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	if cn := strings.TrimSpace(leaf.Subject.CommonName); cn != "" {
+		names = append(names, cn)
+	}
+	names = append(names, leaf.DNSNames...)
+	return names, true
+}
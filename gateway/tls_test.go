@@ -0,0 +1,154 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for cn, usable as a server cert for 127.0.0.1 and as a
+// client cert.
+func (ca *testCA) issue(t *testing.T, cn string, serial int64) ([]byte, []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("issue %s: %v", cn, err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, data []byte, mod time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatalf("chtimes %s: %v", path, err)
+	}
+}
+
+func TestGatewayTLSClientCertIdentityAndReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	serverCert, serverKey := ca.issue(t, "gateway", 10)
+	start := time.Now().Add(-time.Minute)
+	writeFile(t, certFile, serverCert, start)
+	writeFile(t, keyFile, serverKey, start)
+	writeFile(t, caFile, ca.pem, start)
+
+	g := pollGateway(t, pollProcess("a", nil))
+	g.authToken = "shared-token"
+	if err := g.SetTLS(certFile, keyFile, caFile, false); err != nil {
+		t.Fatalf("set TLS: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(g.handleDevice))
+	srv.TLS = g.tlsConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	clientPEM, clientKey := ca.issue(t, "dev", 20)
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKey)
+	if err != nil {
+		t.Fatalf("client key pair: %v", err)
+	}
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+	}
+	get := func(c *http.Client, device, token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/devices/"+device+"/desired", nil)
+		if token != "" {
+			req.Header.Set(deviceTokenHeader, token)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("get %s: %v", device, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	withCert := client(clientCert)
+	if resp := get(withCert, "dev", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the device certificate to authenticate dev, got %d", resp.StatusCode)
+	}
+	if resp := get(withCert, "other", "shared-token"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected dev's certificate to be refused for another device, got %d", resp.StatusCode)
+	}
+	if resp := get(client(), "dev", "shared-token"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected token auth without a client certificate, got %d", resp.StatusCode)
+	}
+
+	// A rotated serving certificate is picked up by new connections without a restart.
+	rotatedCert, rotatedKey := ca.issue(t, "gateway", 11)
+	writeFile(t, certFile, rotatedCert, start.Add(30*time.Second))
+	writeFile(t, keyFile, rotatedKey, start.Add(30*time.Second))
+	resp := get(client(), "dev", "shared-token")
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 11 {
+		t.Fatalf("expected the rotated certificate, got serial %d", serial)
+	}
+}
+
+func TestSetTLSRequiresClientCAForClientCerts(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cert, key := ca.issue(t, "gateway", 10)
+	writeFile(t, filepath.Join(dir, "tls.crt"), cert, time.Now())
+	writeFile(t, filepath.Join(dir, "tls.key"), key, time.Now())
+	g := &Gateway{}
+	if err := g.SetTLS(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), "", true); err == nil {
+		t.Fatalf("expected requiring client certs without a CA to fail")
+	}
+}
@@ -0,0 +1,164 @@
+// Package specsign signs DeviceProcess specs for a device so agents can tell specs stamped by
+// the control plane from ones forged by a compromised or spoofed gateway.
+package specsign
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	apiv1alpha1 "github.com/apollo/praetor/api/azure.com/v1alpha1"
+)
+
+// Annotation carries the base64 Ed25519 signature of a DeviceProcess spec.
+const Annotation = "azure.com/spec-signature"
+
+const (
+	payloadVersion    = "apollo-spec-v2"
+	setPayloadVersion = "apollo-set-v1"
+)
+
+var (
+	// ErrUnsigned is returned for a spec without a signature.
+	ErrUnsigned = errors.New("spec is not signed")
+	// ErrMismatch is returned when no pinned key verifies the signature.
+	ErrMismatch = errors.New("spec signature does not match")
+)
+
+// SetEntry is one DeviceProcess in a device's desired set, with its spec signature.
+type SetEntry struct {
+	Namespace string
+	Name      string
+	Signature string
+}
+
+// payload binds the spec to the DeviceProcess it belongs to and to its generation; the spec
+// itself names the device, so a signature cannot be replayed onto another process or device, and
+// agents refuse a generation lower than one they already ran.
+func payload(namespace, name string, generation int64, spec *apiv1alpha1.DeviceProcessSpec) ([]byte, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return []byte(fmt.Sprintf("%s\n%s\n%s\n%d\n%x", payloadVersion, namespace, name, generation, sum)), nil
+}
+
+// setPayload lists every DeviceProcess of device, so a gateway cannot leave items out of the set.
+func setPayload(device string, revision int64, entries []SetEntry) []byte {
+	sorted := append([]SetEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Namespace == sorted[j].Namespace {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].Namespace < sorted[j].Namespace
+	})
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%s\n%d", setPayloadVersion, device, revision)
+	for _, e := range sorted {
+		fmt.Fprintf(&b, "\n%s/%s %s", e.Namespace, e.Name, e.Signature)
+	}
+	return []byte(b.String())
+}
+
+// Sign returns the signature for spec of DeviceProcess namespace/name at generation.
+func Sign(key ed25519.PrivateKey, namespace, name string, generation int64, spec *apiv1alpha1.DeviceProcessSpec) (string, error) {
+	msg, err := payload(namespace, name, generation, spec)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, msg)), nil
+}
+
+// Verify checks signature against any of keys, so keys can be rotated by pinning both.
+func Verify(keys []ed25519.PublicKey, namespace, name string, generation int64, spec *apiv1alpha1.DeviceProcessSpec, signature string) error {
+	msg, err := payload(namespace, name, generation, spec)
+	if err != nil {
+		return err
+	}
+	return verify(keys, msg, signature)
+}
+
+// SignSet returns the signature over the desired set of device at revision.
+func SignSet(key ed25519.PrivateKey, device string, revision int64, entries []SetEntry) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, setPayload(device, revision, entries)))
+}
+
+// VerifySet checks the signature over the desired set of device at revision.
+func VerifySet(keys []ed25519.PublicKey, device string, revision int64, entries []SetEntry, signature string) error {
+	return verify(keys, setPayload(device, revision, entries), signature)
+}
+
+func verify(keys []ed25519.PublicKey, msg []byte, signature string) error {
+	if signature == "" {
+		return ErrUnsigned
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMismatch, err)
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, msg, sig) {
+			return nil
+		}
+	}
+	return ErrMismatch
+}
+
+// LoadPrivateKey reads a PEM PKCS#8 Ed25519 private key.
+func LoadPrivateKey(file string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key in %s", file)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", file, err)
+	}
+	ed, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 private key", file)
+	}
+	return ed, nil
+}
+
+// LoadPublicKeys reads one or more PEM PKIX Ed25519 public keys from file.
+func LoadPublicKeys(file string) ([]ed25519.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ed25519.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", file, err)
+		}
+		ed, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s holds a key that is not Ed25519", file)
+		}
+		keys = append(keys, ed)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no PEM public keys in %s", file)
+	}
+	return keys, nil
+}
@@ -0,0 +1,150 @@
+// Package tlsutil loads TLS material from disk and picks up rotated files without a restart.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// KeyPair serves a certificate and key from disk, reloading them when either file changes. A
+// rotation that cannot be loaded (for example a half-written pair) keeps the previous pair.
+type KeyPair struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// NewKeyPair loads certFile and keyFile; they must be valid at startup.
+func NewKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	kp := WatchKeyPair(certFile, keyFile)
+	if _, err := kp.current(); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// WatchKeyPair serves certFile and keyFile once they appear, for credentials that are issued
+// after startup. Until then GetClientCertificate presents no certificate.
+func WatchKeyPair(certFile, keyFile string) *KeyPair {
+	return &KeyPair{certFile: certFile, keyFile: keyFile}
+}
+
+func (kp *KeyPair) current() (*tls.Certificate, error) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	certMod, certErr := modTime(kp.certFile)
+	keyMod, keyErr := modTime(kp.keyFile)
+	if kp.cert != nil && (certErr != nil || keyErr != nil || (certMod.Equal(kp.certMod) && keyMod.Equal(kp.keyMod))) {
+		return kp.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(kp.certFile, kp.keyFile)
+	if err != nil {
+		if kp.cert != nil {
+			return kp.cert, nil
+		}
+		return nil, fmt.Errorf("load key pair %s/%s: %w", kp.certFile, kp.keyFile, err)
+	}
+	kp.cert, kp.certMod, kp.keyMod = &cert, certMod, keyMod
+	return kp.cert, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (kp *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return kp.current()
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (kp *KeyPair) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, err := kp.current()
+	if err != nil {
+		// Not issued yet: continue the handshake without a certificate.
+		return &tls.Certificate{}, nil
+	}
+	return cert, nil
+}
+
+// CAPool serves a PEM CA bundle from disk, reloading it when the file changes.
+type CAPool struct {
+	file string
+
+	mu   sync.Mutex
+	pool *x509.CertPool
+	mod  time.Time
+}
+
+// NewCAPool loads file; it must hold at least one certificate at startup.
+func NewCAPool(file string) (*CAPool, error) {
+	p := &CAPool{file: file}
+	if _, err := p.Pool(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Pool returns the current bundle.
+func (p *CAPool) Pool() (*x509.CertPool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	mod, err := modTime(p.file)
+	if p.pool != nil && (err != nil || mod.Equal(p.mod)) {
+		return p.pool, nil
+	}
+	pool, err := LoadCertPool(p.file)
+	if err != nil {
+		if p.pool != nil {
+			return p.pool, nil
+		}
+		return nil, err
+	}
+	p.pool, p.mod = pool, mod
+	return p.pool, nil
+}
+
+// LoadCertPool reads a PEM bundle into a new pool.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", file)
+	}
+	return pool, nil
+}
+
+func modTime(path string) (time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// ParseDeviceCSR decodes a PEM certificate signing request, checks its signature and that its
+// subject CN names device.
+func ParseDeviceCSR(data []byte, device string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("request is not a PEM certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("certificate request signature: %w", err)
+	}
+	if csr.Subject.CommonName != device {
+		return nil, fmt.Errorf("certificate request CN %q does not name device %q", csr.Subject.CommonName, device)
+	}
+	return csr, nil
+}